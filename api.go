@@ -0,0 +1,637 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The API is read-only and uses the same roles as the HTML pages.
+// Requests are authenticated with "Authorization: Bearer <token>", see
+// apitokens.go.
+
+func init() {
+	http.HandleFunc("/api/v1/openapi.yaml", apiOpenAPIHandler)
+
+	http.HandleFunc("/api/v1/students", apiHandler(apiStudentsHandler))
+	http.HandleFunc("/api/v1/employees", apiHandler(apiEmployeesHandler))
+	http.HandleFunc("/api/v1/classsections", apiHandler(apiClassSectionsHandler))
+	http.HandleFunc("/api/v1/assignments", apiHandler(apiAssignmentsHandler))
+	http.HandleFunc("/api/v1/marks", apiHandler(apiMarksHandler))
+	http.HandleFunc("/api/v1/attendance", apiHandler(apiAttendanceHandler))
+	http.HandleFunc("/api/v1/leaverequests", apiHandler(apiLeaveRequestsHandler))
+	http.HandleFunc("/api/v1/homework", apiHandler(apiHomeworkHandler))
+}
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err apiError) Error() string {
+	return err.Message
+}
+
+func apiErrorf(code int, format string, a ...interface{}) apiError {
+	return apiError{code, fmt.Sprintf(format, a...)}
+}
+
+// apiPage is the response of endpoints that return lists
+type apiPage struct {
+	Data   interface{} `json:"data"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Total  int         `json:"total"`
+}
+
+// apiPaginate returns the range [start, end) of the requested page of a list
+// of n items
+func apiPaginate(r *http.Request, n int) (start, end, limit int, err error) {
+	limit = apiDefaultLimit
+	if s := r.Form.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > apiMaxLimit {
+			return 0, 0, 0, apiErrorf(http.StatusBadRequest, "Invalid limit: %s", s)
+		}
+	}
+
+	if s := r.Form.Get("offset"); s != "" {
+		start, err = strconv.Atoi(s)
+		if err != nil || start < 0 {
+			return 0, 0, 0, apiErrorf(http.StatusBadRequest, "Invalid offset: %s", s)
+		}
+	}
+
+	if start > n {
+		start = n
+	}
+	end = start + limit
+	if end > n {
+		end = n
+	}
+
+	return start, end, limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+type apiFunc func(c context.Context, user user, r *http.Request) (interface{}, error)
+
+// apiHandler is the API equivalent of accessHandler
+func apiHandler(f apiFunc) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+
+		writeError := func(err apiError) {
+			if err := writeJSON(w, err.Code, err); err != nil {
+				log.Errorf(c, "Could not write JSON: %s", err)
+			}
+		}
+
+		if r.Method != "GET" {
+			writeError(apiErrorf(http.StatusMethodNotAllowed, "Method not allowed: %s", r.Method))
+			return
+		}
+
+		user, err := getAPIUser(c, r)
+		if err != nil {
+			log.Warningf(c, "Could not get API user: %s", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(apiErrorf(http.StatusUnauthorized, "Invalid or missing API token"))
+			return
+		}
+		defer keepUser(c, user)()
+
+		if !user.Roles.Admin {
+			staffAccess := getStaffAccess(c)
+			if !staffAccess {
+				writeError(apiErrorf(http.StatusServiceUnavailable, "The system is currently in Maintenance. Please try again later."))
+				return
+			}
+		}
+
+		if !canAccess(user, r.URL.Path) {
+			writeError(apiErrorf(http.StatusForbidden, "You are not authorized to access this resource"))
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			writeError(apiErrorf(http.StatusBadRequest, "Could not parse form: %s", err))
+			return
+		}
+
+		allowAccess, err := canAccessScope(c, user, r)
+		if err != nil {
+			log.Errorf(c, "Could not check access: %s", err)
+			writeError(apiErrorf(http.StatusInternalServerError, "Internal server error"))
+			return
+		}
+		if !allowAccess {
+			writeError(apiErrorf(http.StatusForbidden, "You do not have access to this class/subject"))
+			return
+		}
+
+		result, err := f(c, user, r)
+		if err != nil {
+			if apiErr, ok := err.(apiError); ok {
+				writeError(apiErr)
+			} else {
+				log.Errorf(c, "API error in %s: %s", r.URL.Path, err)
+				writeError(apiErrorf(http.StatusInternalServerError, "Internal server error"))
+			}
+			return
+		}
+
+		if err := writeJSON(w, http.StatusOK, result); err != nil {
+			log.Errorf(c, "Could not write JSON: %s", err)
+		}
+	}
+}
+
+func apiOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+	http.ServeFile(w, r, "api/openapi.yaml")
+}
+
+// apiNumber converts a number to a JSON friendly form. NaN, used for marks
+// that are not entered, becomes null.
+func apiNumber(f float64) *float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return &f
+}
+
+func apiMarks(marks []float64) []*float64 {
+	result := make([]*float64, len(marks))
+	for i, m := range marks {
+		result[i] = apiNumber(m)
+	}
+	return result
+}
+
+func apiDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+type apiStudent struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ArabicName    string `json:"arabicName"`
+	Gender        string `json:"gender"`
+	DateOfBirth   string `json:"dateOfBirth"`
+	Nationality   string `json:"nationality"`
+	Class         string `json:"class"`
+	Section       string `json:"section"`
+	Stream        string `json:"stream"`
+	GuardianEmail string `json:"guardianEmail"`
+}
+
+func apiStudentsHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	sy := getSchoolYear(c)
+
+	classSection := r.Form.Get("classsection")
+	if classSection == "" {
+		classSection = "all"
+	}
+
+	scs, err := findStudentsSorted(c, sy, classSection, false)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	start, end, limit, err := apiPaginate(r, len(scs))
+	if err != nil {
+		return nil, err
+	}
+	page := scs[start:end]
+
+	var ids []string
+	for _, sc := range page {
+		ids = append(ids, sc.ID)
+	}
+	var stus []studentType
+	if len(ids) > 0 {
+		stus, err = getStudentMulti(c, ids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	students := []apiStudent{}
+	for i, stu := range stus {
+		sc := page[i]
+		students = append(students, apiStudent{
+			ID:            stu.ID,
+			Name:          stu.Name,
+			ArabicName:    stu.ArabicName,
+			Gender:        stu.Gender,
+			DateOfBirth:   apiDate(stu.DateOfBirth),
+			Nationality:   stu.Nationality,
+			Class:         sc.Class,
+			Section:       sc.Section,
+			Stream:        sc.Stream,
+			GuardianEmail: stu.GuardianEmail,
+		})
+	}
+
+	return apiPage{students, start, limit, len(scs)}, nil
+}
+
+type apiEmployee struct {
+	ID             int64  `json:"id"`
+	Email          string `json:"email"`
+	Name           string `json:"name"`
+	ArabicName     string `json:"arabicName"`
+	Gender         string `json:"gender"`
+	Type           string `json:"type"`
+	JobDescription string `json:"jobDescription"`
+	Enabled        bool   `json:"enabled"`
+	Admin          bool   `json:"admin"`
+	HR             bool   `json:"hr"`
+	Teacher        bool   `json:"teacher"`
+}
+
+func apiEmployeesHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	enabled := r.Form.Get("enabled") != "false"
+
+	typ := r.Form.Get("type")
+	if typ == "" {
+		typ = "all"
+	}
+
+	emps, err := getEmployees(c, enabled, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, limit, err := apiPaginate(r, len(emps))
+	if err != nil {
+		return nil, err
+	}
+
+	employees := []apiEmployee{}
+	for _, emp := range emps[start:end] {
+		employees = append(employees, apiEmployee{
+			ID:             emp.ID,
+			Email:          emp.CPSEmail,
+			Name:           emp.Name,
+			ArabicName:     emp.ArabicName,
+			Gender:         emp.Gender,
+			Type:           emp.Type,
+			JobDescription: emp.JobDescription,
+			Enabled:        emp.Enabled,
+			Admin:          emp.Roles.Admin,
+			HR:             emp.Roles.HR,
+			Teacher:        emp.Roles.Teacher,
+		})
+	}
+
+	return apiPage{employees, start, limit, len(emps)}, nil
+}
+
+type apiClassSection struct {
+	Class    string   `json:"class"`
+	Sections []string `json:"sections"`
+}
+
+func apiClassSectionsHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	sy := getSchoolYear(c)
+
+	classSections := []apiClassSection{}
+	for _, cg := range getClassGroups(c, sy) {
+		classSections = append(classSections, apiClassSection{cg.Class, cg.Sections})
+	}
+
+	start, end, limit, err := apiPaginate(r, len(classSections))
+	if err != nil {
+		return nil, err
+	}
+
+	return apiPage{classSections[start:end], start, limit, len(classSections)}, nil
+}
+
+type apiAssignment struct {
+	ClassSection string `json:"classSection"`
+	Subject      string `json:"subject"`
+	Teacher      int64  `json:"teacher"`
+}
+
+func apiAssignmentsHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	sy := getSchoolYear(c)
+
+	assigns, err := getAllAssignments(c, sy)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, limit, err := apiPaginate(r, len(assigns))
+	if err != nil {
+		return nil, err
+	}
+
+	assignments := []apiAssignment{}
+	for _, at := range assigns[start:end] {
+		assignments = append(assignments, apiAssignment{at.ClassSection, at.Subject, at.Teacher})
+	}
+
+	return apiPage{assignments, start, limit, len(assigns)}, nil
+}
+
+type apiStudentMarks struct {
+	StudentID string     `json:"studentId"`
+	Name      string     `json:"name"`
+	Marks     []*float64 `json:"marks"`
+}
+
+type apiColumn struct {
+	Name        string   `json:"name"`
+	Max         float64  `json:"max"`
+	FinalWeight *float64 `json:"finalWeight"`
+	Editable    bool     `json:"editable"`
+}
+
+type apiMarksResponse struct {
+	ClassSection string            `json:"classSection"`
+	Subject      string            `json:"subject"`
+	Term         string            `json:"term"`
+	Columns      []apiColumn       `json:"columns"`
+	Students     []apiStudentMarks `json:"students"`
+}
+
+func apiMarksHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	sy := getSchoolYear(c)
+
+	classSection := r.Form.Get("classsection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	subject := r.Form.Get("subject")
+	if subject == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "subject is required")
+	}
+
+	term, err := parseTerm(r.Form.Get("term"))
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	allowAccess, err := user.canInScope(c, sy, permMarksView, classSection, subject)
+	if err != nil {
+		return nil, err
+	}
+	if !allowAccess {
+		return nil, apiErrorf(http.StatusForbidden, "You do not have access to this class/subject")
+	}
+
+	gs := getGradingSystem(c, sy, class, subject)
+	if gs == nil {
+		return nil, apiErrorf(http.StatusNotFound, "Unknown subject: %s", subject)
+	}
+
+	cols := gs.description(c, sy, term)
+	if len(cols) == 0 {
+		return nil, apiErrorf(http.StatusNotFound, "Not applicable")
+	}
+
+	students, err := findStudents(c, sy, classSection)
+	if err != nil {
+		return nil, err
+	}
+
+	var inStream []studentClass
+	for _, s := range students {
+		if gs.inStream(s.Stream) {
+			inStream = append(inStream, s)
+		}
+	}
+
+	start, end, limit, err := apiPaginate(r, len(inStream))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := apiMarksResponse{
+		ClassSection: classSection,
+		Subject:      subject,
+		Term:         term.Value(),
+		Columns:      []apiColumn{},
+		Students:     []apiStudentMarks{},
+	}
+	for _, col := range cols {
+		resp.Columns = append(resp.Columns, apiColumn{col.Name, col.Max, apiNumber(col.FinalWeight), col.Editable})
+	}
+
+	for _, s := range inStream[start:end] {
+		var marks []float64
+		if term.Typ == WeekS1 || term.Typ == WeekS2 {
+			marks, err = getWeeklyStudentMarks(c, s.ID, sy, subject, term, gs)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			m, err := getStudentMarks(c, s.ID, sy, subject)
+			if err != nil {
+				return nil, err
+			}
+			gs.evaluate(c, s.ID, sy, term, m) // TODO: check error
+			marks = m[term]
+		}
+		resp.Students = append(resp.Students, apiStudentMarks{s.ID, s.Name, apiMarks(marks)})
+	}
+
+	return apiPage{resp, start, limit, len(inStream)}, nil
+}
+
+type apiAttendance struct {
+	Date string `json:"date"`
+	User string `json:"user"`
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func apiAttendanceHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	date := time.Now()
+	if s := r.Form.Get("date"); s != "" {
+		var err error
+		date, err = time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "Invalid date: %s", s)
+		}
+	}
+
+	group := r.Form.Get("group")
+	if group == "" {
+		group = "employee"
+	}
+
+	atts, err := getGroupAttendances(c, date, group)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	start, end, limit, err := apiPaginate(r, len(atts))
+	if err != nil {
+		return nil, err
+	}
+
+	attendances := []apiAttendance{}
+	for _, att := range atts[start:end] {
+		a := apiAttendance{
+			Date: date.Format("2006-01-02"),
+			Name: att.UserName,
+		}
+		if att.UserKey != nil {
+			a.User = att.UserKey.Encode()
+		}
+		if !att.From.IsZero() {
+			a.From = att.From.Format("15:04")
+		}
+		if !att.To.IsZero() {
+			a.To = att.To.Format("15:04")
+		}
+		attendances = append(attendances, a)
+	}
+
+	return apiPage{attendances, start, limit, len(atts)}, nil
+}
+
+type apiLeaveRequest struct {
+	ID                string `json:"id"`
+	Requester         string `json:"requester"`
+	RequesterName     string `json:"requesterName"`
+	StartDate         string `json:"startDate"`
+	EndDate           string `json:"endDate"`
+	Type              string `json:"type"`
+	Status            string `json:"status"`
+	RequesterComments string `json:"requesterComments"`
+	HRComments        string `json:"hrComments"`
+}
+
+func apiLeaveRequestsHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	status := leaveRequestStatus(r.Form.Get("status"))
+
+	var requests []leaveRequest
+	var err error
+	if user.can(permLeaveApprove) {
+		requests, err = searchLeaveRequests(c, status, r.Form.Get("kind"))
+	} else {
+		key := user.Key()
+		if key == nil {
+			return nil, apiErrorf(http.StatusForbidden, "You are not authorized to access this resource")
+		}
+		var zeroTime time.Time
+		requests, err = getUserLeaveRequests2(c, key, status, zeroTime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, limit, err := apiPaginate(r, len(requests))
+	if err != nil {
+		return nil, err
+	}
+
+	lrs := []apiLeaveRequest{}
+	for _, lr := range requests[start:end] {
+		lrs = append(lrs, apiLeaveRequest{
+			ID:                lr.Key.Encode(),
+			Requester:         lr.RequesterKey.Encode(),
+			RequesterName:     lr.RequesterName,
+			StartDate:         apiDate(lr.StartDate),
+			EndDate:           apiDate(lr.EndDate),
+			Type:              lr.Type.Value(),
+			Status:            lr.Status.Value(),
+			RequesterComments: lr.RequesterComments,
+			HRComments:        lr.HRComments,
+		})
+	}
+
+	return apiPage{lrs, start, limit, len(requests)}, nil
+}
+
+type apiHomework struct {
+	ID       string `json:"id"`
+	Class    string `json:"class"`
+	Section  string `json:"section"`
+	Subject  string `json:"subject"`
+	Date     string `json:"date"`
+	Teacher  string `json:"teacher"`
+	Homework string `json:"homework"`
+}
+
+func apiHomeworkHandler(c context.Context, user user, r *http.Request) (interface{}, error) {
+	sy := getSchoolYear(c)
+
+	var class, section string
+	if user.Roles.Student {
+		// Students can only see the homework of their class
+		sc, err := getStudentClass(c, user.Student.ID, sy)
+		if err != nil {
+			return nil, err
+		}
+		class, section = sc.Class, sc.Section
+	} else {
+		var err error
+		class, section, err = parseClassSection(r.Form.Get("classsection"))
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%s", err)
+		}
+	}
+
+	subject := r.Form.Get("subject")
+	if subject == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "subject is required")
+	}
+
+	hws, err := getHomework(c, sy, class, section, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, limit, err := apiPaginate(r, len(hws))
+	if err != nil {
+		return nil, err
+	}
+
+	homework := []apiHomework{}
+	for _, hw := range hws[start:end] {
+		homework = append(homework, apiHomework{
+			ID:       hw.ID,
+			Class:    hw.Class,
+			Section:  hw.Section,
+			Subject:  hw.Subject,
+			Date:     apiDate(hw.Date),
+			Teacher:  hw.Teacher,
+			Homework: hw.Homework,
+		})
+	}
+
+	return apiPage{homework, start, limit, len(hws)}, nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/apitokens", accessHandler(apiTokensHandler))
+	http.HandleFunc("/apitokens/save", accessHandler(apiTokensSaveHandler))
+	http.HandleFunc("/apitokens/delete", accessHandler(apiTokensDeleteHandler))
+}
+
+// apiToken will be stored in the datastore. The key is the SHA-256 hash of
+// the token, so the token itself is only known to its owner.
+type apiToken struct {
+	ID string `datastore:"-"`
+
+	Email       string
+	Description string
+	Created     time.Time
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIToken(c context.Context, user user, description string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	at := apiToken{
+		Email:       user.Email,
+		Description: description,
+		Created:     time.Now(),
+	}
+
+	key := datastore.NewKey(c, "api_token", hashAPIToken(token), 0, nil)
+	if _, err := nds.Put(c, key, &at); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func getAPITokens(c context.Context, email string) ([]apiToken, error) {
+	q := datastore.NewQuery("api_token").Filter("Email =", email)
+
+	var tokens []apiToken
+	keys, err := q.GetAll(c, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range keys {
+		tokens[i].ID = k.StringID()
+	}
+
+	return tokens, nil
+}
+
+func deleteAPIToken(c context.Context, email, id string) error {
+	key := datastore.NewKey(c, "api_token", id, 0, nil)
+
+	var at apiToken
+	if err := nds.Get(c, key, &at); err != nil {
+		return err
+	}
+	if at.Email != email {
+		return fmt.Errorf("Token does not belong to %s", email)
+	}
+
+	return nds.Delete(c, key)
+}
+
+// getAPIUser returns the owner of the bearer token of the request
+func getAPIUser(c context.Context, r *http.Request) (user, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return user{}, fmt.Errorf("Missing bearer token")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if token == "" {
+		return user{}, fmt.Errorf("Missing bearer token")
+	}
+
+	key := datastore.NewKey(c, "api_token", hashAPIToken(token), 0, nil)
+	var at apiToken
+	if err := nds.Get(c, key, &at); err != nil {
+		return user{}, err
+	}
+
+	return getUserFromEmail(c, at.Email, at.Email, false)
+}
+
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := getAPITokens(c, user.Email)
+	if err != nil {
+		log.Errorf(c, "Could not get API tokens: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Tokens   []apiToken
+		NewToken string
+	}{
+		tokens,
+		"",
+	}
+
+	if err := render(w, r, "apitokens", data); err != nil {
+		log.Errorf(c, "Could not render template apitokens: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func apiTokensSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// The API uses the roles of the employee or student record of the
+	// owner, so administrators of the application need to be employees
+	if user.Employee == nil && user.Student == nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "API tokens are only for employees and students")
+		return
+	}
+
+	description := strings.TrimSpace(r.PostForm.Get("Description"))
+	if description == "" {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Description is required")
+		return
+	}
+
+	token, err := newAPIToken(c, user, description)
+	if err != nil {
+		log.Errorf(c, "Could not create API token: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := getAPITokens(c, user.Email)
+	if err != nil {
+		log.Errorf(c, "Could not get API tokens: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// The token is shown only once, so render instead of redirecting
+	data := struct {
+		Tokens   []apiToken
+		NewToken string
+	}{
+		tokens,
+		token,
+	}
+
+	if err := render(w, r, "apitokens", data); err != nil {
+		log.Errorf(c, "Could not render template apitokens: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func apiTokensDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteAPIToken(c, user.Email, r.PostForm.Get("ID")); err != nil {
+		log.Errorf(c, "Could not delete API token: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/apitokens", http.StatusFound)
+}
@@ -0,0 +1,579 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/atrisk", accessHandler(atRiskHandler))
+	http.HandleFunc("/atrisk/settings", accessHandler(atRiskSettingsHandler))
+	http.HandleFunc("/atrisk/classteachers", accessHandler(atRiskClassTeachersHandler))
+	http.HandleFunc("/atrisk/email", accessHandler(atRiskEmailHandler))
+
+	registerReport(reportType{
+		Name:   ReportAtRiskStudents,
+		Params: []reportParam{reportParamSchoolYear, reportParamClasses, reportParamTerm},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportAtRiskStudents(c, p.SchoolYears[0], p.singleClasses(), p.Term)
+		},
+	})
+}
+
+const ReportAtRiskStudents = "At-Risk Students"
+
+// atRiskSetting is when a student is flagged as at risk
+type atRiskSetting struct {
+	MinMark         float64 // a mark below it is failing
+	MaxDrop         float64 // a drop of more than it from the previous term
+	FailingSubjects int     // this many failing subjects or more
+	MaxAbsences     float64 // more absences than it
+
+	// Quarters are the dates of the quarters, in which the absences of
+	// the daily log are counted
+	Quarters []quarterDates
+}
+
+// quarterDates are the first and last days of a quarter
+type quarterDates struct {
+	Start time.Time
+	End   time.Time
+}
+
+// termDates returns the start of the quarters of term and the day after
+// their end, or false if their dates are not set
+func (setting atRiskSetting) termDates(term Term) (time.Time, time.Time, bool) {
+	var first, last int
+	switch term.Typ {
+	case Quarter:
+		first, last = term.N, term.N
+	case Midterm:
+		first, last = 2*term.N-1, 2*term.N-1
+	case Semester:
+		first, last = 2*term.N-1, 2*term.N
+	case EndOfYear:
+		first, last = 1, 4
+	default:
+		return time.Time{}, time.Time{}, false
+	}
+	if first < 1 || last > len(setting.Quarters) {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start, end := setting.Quarters[first-1].Start, setting.Quarters[last-1].End
+	if start.IsZero() || end.IsZero() {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, end.AddDate(0, 0, 1), true
+}
+
+type atRiskSettings struct {
+	Value atRiskSetting
+}
+
+var defaultAtRiskSetting = atRiskSetting{
+	MinMark:         60,
+	MaxDrop:         15,
+	FailingSubjects: 2,
+	MaxAbsences:     10,
+}
+
+func getAtRiskSetting(c context.Context, sy string) atRiskSetting {
+	key := datastore.NewKey(c, "settings", "atrisk-"+sy, 0, nil)
+
+	setting := atRiskSettings{}
+	if err := nds.Get(c, key, &setting); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Warningf(c, "Could not get at-risk settings: %s", err)
+		}
+		return defaultAtRiskSetting
+	}
+
+	return setting.Value
+}
+
+func saveAtRiskSetting(c context.Context, sy string, setting atRiskSetting) error {
+	key := datastore.NewKey(c, "settings", "atrisk-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &atRiskSettings{setting})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// atRiskStudent is a student flagged by getAtRiskStudents
+type atRiskStudent struct {
+	ID           string
+	Name         string
+	ClassSection string
+
+	Failing          []string // subjects below the minimum mark
+	Drops            []string // subjects that dropped from the previous term
+	Absences         float64  // from the attendance grading columns
+	DailylogAbsences int
+
+	Reasons []string
+	Score   int
+}
+
+type atRiskStudentSorter []atRiskStudent
+
+func (ars atRiskStudentSorter) Len() int {
+	return len(ars)
+}
+
+func (ars atRiskStudentSorter) Less(i, j int) bool {
+	// greater than for reverse sort
+	if ars[i].Score != ars[j].Score {
+		return ars[i].Score > ars[j].Score
+	}
+
+	return ars[i].Name < ars[j].Name
+}
+
+func (ars atRiskStudentSorter) Swap(i, j int) {
+	ars[i], ars[j] = ars[j], ars[i]
+}
+
+// previousTerm returns the term of the same type before term, which the
+// marks are compared to
+func previousTerm(term Term) (Term, bool) {
+	switch term.Typ {
+	case Quarter, Midterm, Semester:
+		if term.N > 1 {
+			return Term{term.Typ, term.N - 1}, true
+		}
+	}
+	return Term{}, false
+}
+
+// termAbsences returns the excused and unexcused absences in the marks of
+// the attendance grading system
+func termAbsences(term Term, m []float64) float64 {
+	switch term.Typ {
+	case Quarter, Midterm:
+		return m[0] + m[1] + m[2]
+	case Semester:
+		return m[4] + m[8]
+	case EndOfYear:
+		return m[2] + m[5]
+	}
+	return 0
+}
+
+// getAtRiskStudents returns the students of the class section who are at
+// risk in term, with the most at risk first
+func getAtRiskStudents(c context.Context, sy string, term Term, classSection string,
+	setting atRiskSetting) ([]atRiskStudent, error) {
+
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		return nil, err
+	}
+
+	students, err := findStudentsSorted(c, sy, classSection, true)
+	if err != nil {
+		return nil, err
+	}
+
+	subjects, err := getSubjects(c, sy, class)
+	if err != nil {
+		return nil, err
+	}
+	gradingSystems := make(map[string]gradingSystem)
+	for _, subject := range subjects {
+		gs := getGradingSystem(c, sy, class, subject)
+		if gs == nil || !gs.subjectInAverage() {
+			continue
+		}
+		gradingSystems[subject] = gs
+	}
+	ags := attendanceGradingSystem{}
+
+	prevTerm, hasPrevTerm := previousTerm(term)
+
+	var atRisk []atRiskStudent
+	for _, s := range students {
+		ar := atRiskStudent{
+			ID:           s.ID,
+			Name:         s.Name,
+			ClassSection: classSection,
+		}
+
+		for _, subject := range subjects {
+			gs, ok := gradingSystems[subject]
+			if !ok || !gs.inStream(s.Stream) {
+				continue
+			}
+
+			marks, err := getStudentMarks(c, s.ID, sy, subject)
+			if err != nil {
+				return nil, err
+			}
+			if err := gs.evaluate(c, s.ID, sy, term, marks); err != nil {
+				log.Warningf(c, "Could not evaluate marks: %s %s %s %s", s.ID, sy, subject, err)
+			}
+			mark := gs.get100(term, marks)
+			if math.IsNaN(mark) {
+				continue
+			}
+
+			if mark < setting.MinMark {
+				ar.Failing = append(ar.Failing, fmt.Sprintf("%s (%s)", subject, formatMark(mark)))
+			}
+
+			if !hasPrevTerm {
+				continue
+			}
+			if err := gs.evaluate(c, s.ID, sy, prevTerm, marks); err != nil {
+				log.Warningf(c, "Could not evaluate marks: %s %s %s %s", s.ID, sy, subject, err)
+			}
+			prevMark := gs.get100(prevTerm, marks)
+			if !math.IsNaN(prevMark) && prevMark-mark > setting.MaxDrop {
+				ar.Drops = append(ar.Drops, fmt.Sprintf("%s (%s to %s)",
+					subject, formatMark(prevMark), formatMark(mark)))
+			}
+		}
+
+		marks, err := getStudentMarks(c, s.ID, sy, "Attendance")
+		if err != nil {
+			return nil, err
+		}
+		if err := ags.evaluate(c, s.ID, sy, term, marks); err != nil {
+			log.Warningf(c, "Could not evaluate attendance: %s %s %s", s.ID, sy, err)
+		}
+		if m := marks[term]; len(m) != 0 {
+			ar.Absences = termAbsences(term, m)
+		}
+
+		// the maximum absences are per term, so only the absences in the
+		// dates of term are counted
+		if from, to, ok := setting.termDates(term); ok {
+			dailylogs, err := getDailylogs(c, s.ID, from, to)
+			if err != nil {
+				return nil, err
+			}
+			for _, dl := range dailylogs {
+				if dl.Attendance == "Absent" {
+					ar.DailylogAbsences++
+				}
+			}
+		}
+
+		for _, f := range ar.Failing {
+			ar.Reasons = append(ar.Reasons, "Below "+formatMark(setting.MinMark)+": "+f)
+		}
+		for _, d := range ar.Drops {
+			ar.Reasons = append(ar.Reasons, "Dropped: "+d)
+		}
+		ar.Score = len(ar.Failing) + len(ar.Drops)
+		if setting.FailingSubjects > 0 && len(ar.Failing) >= setting.FailingSubjects {
+			ar.Reasons = append(ar.Reasons, fmt.Sprintf("%d failing subjects", len(ar.Failing)))
+			ar.Score += 2
+		}
+		if ar.Absences > setting.MaxAbsences {
+			ar.Reasons = append(ar.Reasons, fmt.Sprintf("%s absences", formatMark(ar.Absences)))
+			ar.Score += 2
+		}
+		if float64(ar.DailylogAbsences) > setting.MaxAbsences {
+			ar.Reasons = append(ar.Reasons, fmt.Sprintf("%d absences in the daily log", ar.DailylogAbsences))
+			ar.Score += 2
+		}
+
+		if ar.Score > 0 {
+			atRisk = append(atRisk, ar)
+		}
+	}
+
+	sort.Sort(atRiskStudentSorter(atRisk))
+	return atRisk, nil
+}
+
+func generateReportAtRiskStudents(c context.Context, sy string, classes []string, term Term) ([][]ReportCell, error) {
+	setting := getAtRiskSetting(c, sy)
+
+	rows := [][]ReportCell{
+		{
+			{"Rank", 1, 1},
+			{"ID", 1, 1},
+			{"Name", 1, 1},
+			{"Failing Subjects", 1, 1},
+			{"Drops", 1, 1},
+			{"Absences", 1, 1},
+			{"Daily Log Absences", 1, 1},
+			{"Reasons", 1, 1},
+		},
+	}
+
+	for _, class := range classes {
+		for _, classSection := range getClassSectionsOfClass(c, sy, class) {
+			atRisk, err := getAtRiskStudents(c, sy, term, classSection, setting)
+			if err != nil {
+				return nil, err
+			}
+
+			rows = append(rows, []ReportCell{
+				{fmt.Sprintf("%s %s (%d students)", strings.Replace(classSection, "|", "", 1), term, len(atRisk)), 8, 1},
+			})
+			for i, ar := range atRisk {
+				rows = append(rows, []ReportCell{
+					{strconv.Itoa(i + 1), 1, 1},
+					{ar.ID, 1, 1},
+					{ar.Name, 1, 1},
+					{strconv.Itoa(len(ar.Failing)), 1, 1},
+					{strconv.Itoa(len(ar.Drops)), 1, 1},
+					{formatMark(ar.Absences), 1, 1},
+					{strconv.Itoa(ar.DailylogAbsences), 1, 1},
+					{strings.Join(ar.Reasons, "; "), 1, 1},
+				})
+			}
+		}
+	}
+
+	return rows, nil
+}
+
+// classTeacher is the teacher responsible for a class section
+type classTeacher struct {
+	ClassSection string
+	Teacher      int64
+}
+
+type classTeachersSetting struct {
+	Value []classTeacher
+}
+
+func getClassTeachers(c context.Context, sy string) map[string]int64 {
+	key := datastore.NewKey(c, "settings", "class-teachers-"+sy, 0, nil)
+
+	setting := classTeachersSetting{}
+	if err := nds.Get(c, key, &setting); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Could not get class teachers: %s", err)
+	}
+
+	classTeachers := make(map[string]int64)
+	for _, ct := range setting.Value {
+		classTeachers[ct.ClassSection] = ct.Teacher
+	}
+	return classTeachers
+}
+
+func saveClassTeachers(c context.Context, sy string, classTeachers []classTeacher) error {
+	key := datastore.NewKey(c, "settings", "class-teachers-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &classTeachersSetting{classTeachers})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func atRiskHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	teachers, err := getEmployees(c, true, "Teacher")
+	if err != nil {
+		log.Errorf(c, "Could not retrieve teachers: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var classSections []string
+	for _, class := range getClasses(c, sy) {
+		classSections = append(classSections, getClassSectionsOfClass(c, sy, class)...)
+	}
+
+	setting := getAtRiskSetting(c, sy)
+	quarters := make([]quarterDates, 4)
+	copy(quarters, setting.Quarters)
+
+	data := struct {
+		ReportName    string
+		Setting       atRiskSetting
+		Quarters      []quarterDates
+		ClassSections []string
+		ClassTeachers map[string]int64
+		Teachers      []employeeType
+		Terms         []Term
+	}{
+		ReportAtRiskStudents,
+		setting,
+		quarters,
+		classSections,
+		getClassTeachers(c, sy),
+		teachers,
+		terms,
+	}
+
+	if err := render(w, r, "atrisk", data); err != nil {
+		log.Errorf(c, "Could not render template atrisk: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func atRiskSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+
+	minMark, err1 := strconv.ParseFloat(r.PostForm.Get("MinMark"), 64)
+	maxDrop, err2 := strconv.ParseFloat(r.PostForm.Get("MaxDrop"), 64)
+	failingSubjects, err3 := strconv.Atoi(r.PostForm.Get("FailingSubjects"))
+	maxAbsences, err4 := strconv.ParseFloat(r.PostForm.Get("MaxAbsences"), 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil ||
+		minMark < 0 || minMark > 100 || maxDrop < 0 || failingSubjects < 0 || maxAbsences < 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid settings")
+		return
+	}
+
+	setting := atRiskSetting{minMark, maxDrop, failingSubjects, maxAbsences, nil}
+	for i := 1; i <= 4; i++ {
+		var qd quarterDates
+		var err1, err2 error
+		if start := r.PostForm.Get(fmt.Sprintf("quarter-start-%d", i)); start != "" {
+			qd.Start, err1 = time.Parse("2006-01-02", start)
+		}
+		if end := r.PostForm.Get(fmt.Sprintf("quarter-end-%d", i)); end != "" {
+			qd.End, err2 = time.Parse("2006-01-02", end)
+		}
+		if err1 != nil || err2 != nil || (!qd.Start.IsZero() && qd.End.Before(qd.Start)) {
+			renderErrorMsg(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid dates of Quarter %d", i))
+			return
+		}
+		setting.Quarters = append(setting.Quarters, qd)
+	}
+	if err := saveAtRiskSetting(c, sy, setting); err != nil {
+		log.Errorf(c, "Could not save at-risk settings: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/atrisk", http.StatusFound)
+}
+
+func atRiskClassTeachersHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+
+	var classTeachers []classTeacher
+	for _, class := range getClasses(c, sy) {
+		for _, classSection := range getClassSectionsOfClass(c, sy, class) {
+			teacherStr := r.PostForm.Get("teacher-" + classSection)
+			if teacherStr == "" {
+				continue
+			}
+			teacher, err := strconv.ParseInt(teacherStr, 10, 64)
+			if err != nil {
+				renderErrorMsg(w, r, http.StatusBadRequest, "Invalid teacher")
+				return
+			}
+			classTeachers = append(classTeachers, classTeacher{classSection, teacher})
+		}
+	}
+
+	if err := saveClassTeachers(c, sy, classTeachers); err != nil {
+		log.Errorf(c, "Could not save class teachers: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/atrisk", http.StatusFound)
+}
+
+// atRiskEmailHandler emails every class teacher the at-risk students of
+// their class section
+func atRiskEmailHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, err := parseTerm(r.PostForm.Get("Term"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Select a term")
+		return
+	}
+
+	sy := getSchoolYear(c)
+	setting := getAtRiskSetting(c, sy)
+
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		log.Errorf(c, "Could not retrieve employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	emails := make(map[int64]string)
+	for _, emp := range employees {
+		emails[emp.ID] = emp.CPSEmail
+	}
+
+	for classSection, teacher := range getClassTeachers(c, sy) {
+		email, ok := emails[teacher]
+		if !ok {
+			continue
+		}
+
+		atRisk, err := getAtRiskStudents(c, sy, term, classSection, setting)
+		if err != nil {
+			log.Errorf(c, "Could not get at-risk students: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if len(atRisk) == 0 {
+			continue
+		}
+
+		body := new(bytes.Buffer)
+		fmt.Fprintf(body, "The following students of %s are at risk in %s:\n\n",
+			strings.Replace(classSection, "|", "", 1), term)
+		for i, ar := range atRisk {
+			fmt.Fprintf(body, "%d. %s %s\n", i+1, ar.ID, ar.Name)
+			for _, reason := range ar.Reasons {
+				fmt.Fprintf(body, "   - %s\n", reason)
+			}
+		}
+		fmt.Fprintf(body, "\nTo view their marks, go to: %s/marks\n", siteURL)
+		subject := fmt.Sprintf("At-risk students of %s in %s", strings.Replace(classSection, "|", "", 1), term)
+		sendEmails(c, []string{email}, subject, body.String())
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/atrisk", http.StatusFound)
+}
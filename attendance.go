@@ -322,19 +322,8 @@ func attendanceExportHandler(w http.ResponseWriter, r *http.Request) {
 
 	filename := fmt.Sprintf("Attendance-%s-%s", group, date)
 
-	w.Header().Set("Content-Type", "text/csv")
-	// Force save as with filename
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment;filename=%s.csv", filename))
-
-	var errors []error
-	csvw := csv.NewWriter(w)
-	csvw.UseCRLF = true
-
 	fieldMax := []string{"Do not modify this column", "", "yyyy-mm-dd", "24-hour format", "24-hour format"}
-	errors = append(errors, csvw.Write(attendanceFields))
-	errors = append(errors, csvw.Write(fieldMax))
-
+	records := [][]string{attendanceFields, fieldMax}
 	for _, att := range attendances {
 		var row []string
 		row = append(row, att.UserKey.Encode())
@@ -342,15 +331,28 @@ func attendanceExportHandler(w http.ResponseWriter, r *http.Request) {
 		row = append(row, formatDate(att.Date))
 		row = append(row, formatTime(att.From))
 		row = append(row, formatTime(att.To))
-		errors = append(errors, csvw.Write(row))
+		records = append(records, row)
 	}
 
-	csvw.Flush()
-
-	for _, err := range errors {
-		if err != nil {
-			log.Errorf(c, "Error writing csv: %s", err)
+	if r.Form.Get("format") == "xlsx" {
+		setXLSXHeaders(w, filename)
+		formats := []xlsxFormat{xlsxText, xlsxText, xlsxDate, xlsxTime, xlsxTime}
+		sheet := xlsxSheet{"Attendance", xlsxRecords(records, 2, formats), 2}
+		if err := writeXLSX(w, sheet); err != nil {
+			log.Errorf(c, "Error writing xlsx: %s", err)
 		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	// Force save as with filename
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment;filename=%s.csv", filename))
+
+	csvw := csv.NewWriter(w)
+	csvw.UseCRLF = true
+	if err := csvw.WriteAll(records); err != nil {
+		log.Errorf(c, "Error writing csv: %s", err)
 	}
 }
 
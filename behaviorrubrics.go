@@ -0,0 +1,381 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	http.HandleFunc("/behaviorrubrics/details", accessHandler(behaviorRubricsDetailsHandler))
+	http.HandleFunc("/behaviorrubrics/save", accessHandler(behaviorRubricsSaveHandler))
+}
+
+// BehaviorRubric will be stored in the datastore. Every change to the rubric
+// of a class is stored as a new version, so behavior marks keep the version
+// they were entered under.
+type BehaviorRubric struct {
+	SY      string
+	Class   string
+	Version int
+
+	Max      float64
+	Levels   []string // descriptions of the scale, shown on report cards
+	Criteria []BehaviorCriterion
+
+	// DisciplineDeduction is deducted from Max for every point of the
+	// discipline incidents of the term
+	DisciplineDeduction float64
+}
+
+type BehaviorCriterion struct {
+	Name       string
+	ArabicName string
+	Discipline bool // calculated from the discipline incidents
+}
+
+// legacyBehaviorRubric is version 0 of every rubric. It is used for classes
+// without a rubric, and for marks entered before rubrics were configurable.
+var legacyBehaviorRubric = BehaviorRubric{
+	Version: 0,
+	Max:     4,
+	Levels: []string{
+		"4 = Exceeds Expectations / Above Standards",
+		"3 = Developing as Expected / Meets Standards",
+		"2 = Requires Frequent Guidance",
+		"1 = Requires Considerable Redirection / Below Standards",
+		"0 = Not Yet Assessed",
+	},
+	Criteria: []BehaviorCriterion{
+		{"Follows school guidelines for safe and appropriate behaviour", "", false},
+		{"Demonstrates courtesy and respect", "", false},
+		{"Listens and responds", "", false},
+		{"Strives for quality work", "", false},
+		{"Shows initiative / is a self - starter", "", false},
+		{"Participates enthusiastically in activities", "", false},
+		{"Uses time efficiently and appropriately", "", false},
+		{"Completes class work on time ", "", false},
+		{"Contributes to discussion and group tasks", "", false},
+		{"Works cooperatively with others", "", false},
+		{"Works well independently", "", false},
+		{"Returns complete homework", "", false},
+		{"Organizes shelf, materials and belongings ", "", false},
+		{"Asks questions to clarify content", "", false},
+		{"Clearly communicates to teachers ", "", false},
+	},
+}
+
+func (rubric BehaviorRubric) description() []colDescription {
+	var desc []colDescription
+	for _, criterion := range rubric.Criteria {
+		desc = append(desc, colDescription{criterion.Name, rubric.Max, rubric.Max, !criterion.Discipline})
+	}
+	return desc
+}
+
+// hasDiscipline returns whether the rubric has criteria calculated from the
+// discipline incidents
+func (rubric BehaviorRubric) hasDiscipline() bool {
+	for _, criterion := range rubric.Criteria {
+		if criterion.Discipline {
+			return true
+		}
+	}
+	return false
+}
+
+type behaviorRubricVersionSetting struct {
+	Value int
+}
+
+func getBehaviorRubric(c context.Context, sy, class string, version int) (BehaviorRubric, error) {
+	if version == 0 {
+		rubric := legacyBehaviorRubric
+		rubric.SY = sy
+		rubric.Class = class
+		return rubric, nil
+	}
+
+	keyStr := fmt.Sprintf("%s|%s|%d", sy, class, version)
+	key := datastore.NewKey(c, "behavior_rubric", keyStr, 0, nil)
+
+	var rubric BehaviorRubric
+	if err := nds.Get(c, key, &rubric); err != nil {
+		return BehaviorRubric{}, err
+	}
+
+	return rubric, nil
+}
+
+func behaviorRubricVersionKey(c context.Context, sy, class string) *datastore.Key {
+	return datastore.NewKey(c, "settings", "behavior-rubric-"+sy+"-"+class, 0, nil)
+}
+
+// getCurrentBehaviorRubricVersion returns the version used for new marks
+func getCurrentBehaviorRubricVersion(c context.Context, sy, class string) int {
+	var setting behaviorRubricVersionSetting
+	err := nds.Get(c, behaviorRubricVersionKey(c, sy, class), &setting)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Warningf(c, "Could not get behavior rubric version: %s", err)
+		}
+		return 0
+	}
+
+	return setting.Value
+}
+
+func behaviorRubricPinKey(c context.Context, sy, class string, term Term) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%s|%s", sy, class, term.Value())
+	return datastore.NewKey(c, "behavior_rubric_pin", keyStr, 0, nil)
+}
+
+// getTermBehaviorRubric returns the rubric version pinned to the term, or
+// the current version if no marks were entered yet
+func getTermBehaviorRubric(c context.Context, sy, class string, term Term) (BehaviorRubric, error) {
+	var pin behaviorRubricVersionSetting
+	version := 0
+	err := nds.Get(c, behaviorRubricPinKey(c, sy, class, term), &pin)
+	if err == nil {
+		version = pin.Value
+	} else if err == datastore.ErrNoSuchEntity {
+		version = getCurrentBehaviorRubricVersion(c, sy, class)
+	} else {
+		return BehaviorRubric{}, err
+	}
+
+	rubric, err := getBehaviorRubric(c, sy, class, version)
+	if err != nil {
+		return BehaviorRubric{}, fmt.Errorf("Could not get behavior rubric %s %s %d: %s", sy, class, version, err)
+	}
+
+	return rubric, nil
+}
+
+// pinBehaviorRubric makes the term keep the given rubric version even if
+// the rubric is changed later. Terms that are already pinned are unchanged.
+func pinBehaviorRubric(c context.Context, sy, class string, term Term, version int) error {
+	key := behaviorRubricPinKey(c, sy, class, term)
+
+	var pin behaviorRubricVersionSetting
+	err := nds.Get(c, key, &pin)
+	if err == nil {
+		// Already pinned
+		return nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	_, err = nds.Put(c, key, &behaviorRubricVersionSetting{version})
+	return err
+}
+
+// pinEnteredBehaviorMarks pins the current rubric version to the terms of
+// the class that already have behavior marks
+func pinEnteredBehaviorMarks(c context.Context, sy, class string) error {
+	version := getCurrentBehaviorRubricVersion(c, sy, class)
+
+	students, err := findStudents(c, sy, class+"|")
+	if err != nil {
+		return err
+	}
+	if len(students) == 0 {
+		return nil
+	}
+
+	for _, term := range terms {
+		if term.Typ != Quarter && term.Typ != Midterm {
+			continue
+		}
+
+		var keys []*datastore.Key
+		for _, stu := range students {
+			keyStr := fmt.Sprintf("%s|%s|%s|%s", stu.ID, sy, term.Value(), "Behavior")
+			keys = append(keys, datastore.NewKey(c, "marks", keyStr, 0, nil))
+		}
+
+		rows := make([]marksRow, len(keys))
+		err := nds.GetMulti(c, keys, rows)
+		found := err == nil
+		if merr, ok := err.(appengine.MultiError); ok {
+			for _, err := range merr {
+				if err == nil {
+					found = true
+				} else if err != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if found {
+			if err := pinBehaviorRubric(c, sy, class, term, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// saveBehaviorRubric stores the rubric as a new version and makes it the
+// current version of its class
+func saveBehaviorRubric(c context.Context, rubric BehaviorRubric) error {
+	if err := pinEnteredBehaviorMarks(c, rubric.SY, rubric.Class); err != nil {
+		return fmt.Errorf("Could not pin behavior marks: %s", err)
+	}
+
+	rubric.Version = getCurrentBehaviorRubricVersion(c, rubric.SY, rubric.Class) + 1
+
+	keyStr := fmt.Sprintf("%s|%s|%d", rubric.SY, rubric.Class, rubric.Version)
+	key := datastore.NewKey(c, "behavior_rubric", keyStr, 0, nil)
+	if _, err := nds.Put(c, key, &rubric); err != nil {
+		return err
+	}
+
+	key = behaviorRubricVersionKey(c, rubric.SY, rubric.Class)
+	_, err := nds.Put(c, key, &behaviorRubricVersionSetting{rubric.Version})
+	return err
+}
+
+func behaviorRubricsDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	class := r.Form.Get("class")
+	if class == "" {
+		log.Errorf(c, "Empty class")
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	version := getCurrentBehaviorRubricVersion(c, sy, class)
+	rubric, err := getBehaviorRubric(c, sy, class, version)
+	if err != nil {
+		log.Errorf(c, "Could not get behavior rubric %s %s %d: %s", sy, class, version, err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if len(rubric.Criteria) < 20 {
+		rubric.Criteria = append(rubric.Criteria, make([]BehaviorCriterion, 20-len(rubric.Criteria))...)
+	}
+
+	data := struct {
+		SY     string
+		Class  string
+		Rubric BehaviorRubric
+	}{
+		sy,
+		class,
+		rubric,
+	}
+
+	if err := render(w, r, "behaviorrubric", data); err != nil {
+		log.Errorf(c, "Could not render template behaviorrubric: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func behaviorRubricsSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	class := r.PostForm.Get("class")
+	if class == "" {
+		log.Errorf(c, "Empty class")
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	maxStr := r.PostForm.Get("Max")
+	max, err := strconv.ParseFloat(maxStr, 64)
+	if err != nil || max <= 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Invalid Max: %s", maxStr))
+		return
+	}
+
+	deductionStr := r.PostForm.Get("DisciplineDeduction")
+	deduction, err := strconv.ParseFloat(deductionStr, 64)
+	if deductionStr == "" {
+		deduction, err = 0, nil
+	}
+	if err != nil || deduction < 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Invalid discipline deduction: %s", deductionStr))
+		return
+	}
+
+	rubric := BehaviorRubric{
+		SY:    sy,
+		Class: class,
+		Max:   max,
+
+		DisciplineDeduction: deduction,
+	}
+
+	for _, level := range strings.Split(r.PostForm.Get("Levels"), "\n") {
+		level = strings.TrimSpace(level)
+		if level != "" {
+			rubric.Levels = append(rubric.Levels, level)
+		}
+	}
+
+	for i := 0; ; i++ {
+		_, ok := r.PostForm[fmt.Sprintf("criterion-name-%d", i)]
+		if !ok {
+			break
+		}
+
+		name := strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("criterion-name-%d", i)))
+		arabicName := strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("criterion-arabicname-%d", i)))
+		discipline := r.PostForm.Get(fmt.Sprintf("criterion-discipline-%d", i)) == "on"
+		if name == "" && arabicName == "" {
+			continue
+		}
+
+		rubric.Criteria = append(rubric.Criteria, BehaviorCriterion{name, arabicName, discipline})
+	}
+
+	if len(rubric.Criteria) == 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Please add criteria")
+		return
+	}
+
+	if err := saveBehaviorRubric(c, rubric); err != nil {
+		log.Errorf(c, "Could not save behavior rubric %s %s: %s", sy, class, err)
+		renderErrorMsg(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
@@ -0,0 +1,640 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/remote_api"
+
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cps is the command line tool of the application. Build it from the root of
+// the repository with
+//
+//	go build -o cps .
+//
+// Commands work directly against the datastore of the application through
+// remote_api (-host), so the local development server can be used with
+// "-host localhost:8080". Export commands can also use the JSON API (-api).
+
+type cliCommand struct {
+	Name  string
+	Args  string
+	Help  string
+	Run   func(env *cliEnv, args []string) error
+	NoAPI bool // needs -host
+}
+
+var cliCommands = []cliCommand{
+	{"export-students", "[-classsection all] [-o file]",
+		"Export the students of the school year as CSV, or XLSX if file ends with .xlsx", cliExportStudents, false},
+	{"export-employees", "[-type all] [-disabled] [-o file]",
+		"Export the employees as CSV, or XLSX if file ends with .xlsx", cliExportEmployees, false},
+	{"export-marks", "-term term [-classsection class|section -subject subject] [-dir Marks] [-xlsx]",
+		"Export marks as CSV or XLSX files, one per class section and subject", cliExportMarks, false},
+	{"import-students", "-f file",
+		"Import students from a CSV file", cliImportStudents, true},
+	{"import-employees", "-f file",
+		"Import employees from a CSV file", cliImportEmployees, true},
+	{"import-marks", "-term term -classsection class|section -subject subject -f file",
+		"Import the marks of a class section from a CSV or XLSX file", cliImportMarks, true},
+	{"report", "-name name [-sy 2018-2019,...] [-classes c1,c2] [-subjects s1,s2] [-o file]",
+		"Generate a report as CSV, or XLSX if file ends with .xlsx", cliReport, true},
+	{"completion", "-term term [-rebuild] [-o file]",
+		"Show the number of students with complete marks", cliCompletion, true},
+	{"rollover", "-to school-year -classes c1,c2,... [-activate]",
+		"Prepare the next school year and promote the students", cliRollover, true},
+}
+
+type cliEnv struct {
+	c   context.Context // nil without -host
+	api *apiClient      // nil without -api
+	sy  string
+}
+
+func cliUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: cps [-host host | -api url] [-token token] [-sy school-year] command [flags]\n\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s", cmd.Name, cmd.Args, cmd.Help)
+		if cmd.NoAPI {
+			fmt.Fprintf(os.Stderr, " (-host only)")
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+}
+
+func main() {
+	host := flag.String("host", "", "host of the application, e.g. localhost:8080 or app-id.appspot.com")
+	apiURL := flag.String("api", "", "URL of the application for the JSON API, e.g. https://app-id.appspot.com")
+	token := flag.String("token", "", "OAuth access token of an administrator with -host, or API token with -api")
+	sy := flag.String("sy", "", "school year (default: the current school year)")
+	flag.Usage = cliUsage
+	flag.Parse()
+
+	if flag.NArg() == 0 || (*host == "") == (*apiURL == "") {
+		cliUsage()
+		os.Exit(2)
+	}
+
+	var cmd *cliCommand
+	for i := range cliCommands {
+		if cliCommands[i].Name == flag.Arg(0) {
+			cmd = &cliCommands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", flag.Arg(0))
+		cliUsage()
+		os.Exit(2)
+	}
+
+	env := &cliEnv{sy: *sy}
+	if *host != "" {
+		client := &http.Client{}
+		if *token != "" {
+			client.Transport = bearerTransport{*token, http.DefaultTransport}
+		}
+		c, err := remote_api.NewRemoteContext(*host, client)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not connect to %s: %s\n", *host, err)
+			os.Exit(1)
+		}
+		env.c = c
+		if env.sy == "" {
+			env.sy = getSchoolYear(c)
+		}
+	} else {
+		if cmd.NoAPI {
+			fmt.Fprintf(os.Stderr, "%s needs -host\n", cmd.Name)
+			os.Exit(2)
+		}
+		env.api = &apiClient{strings.TrimRight(*apiURL, "/"), *token}
+		if env.sy != "" {
+			fmt.Fprintf(os.Stderr, "-sy is not supported with -api\n")
+			os.Exit(2)
+		}
+	}
+
+	if err := cmd.Run(env, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// bearerTransport adds an OAuth access token to the requests, such as the
+// output of "gcloud auth print-access-token"
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+func cliFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// cliIsXLSX reports whether filename is an Excel workbook
+func cliIsXLSX(filename string) bool {
+	return strings.HasSuffix(strings.ToLower(filename), ".xlsx")
+}
+
+// cliOutput returns stdout if filename is empty
+func cliOutput(filename string) (io.WriteCloser, error) {
+	if filename == "" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(filename)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// cliTerm accepts the form value of a term (e.g. "1|1") or its name
+// (e.g. "Quarter 1")
+func cliTerm(s string) (Term, error) {
+	if term, err := parseTerm(s); err == nil {
+		return term, nil
+	}
+	for _, term := range terms {
+		if strings.EqualFold(term.String(), s) {
+			return term, nil
+		}
+	}
+	return Term{}, fmt.Errorf("Invalid term: %q", s)
+}
+
+func cliList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func cliExportStudents(env *cliEnv, args []string) error {
+	fs := cliFlags("export-students")
+	classSection := fs.String("classsection", "all", "class and section, e.g. 5|A")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Parse(args)
+
+	var students []studentType
+	var studentClasses []studentClass
+	var err error
+	if env.api != nil {
+		students, studentClasses, err = env.api.students(*classSection)
+	} else {
+		studentClasses, err = findStudents(env.c, env.sy, *classSection)
+		if err == nil && len(studentClasses) > 0 {
+			var ids []string
+			for _, sc := range studentClasses {
+				ids = append(ids, sc.ID)
+			}
+			students, err = getStudentMulti(env.c, ids)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := cliOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if cliIsXLSX(*output) {
+		records := studentsRecords(students, studentClasses)
+		return writeXLSX(w, xlsxSheet{"Students", xlsxRecords(records, 2, studentFieldsFormats), 2})
+	}
+	return writeStudentsCSV(w, students, studentClasses)
+}
+
+func cliExportEmployees(env *cliEnv, args []string) error {
+	fs := cliFlags("export-employees")
+	typ := fs.String("type", "all", "employee type")
+	disabled := fs.Bool("disabled", false, "export disabled employees instead")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Parse(args)
+
+	var employees []employeeType
+	var err error
+	if env.api != nil {
+		employees, err = env.api.employees(*typ, !*disabled)
+	} else {
+		employees, err = getEmployees(env.c, !*disabled, *typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := cliOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if cliIsXLSX(*output) {
+		records := employeesRecords(employees)
+		return writeXLSX(w, xlsxSheet{"Employees", xlsxRecords(records, 2, employeeFieldsFormats), 2})
+	}
+	return writeEmployeesCSV(w, employees)
+}
+
+func cliExportMarks(env *cliEnv, args []string) error {
+	fs := cliFlags("export-marks")
+	termStr := fs.String("term", "", "term, e.g. \"Quarter 1\"")
+	classSection := fs.String("classsection", "", "class and section, e.g. 5|A (default: all)")
+	subject := fs.String("subject", "", "subject (default: all)")
+	dir := fs.String("dir", "Marks", "output directory")
+	asXLSX := fs.Bool("xlsx", false, "write XLSX files instead of CSV")
+	fs.Parse(args)
+
+	term, err := cliTerm(*termStr)
+	if err != nil {
+		return err
+	}
+
+	type marksFile struct {
+		ClassSection string
+		Subject      string
+	}
+	var files []marksFile
+
+	switch {
+	case *classSection != "" && *subject != "":
+		files = append(files, marksFile{*classSection, *subject})
+	case env.api != nil:
+		// Only administrators can list the assignments
+		assignments, err := env.api.assignments()
+		if err != nil {
+			return err
+		}
+		for _, at := range assignments {
+			if (*classSection == "" || *classSection == at.ClassSection) &&
+				(*subject == "" || *subject == at.Subject) {
+				files = append(files, marksFile{at.ClassSection, at.Subject})
+			}
+		}
+	default:
+		sections := getClassSections(env.c, env.sy)
+		var classes []string
+		for class := range sections {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			subjects, err := getSubjects(env.c, env.sy, class)
+			if err != nil {
+				return err
+			}
+			subjects = append(subjects, "Remarks")
+			for _, section := range sections[class] {
+				cs := fmt.Sprintf("%s|%s", class, section)
+				if *classSection != "" && *classSection != cs {
+					continue
+				}
+				for _, s := range subjects {
+					if *subject == "" || *subject == s {
+						files = append(files, marksFile{cs, s})
+					}
+				}
+			}
+		}
+	}
+
+	for i, f := range files {
+		id := fmt.Sprintf("(%4d/%4d) %15s %7s %22s", i+1, len(files), term, f.ClassSection, f.Subject)
+
+		var cols []colDescription
+		var rows []studentRow
+		if env.api != nil {
+			cols, rows, err = env.api.marks(f.ClassSection, f.Subject, term)
+		} else {
+			cols, rows, err = getMarksRows(env.c, env.sy, term, f.ClassSection, f.Subject)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", id, err)
+		}
+		if len(cols) == 0 || len(rows) == 0 {
+			// Not Applicable
+			fmt.Printf("%s: skipped\n", id)
+			continue
+		}
+
+		class, section, err := parseClassSection(f.ClassSection)
+		if err != nil {
+			return err
+		}
+		safe := strings.NewReplacer("/", "_", "|", "_")
+		filedir := filepath.Join(*dir, term.String(), safe.Replace(f.Subject))
+		ext := "csv"
+		if *asXLSX {
+			ext = "xlsx"
+		}
+		filename := filepath.Join(filedir, fmt.Sprintf("%s-%s%s.%s",
+			safe.Replace(f.Subject), safe.Replace(class), safe.Replace(section), ext))
+
+		if err := os.MkdirAll(filedir, os.ModePerm); err != nil {
+			return err
+		}
+		w, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		if *asXLSX {
+			err = writeMarksXLSX(w, term, f.ClassSection, f.Subject, cols, rows)
+		} else {
+			err = writeMarksCSV(w, term, f.ClassSection, f.Subject, cols, rows)
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: saved to %s\n", id, filename)
+	}
+
+	return nil
+}
+
+func cliPrintErrors(errors []error) error {
+	for _, err := range errors {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%d rows were not imported", len(errors))
+	}
+	return nil
+}
+
+func cliImportStudents(env *cliEnv, args []string) error {
+	fs := cliFlags("import-students")
+	filename := fs.String("f", "", "CSV file, in the format of export-students")
+	fs.Parse(args)
+
+	f, err := os.Open(*filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	errors, err := importStudentsCSV(env.c, env.sy, f)
+	if err != nil {
+		return err
+	}
+	return cliPrintErrors(errors)
+}
+
+func cliImportEmployees(env *cliEnv, args []string) error {
+	fs := cliFlags("import-employees")
+	filename := fs.String("f", "", "CSV file, in the format of export-employees")
+	fs.Parse(args)
+
+	f, err := os.Open(*filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// remote_api is only available to administrators
+	errors, err := importEmployeesCSV(env.c, f, true)
+	if err != nil {
+		return err
+	}
+	return cliPrintErrors(errors)
+}
+
+func cliImportMarks(env *cliEnv, args []string) error {
+	fs := cliFlags("import-marks")
+	termStr := fs.String("term", "", "term, e.g. \"Quarter 1\"")
+	classSection := fs.String("classsection", "", "class and section, e.g. 5|A")
+	subject := fs.String("subject", "", "subject")
+	filename := fs.String("f", "", "CSV or XLSX file, in the format of export-marks")
+	fs.Parse(args)
+
+	term, err := cliTerm(*termStr)
+	if err != nil {
+		return err
+	}
+	if *subject == "" {
+		return fmt.Errorf("-subject is required")
+	}
+
+	f, err := os.Open(*filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := readMarksFile(*filename, f)
+	if err != nil {
+		return err
+	}
+
+	return applyMarksImport(env.c, env.sy, term, *classSection, *subject, records)
+}
+
+func cliReport(env *cliEnv, args []string) error {
+	fs := cliFlags("report")
+	name := fs.String("name", "", fmt.Sprintf("one of %q", reportNames()))
+	sys := fs.String("sy", "", "comma separated school years (default: the current school year)")
+	classesStr := fs.String("classes", "", "comma separated classes (default: all)")
+	subjectsStr := fs.String("subjects", "", "comma separated subjects (default: all)")
+	termStr := fs.String("term", "", "term, for reports of a term")
+	fromStr := fs.String("from", "", "start date (yyyy-mm-dd), for reports of a date range")
+	toStr := fs.String("to", "", "end date (yyyy-mm-dd), for reports of a date range")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Parse(args)
+
+	rt, ok := getReportType(*name)
+	if !ok {
+		return fmt.Errorf("unknown report %q", *name)
+	}
+
+	schoolYears := cliList(*sys)
+	if len(schoolYears) == 0 {
+		schoolYears = []string{env.sy}
+	}
+
+	classNames := cliList(*classesStr)
+	if len(classNames) == 0 {
+		classNames = getClasses(env.c, schoolYears[0])
+	}
+	subjectNames := cliList(*subjectsStr)
+	if len(subjectNames) == 0 {
+		subjectNames = getAllSubjects(env.c, schoolYears[0])
+	}
+
+	form := url.Values{
+		"SchoolYears": schoolYears,
+		"Term":        {*termStr},
+		"From":        {*fromStr},
+		"To":          {*toStr},
+	}
+	// The same classes and subjects in every school year
+	for _, sy := range schoolYears {
+		for _, class := range classNames {
+			form.Add("classes-"+sy, class)
+		}
+		for _, subject := range subjectNames {
+			form.Add("subjects-"+sy, subject)
+		}
+	}
+	params, err := parseReportParams(env.c, rt, form)
+	if err != nil {
+		return err
+	}
+
+	report, err := rt.Generate(env.c, params)
+	if err != nil {
+		return err
+	}
+
+	w, err := cliOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if cliIsXLSX(*output) {
+		return writeXLSX(w, reportXLSX(*name, report))
+	}
+
+	csvw := csv.NewWriter(w)
+	csvw.UseCRLF = true
+	for _, row := range flattenReport(report) {
+		if err := csvw.Write(row); err != nil {
+			return err
+		}
+	}
+	csvw.Flush()
+	return csvw.Error()
+}
+
+func cliCompletion(env *cliEnv, args []string) error {
+	fs := cliFlags("completion")
+	termStr := fs.String("term", "", "term, e.g. \"Quarter 1\"")
+	rebuild := fs.Bool("rebuild", false, "recalculate the completion from the marks first")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Parse(args)
+
+	term, err := cliTerm(*termStr)
+	if err != nil {
+		return err
+	}
+
+	if *rebuild {
+		if err := rebuildCompletion(env.c, env.sy, term); err != nil {
+			return err
+		}
+	}
+
+	rows, err := getCompletionRows(env.c, env.sy, term)
+	if err != nil {
+		return err
+	}
+
+	subjects := append(getAllSubjects(env.c, env.sy), "Remarks")
+
+	w, err := cliOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	csvw := csv.NewWriter(w)
+	csvw.UseCRLF = true
+	if err := csvw.Write(append([]string{"Class"}, subjects...)); err != nil {
+		return err
+	}
+	for _, cr := range rows {
+		record := []string{cr.ClassSection}
+		for _, subject := range subjects {
+			n, ok := cr.Completion[subject]
+			switch {
+			case n == -1:
+				record = append(record, "-")
+			case !ok:
+				record = append(record, fmt.Sprintf("0/%d", cr.NumStudents[subject]))
+			case subject == "Remarks":
+				record = append(record, fmt.Sprint(n))
+			default:
+				record = append(record, fmt.Sprintf("%d/%d", n, cr.NumStudents[subject]))
+			}
+		}
+		if err := csvw.Write(record); err != nil {
+			return err
+		}
+	}
+	csvw.Flush()
+	return csvw.Error()
+}
+
+func cliRollover(env *cliEnv, args []string) error {
+	fs := cliFlags("rollover")
+	to := fs.String("to", "", "the new school year, e.g. 2019-2020")
+	classes := fs.String("classes", "", "comma separated classes, in the order students are promoted. Students of the last class graduate.")
+	activate := fs.Bool("activate", false, "make the new school year the current school year")
+	fs.Parse(args)
+
+	start := time.Now()
+	result, err := rolloverSchoolYear(env.c, env.sy, *to, cliList(*classes))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rollover from %s to %s done in %s\n", env.sy, *to, time.Since(start))
+	fmt.Printf("Promoted: %d, graduated: %d, retained: %d, pending remedial: %d, already assigned: %d\n",
+		result.Promoted, result.Graduated, result.Retained, result.Pending, result.Skipped)
+	if len(result.Unplaced) > 0 {
+		fmt.Printf("Not assigned, because their section does not exist in %s:\n", *to)
+		for _, stu := range result.Unplaced {
+			fmt.Printf("  %s\n", stu)
+		}
+	}
+
+	if *activate {
+		if err := saveSchoolYear(env.c, *to); err != nil {
+			return err
+		}
+		fmt.Printf("The current school year is now %s\n", *to)
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// apiClient reads data from the JSON API of api.go
+type apiClient struct {
+	baseURL string
+	token   string
+}
+
+// getPage gets a page of the results and decodes its data into v
+func (ac *apiClient) getPage(path string, params url.Values, offset int, v interface{}) (apiPage, error) {
+	q := url.Values{}
+	for k, vs := range params {
+		q[k] = vs
+	}
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(apiMaxLimit))
+
+	req, err := http.NewRequest("GET", ac.baseURL+"/api/v1"+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return apiPage{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return apiPage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Message == "" {
+			apiErr = apiError{resp.StatusCode, resp.Status}
+		}
+		apiErr.Message = fmt.Sprintf("%s: %s", path, apiErr.Message)
+		return apiPage{}, apiErr
+	}
+
+	page := apiPage{Data: v}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return apiPage{}, err
+	}
+
+	return page, nil
+}
+
+// getAll gets all the pages of a list. add is called with the number of
+// items of every page.
+func (ac *apiClient) getAll(path string, params url.Values, v interface{}, add func() int) error {
+	offset := 0
+	for {
+		page, err := ac.getPage(path, params, offset, v)
+		if err != nil {
+			return err
+		}
+		n := add()
+		offset += n
+		if n == 0 || offset >= page.Total {
+			return nil
+		}
+	}
+}
+
+func (ac *apiClient) students(classSection string) ([]studentType, []studentClass, error) {
+	var students []studentType
+	var studentClasses []studentClass
+
+	var page []apiStudent
+	add := func() int {
+		for _, s := range page {
+			dob, _ := time.Parse("2006-01-02", s.DateOfBirth)
+			students = append(students, studentType{
+				ID:            s.ID,
+				Name:          s.Name,
+				ArabicName:    s.ArabicName,
+				Gender:        s.Gender,
+				DateOfBirth:   dob,
+				Nationality:   s.Nationality,
+				Stream:        s.Stream,
+				GuardianEmail: s.GuardianEmail,
+			})
+			studentClasses = append(studentClasses, studentClass{
+				ID:      s.ID,
+				Name:    s.Name,
+				Class:   s.Class,
+				Section: s.Section,
+				Stream:  s.Stream,
+			})
+		}
+		n := len(page)
+		page = nil
+		return n
+	}
+
+	params := url.Values{"classsection": {classSection}}
+	if err := ac.getAll("/students", params, &page, add); err != nil {
+		return nil, nil, err
+	}
+
+	return students, studentClasses, nil
+}
+
+func (ac *apiClient) employees(typ string, enabled bool) ([]employeeType, error) {
+	var employees []employeeType
+
+	var page []apiEmployee
+	add := func() int {
+		for _, e := range page {
+			employees = append(employees, employeeType{
+				ID:       e.ID,
+				CPSEmail: e.Email,
+				Roles: roles{
+					Admin:   e.Admin,
+					HR:      e.HR,
+					Teacher: e.Teacher,
+				},
+				Enabled:        e.Enabled,
+				Name:           e.Name,
+				ArabicName:     e.ArabicName,
+				Gender:         e.Gender,
+				Type:           e.Type,
+				JobDescription: e.JobDescription,
+			})
+		}
+		n := len(page)
+		page = nil
+		return n
+	}
+
+	params := url.Values{
+		"type":    {typ},
+		"enabled": {strconv.FormatBool(enabled)},
+	}
+	if err := ac.getAll("/employees", params, &page, add); err != nil {
+		return nil, err
+	}
+
+	return employees, nil
+}
+
+func (ac *apiClient) assignments() ([]apiAssignment, error) {
+	var assignments []apiAssignment
+
+	var page []apiAssignment
+	add := func() int {
+		assignments = append(assignments, page...)
+		n := len(page)
+		page = nil
+		return n
+	}
+
+	if err := ac.getAll("/assignments", nil, &page, add); err != nil {
+		return nil, err
+	}
+
+	return assignments, nil
+}
+
+func (ac *apiClient) marks(classSection, subject string, term Term) ([]colDescription, []studentRow, error) {
+	var cols []colDescription
+	var rows []studentRow
+
+	var page apiMarksResponse
+	add := func() int {
+		if cols == nil {
+			for _, col := range page.Columns {
+				finalWeight := math.NaN()
+				if col.FinalWeight != nil {
+					finalWeight = *col.FinalWeight
+				}
+				cols = append(cols, colDescription{col.Name, col.Max, finalWeight, col.Editable})
+			}
+		}
+		for _, s := range page.Students {
+			marks := make([]float64, len(s.Marks))
+			for i, m := range s.Marks {
+				if m == nil {
+					marks[i] = math.NaN()
+				} else {
+					marks[i] = *m
+				}
+			}
+			rows = append(rows, studentRow{s.StudentID, s.Name, marks, ""})
+		}
+		n := len(page.Students)
+		page = apiMarksResponse{}
+		return n
+	}
+
+	params := url.Values{
+		"classsection": {classSection},
+		"subject":      {subject},
+		"term":         {term.Value()},
+	}
+	if err := ac.getAll("/marks", params, &page, add); err != nil {
+		if apiErr, ok := err.(apiError); ok && apiErr.Code == http.StatusNotFound {
+			// Not applicable
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	return cols, rows, nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	http.HandleFunc("/progressreports/comments", accessHandler(commentBankHandler))
+	http.HandleFunc("/progressreports/comments/save", accessHandler(commentBankSaveHandler))
+	http.HandleFunc("/progressreports/comments/delete", accessHandler(commentBankDeleteHandler))
+}
+
+// bankComment will be stored in the datastore. It is shared by all teachers
+// and school years.
+type bankComment struct {
+	ID string `datastore:"-"`
+
+	Category string
+	Text     string `datastore:",noindex"`
+	Author   string
+}
+
+// commentPlaceholders are replaced with the student's details when a
+// comment is inserted into a progress report
+var commentPlaceholders = []string{"{name}", "{firstname}", "{class}"}
+
+var genderedPronoun = regexp.MustCompile(`(?i)\b(he|she|him|her|his|hers|himself|herself)\b`)
+
+func (bc bankComment) validate() error {
+	if strings.TrimSpace(bc.Text) == "" {
+		return fmt.Errorf("Comment is required")
+	}
+	if p := genderedPronoun.FindString(bc.Text); p != "" {
+		return fmt.Errorf("Please use {name} or pronoun-neutral phrasing instead of %q", p)
+	}
+	return nil
+}
+
+// expand replaces the placeholders of the comment
+func (bc bankComment) expand(name, class string) string {
+	firstName := name
+	if fields := strings.Fields(name); len(fields) > 0 {
+		firstName = fields[0]
+	}
+	r := strings.NewReplacer(
+		"{name}", name,
+		"{firstname}", firstName,
+		"{class}", class,
+	)
+	return r.Replace(bc.Text)
+}
+
+func getBankComments(c context.Context, search string) ([]bankComment, error) {
+	q := datastore.NewQuery("comment").Order("Category")
+
+	var comments []bankComment
+	keys, err := q.GetAll(c, &comments)
+	if err != nil {
+		return nil, err
+	}
+
+	search = strings.ToLower(strings.TrimSpace(search))
+	var result []bankComment
+	for i, bc := range comments {
+		if search != "" &&
+			!strings.Contains(strings.ToLower(bc.Text), search) &&
+			!strings.Contains(strings.ToLower(bc.Category), search) {
+			continue
+		}
+		bc.ID = keys[i].Encode()
+		result = append(result, bc)
+	}
+
+	return result, nil
+}
+
+func (bc bankComment) save(c context.Context) error {
+	if err := bc.validate(); err != nil {
+		return err
+	}
+	key := datastore.NewIncompleteKey(c, "comment", nil)
+	_, err := nds.Put(c, key, &bc)
+	return err
+}
+
+func bankCommentKey(id string) (*datastore.Key, error) {
+	key, err := datastore.DecodeKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.Kind() != "comment" {
+		return nil, fmt.Errorf("Invalid comment: %s", id)
+	}
+	return key, nil
+}
+
+func getBankComment(c context.Context, id string) (bankComment, error) {
+	key, err := bankCommentKey(id)
+	if err != nil {
+		return bankComment{}, err
+	}
+	var bc bankComment
+	if err := nds.Get(c, key, &bc); err != nil {
+		return bankComment{}, err
+	}
+	bc.ID = id
+	return bc, nil
+}
+
+func deleteBankComment(c context.Context, id string) error {
+	key, err := bankCommentKey(id)
+	if err != nil {
+		return err
+	}
+	return nds.Delete(c, key)
+}
+
+// canDelete returns whether the user can delete the comment. Only its author
+// and the administrators can.
+func (bc bankComment) canDelete(user user) bool {
+	return bc.Author == user.Email || user.Roles.Admin
+}
+
+func commentBankHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	search := r.Form.Get("q")
+	comments, err := getBankComments(c, search)
+	if err != nil {
+		log.Errorf(c, "Could not get comments: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	type commentRow struct {
+		bankComment
+		CanDelete bool
+	}
+	var rows []commentRow
+	for _, bc := range comments {
+		rows = append(rows, commentRow{bc, bc.canDelete(user)})
+	}
+
+	data := struct {
+		Search       string
+		Comments     []commentRow
+		Placeholders []string
+	}{
+		search,
+		rows,
+		commentPlaceholders,
+	}
+
+	if err := render(w, r, "commentbank", data); err != nil {
+		log.Errorf(c, "Could not render template commentbank: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func commentBankSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	bc := bankComment{
+		Category: strings.TrimSpace(r.PostForm.Get("Category")),
+		Text:     strings.TrimSpace(r.PostForm.Get("Text")),
+		Author:   user.Email,
+	}
+
+	if err := bc.save(c); err != nil {
+		log.Errorf(c, "Could not save comment: %s", err)
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/progressreports/comments", http.StatusFound)
+}
+
+func commentBankDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	bc, err := getBankComment(c, r.PostForm.Get("ID"))
+	if err != nil {
+		log.Errorf(c, "Could not get comment: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !bc.canDelete(user) {
+		renderErrorMsg(w, r, http.StatusForbidden, "Only the author can delete the comment")
+		return
+	}
+
+	if err := deleteBankComment(c, bc.ID); err != nil {
+		log.Errorf(c, "Could not delete comment: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/progressreports/comments", http.StatusFound)
+}
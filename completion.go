@@ -9,55 +9,474 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/log"
 
+	"bytes"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
 // completion will be stored in the datastore
 type completion struct {
+	SY           string
 	ClassSection string
 	Term         string
 	Subject      string
 	N            int
 }
 
-func getCompletions(c context.Context, term Term, classSection string) ([]completion, error) {
+func getCompletions(c context.Context, sy string, term Term, classSection string) ([]completion, error) {
 	q := datastore.NewQuery("completion").
 		Filter("Term =", term.Value()).
 		Filter("ClassSection =", classSection)
-	var completions []completion
-	_, err := q.GetAll(c, &completions)
+	var stored []completion
+	_, err := q.GetAll(c, &stored)
 	if err != nil {
 		return nil, err
 	}
 
+	var completions []completion
+	found := make(map[string]bool)
+	for _, cr := range stored {
+		if cr.SY == sy {
+			completions = append(completions, cr)
+			found[cr.Subject] = true
+		}
+	}
+
+	// Entities without a school year are from before it was stored. They
+	// are used until the subject is stored again or the completion is
+	// rebuilt.
+	for _, cr := range stored {
+		if cr.SY == "" && !found[cr.Subject] {
+			cr.SY = sy
+			completions = append(completions, cr)
+		}
+	}
+
 	return completions, nil
 }
 
-func storeCompletion(c context.Context, classSection string, term Term,
+// completionHistory will be stored in the datastore. An entry is added every
+// time the number of students with complete marks changes, so it is known
+// when each subject was completed.
+type completionHistory struct {
+	SY           string
+	ClassSection string
+	Term         string
+	Subject      string
+	N            int
+	Time         time.Time
+}
+
+func getCompletionHistory(c context.Context, sy string, term Term, classSection string) ([]completionHistory, error) {
+	q := datastore.NewQuery("completionhistory").
+		Filter("SY =", sy).
+		Filter("Term =", term.Value()).
+		Filter("ClassSection =", classSection).
+		Order("Time")
+	var history []completionHistory
+	_, err := q.GetAll(c, &history)
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+func completionKey(c context.Context, sy, classSection string, term Term, subject string) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%s|%s|%s", sy, classSection, term.Value(), subject)
+	return datastore.NewKey(c, "completion", keyStr, 0, nil)
+}
+
+// putCompletion stores the number of students of the class section with
+// complete marks in subject
+func putCompletion(c context.Context, sy, classSection string, term Term,
 	subject string, nComplete int) error {
 
-	cr := completion{classSection, term.Value(), subject, nComplete}
-	keyStr := fmt.Sprintf("%s|%s|%s", classSection, term, subject)
-	key := datastore.NewKey(c, "completion", keyStr, 0, nil)
-	_, err := nds.Put(c, key, &cr)
+	// Historical mistake: term instead of term.Value(), and no school year
+	oldKeyStr := fmt.Sprintf("%s|%s|%s", classSection, term, subject)
+	oldKey := datastore.NewKey(c, "completion", oldKeyStr, 0, nil)
+	if err := nds.Delete(c, oldKey); err != nil {
+		return err
+	}
+
+	cr := completion{sy, classSection, term.Value(), subject, nComplete}
+	_, err := nds.Put(c, completionKey(c, sy, classSection, term, subject), &cr)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// storeCompletion stores the completion after marks are saved, and adds an
+// entry to the completion history if it changed
+func storeCompletion(c context.Context, sy, classSection string, term Term,
+	subject string, nComplete int) error {
+
+	var old completion
+	err := nds.Get(c, completionKey(c, sy, classSection, term, subject), &old)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	if err == datastore.ErrNoSuchEntity || old.N != nComplete {
+		ch := completionHistory{sy, classSection, term.Value(), subject, nComplete, time.Now()}
+		hKey := datastore.NewIncompleteKey(c, "completionhistory", nil)
+		if _, err := nds.Put(c, hKey, &ch); err != nil {
+			return err
+		}
+	}
+
+	return putCompletion(c, sy, classSection, term, subject, nComplete)
+}
+
+// computeCompletion returns the number of students of the class section with
+// complete marks in subject, from the stored marks
+func computeCompletion(c context.Context, sy string, term Term, classSection, subject string) (int, error) {
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		return 0, err
+	}
+
+	students, err := findStudents(c, sy, classSection)
+	if err != nil {
+		return 0, err
+	}
+
+	nComplete := 0
+	if subject == "Remarks" {
+		for _, s := range students {
+			rem, err := getStudentRemark(c, sy, s.ID, term)
+			if err != nil {
+				return 0, err
+			}
+			if rem != "" {
+				nComplete++
+			}
+		}
+		return nComplete, nil
+	}
+
+	gs := getGradingSystem(c, sy, class, subject)
+	if gs == nil {
+		return 0, nil
+	}
+
+	for _, s := range students {
+		if !gs.inStream(s.Stream) {
+			continue
+		}
+		var m studentMarks
+		if term.Typ == WeekS1 || term.Typ == WeekS2 {
+			m = make(studentMarks)
+		} else {
+			m, err = getStudentMarks(c, s.ID, sy, subject)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if err := gs.evaluate(c, s.ID, sy, term, m); err != nil {
+			log.Warningf(c, "Could not evaluate marks of %s in %s: %s", s.ID, subject, err)
+			continue
+		}
+		if gs.ready(term, m) {
+			nComplete++
+		}
+	}
+
+	return nComplete, nil
+}
+
+// rebuildCompletion replaces the stored completion of term with the one
+// computed from the marks of every class section and subject
+func rebuildCompletion(c context.Context, sy string, term Term) error {
+	q := datastore.NewQuery("completion").Filter("Term =", term.Value())
+	var existing []completion
+	keys, err := q.GetAll(c, &existing)
 	if err != nil {
 		return err
 	}
 
+	// Entities without a school year are from before it was stored
+	var staleKeys []*datastore.Key
+	for i, cr := range existing {
+		if cr.SY == sy || cr.SY == "" {
+			staleKeys = append(staleKeys, keys[i])
+		}
+	}
+	if err := nds.DeleteMulti(c, staleKeys); err != nil {
+		return err
+	}
+
+	sections := getClassSections(c, sy)
+	for _, class := range getClasses(c, sy) {
+		subjects, err := getSubjects(c, sy, class)
+		if err != nil {
+			return fmt.Errorf("Could not get subjects: %s", err)
+		}
+		subjects = append(subjects, "Remarks")
+
+		for _, section := range sections[class] {
+			classSection := fmt.Sprintf("%s|%s", class, section)
+			for _, subject := range subjects {
+				if subject != "Remarks" && getGradingSystem(c, sy, class, subject) == nil {
+					// class doesn't have subject
+					continue
+				}
+				nComplete, err := computeCompletion(c, sy, term, classSection, subject)
+				if err != nil {
+					return fmt.Errorf("%s %s: %s", classSection, subject, err)
+				}
+				err = putCompletion(c, sy, classSection, term, subject, nComplete)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	log.Infof(c, "Rebuilt completion of %s %s", sy, term)
+
+	return nil
+}
+
+var rebuildCompletionFunc = delay.Func("rebuildCompletion", func(c context.Context, sy, termValue string) error {
+	term, err := parseTerm(termValue)
+	if err != nil {
+		log.Errorf(c, "Could not rebuild completion: %s", err)
+		// retrying will not help
+		return nil
+	}
+
+	return rebuildCompletion(c, sy, term)
+})
+
+// queueCompletionRebuild rebuilds the completion of every term of sy in the
+// background, one task for each term
+func queueCompletionRebuild(c context.Context, sy string, rebuildTerms []Term) error {
+	for _, term := range rebuildTerms {
+		if err := rebuildCompletionFunc.Call(c, sy, term.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allCompletionTerms returns the terms and weeks that have completion
+func allCompletionTerms(c context.Context) []Term {
+	allTerms := append([]Term{}, terms...)
+	maxWeeks := getMaxWeeks(c)
+	for i := 1; i <= maxWeeks; i++ {
+		allTerms = append(allTerms, Term{WeekS1, i}, Term{WeekS2, i})
+	}
+	return allTerms
+}
+
+// completionDeadline is the date by which the marks of Term should be complete
+type completionDeadline struct {
+	Term     Term
+	Deadline time.Time
+}
+
+type completionDeadlinesSetting struct {
+	Value []completionDeadline
+}
+
+func getCompletionDeadlines(c context.Context, sy string) map[Term]time.Time {
+	key := datastore.NewKey(c, "settings", "completion-deadlines-"+sy, 0, nil)
+
+	setting := completionDeadlinesSetting{}
+	err := nds.Get(c, key, &setting)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Could not get completion deadlines: %s\nUsing defaults instead", err)
+	}
+
+	deadlines := make(map[Term]time.Time)
+	for _, cd := range setting.Value {
+		deadlines[cd.Term] = cd.Deadline
+	}
+
+	return deadlines
+}
+
+// saveCompletionDeadline sets the deadline of term. A zero deadline removes it.
+func saveCompletionDeadline(c context.Context, sy string, term Term, deadline time.Time) error {
+	deadlines := getCompletionDeadlines(c, sy)
+	if deadline.IsZero() {
+		delete(deadlines, term)
+	} else {
+		deadlines[term] = deadline
+	}
+
+	var setting completionDeadlinesSetting
+	for t, d := range deadlines {
+		setting.Value = append(setting.Value, completionDeadline{t, d})
+	}
+
+	key := datastore.NewKey(c, "settings", "completion-deadlines-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &setting)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// daysUntil returns the number of days from today until date. It is
+// negative if date has passed.
+func daysUntil(date time.Time) int {
+	today := dateOnly(time.Now().In(date.Location()))
+	return int(dateOnly(date).Sub(today).Hours() / 24)
+}
+
 type completionRow struct {
 	ClassSection string
 	NumStudents  map[string]int
 	Completion   map[string]int
+
+	// Key is the class section as stored in the datastore ("class|section")
+	Key string
+
+	// Teachers assigned to each subject
+	Teachers map[string][]employeeType
+
+	// Completed is when each complete subject was completed
+	Completed map[string]time.Time
+
+	// Reviews are the reviews of the heads of department
+	Reviews map[string]marksReview
+}
+
+// incomplete returns the subjects of the row with incomplete marks
+func (cr completionRow) incomplete() []string {
+	var subjects []string
+	for subject, n := range cr.NumStudents {
+		if cr.Completion[subject] != -1 && cr.Completion[subject] < n {
+			subjects = append(subjects, subject)
+		}
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// getCompletionRows returns the number of students with complete marks in
+// every class section and subject
+func getCompletionRows(c context.Context, sy string, term Term) ([]completionRow, error) {
+	var completionRows []completionRow
+
+	classes := getClasses(c, sy)
+	sections := getClassSections(c, sy)
+
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get employees: %s", err)
+	}
+	employeesMap := make(map[int64]employeeType)
+	for _, emp := range employees {
+		employeesMap[emp.ID] = emp
+	}
+
+	assigns, err := getAllAssignments(c, sy)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get assignments: %s", err)
+	}
+	teachers := make(map[string]map[string][]employeeType)
+	for _, at := range assigns {
+		emp, ok := employeesMap[at.Teacher]
+		if !ok {
+			// disabled employee
+			continue
+		}
+		if teachers[at.ClassSection] == nil {
+			teachers[at.ClassSection] = make(map[string][]employeeType)
+		}
+		teachers[at.ClassSection][at.Subject] = append(teachers[at.ClassSection][at.Subject], emp)
+	}
+
+	reviews, err := getMarksReviews(c, sy, term)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get marks reviews: %s", err)
+	}
+
+	for _, class := range classes {
+		subjects, err := getSubjects(c, sy, class)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get subjects: %s", err)
+		}
+		for _, section := range sections[class] {
+			var cr completionRow
+
+			cr.ClassSection = class + section
+
+			classSection := fmt.Sprintf("%s|%s", class, section)
+			cr.Key = classSection
+			cr.Teachers = teachers[classSection]
+			cr.Reviews = reviews[classSection]
+
+			numStudentsStream := make(map[string]int)
+			cr.NumStudents = make(map[string]int)
+			cr.Completion = make(map[string]int)
+			for _, subject := range subjects {
+				gs := getGradingSystem(c, sy, class, subject)
+				if gs == nil {
+					// class doesn't have subject
+					cr.Completion[subject] = -1
+				} else if stream, ok := subjectStream(gs); ok {
+					numStudentsStream[stream], ok = numStudentsStream[stream]
+					if !ok {
+						numStudentsStream[stream], err = findStudentsCount(c, sy, classSection, stream)
+						if err != nil {
+							return nil, fmt.Errorf("Could not retrieve number of students: %s", err)
+						}
+					}
+					cr.NumStudents[subject] = numStudentsStream[stream]
+				}
+			}
+
+			cr.Completion["Remarks"] = 0
+			completions, err := getCompletions(c, sy, term, classSection)
+			if err != nil {
+				return nil, fmt.Errorf("Could not retrieve completions: %s", err)
+			}
+			for _, comp := range completions {
+				cr.Completion[comp.Subject] = comp.N
+			}
+
+			history, err := getCompletionHistory(c, sy, term, classSection)
+			if err != nil {
+				return nil, fmt.Errorf("Could not retrieve completion history: %s", err)
+			}
+			cr.Completed = make(map[string]time.Time)
+			for _, ch := range history {
+				n, ok := cr.NumStudents[ch.Subject]
+				if ok && n > 0 && ch.N == n {
+					cr.Completed[ch.Subject] = ch.Time
+				} else {
+					delete(cr.Completed, ch.Subject)
+				}
+			}
+
+			completionRows = append(completionRows, cr)
+		}
+	}
+
+	return completionRows, nil
 }
 
 func init() {
 	http.HandleFunc("/completion", accessHandler(completionHandler))
+	http.HandleFunc("/completion/deadline", accessHandler(completionDeadlineHandler))
+	http.HandleFunc("/completion/history", accessHandler(completionHistoryHandler))
+	http.HandleFunc("/completion/rebuild", accessHandler(completionRebuildHandler))
+
+	// Protected by "login: admin" in app.yaml
+	http.HandleFunc("/cron/completion/reminders", completionRemindersHandler)
+	http.HandleFunc("/cron/completion/rebuild", completionRebuildCronHandler)
 }
 
 func completionHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,61 +496,12 @@ func completionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var completionRows []completionRow
-
-	classes := getClasses(c, sy)
-	sections := getClassSections(c, sy)
-
 	if (term != Term{}) {
-		for _, class := range classes {
-			subjects, err := getSubjects(c, sy, class)
-			if err != nil {
-				log.Errorf(c, "Could not get subjects: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			for _, section := range sections[class] {
-				var cr completionRow
-
-				cr.ClassSection = class + section
-
-				classSection := fmt.Sprintf("%s|%s", class, section)
-
-				numStudentsStream := make(map[string]int)
-				cr.NumStudents = make(map[string]int)
-				cr.Completion = make(map[string]int)
-				for _, subject := range subjects {
-					gs := getGradingSystem(c, sy, class, subject)
-					if gs == nil {
-						// class doesn't have subject
-						cr.Completion[subject] = -1
-					} else if subjectSubject, ok := gs.(Subject); ok {
-						stream := subjectSubject.Stream
-						numStudentsStream[stream], ok = numStudentsStream[stream]
-						if !ok {
-							numStudentsStream[stream], err = findStudentsCount(c, sy, classSection, stream)
-							if err != nil {
-								log.Errorf(c, "Could not retrieve number of students: %s", err)
-								renderError(w, r, http.StatusInternalServerError)
-								return
-							}
-						}
-						cr.NumStudents[subject] = numStudentsStream[stream]
-					}
-				}
-
-				cr.Completion["Remarks"] = 0
-				completions, err := getCompletions(c, term, classSection)
-				if err != nil {
-					log.Errorf(c, "Could not retrieve completions: %s", err)
-					renderError(w, r, http.StatusInternalServerError)
-					return
-				}
-				for _, comp := range completions {
-					cr.Completion[comp.Subject] = comp.N
-				}
-
-				completionRows = append(completionRows, cr)
-			}
+		completionRows, err = getCompletionRows(c, sy, term)
+		if err != nil {
+			log.Errorf(c, "Could not get completion: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -145,12 +515,32 @@ func completionHandler(w http.ResponseWriter, r *http.Request) {
 
 	allSubjects := getAllSubjects(c, sy)
 
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	deadline := getCompletionDeadlines(c, sy)[term]
+	daysLeft := 0
+	if !deadline.IsZero() {
+		daysLeft = daysUntil(deadline)
+	}
+
 	data := struct {
 		Terms       []Term
 		WeekS1Terms []Term
 		WeekS2Terms []Term
 		Term        Term
 
+		Deadline time.Time
+		Due      time.Time // the end of the deadline day
+		DaysLeft int
+
+		CanSetDeadline bool
+		CanRebuild     bool
+
 		Subjects       []string
 		CompletionRows []completionRow
 	}{
@@ -159,6 +549,13 @@ func completionHandler(w http.ResponseWriter, r *http.Request) {
 		weekS2Terms,
 		term,
 
+		deadline,
+		deadline.AddDate(0, 0, 1),
+		daysLeft,
+
+		canOpen(user, "/completion/deadline"),
+		canAccess(user, "/completion/rebuild"),
+
 		allSubjects,
 		completionRows,
 	}
@@ -169,3 +566,202 @@ func completionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func completionDeadlineHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, err := parseTerm(r.PostForm.Get("Term"))
+	if err != nil {
+		log.Errorf(c, "Could not parse term: %s", err)
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	deadline, err := parseDate(r.PostForm.Get("Deadline"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid deadline")
+		return
+	}
+
+	if err := saveCompletionDeadline(c, sy, term, deadline); err != nil {
+		log.Errorf(c, "Could not save completion deadline: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/completion?Term="+term.Value(), http.StatusFound)
+}
+
+func completionHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, err := parseTerm(r.Form.Get("Term"))
+	classSection := r.Form.Get("ClassSection")
+	subject := r.Form.Get("Subject")
+	if err != nil || classSection == "" || subject == "" {
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	history, err := getCompletionHistory(c, sy, term, classSection)
+	if err != nil {
+		log.Errorf(c, "Could not get completion history: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var subjectHistory []completionHistory
+	for _, ch := range history {
+		if ch.Subject == subject {
+			subjectHistory = append(subjectHistory, ch)
+		}
+	}
+
+	data := struct {
+		Term         Term
+		ClassSection string
+		Subject      string
+		Deadline     time.Time
+
+		History []completionHistory
+	}{
+		term,
+		classSection,
+		subject,
+		getCompletionDeadlines(c, sy)[term],
+
+		subjectHistory,
+	}
+
+	if err := render(w, r, "completionhistory", data); err != nil {
+		log.Errorf(c, "Could not render template completionhistory: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+// completionReminderDays are the number of days before the deadline in which
+// teachers with incomplete marks are reminded
+var completionReminderDays = map[int]bool{7: true, 3: true, 1: true, 0: true}
+
+func completionRemindersHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	for term, deadline := range getCompletionDeadlines(c, sy) {
+		daysLeft := daysUntil(deadline)
+		if !completionReminderDays[daysLeft] {
+			continue
+		}
+
+		completionRows, err := getCompletionRows(c, sy, term)
+		if err != nil {
+			log.Errorf(c, "Could not get completion of %s: %s", term, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// incomplete subjects of every teacher
+		var emails []string
+		incomplete := make(map[string][]string)
+		for _, cr := range completionRows {
+			for _, subject := range cr.incomplete() {
+				line := fmt.Sprintf("%s %s: %d/%d", cr.ClassSection, subject,
+					cr.Completion[subject], cr.NumStudents[subject])
+				for _, emp := range cr.Teachers[subject] {
+					if emp.CPSEmail == "" {
+						continue
+					}
+					if incomplete[emp.CPSEmail] == nil {
+						emails = append(emails, emp.CPSEmail)
+					}
+					incomplete[emp.CPSEmail] = append(incomplete[emp.CPSEmail], line)
+				}
+			}
+		}
+
+		when := fmt.Sprintf("in %d days", daysLeft)
+		switch daysLeft {
+		case 0:
+			when = "today"
+		case 1:
+			when = "tomorrow"
+		}
+
+		for _, email := range emails {
+			body := new(bytes.Buffer)
+			fmt.Fprintf(body, "The marks of %s are due %s (%s). The following marks are incomplete:\n\n",
+				term, when, formatDateHuman(deadline))
+			fmt.Fprintf(body, "%s\n\n", strings.Join(incomplete[email], "\n"))
+			fmt.Fprintf(body, "To enter the marks, go to: %s/marks\n", siteURL)
+			subject := fmt.Sprintf("Reminder: %s marks are due %s", term, when)
+			sendEmails(c, []string{email}, subject, body.String())
+		}
+
+		log.Infof(c, "Sent %s completion reminders to %d teachers", term, len(emails))
+	}
+}
+
+func completionRebuildHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// Without a term, all the terms are rebuilt
+	rebuildTerms := allCompletionTerms(c)
+	redirectURL := "/completion"
+	if t := r.PostForm.Get("Term"); t != "" {
+		term, err := parseTerm(t)
+		if err != nil {
+			log.Errorf(c, "Could not parse term: %s", err)
+			renderError(w, r, http.StatusBadRequest)
+			return
+		}
+		rebuildTerms = []Term{term}
+		redirectURL += "?Term=" + term.Value()
+	}
+
+	if err := queueCompletionRebuild(c, sy, rebuildTerms); err != nil {
+		log.Errorf(c, "Could not queue completion rebuild: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+func completionRebuildCronHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+	if err := queueCompletionRebuild(c, sy, allCompletionTerms(c)); err != nil {
+		log.Errorf(c, "Could not queue completion rebuild: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -11,9 +11,11 @@ import (
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -22,13 +24,33 @@ func init() {
 	http.HandleFunc("/dailylog/student", accessHandler(dailylogStudentHandler))
 	http.HandleFunc("/dailylog/edit", accessHandler(dailylogEditHandler))
 	http.HandleFunc("/dailylog/save", accessHandler(dailylogSaveHandler))
+	http.HandleFunc("/dailylog/class", accessHandler(dailylogClassHandler))
+	http.HandleFunc("/dailylog/class/save", accessHandler(dailylogClassSaveHandler))
 
 	http.HandleFunc("/viewdailylog", accessHandler(viewDailylogHandler))
 	http.HandleFunc("/viewdailylog/day", accessHandler(viewDailylogDayHandler))
+
+	// Protected by "login: admin" in app.yaml
+	http.HandleFunc("/cron/dailylog/weekly", dailylogWeeklyHandler)
+}
+
+// dailylogAttendances are the attendance values of a daily log. Empty is
+// full attendance.
+var dailylogAttendances = []string{
+	"Absent",
+	"Tardy",
+	"Early leave",
 }
 
+// dailylogType is keyed by the student and the date. SY, Class and Section
+// are the class of the student when the log was saved. Logs saved before
+// they were added don't have them, so queries of a student use the dates of
+// the school year instead.
 type dailylogType struct {
-	// TODO: per-year?
+	SY      string
+	Class   string
+	Section string
+
 	StudentID string
 
 	Date       time.Time
@@ -37,6 +59,15 @@ type dailylogType struct {
 	Details    string
 }
 
+func (dl dailylogType) isEmpty() bool {
+	return strings.TrimSpace(dl.Behavior) == "" && dl.Attendance == "" && strings.TrimSpace(dl.Details) == ""
+}
+
+func dailylogKey(c context.Context, studentID string, date time.Time) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%s", studentID, date.Format("2006-01-02"))
+	return datastore.NewKey(c, "dailylog", keyStr, 0, nil)
+}
+
 func getDailylog(c context.Context, studentID, date string) (dailylogType, error) {
 	key := datastore.NewKey(c, "dailylog", fmt.Sprintf("%s|%s", studentID, date), 0, nil)
 	var dailylog dailylogType
@@ -48,8 +79,14 @@ func getDailylog(c context.Context, studentID, date string) (dailylogType, error
 	return dailylog, nil
 }
 
-func getDailylogs(c context.Context, StudentID string) ([]dailylogType, error) {
-	q := datastore.NewQuery("dailylog").Filter("StudentID =", StudentID)
+// getDailylogs returns the daily logs of the student from the date from and
+// before the date to, ordered by date
+func getDailylogs(c context.Context, StudentID string, from, to time.Time) ([]dailylogType, error) {
+	q := datastore.NewQuery("dailylog").
+		Filter("StudentID =", StudentID).
+		Filter("Date >=", from).
+		Filter("Date <", to).
+		Order("Date")
 	var dailylogs []dailylogType
 	_, err := q.GetAll(c, &dailylogs)
 	if err != nil {
@@ -59,10 +96,31 @@ func getDailylogs(c context.Context, StudentID string) ([]dailylogType, error) {
 	return dailylogs, nil
 }
 
+// getClassDailylogs returns the daily logs of the class section from the
+// date from and before the date to, ordered by date
+func getClassDailylogs(c context.Context, sy, classSection string, from, to time.Time) ([]dailylogType, error) {
+	class, section, err := parseClassSection(classSection)
+	if err != nil {
+		return nil, err
+	}
+
+	q := datastore.NewQuery("dailylog").
+		Filter("Class =", class).
+		Filter("SY =", sy).
+		Filter("Section =", section).
+		Filter("Date >=", from).
+		Filter("Date <", to).
+		Order("Date")
+	var dailylogs []dailylogType
+	if _, err := q.GetAll(c, &dailylogs); err != nil {
+		return nil, err
+	}
+
+	return dailylogs, nil
+}
+
 func (dl dailylogType) save(c context.Context) error {
-	keyStr := fmt.Sprintf("%s|%s", dl.StudentID, dl.Date.Format("2006-01-02"))
-	key := datastore.NewKey(c, "dailylog", keyStr, 0, nil)
-	_, err := nds.Put(c, key, &dl)
+	_, err := nds.Put(c, dailylogKey(c, dl.StudentID, dl.Date), &dl)
 	if err != nil {
 		return err
 	}
@@ -71,9 +129,7 @@ func (dl dailylogType) save(c context.Context) error {
 }
 
 func (dl dailylogType) delete(c context.Context) error {
-	keyStr := fmt.Sprintf("%s|%s", dl.StudentID, dl.Date.Format("2006-01-02"))
-	key := datastore.NewKey(c, "dailylog", keyStr, 0, nil)
-	err := nds.Delete(c, key)
+	err := nds.Delete(c, dailylogKey(c, dl.StudentID, dl.Date))
 	if err != nil {
 		return err
 	}
@@ -81,6 +137,134 @@ func (dl dailylogType) delete(c context.Context) error {
 	return nil
 }
 
+// dailylogMonth is the month of the daily logs shown in a page
+type dailylogMonth struct {
+	Month  time.Time
+	Months []time.Time // the months of the school year
+}
+
+func (dm dailylogMonth) end() time.Time {
+	return dm.Month.AddDate(0, 1, 0)
+}
+
+// getDailylogMonth returns the month s (2006-01) of the school year. The
+// current month is used if s is not a month of the school year.
+func getDailylogMonth(sy, s string) dailylogMonth {
+	from, to := schoolYearDates(sy)
+
+	var dm dailylogMonth
+	for m := from; m.Before(to); m = m.AddDate(0, 1, 0) {
+		dm.Months = append(dm.Months, m)
+	}
+
+	month, err := time.Parse("2006-01", s)
+	if err != nil || month.Before(from) || !month.Before(to) {
+		now := time.Now()
+		month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if month.Before(from) {
+			month = from
+		} else if !month.Before(to) {
+			month = to.AddDate(0, -1, 0)
+		}
+	}
+	dm.Month = month
+
+	return dm
+}
+
+// weekStart returns the Sunday that starts the school week of t
+func weekStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -int(day.Weekday()))
+}
+
+// repeatedConcern is the number of absences, late arrivals or behavior notes
+// in a week that is flagged in the weekly summary
+const repeatedConcern = 2
+
+// dailylogSummary is the summary of the daily logs of a student in a week
+type dailylogSummary struct {
+	Start time.Time
+	End   time.Time // the last day of the week
+
+	Logs          int
+	Absences      int
+	Late          int // tardies and early leaves
+	BehaviorNotes int
+	Concerns      []string
+}
+
+// summarizeDailylogs returns the summary of the logs in the week that starts
+// at start
+func summarizeDailylogs(start time.Time, dailylogs []dailylogType) dailylogSummary {
+	end := start.AddDate(0, 0, 7)
+	summary := dailylogSummary{Start: start, End: end.AddDate(0, 0, -1)}
+	for _, dl := range dailylogs {
+		if dl.Date.Before(start) || !dl.Date.Before(end) {
+			continue
+		}
+		summary.Logs++
+		switch dl.Attendance {
+		case "Absent":
+			summary.Absences++
+		case "Tardy", "Early leave":
+			summary.Late++
+		}
+		if strings.TrimSpace(dl.Behavior) != "" {
+			summary.BehaviorNotes++
+		}
+	}
+
+	if summary.Absences >= repeatedConcern {
+		summary.Concerns = append(summary.Concerns, fmt.Sprintf("%d absences", summary.Absences))
+	}
+	if summary.Late >= repeatedConcern {
+		summary.Concerns = append(summary.Concerns, fmt.Sprintf("%d late arrivals or early leaves", summary.Late))
+	}
+	if summary.BehaviorNotes >= repeatedConcern {
+		summary.Concerns = append(summary.Concerns, fmt.Sprintf("%d behavior notes", summary.BehaviorNotes))
+	}
+
+	return summary
+}
+
+// monthSummaries returns the weekly summaries of the weeks of the month,
+// from the logs of the month and of the days of its weeks around it
+func monthSummaries(dm dailylogMonth, dailylogs []dailylogType) []dailylogSummary {
+	var summaries []dailylogSummary
+	for w := weekStart(dm.Month); w.Before(dm.end()); w = w.AddDate(0, 0, 7) {
+		summaries = append(summaries, summarizeDailylogs(w, dailylogs))
+	}
+	return summaries
+}
+
+// getStudentMonthDailylogs returns the logs of the student in the month, and
+// the weekly summaries of the month
+func getStudentMonthDailylogs(c context.Context, id string, dm dailylogMonth) ([]dailylogType, []dailylogSummary, error) {
+	from := weekStart(dm.Month)
+	to := weekStart(dm.end().AddDate(0, 0, -1)).AddDate(0, 0, 7)
+	dailylogs, err := getDailylogs(c, id, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var monthLogs []dailylogType
+	for _, dl := range dailylogs {
+		if !dl.Date.Before(dm.Month) && dl.Date.Before(dm.end()) {
+			monthLogs = append(monthLogs, dl)
+		}
+	}
+	return monthLogs, monthSummaries(dm, dailylogs), nil
+}
+
+func dailylogURL(id string, date time.Time) string {
+	urlValues := url.Values{
+		"id":    []string{id},
+		"month": []string{date.Format("2006-01")},
+	}
+	return fmt.Sprintf("/dailylog/student?%s", urlValues.Encode())
+}
+
 func dailylogHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
@@ -114,12 +298,14 @@ func dailylogHandler(w http.ResponseWriter, r *http.Request) {
 		CG []classGroup
 
 		ClassSection string
+		Today        time.Time
 	}{
 		students,
 
 		classGroups,
 
 		classSection,
+		time.Now(),
 	}
 
 	if err := render(w, r, "dailylog", data); err != nil {
@@ -155,7 +341,8 @@ func dailylogStudentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	class, section := cs.Class, cs.Section
 
-	dailylogs, err := getDailylogs(c, id)
+	dm := getDailylogMonth(sy, r.Form.Get("month"))
+	dailylogs, summaries, err := getStudentMonthDailylogs(c, id, dm)
 	if err != nil {
 		log.Errorf(c, "Could not retrieve daily logs: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
@@ -167,13 +354,17 @@ func dailylogStudentHandler(w http.ResponseWriter, r *http.Request) {
 		Class     string
 		Section   string
 		Today     time.Time
+		Month     dailylogMonth
 		Dailylogs []dailylogType
+		Summaries []dailylogSummary
 	}{
 		stu,
 		class,
 		section,
 		time.Now(),
+		dm,
 		dailylogs,
+		summaries,
 	}
 
 	if err := render(w, r, "dailylogstudent", data); err != nil {
@@ -248,7 +439,19 @@ func dailylogSaveHandler(w http.ResponseWriter, r *http.Request) {
 	attendance := f.Get("Attendance")
 	details := f.Get("Details")
 
+	sy := getSchoolYear(c)
+	sc, err := getStudentClass(c, id, sy)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve student class: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
 	dailylog := dailylogType{
+		SY:      sy,
+		Class:   sc.Class,
+		Section: sc.Section,
+
 		StudentID: id,
 
 		Date:       date,
@@ -274,19 +477,258 @@ func dailylogSaveHandler(w http.ResponseWriter, r *http.Request) {
 
 	if isSave {
 		subject := "New Daily Log Added"
-		body := "A new daily log is added. To view it, go to: https://creativity-private-school-2015.appspot.com/viewdailylog/day?date=" + f.Get("Date")
+		body := "A new daily log is added. To view it, go to: " + siteURL + "/viewdailylog/day?date=" + f.Get("Date")
+
+		notify(c, notifyDailylog, studentNotificationEmails(c, []string{id}), subject, body)
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, dailylogURL(id, date), http.StatusFound)
+
+}
+
+// dailylogClassRow is a student in the daily log of a class section
+type dailylogClassRow struct {
+	Name     string
+	Dailylog dailylogType
+}
+
+// getClassDayDailylogs returns the daily logs of the students on date. The
+// logs are read by their keys, so the logs saved without a class are
+// included.
+func getClassDayDailylogs(c context.Context, students []studentClass, date time.Time) ([]dailylogType, error) {
+	var keys []*datastore.Key
+	for _, s := range students {
+		keys = append(keys, dailylogKey(c, s.ID, date))
+	}
+
+	dailylogs := make([]dailylogType, len(keys))
+	err := nds.GetMulti(c, keys, dailylogs)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for i, err := range merr {
+			if err == datastore.ErrNoSuchEntity {
+				dailylogs[i] = dailylogType{}
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, s := range students {
+		dailylogs[i].StudentID = s.ID
+		dailylogs[i].Date = date
+	}
+	return dailylogs, nil
+}
+
+func dailylogClassHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.Form.Get("ClassSection")
+	if _, _, err := parseClassSection(classSection); err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	date, err := time.Parse("2006-01-02", r.Form.Get("date"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid date")
+		return
+	}
+
+	students, err := findStudentsSorted(c, sy, classSection, true)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve students: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	dailylogs, err := getClassDayDailylogs(c, students, date)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve daily logs: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var rows []dailylogClassRow
+	for i, s := range students {
+		rows = append(rows, dailylogClassRow{s.Name, dailylogs[i]})
+	}
+
+	data := struct {
+		ClassSection string
+		Date         time.Time
+		Attendances  []string
+		Rows         []dailylogClassRow
+	}{
+		classSection,
+		date,
+		dailylogAttendances,
+		rows,
+	}
+
+	if err := render(w, r, "dailylogclass", data); err != nil {
+		log.Errorf(c, "Could not render template dailylogclass: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func dailylogClassSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	f := r.PostForm
+
+	classSection := f.Get("ClassSection")
+	class, section, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	date, err := time.Parse("2006-01-02", f.Get("Date"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid date")
+		return
+	}
+
+	students, err := findStudents(c, sy, classSection)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve students: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	old, err := getClassDayDailylogs(c, students, date)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve daily logs: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var saved []string
+	for i, s := range students {
+		dailylog := dailylogType{
+			SY:      sy,
+			Class:   class,
+			Section: section,
+
+			StudentID: s.ID,
+
+			Date:       date,
+			Behavior:   f.Get(s.ID + "|Behavior"),
+			Attendance: f.Get(s.ID + "|Attendance"),
+			Details:    f.Get(s.ID + "|Details"),
+		}
+		o := old[i]
+		if dailylog.Behavior == o.Behavior && dailylog.Attendance == o.Attendance && dailylog.Details == o.Details {
+			continue
+		}
+
+		if dailylog.isEmpty() {
+			err = dailylog.delete(c)
+		} else {
+			err = dailylog.save(c)
+			saved = append(saved, s.ID)
+		}
+		if err != nil {
+			log.Errorf(c, "Could not store dailylog: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if len(saved) > 0 {
+		subject := "New Daily Log Added"
+		body := "A new daily log is added. To view it, go to: " + siteURL + "/viewdailylog/day?date=" + date.Format("2006-01-02")
 
-		sendStudentEmails(c, []string{id}, subject, body)
+		notify(c, notifyDailylog, studentNotificationEmails(c, saved), subject, body)
 	}
 
 	// TODO: message of success
 	urlValues := url.Values{
-		"id":   []string{id},
-		"date": []string{date.Format("2006-01-02")},
+		"ClassSection": []string{classSection},
+		"date":         []string{date.Format("2006-01-02")},
 	}
-	redirectURL := fmt.Sprintf("/dailylog/student?%s", urlValues.Encode())
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	http.Redirect(w, r, "/dailylog/class?"+urlValues.Encode(), http.StatusFound)
+}
+
+// dailylogWeeklyHandler sends the students and their guardians the summary
+// of the daily logs of the week. It should run at the end of the school
+// week.
+func dailylogWeeklyHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+	start := weekStart(time.Now())
+	end := start.AddDate(0, 0, 7)
+
+	for _, class := range getClasses(c, sy) {
+		for _, classSection := range getClassSectionsOfClass(c, sy, class) {
+			dailylogs, err := getClassDailylogs(c, sy, classSection, start, end)
+			if err != nil {
+				log.Errorf(c, "Could not get daily logs of %s: %s", classSection, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(dailylogs) == 0 {
+				continue
+			}
+
+			byStudent := make(map[string][]dailylogType)
+			for _, dl := range dailylogs {
+				byStudent[dl.StudentID] = append(byStudent[dl.StudentID], dl)
+			}
+
+			students, err := findStudents(c, sy, classSection)
+			if err != nil {
+				log.Errorf(c, "Could not get students of %s: %s", classSection, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, s := range students {
+				if len(byStudent[s.ID]) == 0 {
+					continue
+				}
+				summary := summarizeDailylogs(start, byStudent[s.ID])
+				subject := fmt.Sprintf("Weekly Daily Log Summary: %s", s.Name)
+				if len(summary.Concerns) > 0 {
+					subject += " (needs attention)"
+				}
+				notify(c, notifyDailylogWeekly, studentNotificationEmails(c, []string{s.ID}),
+					subject, summary.text(s.Name))
+			}
+		}
+	}
+}
 
+// text returns the summary as the body of an email
+func (summary dailylogSummary) text(name string) string {
+	body := new(bytes.Buffer)
+	fmt.Fprintf(body, "The daily logs of %s for the week of %s to %s:\n\n",
+		name, formatDateHuman(summary.Start), formatDateHuman(summary.End))
+	fmt.Fprintf(body, "Entries: %d\nAbsences: %d\nLate arrivals or early leaves: %d\nBehavior notes: %d\n",
+		summary.Logs, summary.Absences, summary.Late, summary.BehaviorNotes)
+	if len(summary.Concerns) > 0 {
+		fmt.Fprintf(body, "\nRepeated concerns this week: %s\n", strings.Join(summary.Concerns, ", "))
+	}
+	fmt.Fprintf(body, "\nTo view them, go to: %s/viewdailylog?month=%s\n", siteURL, summary.Start.Format("2006-01"))
+	return body.String()
 }
 
 func viewDailylogHandler(w http.ResponseWriter, r *http.Request) {
@@ -320,7 +762,8 @@ func viewDailylogHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	class, section := cs.Class, cs.Section
 
-	dailylogs, err := getDailylogs(c, stu.ID)
+	dm := getDailylogMonth(sy, r.Form.Get("month"))
+	dailylogs, summaries, err := getStudentMonthDailylogs(c, stu.ID, dm)
 	if err != nil {
 		log.Errorf(c, "Could not retrieve daily logs: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
@@ -332,13 +775,17 @@ func viewDailylogHandler(w http.ResponseWriter, r *http.Request) {
 		Class     string
 		Section   string
 		Today     time.Time
+		Month     dailylogMonth
 		Dailylogs []dailylogType
+		Summaries []dailylogSummary
 	}{
 		stu,
 		class,
 		section,
 		time.Now(),
+		dm,
 		dailylogs,
+		summaries,
 	}
 
 	if err := render(w, r, "viewdailylog", data); err != nil {
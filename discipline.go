@@ -0,0 +1,1110 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/discipline", accessHandler(disciplineHandler))
+	http.HandleFunc("/discipline/student", accessHandler(disciplineStudentHandler))
+	http.HandleFunc("/discipline/incident", accessHandler(disciplineIncidentHandler))
+	http.HandleFunc("/discipline/save", accessHandler(disciplineSaveHandler))
+	http.HandleFunc("/discipline/settings", accessHandler(disciplineSettingsHandler))
+
+	registerReport(reportType{
+		Name:   ReportDisciplineIncidents,
+		Params: []reportParam{reportParamSchoolYear, reportParamClasses, reportParamTerm},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportDisciplineIncidents(c, p.SchoolYears[0], p.singleClasses(), p.Term)
+		},
+	})
+}
+
+const ReportDisciplineIncidents = "Discipline Incidents"
+
+// incidentCategories are the categories of discipline incidents
+var incidentCategories = []string{
+	"Disruption",
+	"Disrespect",
+	"Bullying",
+	"Fighting",
+	"Cheating",
+	"Truancy",
+	"Damage to property",
+	"Dress code",
+	"Use of phones",
+	"Other",
+}
+
+// incidentSeverity is also the number of points of an incident, deducted
+// from the discipline criteria of the behavior rubric
+type incidentSeverity int
+
+const (
+	severityMinor incidentSeverity = iota + 1
+	severityModerate
+	severityMajor
+	severitySevere
+)
+
+var incidentSeverities = []incidentSeverity{
+	severityMinor,
+	severityModerate,
+	severityMajor,
+	severitySevere,
+}
+
+var incidentSeverityStrings = map[incidentSeverity]string{
+	severityMinor:    "Minor",
+	severityModerate: "Moderate",
+	severityMajor:    "Major",
+	severitySevere:   "Severe",
+}
+
+func (is incidentSeverity) Value() string {
+	return strconv.Itoa(int(is))
+}
+
+func (is incidentSeverity) String() string {
+	str, ok := incidentSeverityStrings[is]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid incidentSeverity: %d", int(is)))
+}
+
+func parseIncidentSeverity(s string) (incidentSeverity, error) {
+	n, err := strconv.Atoi(s)
+	is := incidentSeverity(n)
+	if _, ok := incidentSeverityStrings[is]; err != nil || !ok {
+		return 0, fmt.Errorf("Invalid severity: %s", s)
+	}
+	return is, nil
+}
+
+type incidentAction string
+
+const (
+	actionWarning    incidentAction = "warning"
+	actionDetention  incidentAction = "detention"
+	actionSuspension incidentAction = "suspension"
+)
+
+var incidentActions = []incidentAction{
+	actionWarning,
+	actionDetention,
+	actionSuspension,
+}
+
+var incidentActionStrings = map[incidentAction]string{
+	actionWarning:    "Warning",
+	actionDetention:  "Detention",
+	actionSuspension: "Suspension",
+}
+
+func (ia incidentAction) Value() string {
+	return string(ia)
+}
+
+func (ia incidentAction) String() string {
+	str, ok := incidentActionStrings[ia]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid incidentAction: %s", string(ia)))
+}
+
+func parseIncidentAction(s string) (incidentAction, error) {
+	ia := incidentAction(s)
+	if _, ok := incidentActionStrings[ia]; !ok {
+		return "", fmt.Errorf("Invalid action: %s", s)
+	}
+	return ia, nil
+}
+
+type incidentStatus string
+
+const (
+	incidentOpen     incidentStatus = "open"
+	incidentFollowUp incidentStatus = "followup"
+	incidentClosed   incidentStatus = "closed"
+)
+
+var incidentStatuses = []incidentStatus{
+	incidentOpen,
+	incidentFollowUp,
+	incidentClosed,
+}
+
+var incidentStatusStrings = map[incidentStatus]string{
+	incidentOpen:     "Open",
+	incidentFollowUp: "Follow-up",
+	incidentClosed:   "Closed",
+}
+
+func (is incidentStatus) Value() string {
+	return string(is)
+}
+
+func (is incidentStatus) String() string {
+	str, ok := incidentStatusStrings[is]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid incidentStatus: %s", string(is)))
+}
+
+// Context returns the bootstrap contextual class of the status
+func (is incidentStatus) Context() string {
+	switch is {
+	case incidentOpen:
+		return "danger"
+	case incidentFollowUp:
+		return "warning"
+	}
+	return "success"
+}
+
+func parseIncidentStatus(s string) (incidentStatus, error) {
+	is := incidentStatus(s)
+	if _, ok := incidentStatusStrings[is]; !ok {
+		return "", fmt.Errorf("Invalid status: %s", s)
+	}
+	return is, nil
+}
+
+// incident is a discipline incident of one or more students of a class
+// section. It will be stored in the datastore.
+type incident struct {
+	ID int64 `datastore:"-"`
+
+	SY           string
+	ClassSection string
+	Term         string // the quarter of the incident
+	Date         time.Time
+
+	Category    string
+	Severity    incidentSeverity
+	Location    string
+	Description string `datastore:",noindex"`
+
+	Students  []string // IDs of the involved students
+	Names     []string `datastore:",noindex"`
+	Witnesses string   `datastore:",noindex"`
+
+	Actions  []incidentAction
+	Status   incidentStatus
+	FollowUp string `datastore:",noindex"`
+
+	Reporter   string // email
+	ReportedBy string `datastore:",noindex"`
+	Created    time.Time
+	Updated    time.Time
+}
+
+// Quarter returns the term of the incident
+func (inc incident) Quarter() Term {
+	term, err := parseTerm(inc.Term)
+	if err != nil {
+		return Term{Quarter, 1}
+	}
+	return term
+}
+
+// HasAction returns whether action was taken for the incident
+func (inc incident) HasAction(action incidentAction) bool {
+	for _, a := range inc.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Involves returns whether the student is involved in the incident
+func (inc incident) Involves(id string) bool {
+	for _, s := range inc.Students {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+type incidentSorter []incident
+
+func (is incidentSorter) Len() int {
+	return len(is)
+}
+
+func (is incidentSorter) Less(i, j int) bool {
+	if !is[i].Date.Equal(is[j].Date) {
+		return is[i].Date.After(is[j].Date)
+	}
+	return is[i].Created.After(is[j].Created)
+}
+
+func (is incidentSorter) Swap(i, j int) {
+	is[i], is[j] = is[j], is[i]
+}
+
+// termIncludes returns whether term includes the quarter of an incident.
+// A midterm or a semester includes its two quarters, and the end of the year
+// includes all of them.
+func termIncludes(term, quarter Term) bool {
+	switch term.Typ {
+	case Quarter:
+		return term == quarter
+	case Midterm, Semester:
+		return (quarter.N+1)/2 == term.N
+	case EndOfYear, EndOfYearGpa:
+		return true
+	}
+	return false
+}
+
+func incidentKey(c context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "incident", "", id, nil)
+}
+
+func getIncident(c context.Context, id int64) (incident, error) {
+	var inc incident
+	if err := nds.Get(c, incidentKey(c, id), &inc); err != nil {
+		return incident{}, err
+	}
+	inc.ID = id
+	return inc, nil
+}
+
+func getIncidents(c context.Context, q *datastore.Query) ([]incident, error) {
+	var incidents []incident
+	keys, err := q.GetAll(c, &incidents)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		incidents[i].ID = k.IntID()
+	}
+	sort.Sort(incidentSorter(incidents))
+	return incidents, nil
+}
+
+// getSYIncidents returns the incidents of the school year, latest first
+func getSYIncidents(c context.Context, sy string) ([]incident, error) {
+	return getIncidents(c, datastore.NewQuery("incident").Filter("SY =", sy))
+}
+
+// getStudentIncidents returns the incidents of the student in every school
+// year, latest first
+func getStudentIncidents(c context.Context, id string) ([]incident, error) {
+	return getIncidents(c, datastore.NewQuery("incident").Filter("Students =", id))
+}
+
+// getStudentTermIncidents returns the incidents of the student in sy that
+// are included in term
+func getStudentTermIncidents(c context.Context, id, sy string, term Term) ([]incident, error) {
+	q := datastore.NewQuery("incident").
+		Filter("Students =", id).
+		Filter("SY =", sy)
+	incidents, err := getIncidents(c, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var termIncidents []incident
+	for _, inc := range incidents {
+		if termIncludes(term, inc.Quarter()) {
+			termIncidents = append(termIncidents, inc)
+		}
+	}
+	return termIncidents, nil
+}
+
+// incidentPoints returns the sum of the severities of the incidents
+func incidentPoints(incidents []incident) int {
+	points := 0
+	for _, inc := range incidents {
+		points += int(inc.Severity)
+	}
+	return points
+}
+
+// escalationRule notifies the guardians of the involved students and the
+// administrators of an incident at least as severe as MinSeverity, when the
+// student has at least MinIncidents such incidents in the school year
+type escalationRule struct {
+	MinSeverity  incidentSeverity
+	MinIncidents int
+	Guardians    bool
+	Admins       bool
+}
+
+type disciplineSetting struct {
+	Rules []escalationRule
+}
+
+type disciplineSettings struct {
+	Value disciplineSetting
+}
+
+// maxEscalationRules is the number of rules shown in the settings
+const maxEscalationRules = 4
+
+var defaultDisciplineSetting = disciplineSetting{
+	Rules: []escalationRule{
+		{severityMajor, 1, true, true},
+		{severityMinor, 3, true, false},
+	},
+}
+
+func getDisciplineSetting(c context.Context, sy string) disciplineSetting {
+	key := datastore.NewKey(c, "settings", "discipline-"+sy, 0, nil)
+
+	setting := disciplineSettings{}
+	if err := nds.Get(c, key, &setting); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Warningf(c, "Could not get discipline settings: %s", err)
+		}
+		return defaultDisciplineSetting
+	}
+
+	return setting.Value
+}
+
+func saveDisciplineSetting(c context.Context, sy string, setting disciplineSetting) error {
+	key := datastore.NewKey(c, "settings", "discipline-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &disciplineSettings{setting})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// adminEmails returns the emails of the enabled administrators
+func adminEmails(c context.Context) ([]string, error) {
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []string
+	for _, emp := range employees {
+		if emp.Roles.Admin {
+			emails = append(emails, emp.CPSEmail)
+		}
+	}
+	return emails, nil
+}
+
+// guardianEmails returns the emails of the guardians of the students
+func guardianEmails(c context.Context, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	stus, err := getStudentMulti(c, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []string
+	for _, stu := range stus {
+		if stu.GuardianEmail != "" {
+			emails = append(emails, stu.GuardianEmail)
+		}
+	}
+	return emails, nil
+}
+
+// escalateIncident notifies the guardians and the administrators of a new
+// incident according to the escalation rules of its school year
+func escalateIncident(c context.Context, inc incident) error {
+	setting := getDisciplineSetting(c, inc.SY)
+
+	guardians := make(map[string]bool)
+	admins := false
+	for _, id := range inc.Students {
+		var history []incident
+		for _, rule := range setting.Rules {
+			if inc.Severity < rule.MinSeverity {
+				continue
+			}
+			if history == nil {
+				q := datastore.NewQuery("incident").
+					Filter("Students =", id).
+					Filter("SY =", inc.SY)
+				var err error
+				if history, err = getIncidents(c, q); err != nil {
+					return err
+				}
+			}
+			// the new incident may not be in the query results yet
+			n := 1
+			for _, h := range history {
+				if h.ID != inc.ID && h.Severity >= rule.MinSeverity {
+					n++
+				}
+			}
+			if n < rule.MinIncidents {
+				continue
+			}
+			if rule.Guardians {
+				guardians[id] = true
+			}
+			if rule.Admins {
+				admins = true
+			}
+		}
+	}
+
+	// Each family is only told about its own child. The names of the other
+	// students and the description are for the school only.
+	subject := fmt.Sprintf("%s Discipline Incident: %s", inc.Severity, inc.Category)
+	for i, id := range inc.Students {
+		if !guardians[id] {
+			continue
+		}
+		emails, err := guardianEmails(c, []string{id})
+		if err != nil {
+			return err
+		}
+		if len(emails) == 0 {
+			continue
+		}
+		name := id
+		if i < len(inc.Names) {
+			name = inc.Names[i]
+		}
+		body := fmt.Sprintf("A %s discipline incident (%s) involving %s was reported on %s.\n\nFor details, please contact the school.",
+			strings.ToLower(inc.Severity.String()), inc.Category, name, formatDateHuman(inc.Date))
+		notify(c, notifyDiscipline, emails, subject, body)
+	}
+
+	if admins {
+		emails, err := adminEmails(c)
+		if err != nil {
+			return err
+		}
+		if len(emails) > 0 {
+			body := fmt.Sprintf("A %s discipline incident (%s) involving %s was reported on %s.\n\n%s\n\nFor details, please contact the school.",
+				strings.ToLower(inc.Severity.String()), inc.Category, strings.Join(inc.Names, ", "),
+				formatDateHuman(inc.Date), inc.Description)
+			notify(c, notifyDiscipline, emails, subject, body)
+		}
+	}
+	return nil
+}
+
+// disciplineMarks returns the mark of the discipline criteria of the
+// behavior rubric after the incidents of the student in term
+func (rubric BehaviorRubric) disciplineMarks(c context.Context, studentID, sy string, term Term) (float64, error) {
+	incidents, err := getStudentTermIncidents(c, studentID, sy, term)
+	if err != nil {
+		return math.NaN(), err
+	}
+	points := float64(incidentPoints(incidents))
+	return math.Max(0, rubric.Max-points*rubric.DisciplineDeduction), nil
+}
+
+// refreshDisciplineMarks stores the behavior marks of the students after a
+// change to their incidents in quarter, for the classes whose rubric has
+// discipline criteria
+func refreshDisciplineMarks(c context.Context, sy string, ids []string, quarter Term) error {
+	for _, id := range ids {
+		sc, err := getStudentClass(c, id, sy)
+		if err != nil {
+			return err
+		}
+		gs := behaviorGradingSystem{sc.Class}
+		for _, term := range []Term{quarter, {Midterm, (quarter.N + 1) / 2}} {
+			rubric, err := getTermBehaviorRubric(c, sy, sc.Class, term)
+			if err != nil {
+				return err
+			}
+			if !rubric.hasDiscipline() {
+				continue
+			}
+			if err := refreshStudentMarks(c, id, sy, "Behavior", term, gs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quarters returns the terms an incident can be in
+func quarters() []Term {
+	var qs []Term
+	for _, term := range terms {
+		if term.Typ == Quarter {
+			qs = append(qs, term)
+		}
+	}
+	return qs
+}
+
+func disciplineHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.Form.Get("ClassSection")
+	status := incidentStatus(r.Form.Get("Status"))
+
+	incidents, err := getSYIncidents(c, sy)
+	if err != nil {
+		log.Errorf(c, "Could not get incidents: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// incidents of class sections outside of the scope of the user are
+	// not shown
+	inScope := make(map[string]bool)
+	var filtered []incident
+	for _, inc := range incidents {
+		if classSection != "" && inc.ClassSection != classSection {
+			continue
+		}
+		if status != "" && inc.Status != status {
+			continue
+		}
+		allowAccess, ok := inScope[inc.ClassSection]
+		if !ok {
+			allowAccess, err = user.canInScope(c, sy, permDisciplineEdit, inc.ClassSection, "")
+			if err != nil {
+				log.Errorf(c, "Could not check access: %s", err)
+				renderError(w, r, http.StatusInternalServerError)
+				return
+			}
+			inScope[inc.ClassSection] = allowAccess
+		}
+		if !allowAccess {
+			continue
+		}
+		filtered = append(filtered, inc)
+	}
+
+	setting := getDisciplineSetting(c, sy)
+	rules := make([]escalationRule, maxEscalationRules)
+	copy(rules, setting.Rules)
+
+	data := struct {
+		CG           []classGroup
+		ClassSection string
+		Status       incidentStatus
+		Statuses     []incidentStatus
+		Incidents    []incident
+
+		CanManage  bool
+		Rules      []escalationRule
+		Severities []incidentSeverity
+		ReportName string
+	}{
+		getClassGroups(c, sy),
+		classSection,
+		status,
+		incidentStatuses,
+		filtered,
+
+		user.can(permDisciplineManage),
+		rules,
+		incidentSeverities,
+		ReportDisciplineIncidents,
+	}
+
+	if err := render(w, r, "discipline", data); err != nil {
+		log.Errorf(c, "Could not render template discipline: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func disciplineStudentHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	id := r.Form.Get("id")
+	stu, err := getStudent(c, id)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve student details: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	incidents, err := getStudentIncidents(c, stu.ID)
+	if err != nil {
+		log.Errorf(c, "Could not get incidents: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+	var syIncidents []incident
+	for _, inc := range incidents {
+		if inc.SY == sy {
+			syIncidents = append(syIncidents, inc)
+		}
+	}
+
+	data := struct {
+		S         studentType
+		SY        string
+		Incidents []incident
+		Points    int
+	}{
+		stu,
+		sy,
+		incidents,
+		incidentPoints(syIncidents),
+	}
+
+	if err := render(w, r, "disciplinestudent", data); err != nil {
+		log.Errorf(c, "Could not render template disciplinestudent: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func disciplineIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	inc := incident{
+		SY:           sy,
+		ClassSection: r.Form.Get("ClassSection"),
+		Term:         Term{Quarter, 1}.Value(),
+		Date:         time.Now(),
+		Severity:     severityMinor,
+		Status:       incidentOpen,
+	}
+	if idStr := r.Form.Get("ID"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid incident")
+			return
+		}
+		inc, err = getIncident(c, id)
+		if err != nil {
+			log.Errorf(c, "Could not get incident %d: %s", id, err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	} else if id := r.Form.Get("StudentID"); id != "" {
+		sc, err := getStudentClass(c, id, sy)
+		if err != nil {
+			log.Errorf(c, "Could not retrieve student class: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		inc.ClassSection = sc.Class + "|" + sc.Section
+		inc.Students = []string{id}
+	}
+
+	var students []studentClass
+	if inc.ClassSection != "" {
+		user, err := getUser(c)
+		if err != nil {
+			log.Errorf(c, "Could not get user: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		allowAccess, err := user.canInScope(c, sy, permDisciplineEdit, inc.ClassSection, "")
+		if err != nil {
+			log.Errorf(c, "Could not check access: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if !allowAccess {
+			renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
+			return
+		}
+
+		students, err = findStudents(c, inc.SY, inc.ClassSection)
+		if err != nil {
+			log.Errorf(c, "Could not retrieve students: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := struct {
+		CG       []classGroup
+		Incident incident
+		Students []studentClass
+
+		Quarters   []Term
+		Categories []string
+		Severities []incidentSeverity
+		Actions    []incidentAction
+		Statuses   []incidentStatus
+	}{
+		getClassGroups(c, inc.SY),
+		inc,
+		students,
+
+		quarters(),
+		incidentCategories,
+		incidentSeverities,
+		incidentActions,
+		incidentStatuses,
+	}
+
+	if err := render(w, r, "disciplineincident", data); err != nil {
+		log.Errorf(c, "Could not render template disciplineincident: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func disciplineSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	f := r.PostForm
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var inc incident
+	var oldStudents []string
+	var oldQuarter Term
+	isNew := f.Get("ID") == ""
+	if isNew {
+		inc = incident{
+			SY:         sy,
+			Status:     incidentOpen,
+			Reporter:   user.Email,
+			ReportedBy: user.FullName(),
+			Created:    time.Now(),
+		}
+		if inc.ReportedBy == "" {
+			inc.ReportedBy = user.Name
+		}
+	} else {
+		id, err := strconv.ParseInt(f.Get("ID"), 10, 64)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid incident")
+			return
+		}
+		inc, err = getIncident(c, id)
+		if err != nil {
+			log.Errorf(c, "Could not get incident %d: %s", id, err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if inc.Reporter != user.Email && !user.can(permDisciplineManage) {
+			renderErrorMsg(w, r, http.StatusForbidden, "Only the reporter can edit the incident")
+			return
+		}
+		oldStudents = inc.Students
+		oldQuarter = inc.Quarter()
+	}
+
+	classSection := f.Get("ClassSection")
+	if _, _, err := parseClassSection(classSection); err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	quarter, err := parseTerm(f.Get("Term"))
+	if err != nil || quarter.Typ != Quarter {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid term")
+		return
+	}
+	date, err := time.Parse("2006-01-02", f.Get("Date"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid date")
+		return
+	}
+	severity, err := parseIncidentSeverity(f.Get("Severity"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	status := incidentOpen
+	if !isNew {
+		if status, err = parseIncidentStatus(f.Get("Status")); err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	var actions []incidentAction
+	for _, a := range f["Actions"] {
+		action, err := parseIncidentAction(a)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		actions = append(actions, action)
+	}
+
+	students, err := findStudents(c, inc.SY, classSection)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve students: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	selected := make(map[string]bool)
+	for _, id := range f["Students"] {
+		selected[id] = true
+	}
+	var ids, names []string
+	for _, s := range students {
+		if selected[s.ID] {
+			ids = append(ids, s.ID)
+			names = append(names, s.Name)
+		}
+	}
+	if len(ids) == 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Please select the involved students")
+		return
+	}
+
+	category := strings.TrimSpace(f.Get("Category"))
+	if category == "" {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Please choose a category")
+		return
+	}
+
+	inc.ClassSection = classSection
+	inc.Term = quarter.Value()
+	inc.Date = date
+	inc.Category = category
+	inc.Severity = severity
+	inc.Location = strings.TrimSpace(f.Get("Location"))
+	inc.Description = strings.TrimSpace(f.Get("Description"))
+	inc.Students = ids
+	inc.Names = names
+	inc.Witnesses = strings.TrimSpace(f.Get("Witnesses"))
+	inc.Actions = actions
+	inc.Status = status
+	inc.FollowUp = strings.TrimSpace(f.Get("FollowUp"))
+	inc.Updated = time.Now()
+
+	key := datastore.NewIncompleteKey(c, "incident", nil)
+	if !isNew {
+		key = incidentKey(c, inc.ID)
+	}
+	key, err = nds.Put(c, key, &inc)
+	if err != nil {
+		log.Errorf(c, "Could not save incident: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	inc.ID = key.IntID()
+
+	if err := refreshDisciplineMarks(c, inc.SY, ids, quarter); err != nil {
+		log.Errorf(c, "Could not refresh behavior marks: %s", err)
+	}
+	if len(oldStudents) > 0 {
+		var removed []string
+		for _, id := range oldStudents {
+			if oldQuarter != quarter || !inc.Involves(id) {
+				removed = append(removed, id)
+			}
+		}
+		if err := refreshDisciplineMarks(c, inc.SY, removed, oldQuarter); err != nil {
+			log.Errorf(c, "Could not refresh behavior marks: %s", err)
+		}
+	}
+
+	if isNew {
+		if err := escalateIncident(c, inc); err != nil {
+			log.Errorf(c, "Could not escalate incident: %s", err)
+		}
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/discipline?"+url.Values{"ClassSection": {classSection}}.Encode(), http.StatusFound)
+}
+
+func disciplineSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var setting disciplineSetting
+	for i := 0; i < maxEscalationRules; i++ {
+		severityStr := r.PostForm.Get(fmt.Sprintf("rule-severity-%d", i))
+		if severityStr == "" {
+			continue
+		}
+		severity, err := parseIncidentSeverity(severityStr)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		n, err := strconv.Atoi(r.PostForm.Get(fmt.Sprintf("rule-incidents-%d", i)))
+		if err != nil || n < 1 {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid number of incidents")
+			return
+		}
+		rule := escalationRule{
+			MinSeverity:  severity,
+			MinIncidents: n,
+			Guardians:    r.PostForm.Get(fmt.Sprintf("rule-guardians-%d", i)) == "on",
+			Admins:       r.PostForm.Get(fmt.Sprintf("rule-admins-%d", i)) == "on",
+		}
+		if !rule.Guardians && !rule.Admins {
+			continue
+		}
+		setting.Rules = append(setting.Rules, rule)
+	}
+
+	if err := saveDisciplineSetting(c, sy, setting); err != nil {
+		log.Errorf(c, "Could not save discipline settings: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/discipline", http.StatusFound)
+}
+
+func generateReportDisciplineIncidents(c context.Context, sy string, classes []string, term Term) ([][]ReportCell, error) {
+	incidents, err := getSYIncidents(c, sy)
+	if err != nil {
+		return nil, err
+	}
+
+	type studentIncidents struct {
+		Count       int
+		Points      int
+		Major       int
+		Detentions  int
+		Suspensions int
+		Open        int
+	}
+	byStudent := make(map[string]*studentIncidents)
+	for _, inc := range incidents {
+		if !termIncludes(term, inc.Quarter()) {
+			continue
+		}
+		for _, id := range inc.Students {
+			si, ok := byStudent[id]
+			if !ok {
+				si = &studentIncidents{}
+				byStudent[id] = si
+			}
+			si.Count++
+			si.Points += int(inc.Severity)
+			if inc.Severity >= severityMajor {
+				si.Major++
+			}
+			if inc.HasAction(actionDetention) {
+				si.Detentions++
+			}
+			if inc.HasAction(actionSuspension) {
+				si.Suspensions++
+			}
+			if inc.Status != incidentClosed {
+				si.Open++
+			}
+		}
+	}
+
+	rows := [][]ReportCell{
+		{
+			{"ID", 1, 1},
+			{"Name", 1, 1},
+			{"Incidents", 1, 1},
+			{"Points", 1, 1},
+			{"Major or Severe", 1, 1},
+			{"Detentions", 1, 1},
+			{"Suspensions", 1, 1},
+			{"Not Closed", 1, 1},
+		},
+	}
+
+	for _, class := range classes {
+		for _, classSection := range getClassSectionsOfClass(c, sy, class) {
+			students, err := findStudentsSorted(c, sy, classSection, true)
+			if err != nil {
+				return nil, err
+			}
+
+			var sectionRows [][]ReportCell
+			for _, s := range students {
+				si, ok := byStudent[s.ID]
+				if !ok {
+					continue
+				}
+				sectionRows = append(sectionRows, []ReportCell{
+					{s.ID, 1, 1},
+					{s.Name, 1, 1},
+					{strconv.Itoa(si.Count), 1, 1},
+					{strconv.Itoa(si.Points), 1, 1},
+					{strconv.Itoa(si.Major), 1, 1},
+					{strconv.Itoa(si.Detentions), 1, 1},
+					{strconv.Itoa(si.Suspensions), 1, 1},
+					{strconv.Itoa(si.Open), 1, 1},
+				})
+			}
+
+			rows = append(rows, []ReportCell{
+				{fmt.Sprintf("%s %s (%d students)", strings.Replace(classSection, "|", "", 1), term, len(sectionRows)), 8, 1},
+			})
+			rows = append(rows, sectionRows...)
+		}
+	}
+
+	return rows, nil
+}
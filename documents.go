@@ -166,6 +166,11 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	uploadDate := time.Now()
 	blobKey := file[0].BlobKey
 
+	if !canAccessIn(w, r, c, getSchoolYear(c), permDocumentsUpload, class, "", "") {
+		blobstore.Delete(c, blobKey)
+		return
+	}
+
 	document := documentType{
 		Title:      title,
 		Class:      class,
@@ -234,8 +239,8 @@ func uploadLinkHandler(w http.ResponseWriter, r *http.Request) {
 
 func sendDocumentEmails(c context.Context, class string) {
 	subject := "New Document Uploaded"
-	body := "A new document is uploaded. To view it, go to: https://creativity-private-school-2015.appspot.com/documents"
-	sendClassEmails(c, class, subject, body)
+	body := "A new document is uploaded. To view it, go to: " + siteURL + "/documents"
+	notify(c, notifyDocument, classNotificationEmails(c, class), subject, body)
 }
 
 func documentsHandler(w http.ResponseWriter, r *http.Request) {
@@ -316,6 +321,10 @@ func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canAccessIn(w, r, c, getSchoolYear(c), permDocumentsUpload, document.Class, "", "") {
+		return
+	}
+
 	err = document.delete(c)
 	if err != nil {
 		log.Errorf(c, "Could not delete document %v: %s", keyInt, err)
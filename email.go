@@ -13,12 +13,23 @@ import (
 	"google.golang.org/appengine/mail"
 )
 
+func studentEmail(id string) string {
+	return fmt.Sprintf("%s@%s", id, schoolDomain)
+}
+
 func sendStudentEmails(c context.Context, ids []string, subject, body string) {
 	var emails []string
 	for _, id := range ids {
-		email := fmt.Sprintf("%s@%s", id, schoolDomain)
-		emails = append(emails, email)
+		emails = append(emails, studentEmail(id))
+	}
+	sendEmails(c, emails, subject, body)
+}
+
+func sendEmails(c context.Context, emails []string, subject, body string) {
+	if len(emails) == 0 {
+		return
 	}
+
 	msg := &mail.Message{
 		Sender:  fmt.Sprintf("Creativity Private School <noreply@%s>", schoolDomain),
 		Subject: subject,
@@ -37,6 +48,12 @@ func sendStudentEmails(c context.Context, ids []string, subject, body string) {
 }
 
 func sendClassEmails(c context.Context, class string, subject, body string) {
+	sendStudentEmails(c, getClassStudentIDs(c, class), subject, body)
+}
+
+// getClassStudentIDs returns the IDs of the students in class, which can be
+// a class, a class|section, or "all"
+func getClassStudentIDs(c context.Context, class string) []string {
 	sy := getSchoolYear(c)
 
 	if class == "" || class == "|" {
@@ -65,5 +82,5 @@ func sendClassEmails(c context.Context, class string, subject, body string) {
 		ids = append(ids, stu.ID)
 	}
 
-	sendStudentEmails(c, ids, subject, body)
+	return ids
 }
@@ -272,7 +272,7 @@ func employeesDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		emp,
 		employeeTypes,
 		countries,
-		u.Roles.Admin,
+		u.can(permRolesEdit),
 	}
 
 	if err := render(w, r, "employeesdetails", data); err != nil {
@@ -314,7 +314,7 @@ func employeesSaveHandler(w http.ResponseWriter, r *http.Request) {
 		renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-	if u.Roles.Admin {
+	if u.can(permRolesEdit) {
 		emp.CPSEmail = f.Get("CPSEmail")
 		emp.Roles = roles{
 			Admin:   f.Get("AdminRole") == "on",
@@ -433,45 +433,11 @@ var employeeFieldsDesc = []string{
 	"",
 }
 
-func employeesImportHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	var errors []error
-
-	message := struct {
-		Msg string
-	}{}
-
-	err := r.ParseMultipartForm(1e6)
-	if err != nil || r.MultipartForm == nil || len(r.MultipartForm.File["csvfile"]) != 1 {
-		// nothing to import
-		if err != nil {
-			message.Msg = err.Error()
-		}
-		if err := render(w, r, "employeesimport", message); err != nil {
-			log.Errorf(c, "Could not render template employeesimport: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		return
-	}
-
-	file, err := r.MultipartForm.File["csvfile"][0].Open()
-	if err != nil {
-		log.Errorf(c, "Could not open uploaded file: %s", err)
-		renderError(w, r, http.StatusInternalServerError)
-		return
-	}
-	defer file.Close()
-
-	u, err := getUser(c)
-	if err != nil {
-		log.Errorf(c, "Could not get user: %s", err)
-		renderError(w, r, http.StatusInternalServerError)
-		return
-	}
-	isAdmin := u.Roles.Admin
-
-	csvr := csv.NewReader(file)
+// importEmployeesCSV saves the employees in the CSV file. Emails and roles
+// are only changed if isAdmin is true. errors has the errors of individual
+// rows, and err is returned if the file is not in the expected format.
+func importEmployeesCSV(c context.Context, r io.Reader, isAdmin bool) (errors []error, err error) {
+	csvr := csv.NewReader(r)
 	csvr.LazyQuotes = true
 	csvr.TrailingComma = true
 	i := 0
@@ -488,13 +454,7 @@ func employeesImportHandler(w http.ResponseWriter, r *http.Request) {
 		if i == 1 {
 			// header
 			if !reflect.DeepEqual(record, employeeFields) {
-				message.Msg = fmt.Sprintf("Invalid file format: %q", record)
-				if err := render(w, r, "employeesimport", message); err != nil {
-					log.Errorf(c, "Could not render template employeesimport: %s", err)
-					renderError(w, r, http.StatusInternalServerError)
-					return
-				}
-				return
+				return nil, fmt.Errorf("Invalid file format: %q", record)
 			}
 			continue
 		} else if i == 2 {
@@ -568,6 +528,56 @@ func employeesImportHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	return errors, nil
+}
+
+func employeesImportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	message := struct {
+		Msg string
+	}{}
+
+	err := r.ParseMultipartForm(1e6)
+	if err != nil || r.MultipartForm == nil || len(r.MultipartForm.File["csvfile"]) != 1 {
+		// nothing to import
+		if err != nil {
+			message.Msg = err.Error()
+		}
+		if err := render(w, r, "employeesimport", message); err != nil {
+			log.Errorf(c, "Could not render template employeesimport: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	file, err := r.MultipartForm.File["csvfile"][0].Open()
+	if err != nil {
+		log.Errorf(c, "Could not open uploaded file: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	u, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	errors, err := importEmployeesCSV(c, file, u.can(permRolesEdit))
+	if err != nil {
+		message.Msg = err.Error()
+		if err := render(w, r, "employeesimport", message); err != nil {
+			log.Errorf(c, "Could not render template employeesimport: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
 	if len(errors) == 0 {
 		// no errors
 		http.Redirect(w, r, "/employees", http.StatusFound)
@@ -587,35 +597,11 @@ func employeesImportHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func employeesExportHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	var errors []error
-	var employees []employeeType
-	var filename string
-
-	r.ParseForm()
-	if r.Form.Get("template") == "true" {
-		filename = "Employees-template"
-	} else {
-		filename = fmt.Sprintf("Employees-%s", time.Now().Format("2006-01-02"))
-		var err error
-		employees, err = getEmployees(c, r.Form.Get("enabled") != "no", r.Form.Get("type"))
-		if err != nil {
-			log.Errorf(c, "Could not retrieve employees: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-	}
-
-	w.Header().Set("Content-Type", "text/csv")
-	// Force save as with filename
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment;filename=%s.csv", filename))
-
-	csvw := csv.NewWriter(w)
-	csvw.UseCRLF = true
-	errors = append(errors, csvw.Write(employeeFields))
-	errors = append(errors, csvw.Write(employeeFieldsDesc))
+// writeEmployeesCSV writes the employees in the format of importEmployeesCSV
+// employeesRecords returns the rows of the employees file, including the two
+// header rows
+func employeesRecords(employees []employeeType) [][]string {
+	records := [][]string{employeeFields, employeeFieldsDesc}
 
 	for _, emp := range employees {
 		var row []string
@@ -663,14 +649,59 @@ func employeesExportHandler(w http.ResponseWriter, r *http.Request) {
 		row = append(row, emp.HealthInfo)
 		row = append(row, emp.Comments)
 
-		errors = append(errors, csvw.Write(row))
+		records = append(records, row)
 	}
 
-	csvw.Flush()
+	return records
+}
 
-	for _, err := range errors {
+func writeEmployeesCSV(w io.Writer, employees []employeeType) error {
+	csvw := csv.NewWriter(w)
+	csvw.UseCRLF = true
+	return csvw.WriteAll(employeesRecords(employees))
+}
+
+// used for XLSX. The rest of the fields are text.
+var employeeFieldsFormats = []xlsxFormat{11: xlsxDate, 16: xlsxDate}
+
+func employeesExportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	var employees []employeeType
+	var filename string
+
+	r.ParseForm()
+	if r.Form.Get("template") == "true" {
+		filename = "Employees-template"
+	} else {
+		filename = fmt.Sprintf("Employees-%s", time.Now().Format("2006-01-02"))
+		var err error
+		employees, err = getEmployees(c, r.Form.Get("enabled") != "no", r.Form.Get("type"))
 		if err != nil {
-			log.Errorf(c, "Error writing csv: %s", err)
+			log.Errorf(c, "Could not retrieve employees: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Form.Get("format") == "xlsx" {
+		setXLSXHeaders(w, filename)
+		sheet := xlsxSheet{
+			"Employees",
+			xlsxRecords(employeesRecords(employees), 2, employeeFieldsFormats),
+			2,
+		}
+		if err := writeXLSX(w, sheet); err != nil {
+			log.Errorf(c, "Error writing xlsx: %s", err)
 		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	// Force save as with filename
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment;filename=%s.csv", filename))
+
+	if err := writeEmployeesCSV(w, employees); err != nil {
+		log.Errorf(c, "Error writing csv: %s", err)
 	}
 }
@@ -48,6 +48,9 @@ type GPARow struct {
 
 	FinalMark float64
 	FinalGpa  float64
+
+	// the final mark is changed by the remedial course
+	Remedial bool
 }
 
 func gpaReportcardHandler(w http.ResponseWriter, r *http.Request) {
@@ -227,6 +230,10 @@ func gpaReportcardHandler(w http.ResponseWriter, r *http.Request) {
 				gpaRow.FinalGpa = gpaRow.S2WGP
 			}
 
+			earned, weighted := gpaRow.applyRemedial(c, sy, id, subject)
+			yearCreditsEarned += earned
+			yearWeightedTotal += weighted
+
 			yearSubjectCount += 1
 			yearMarksTotal += gpaRow.FinalMark
 			yearGpTotal += gpaRow.FinalGpa
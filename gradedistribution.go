@@ -0,0 +1,281 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerReport(reportType{
+		Name:   ReportGradeDistribution,
+		Params: []reportParam{reportParamSchoolYear, reportParamClasses, reportParamSubjects, reportParamTerm},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportGradeDistribution(c, p.SchoolYears[0], p.singleClasses(), p.singleSubjects(), p.Term)
+		},
+	})
+}
+
+const ReportGradeDistribution = "Grade Distribution and Item Analysis"
+
+// passPercentage is the percentage of the maximum mark of a column needed to
+// pass it
+const passPercentage = 60
+
+// distributionBuckets are the lower bounds of the histogram buckets, as a
+// percentage of the maximum mark of a column
+var distributionBuckets = []float64{0, 60, 70, 80, 90}
+
+// columnStats are the statistics of the marks of a column
+type columnStats struct {
+	Marks   []float64 // entered marks, sorted
+	Missing int
+	Max     float64
+}
+
+func (cs *columnStats) add(mark float64) {
+	if math.IsNaN(mark) {
+		cs.Missing++
+		return
+	}
+	cs.Marks = append(cs.Marks, mark)
+}
+
+func (cs columnStats) total() int {
+	return len(cs.Marks) + cs.Missing
+}
+
+func (cs columnStats) mean() float64 {
+	if len(cs.Marks) == 0 {
+		return math.NaN()
+	}
+	return sumMarks(cs.Marks...) / float64(len(cs.Marks))
+}
+
+func (cs columnStats) median() float64 {
+	n := len(cs.Marks)
+	if n == 0 {
+		return math.NaN()
+	}
+	if n%2 == 1 {
+		return cs.Marks[n/2]
+	}
+	return (cs.Marks[n/2-1] + cs.Marks[n/2]) / 2
+}
+
+func (cs columnStats) stdDev() float64 {
+	if len(cs.Marks) == 0 {
+		return math.NaN()
+	}
+	mean := cs.mean()
+	var sum float64
+	for _, mark := range cs.Marks {
+		sum += (mark - mean) * (mark - mean)
+	}
+	return math.Sqrt(sum / float64(len(cs.Marks)))
+}
+
+// percentage returns mark as a percentage of the maximum mark of the column
+func (cs columnStats) percentage(mark float64) float64 {
+	if cs.Max == 0 {
+		return math.NaN()
+	}
+	return mark / cs.Max * 100
+}
+
+func (cs columnStats) passRate() float64 {
+	if len(cs.Marks) == 0 {
+		return math.NaN()
+	}
+	passed := 0
+	for _, mark := range cs.Marks {
+		if cs.percentage(mark) >= passPercentage {
+			passed++
+		}
+	}
+	return float64(passed) / float64(len(cs.Marks)) * 100
+}
+
+func (cs columnStats) missingRate() float64 {
+	if cs.total() == 0 {
+		return math.NaN()
+	}
+	return float64(cs.Missing) / float64(cs.total()) * 100
+}
+
+// histogram returns the number of marks in each of distributionBuckets
+func (cs columnStats) histogram() []int {
+	counts := make([]int, len(distributionBuckets))
+	for _, mark := range cs.Marks {
+		p := cs.percentage(mark)
+		for i := len(distributionBuckets) - 1; i >= 0; i-- {
+			if p >= distributionBuckets[i] {
+				counts[i]++
+				break
+			}
+		}
+	}
+	return counts
+}
+
+// row returns the cells of the statistics, after the first cells of the row
+func (cs columnStats) row(first []ReportCell, allMean float64) []ReportCell {
+	sort.Float64s(cs.Marks)
+
+	mean := cs.mean()
+	row := append(first,
+		ReportCell{strconv.Itoa(cs.total()), 1, 1},
+		ReportCell{formatMark(cs.missingRate()), 1, 1},
+		ReportCell{formatMark(mean), 1, 1},
+		ReportCell{formatMark(mean - allMean), 1, 1},
+		ReportCell{formatMark(cs.median()), 1, 1},
+		ReportCell{formatMark(cs.stdDev()), 1, 1},
+		ReportCell{formatMark(cs.passRate()), 1, 1},
+	)
+	for _, count := range cs.histogram() {
+		row = append(row, ReportCell{strconv.Itoa(count), 1, 1})
+	}
+	return row
+}
+
+func gradeDistributionHeader() []ReportCell {
+	row := []ReportCell{
+		{"Column", 1, 1},
+		{"Max", 1, 1},
+		{"Section", 1, 1},
+		{"Teacher", 1, 1},
+		{"Students", 1, 1},
+		{"Missing (%)", 1, 1},
+		{"Mean", 1, 1},
+		{"Mean vs All", 1, 1},
+		{"Median", 1, 1},
+		{"Std Dev", 1, 1},
+		{fmt.Sprintf("Pass Rate (%d%%+) (%%)", passPercentage), 1, 1},
+	}
+	for i, bucket := range distributionBuckets {
+		if i == len(distributionBuckets)-1 {
+			row = append(row, ReportCell{fmt.Sprintf("%g - 100%%", bucket), 1, 1})
+		} else {
+			row = append(row, ReportCell{fmt.Sprintf("%g - %g%%", bucket, distributionBuckets[i+1]), 1, 1})
+		}
+	}
+	return row
+}
+
+func generateReportGradeDistribution(c context.Context, sy string, classes, subjects []string, term Term) ([][]ReportCell, error) {
+	var rows [][]ReportCell
+
+	header := gradeDistributionHeader()
+
+	assigns, err := getAllAssignments(c, sy)
+	if err != nil {
+		return nil, err
+	}
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		return nil, err
+	}
+	employeeNames := make(map[int64]string)
+	for _, emp := range employees {
+		employeeNames[emp.ID] = emp.Name
+	}
+	// class section|subject -> teacher names
+	teachers := make(map[string][]string)
+	for _, assign := range assigns {
+		k := assign.ClassSection + "|" + assign.Subject
+		teachers[k] = append(teachers[k], employeeNames[assign.Teacher])
+	}
+
+	for _, subject := range subjects {
+		for _, class := range classes {
+			gs := getGradingSystem(c, sy, class, subject)
+			if gs == nil {
+				// class doesn't have subject
+				continue
+			}
+			cols := gs.description(c, sy, term)
+			if len(cols) == 0 {
+				continue
+			}
+
+			classSections := getClassSectionsOfClass(c, sy, class)
+
+			// stats[section][column], and all sections in the last one
+			stats := make([][]columnStats, len(classSections)+1)
+			for i := 0; i < len(stats); i++ {
+				stats[i] = make([]columnStats, len(cols))
+				for j, col := range cols {
+					stats[i][j].Max = col.Max
+				}
+			}
+
+			for csi, classSection := range classSections {
+				students, err := findStudents(c, sy, classSection)
+				if err != nil {
+					return nil, err
+				}
+				for _, s := range students {
+					if !gs.inStream(s.Stream) {
+						continue
+					}
+					marks, err := getStudentMarks(c, s.ID, sy, subject)
+					if err != nil {
+						return nil, err
+					}
+					if err := gs.evaluate(c, s.ID, sy, term, marks); err != nil {
+						log.Warningf(c, "Could not evaluate marks: %s %s %s %s", s.ID, sy, subject, err)
+					}
+					m := marks[term]
+					if len(m) != len(cols) {
+						continue
+					}
+					for j, mark := range m {
+						stats[csi][j].add(mark)
+						stats[len(classSections)][j].add(mark)
+					}
+				}
+			}
+
+			rows = append(rows, []ReportCell{{fmt.Sprintf("%s - %s - %s", subject, class, term), len(header), 1}})
+			rows = append(rows, header)
+			for j, col := range cols {
+				all := stats[len(classSections)][j]
+				sort.Float64s(all.Marks)
+				allMean := all.mean()
+
+				for csi, classSection := range classSections {
+					var first []ReportCell
+					if csi == 0 {
+						first = []ReportCell{
+							{col.Name, 1, len(classSections) + 1},
+							{formatMarkTrim(col.Max), 1, len(classSections) + 1},
+						}
+					}
+					_, section, _ := parseClassSection(classSection)
+					first = append(first,
+						ReportCell{section, 1, 1},
+						ReportCell{strings.Join(teachers[classSection+"|"+subject], ", "), 1, 1},
+					)
+					rows = append(rows, stats[csi][j].row(first, allMean))
+				}
+				first := []ReportCell{{"All", 2, 1}}
+				if len(classSections) == 0 {
+					first = append([]ReportCell{{col.Name, 1, 1}, {formatMarkTrim(col.Max), 1, 1}}, first...)
+				}
+				rows = append(rows, all.row(first, allMean))
+			}
+			rows = append(rows, emptyRow(len(header)))
+		}
+	}
+
+	return rows, nil
+}
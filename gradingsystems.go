@@ -165,7 +165,7 @@ type letterType struct {
 
 func getGradingSystem(c context.Context, sy, class, subjectname string) gradingSystem {
 	if subjectname == "Behavior" {
-		return behaviorGradingSystem{}
+		return behaviorGradingSystem{class}
 	}
 	if subjectname == "Attendance" {
 		return attendanceGradingSystem{}
@@ -176,6 +176,9 @@ func getGradingSystem(c context.Context, sy, class, subjectname string) gradingS
 		log.Errorf(c, "Could not get subject %s %s %s: %s", sy, class, subjectname, err)
 		return nil
 	}
+	if subject.StandardsBased {
+		return standardsGradingSystem{subject}
+	}
 
 	var qWeight, sWeight float64
 	found := false
@@ -352,11 +355,17 @@ type Subject struct {
 	TotalWeeksS1       int
 	MidtermWeeksS2     int
 	TotalWeeksS2       int
+	PeriodsPerWeek     int
 
 	WeeklyGradingColumns   []gradingColumn
 	QuarterGradingColumns  []gradingColumn
 	SemesterGradingColumns []gradingColumn
 
+	// StandardsBased subjects report the proficiency of their learning
+	// outcomes instead of the grading columns
+	StandardsBased bool
+	Outcomes       []learningOutcome
+
 	qWeight float64 `datastore:"-"`
 	sWeight float64 `datastore:"-"`
 }
@@ -581,6 +590,26 @@ func (s Subject) evaluate(c context.Context, studentID, sy string, term Term, ma
 		}
 	}
 
+	// The moderated marks are used to evaluate the term, and the raw marks
+	// are put back after it
+	if raw := s.moderate(c, studentID, sy, term, m, cols); len(raw) > 0 {
+		defer func() {
+			for i, mark := range raw {
+				m[i] = mark
+			}
+		}()
+	}
+
+	// Re-sits and make-ups are applied after the moderations, which are of
+	// the first attempt only
+	if raw := s.applyAttempts(c, studentID, sy, term, m, cols); len(raw) > 0 {
+		defer func() {
+			for i, mark := range raw {
+				m[i] = mark
+			}
+		}()
+	}
+
 	marks[term] = m
 
 	if term.Typ == Quarter {
@@ -924,7 +953,8 @@ func (s Subject) evaluate(c context.Context, studentID, sy string, term Term, ma
 		m[0] = s.get100(Term{Semester, 1}, marks)
 		m[1] = s.get100(Term{Semester, 2}, marks)
 
-		m[2] = sumMarks(m[0], m[1]) / 2.0
+		// Failed subjects are changed by the remedial course
+		m[2] = s.remedialFinalMark(c, studentID, sy, eoyRawMark(m))
 	} else {
 		return fmt.Errorf("Invalid term type: %d", term.Typ)
 	}
@@ -1025,33 +1055,32 @@ func (s Subject) inStream(stream string) bool {
 	return s.Stream == "" || stream == s.Stream
 }
 
-// behaviorGradingSystem contains behavrior. There are no calculations to make
+// subjectStream returns the stream of the subject of gs, and whether gs is
+// a subject
+func subjectStream(gs gradingSystem) (string, bool) {
+	switch s := gs.(type) {
+	case Subject:
+		return s.Stream, true
+	case standardsGradingSystem:
+		return s.Stream, true
+	}
+	return "", false
+}
+
+// behaviorGradingSystem contains behavrior. The only calculations are of the
+// discipline criteria.
 type behaviorGradingSystem struct {
+	Class string
 }
 
-var behaviorDesc = []colDescription{
-	{"Follows school guidelines for safe and appropriate behaviour", 4, 4, true},
-	{"Demonstrates courtesy and respect", 4, 4, true},
-	{"Listens and responds", 4, 4, true},
-	{"Strives for quality work", 4, 4, true},
-	{"Shows initiative / is a self - starter", 4, 4, true},
-	{"Participates enthusiastically in activities", 4, 4, true},
-	{"Uses time efficiently and appropriately", 4, 4, true},
-	{"Completes class work on time ", 4, 4, true},
-	{"Contributes to discussion and group tasks", 4, 4, true},
-	{"Works cooperatively with others", 4, 4, true},
-	{"Works well independently", 4, 4, true},
-	{"Returns complete homework", 4, 4, true},
-	{"Organizes shelf, materials and belongings ", 4, 4, true},
-	{"Asks questions to clarify content", 4, 4, true},
-	{"Clearly communicates to teachers ", 4, 4, true},
-}
-
-func (behaviorGradingSystem) description(c context.Context, sy string, term Term) []colDescription {
-	if term.Typ == Quarter {
-		return behaviorDesc
-	} else if term.Typ == Midterm {
-		return behaviorDesc
+func (bgs behaviorGradingSystem) description(c context.Context, sy string, term Term) []colDescription {
+	if term.Typ == Quarter || term.Typ == Midterm {
+		rubric, err := getTermBehaviorRubric(c, sy, bgs.Class, term)
+		if err != nil {
+			log.Errorf(c, "Could not get behavior rubric of %s %s: %s", bgs.Class, term, err)
+			return nil
+		}
+		return rubric.description()
 	} else if term.Typ == Semester || term.Typ == EndOfYear ||
 		term.Typ == WeekS1 || term.Typ == WeekS2 {
 		// No calculations
@@ -1061,9 +1090,20 @@ func (behaviorGradingSystem) description(c context.Context, sy string, term Term
 }
 
 func (bgs behaviorGradingSystem) evaluate(c context.Context, studentID, sy string, term Term, marks studentMarks) (err error) {
-	m := marks[term]
-	desc := bgs.description(c, sy, term)
+	var rubric BehaviorRubric
+	var desc []colDescription
+	if term.Typ == Quarter || term.Typ == Midterm {
+		// the stored marks are kept if the rubric of the term is unknown
+		rubric, err = getTermBehaviorRubric(c, sy, bgs.Class, term)
+		if err != nil {
+			return err
+		}
+		desc = rubric.description()
+	} else {
+		desc = bgs.description(c, sy, term)
+	}
 
+	m := marks[term]
 	switch {
 	case m == nil: // first time to evaluate it
 		m = make([]float64, len(desc))
@@ -1088,7 +1128,20 @@ func (bgs behaviorGradingSystem) evaluate(c context.Context, studentID, sy strin
 		}
 	}
 
-	// no calculations
+	// the discipline criteria are calculated from the incidents
+	if term.Typ == Quarter || term.Typ == Midterm {
+		if rubric.hasDiscipline() {
+			mark, derr := rubric.disciplineMarks(c, studentID, sy, term)
+			if derr != nil {
+				log.Warningf(c, "Could not get incidents of %s: %s", studentID, derr)
+			}
+			for i, d := range desc {
+				if !d.Editable {
+					m[i] = mark
+				}
+			}
+		}
+	}
 
 	marks[term] = m
 	return
@@ -122,34 +122,7 @@ func homeworkHandler(w http.ResponseWriter, r *http.Request) {
 	var hws []Homework
 
 	if subject != "" {
-		user, err := getUser(c)
-		if err != nil {
-			log.Errorf(c, "Could not get user: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		allowAccess := false
-		if user.Roles.Admin {
-			allowAccess = true
-		} else if user.Roles.Teacher {
-			emp, err := getEmployeeFromEmail(c, user.Email)
-			if err != nil {
-				log.Errorf(c, "Could not get employee: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			allowAccess, err = isTeacherAssigned(c, sy, classSection, subject, emp.ID)
-			if err != nil {
-				log.Errorf(c, "Could not get assignment: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-		} else {
-			allowAccess = false
-		}
-
-		if !allowAccess {
-			renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
+		if !canAccessIn(w, r, c, sy, permHomeworkEdit, "", classSection, subject) {
 			return
 		}
 
@@ -229,39 +202,17 @@ func homeworkSaveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canAccessIn(w, r, c, sy, permHomeworkEdit, "", classSection, subject) {
+		return
+	}
+
 	user, err := getUser(c)
 	if err != nil {
 		log.Errorf(c, "Could not get user: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-
-	var teacher string
-	allowAccess := false
-	if user.Roles.Admin {
-		allowAccess = true
-	} else if user.Roles.Teacher {
-		emp, err := getEmployeeFromEmail(c, user.Email)
-		if err != nil {
-			log.Errorf(c, "Could not get employee: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		allowAccess, err = isTeacherAssigned(c, sy, classSection, subject, emp.ID)
-		if err != nil {
-			log.Errorf(c, "Could not get assignment: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		teacher = emp.Name
-	} else {
-		allowAccess = false
-	}
-
-	if !allowAccess {
-		renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
-		return
-	}
+	teacher := user.FullName()
 
 	// used for redirecting
 	urlValues := url.Values{
@@ -277,6 +228,11 @@ func homeworkSaveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	notifySubject := fmt.Sprintf("New %s Homework", subject)
+	notifyBody := fmt.Sprintf("A new homework is added for %s (%s):\n%s\n\nTo view it, go to: %s/homeworks",
+		subject, date.Format("2006-01-02"), homework, siteURL)
+	notify(c, notifyHomework, classNotificationEmails(c, classSection), notifySubject, notifyBody)
+
 	// TODO: message of success/fail
 	http.Redirect(w, r, redirectURL, http.StatusFound)
 }
@@ -305,35 +261,7 @@ func homeworkDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := getUser(c)
-	if err != nil {
-		log.Errorf(c, "Could not get user: %s", err)
-		renderError(w, r, http.StatusInternalServerError)
-		return
-	}
-
-	allowAccess := false
-	if user.Roles.Admin {
-		allowAccess = true
-	} else if user.Roles.Teacher {
-		emp, err := getEmployeeFromEmail(c, user.Email)
-		if err != nil {
-			log.Errorf(c, "Could not get employee: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		allowAccess, err = isTeacherAssigned(c, sy, classSection, subject, emp.ID)
-		if err != nil {
-			log.Errorf(c, "Could not get assignment: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-	} else {
-		allowAccess = false
-	}
-
-	if !allowAccess {
-		renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
+	if !canAccessIn(w, r, c, sy, permHomeworkEdit, "", classSection, subject) {
 		return
 	}
 
@@ -344,7 +272,7 @@ func homeworkDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	redirectURL := fmt.Sprintf("/homework?%s", urlValues.Encode())
 
-	err = deleteHomework(c, homeworkId)
+	err := deleteHomework(c, homeworkId)
 	if err != nil {
 		log.Errorf(c, "Could not save homework: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
@@ -14,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -548,8 +549,20 @@ func leaveRequestSaveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if action == leaveSaveApprove || action == leaveSaveReject {
+		subject := fmt.Sprintf("Leave Request %s", request.Status)
+		body := fmt.Sprintf("Your %s request starting %s was %s.\n%s\n\nTo view it, go to: %s/leave/myrequests",
+			request.Type, request.StartDate.Format("2006-01-02"), strings.ToLower(request.Status.String()),
+			request.HRComments, siteURL)
+		notify(c, notifyLeave, requesterNotificationEmails(c, request.RequesterKey), subject, body)
+	}
+
 	var redirectUrl string
-	if isHr {
+	if action == leaveSaveApprove && request.RequesterKeyKind == "employee" &&
+		request.Type == LeaveOfAbsence {
+		// assign substitutes to cover the classes
+		redirectUrl = "/substitutions?Date=" + formatDate(request.StartDate)
+	} else if isHr {
 		redirectUrl = "/leave/allrequests"
 	} else {
 		redirectUrl = "/leave/myrequests"
@@ -563,9 +576,9 @@ func evalLeaveRequestPermission(request leaveRequest, user user) (isHr, hasPermi
 	if request.RequesterKey.Equal(user.Key()) {
 		// Handle case where HR is requesting a leave
 		// TODO: allow edit for HR
-		isHr := user.Roles.HR && request.Status != ""
+		isHr := user.can(permLeaveApprove) && request.Status != ""
 		return isHr, true
-	} else if user.Roles.HR {
+	} else if user.can(permLeaveApprove) {
 		return true, true
 	} else {
 		return false, false
@@ -0,0 +1,787 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/lessonplans", accessHandler(lessonPlansHandler))
+	http.HandleFunc("/lessonplans/edit", accessHandler(lessonPlansEditHandler))
+	http.HandleFunc("/lessonplans/save", accessHandler(lessonPlansSaveHandler))
+	http.HandleFunc("/lessonplans/review", accessHandler(lessonPlansReviewHandler))
+	http.HandleFunc("/lessonplans/review/save", accessHandler(lessonPlansReviewSaveHandler))
+	http.HandleFunc("/lessonplans/standards", accessHandler(lessonPlansStandardsHandler))
+	http.HandleFunc("/lessonplans/standards/save", accessHandler(lessonPlansStandardsSaveHandler))
+
+	registerReport(reportType{
+		Name:   ReportCurriculumCoverage,
+		Params: []reportParam{reportParamSchoolYear, reportParamClasses, reportParamSubjects},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportCurriculumCoverage(c, p.SchoolYears[0], p.singleClasses(), p.singleSubjects())
+		},
+	})
+}
+
+const ReportCurriculumCoverage = "Curriculum Coverage"
+
+// curriculumStandard is a standard of the curriculum of a subject in a class
+type curriculumStandard struct {
+	Code        string
+	Description string
+}
+
+// curriculum is the list of standards of a subject in a class. It will be
+// stored in the datastore.
+type curriculum struct {
+	SY        string
+	Class     string
+	Subject   string
+	Standards []curriculumStandard
+}
+
+func curriculumKey(c context.Context, sy, class, subject string) *datastore.Key {
+	return datastore.NewKey(c, "curriculum", fmt.Sprintf("%s|%s|%s", sy, class, subject), 0, nil)
+}
+
+// getCurriculum returns the standards of the subject in class
+func getCurriculum(c context.Context, sy, class, subject string) ([]curriculumStandard, error) {
+	var cur curriculum
+	err := nds.Get(c, curriculumKey(c, sy, class, subject), &cur)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cur.Standards, nil
+}
+
+func saveCurriculum(c context.Context, cur curriculum) error {
+	_, err := nds.Put(c, curriculumKey(c, cur.SY, cur.Class, cur.Subject), &cur)
+	return err
+}
+
+type lessonPlanStatus string
+
+const (
+	lessonPlanDraft     lessonPlanStatus = "Draft"
+	lessonPlanSubmitted lessonPlanStatus = "Submitted"
+	lessonPlanApproved  lessonPlanStatus = "Approved"
+	lessonPlanReturned  lessonPlanStatus = "Returned"
+)
+
+// Context returns the bootstrap contextual class of the status
+func (s lessonPlanStatus) Context() string {
+	switch s {
+	case lessonPlanApproved:
+		return "success"
+	case lessonPlanReturned:
+		return "warning"
+	case lessonPlanSubmitted:
+		return "info"
+	}
+	return ""
+}
+
+// Reviewable returns whether a plan with the status can be approved or
+// returned
+func (s lessonPlanStatus) Reviewable() bool {
+	return s == lessonPlanSubmitted
+}
+
+// lessonPlan is the plan of a subject in a class section for a week. It
+// will be stored in the datastore.
+type lessonPlan struct {
+	SY           string
+	ClassSection string
+	Subject      string
+	Week         string // a WeekS1 or WeekS2 term
+
+	Objectives string   `datastore:",noindex"`
+	Standards  []string // codes of the curriculum standards
+	Resources  string   `datastore:",noindex"`
+	Homework   string   `datastore:",noindex"`
+
+	Status       lessonPlanStatus
+	Teacher      string `datastore:",noindex"`
+	TeacherEmail string
+	Updated      time.Time
+
+	Comments string `datastore:",noindex"`
+	Reviewer string `datastore:",noindex"`
+	Reviewed time.Time
+}
+
+// WeekTerm returns the week of the plan
+func (lp lessonPlan) WeekTerm() Term {
+	week, err := parseTerm(lp.Week)
+	if err != nil {
+		return Term{WeekS1, 1}
+	}
+	return week
+}
+
+// HasStandard returns whether the plan covers the standard
+func (lp lessonPlan) HasStandard(code string) bool {
+	return containsString(lp.Standards, code)
+}
+
+func lessonPlanKey(c context.Context, sy, classSection, subject string, week Term) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%s|%s|%s", sy, classSection, subject, week.Value())
+	return datastore.NewKey(c, "lessonplan", keyStr, 0, nil)
+}
+
+// getLessonPlan returns the plan of the week, and whether it exists
+func getLessonPlan(c context.Context, sy, classSection, subject string, week Term) (lessonPlan, bool, error) {
+	var lp lessonPlan
+	err := nds.Get(c, lessonPlanKey(c, sy, classSection, subject, week), &lp)
+	if err == datastore.ErrNoSuchEntity {
+		return lessonPlan{
+			SY:           sy,
+			ClassSection: classSection,
+			Subject:      subject,
+			Week:         week.Value(),
+			Status:       lessonPlanDraft,
+		}, false, nil
+	} else if err != nil {
+		return lp, false, err
+	}
+	return lp, true, nil
+}
+
+// getLessonPlans returns the plans of the subject in the class section, by
+// week
+func getLessonPlans(c context.Context, sy, classSection, subject string) (map[Term]lessonPlan, error) {
+	q := datastore.NewQuery("lessonplan").
+		Filter("SY =", sy).
+		Filter("ClassSection =", classSection).
+		Filter("Subject =", subject)
+
+	var lps []lessonPlan
+	if _, err := q.GetAll(c, &lps); err != nil {
+		return nil, err
+	}
+
+	plans := make(map[Term]lessonPlan)
+	for _, lp := range lps {
+		plans[lp.WeekTerm()] = lp
+	}
+	return plans, nil
+}
+
+// lessonPlanWeeks returns the weeks of the subject in class. Subjects
+// without weeks use the most weeks of all subjects.
+func lessonPlanWeeks(c context.Context, sy, class, subject string) []Term {
+	weeksS1, weeksS2 := 0, 0
+	if s, err := getSubject(c, sy, class, subject); err == nil {
+		weeksS1, weeksS2 = s.TotalWeeksS1, s.TotalWeeksS2
+	}
+	if weeksS1 == 0 && weeksS2 == 0 {
+		weeksS1 = getMaxWeeks(c)
+		weeksS2 = weeksS1
+	}
+
+	var weeks []Term
+	for i := 1; i <= weeksS1; i++ {
+		weeks = append(weeks, Term{WeekS1, i})
+	}
+	for i := 1; i <= weeksS2; i++ {
+		weeks = append(weeks, Term{WeekS2, i})
+	}
+	return weeks
+}
+
+// hodEmail returns the email of the head of department of the subject, or
+// "" if there is none
+func hodEmail(c context.Context, sy, subject string) string {
+	hod, ok := getHeadsOfDepartment(c, sy)[subject]
+	if !ok {
+		return ""
+	}
+	emp, err := getEmployee(c, fmt.Sprint(hod))
+	if err != nil {
+		log.Warningf(c, "Could not get employee %d: %s", hod, err)
+		return ""
+	}
+	return emp.CPSEmail
+}
+
+func lessonPlansURL(classSection, subject string) string {
+	return "/lessonplans?" + url.Values{
+		"ClassSection": {classSection},
+		"Subject":      {subject},
+	}.Encode()
+}
+
+// lessonPlanRow is a week in the lesson plans page
+type lessonPlanRow struct {
+	Week   Term
+	Plan   lessonPlan
+	Exists bool
+}
+
+func lessonPlansHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.Form.Get("ClassSection")
+	subject := r.Form.Get("Subject")
+
+	var rows []lessonPlanRow
+	if class, _, err := parseClassSection(classSection); err == nil && subject != "" {
+		if !canAccessIn(w, r, c, sy, permLessonPlansEdit, "", classSection, subject) {
+			return
+		}
+
+		plans, err := getLessonPlans(c, sy, classSection, subject)
+		if err != nil {
+			log.Errorf(c, "Could not get lesson plans: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		for _, week := range lessonPlanWeeks(c, sy, class, subject) {
+			lp, ok := plans[week]
+			rows = append(rows, lessonPlanRow{week, lp, ok})
+		}
+	} else {
+		classSection = ""
+	}
+
+	data := struct {
+		CG           []classGroup
+		Subjects     []string
+		ClassSection string
+		Subject      string
+
+		Rows []lessonPlanRow
+	}{
+		getClassGroups(c, sy),
+		getAllSubjects(c, sy),
+		classSection,
+		subject,
+
+		rows,
+	}
+
+	if err := render(w, r, "lessonplans", data); err != nil {
+		log.Errorf(c, "Could not render template lessonplans: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func lessonPlansEditHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.Form.Get("ClassSection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	subject := r.Form.Get("Subject")
+	week, err := parseTerm(r.Form.Get("Week"))
+	if err != nil || (week.Typ != WeekS1 && week.Typ != WeekS2) {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid week")
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permLessonPlansEdit, "", classSection, subject) {
+		return
+	}
+
+	lp, _, err := getLessonPlan(c, sy, classSection, subject, week)
+	if err != nil {
+		log.Errorf(c, "Could not get lesson plan: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	standards, err := getCurriculum(c, sy, class, subject)
+	if err != nil {
+		log.Errorf(c, "Could not get curriculum: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Week      Term
+		Plan      lessonPlan
+		Standards []curriculumStandard
+	}{
+		week,
+		lp,
+		standards,
+	}
+
+	if err := render(w, r, "lessonplanedit", data); err != nil {
+		log.Errorf(c, "Could not render template lessonplanedit: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func lessonPlansSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	f := r.PostForm
+
+	classSection := f.Get("ClassSection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	subject := f.Get("Subject")
+	week, err := parseTerm(f.Get("Week"))
+	if err != nil || (week.Typ != WeekS1 && week.Typ != WeekS2) {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid week")
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permLessonPlansEdit, "", classSection, subject) {
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	lp, _, err := getLessonPlan(c, sy, classSection, subject, week)
+	if err != nil {
+		log.Errorf(c, "Could not get lesson plan: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	standards, err := getCurriculum(c, sy, class, subject)
+	if err != nil {
+		log.Errorf(c, "Could not get curriculum: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	lp.Standards = nil
+	for _, standard := range standards {
+		if containsString(f["Standards"], standard.Code) {
+			lp.Standards = append(lp.Standards, standard.Code)
+		}
+	}
+
+	lp.Objectives = strings.TrimSpace(f.Get("Objectives"))
+	lp.Resources = strings.TrimSpace(f.Get("Resources"))
+	lp.Homework = strings.TrimSpace(f.Get("Homework"))
+	lp.Teacher = user.FullName()
+	if lp.Teacher == "" {
+		lp.Teacher = user.Name
+	}
+	lp.TeacherEmail = user.Email
+	lp.Updated = time.Now()
+
+	// changing a plan requires it to be submitted and approved again
+	submit := f.Get("action") == "Submit"
+	if submit {
+		if lp.Objectives == "" {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Objectives are required to submit the plan")
+			return
+		}
+		lp.Status = lessonPlanSubmitted
+	} else {
+		lp.Status = lessonPlanDraft
+	}
+
+	if _, err := nds.Put(c, lessonPlanKey(c, sy, classSection, subject, week), &lp); err != nil {
+		log.Errorf(c, "Could not save lesson plan: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if submit {
+		if email := hodEmail(c, sy, subject); email != "" {
+			cs := strings.Replace(classSection, "|", "", 1)
+			notifySubject := fmt.Sprintf("%s %s Lesson Plan Submitted", subject, cs)
+			notifyBody := fmt.Sprintf("The %s lesson plan of %s for %s was submitted by %s.\n\nTo review it, go to: %s/lessonplans/review",
+				subject, cs, week, lp.Teacher, siteURL)
+			notify(c, notifyLessonPlan, []string{email}, notifySubject, notifyBody)
+		}
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, lessonPlansURL(classSection, subject), http.StatusFound)
+}
+
+func lessonPlansReviewHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	status := lessonPlanStatus(r.Form.Get("Status"))
+	if status == "" {
+		status = lessonPlanSubmitted
+	}
+
+	q := datastore.NewQuery("lessonplan").
+		Filter("SY =", sy).
+		Filter("Status =", string(status))
+	var lps []lessonPlan
+	if _, err := q.GetAll(c, &lps); err != nil {
+		log.Errorf(c, "Could not get lesson plans: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var plans []lessonPlan
+	for _, lp := range lps {
+		if user.Permissions.inScope(permLessonPlansApprove, "", lp.ClassSection, lp.Subject) {
+			plans = append(plans, lp)
+		}
+	}
+
+	data := struct {
+		Status   lessonPlanStatus
+		Statuses []lessonPlanStatus
+		Plans    []lessonPlan
+	}{
+		status,
+		[]lessonPlanStatus{lessonPlanSubmitted, lessonPlanApproved, lessonPlanReturned},
+		plans,
+	}
+
+	if err := render(w, r, "lessonplansreview", data); err != nil {
+		log.Errorf(c, "Could not render template lessonplansreview: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func lessonPlansReviewSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	f := r.PostForm
+
+	classSection := f.Get("ClassSection")
+	if _, _, err := parseClassSection(classSection); err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	subject := f.Get("Subject")
+	week, err := parseTerm(f.Get("Week"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid week")
+		return
+	}
+	comments := strings.TrimSpace(f.Get("Comments"))
+
+	var status lessonPlanStatus
+	switch f.Get("action") {
+	case "Approve":
+		status = lessonPlanApproved
+	case "Return":
+		if comments == "" {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Comments are required to return a plan")
+			return
+		}
+		status = lessonPlanReturned
+	default:
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid action")
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	lp, ok, err := getLessonPlan(c, sy, classSection, subject, week)
+	if err != nil {
+		log.Errorf(c, "Could not get lesson plan: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		renderErrorMsg(w, r, http.StatusBadRequest, "The lesson plan does not exist")
+		return
+	}
+	if !lp.Status.Reviewable() {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Only submitted lesson plans can be reviewed")
+		return
+	}
+
+	lp.Status = status
+	lp.Comments = comments
+	lp.Reviewer = user.FullName()
+	if lp.Reviewer == "" {
+		lp.Reviewer = user.Name
+	}
+	lp.Reviewed = time.Now()
+
+	if _, err := nds.Put(c, lessonPlanKey(c, sy, classSection, subject, week), &lp); err != nil {
+		log.Errorf(c, "Could not save lesson plan: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	emails, err := assignedTeacherEmails(c, sy, classSection, subject)
+	if err != nil {
+		log.Errorf(c, "Could not get teachers: %s", err)
+	}
+	emails = append(emails, lp.TeacherEmail)
+	cs := strings.Replace(classSection, "|", "", 1)
+	notifySubject := fmt.Sprintf("%s %s Lesson Plan %s", subject, cs, status)
+	notifyBody := fmt.Sprintf("The %s lesson plan of %s for %s was %s by %s.\n\n%s\n\nTo view it, go to: %s%s",
+		subject, cs, week, strings.ToLower(string(status)), lp.Reviewer, comments,
+		siteURL, lessonPlansURL(classSection, subject))
+	notify(c, notifyLessonPlan, emails, notifySubject, notifyBody)
+
+	// TODO: message of success
+	http.Redirect(w, r, "/lessonplans/review", http.StatusFound)
+}
+
+func lessonPlansStandardsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	class := r.Form.Get("Class")
+	subject := r.Form.Get("Subject")
+
+	var standards []curriculumStandard
+	if class != "" && subject != "" {
+		var err error
+		standards, err = getCurriculum(c, sy, class, subject)
+		if err != nil {
+			log.Errorf(c, "Could not get curriculum: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		standards = append(standards, make([]curriculumStandard, 10)...)
+	}
+
+	data := struct {
+		Classes   []string
+		Subjects  []string
+		Class     string
+		Subject   string
+		Standards []curriculumStandard
+	}{
+		getClasses(c, sy),
+		getAllSubjects(c, sy),
+		class,
+		subject,
+		standards,
+	}
+
+	if err := render(w, r, "lessonplansstandards", data); err != nil {
+		log.Errorf(c, "Could not render template lessonplansstandards: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func lessonPlansStandardsSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	class := r.PostForm.Get("Class")
+	subject := r.PostForm.Get("Subject")
+	if class == "" || subject == "" {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class or subject")
+		return
+	}
+
+	cur := curriculum{
+		SY:      sy,
+		Class:   class,
+		Subject: subject,
+	}
+	codes := make(map[string]bool)
+	for i := 0; ; i++ {
+		_, ok := r.PostForm[fmt.Sprintf("standard-code-%d", i)]
+		if !ok {
+			break
+		}
+
+		code := strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("standard-code-%d", i)))
+		description := strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("standard-description-%d", i)))
+		if code == "" && description == "" {
+			continue
+		}
+		if code == "" {
+			renderErrorMsg(w, r, http.StatusBadRequest, fmt.Sprintf("Missing code of standard: %s", description))
+			return
+		}
+		if codes[code] {
+			renderErrorMsg(w, r, http.StatusBadRequest, fmt.Sprintf("Duplicate standard: %s", code))
+			return
+		}
+		codes[code] = true
+
+		cur.Standards = append(cur.Standards, curriculumStandard{code, description})
+	}
+
+	if err := saveCurriculum(c, cur); err != nil {
+		log.Errorf(c, "Could not save curriculum: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/lessonplans/standards?"+url.Values{
+		"Class":   {class},
+		"Subject": {subject},
+	}.Encode(), http.StatusFound)
+}
+
+// generateReportCurriculumCoverage shows the weeks in which each standard
+// was taught in each class section, from the approved lesson plans
+func generateReportCurriculumCoverage(c context.Context, sy string, classes, subjects []string) ([][]ReportCell, error) {
+	var rows [][]ReportCell
+
+	for _, class := range classes {
+		classSections := getClassSectionsOfClass(c, sy, class)
+		classSubjects, err := getSubjects(c, sy, class)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subject := range subjects {
+			if !containsString(classSubjects, subject) {
+				continue
+			}
+
+			standards, err := getCurriculum(c, sy, class, subject)
+			if err != nil {
+				return nil, err
+			}
+			if len(standards) == 0 {
+				continue
+			}
+
+			header := []ReportCell{
+				{"Standard", 1, 1},
+				{"Description", 1, 1},
+			}
+			// weeks of each standard, by class section
+			taught := make([]map[string][]string, len(classSections))
+			for i, classSection := range classSections {
+				header = append(header, ReportCell{strings.Replace(classSection, "|", "", 1), 1, 1})
+
+				plans, err := getLessonPlans(c, sy, classSection, subject)
+				if err != nil {
+					return nil, err
+				}
+				taught[i] = make(map[string][]string)
+				for _, week := range lessonPlanWeeks(c, sy, class, subject) {
+					lp, ok := plans[week]
+					if !ok || lp.Status != lessonPlanApproved {
+						continue
+					}
+					for _, code := range lp.Standards {
+						taught[i][code] = append(taught[i][code], week.String())
+					}
+				}
+			}
+
+			rows = append(rows, []ReportCell{
+				{fmt.Sprintf("%s %s", class, subject), len(header), 1},
+			})
+			rows = append(rows, header)
+
+			covered := make([]int, len(classSections))
+			for _, standard := range standards {
+				row := []ReportCell{
+					{standard.Code, 1, 1},
+					{standard.Description, 1, 1},
+				}
+				for i := range classSections {
+					weeks := taught[i][standard.Code]
+					if len(weeks) > 0 {
+						covered[i]++
+					}
+					row = append(row, ReportCell{strings.Join(weeks, ", "), 1, 1})
+				}
+				rows = append(rows, row)
+			}
+
+			total := []ReportCell{{"Taught", 2, 1}}
+			for i := range classSections {
+				total = append(total, ReportCell{fmt.Sprintf("%d/%d", covered[i], len(standards)), 1, 1})
+			}
+			rows = append(rows, total)
+		}
+	}
+
+	return rows, nil
+}
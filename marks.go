@@ -18,8 +18,8 @@ import (
 	"math"
 	"net/http"
 	"net/url"
-	"reflect"
 	"strconv"
+	"strings"
 )
 
 func init() {
@@ -128,6 +128,22 @@ func storeMarksRow(c context.Context, id string, sy string, term Term,
 		return err
 	}
 
+	if _, ok := gs.(Subject); ok && term.Typ == EndOfYear {
+		if err := syncRemedialEnrollment(c, id, sy, subject, eoyRawMark(marks)); err != nil {
+			return err
+		}
+	}
+
+	if bgs, ok := gs.(behaviorGradingSystem); ok && (term.Typ == Quarter || term.Typ == Midterm) {
+		rubric, err := getTermBehaviorRubric(c, sy, bgs.Class, term)
+		if err != nil {
+			return err
+		}
+		if err := pinBehaviorRubric(c, sy, bgs.Class, term, rubric.Version); err != nil {
+			return err
+		}
+	}
+
 	if term.Typ == WeekS1 || term.Typ == WeekS2 {
 		// Load the rest of the marks
 		mOld, err := getStudentMarks(c, id, sy, subject)
@@ -280,6 +296,10 @@ func marksHandler(w http.ResponseWriter, r *http.Request) {
 
 	var subjectDisplayName string
 
+	var review marksReview
+	var canEdit, canReview, canAddAttempts bool
+	var moderations []moderation
+
 	if subject != "" {
 		user, err := getUser(c)
 		if err != nil {
@@ -287,24 +307,29 @@ func marksHandler(w http.ResponseWriter, r *http.Request) {
 			renderError(w, r, http.StatusInternalServerError)
 			return
 		}
-		allowAccess := false
-		if user.Roles.Admin {
-			allowAccess = true
-		} else if user.Roles.Teacher {
-			emp, err := getEmployeeFromEmail(c, user.Email)
-			if err != nil {
-				log.Errorf(c, "Could not get employee: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			allowAccess, err = isTeacherAssigned(c, sy, classSection, subject, emp.ID)
-			if err != nil {
-				log.Errorf(c, "Could not get assignment: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
+		allowAccess, err := user.canInScope(c, sy, permMarksView, classSection, subject)
+		if err != nil {
+			log.Errorf(c, "Could not get assignment: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		canEdit, err = user.canInScope(c, sy, permMarksEdit, classSection, subject)
+		if err != nil {
+			log.Errorf(c, "Could not get assignment: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		canReview = user.Permissions.inScope(permMarksReview, "", classSection, subject)
+
+		review, err = getMarksReview(c, sy, classSection, term, subject)
+		if err != nil {
+			log.Warningf(c, "Could not get marks review: %s", err)
+		}
+
+		for _, mod := range getModerations(c, sy) {
+			if mod.matches(class, section, subject, term) {
+				moderations = append(moderations, mod)
 			}
-		} else {
-			allowAccess = false
 		}
 
 		if !allowAccess {
@@ -364,6 +389,15 @@ func marksHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		} else if gs := getGradingSystem(c, sy, class, subject); gs != nil {
+			if bgs, ok := gs.(behaviorGradingSystem); ok {
+				if _, err := getTermBehaviorRubric(c, sy, bgs.Class, term); err != nil {
+					log.Errorf(c, "Could not get behavior rubric: %s", err)
+					renderError(w, r, http.StatusInternalServerError)
+					return
+				}
+			}
+			_, isSubject := gs.(Subject)
+			canAddAttempts = canEdit && isSubject && adjustableTerm(term)
 			cols = gs.description(c, sy, term)
 			if len(cols) == 0 {
 				renderErrorMsg(w, r, http.StatusNotFound, "Not applicable")
@@ -431,6 +465,12 @@ func marksHandler(w http.ResponseWriter, r *http.Request) {
 
 		Cols     []colDescription
 		Students []studentRow
+
+		Review         marksReview
+		CanEdit        bool
+		CanReview      bool
+		CanAddAttempts bool
+		Moderations    []moderation
 	}{
 		term,
 		class,
@@ -447,6 +487,12 @@ func marksHandler(w http.ResponseWriter, r *http.Request) {
 
 		cols,
 		studentRows,
+
+		review,
+		canEdit,
+		canReview,
+		canAddAttempts,
+		moderations,
 	}
 
 	if err := render(w, r, "marks", data); err != nil {
@@ -479,6 +525,10 @@ func marksSaveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canAccessIn(w, r, c, sy, permMarksEdit, "", classSection, subject) {
+		return
+	}
+
 	// used for redirecting
 	urlValues := url.Values{
 		"Term":         []string{term.Value()},
@@ -513,6 +563,13 @@ func marksSaveHandler(w http.ResponseWriter, r *http.Request) {
 			nComplete++
 		}
 	} else if gs := getGradingSystem(c, sy, class, subject); gs != nil {
+		if bgs, ok := gs.(behaviorGradingSystem); ok {
+			if _, err := getTermBehaviorRubric(c, sy, bgs.Class, term); err != nil {
+				log.Errorf(c, "Could not get behavior rubric: %s", err)
+				renderError(w, r, http.StatusInternalServerError)
+				return
+			}
+		}
 		cols := gs.description(c, sy, term)
 		hasEditable := false
 		for _, col := range cols {
@@ -532,6 +589,7 @@ func marksSaveHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		anyChanged := false
 		for _, s := range students {
 			if !gs.inStream(s.Stream) {
 				continue
@@ -563,6 +621,7 @@ func marksSaveHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			gs.evaluate(c, s.ID, sy, term, m) // TODO: check error
 			if marksChanged {
+				anyChanged = true
 				err := storeMarksRow(c, s.ID, sy, term, subject, m, gs)
 				if err != nil {
 					log.Errorf(c, "Could not store marks: %s", err)
@@ -574,9 +633,16 @@ func marksSaveHandler(w http.ResponseWriter, r *http.Request) {
 				nComplete++
 			}
 		}
+
+		// Reviewed marks are reviewed again after they are changed
+		if anyChanged {
+			if err := resubmitMarksReview(c, sy, classSection, term, subject); err != nil {
+				log.Errorf(c, "Could not resubmit marks review: %s", err)
+			}
+		}
 	}
 
-	err := storeCompletion(c, classSection, term, subject, nComplete)
+	err := storeCompletion(c, sy, classSection, term, subject, nComplete)
 	if err != nil {
 		log.Errorf(c, "Could not store completion: %s", err)
 	}
@@ -585,30 +651,14 @@ func marksSaveHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectURL, http.StatusFound)
 }
 
-func marksExportHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	sy := getSchoolYear(c)
-
-	if err := r.ParseForm(); err != nil {
-		log.Errorf(c, "Could not parse form: %s", err)
-		renderError(w, r, http.StatusInternalServerError)
-		return
-	}
-
-	term, err := parseTerm(r.Form.Get("Term"))
-	if err != nil {
-		term = Term{}
-	}
-
-	classSection := r.Form.Get("ClassSection")
+// getMarksRows returns the columns and the marks of the students of the
+// class section, as shown in the marks page
+func getMarksRows(c context.Context, sy string, term Term, classSection, subject string) ([]colDescription, []studentRow, error) {
 	class, _, err := parseClassSection(classSection)
 	if err != nil {
 		class = ""
 	}
 
-	subject := r.Form.Get("Subject")
-
 	var cols []colDescription
 	var studentRows []studentRow
 
@@ -616,9 +666,7 @@ func marksExportHandler(w http.ResponseWriter, r *http.Request) {
 		cols = []colDescription{{Name: "Remarks"}}
 		students, err := findStudents(c, sy, classSection)
 		if err != nil {
-			log.Errorf(c, "Could not get students: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
+			return nil, nil, err
 		}
 
 		for _, s := range students {
@@ -633,9 +681,7 @@ func marksExportHandler(w http.ResponseWriter, r *http.Request) {
 		cols = gs.description(c, sy, term)
 		students, err := findStudents(c, sy, classSection)
 		if err != nil {
-			log.Errorf(c, "Could not get students: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
+			return nil, nil, err
 		}
 
 		for _, s := range students {
@@ -657,16 +703,14 @@ func marksExportHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	filename := fmt.Sprintf("%s-%s-%s", term, classSection, subject)
-
-	w.Header().Set("Content-Type", "text/csv")
-	// Force save as with filename
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment;filename=Marks-%s.csv", filename))
+	return cols, studentRows, nil
+}
 
-	var errors []error
-	csvw := csv.NewWriter(w)
-	csvw.UseCRLF = true
+// marksRecords returns the rows of the marks file, including the two header
+// rows
+func marksRecords(term Term, classSection, subject string,
+	cols []colDescription, studentRows []studentRow) [][]string {
+	filename := fmt.Sprintf("%s-%s-%s", term, classSection, subject)
 
 	fieldNames := []string{filename, "Student Name"}
 	fieldMax := []string{"Do not modify this column", ""}
@@ -674,8 +718,7 @@ func marksExportHandler(w http.ResponseWriter, r *http.Request) {
 		fieldNames = append(fieldNames, col.Name)
 		fieldMax = append(fieldMax, maxAndWeight(col.Max, col.FinalWeight))
 	}
-	errors = append(errors, csvw.Write(fieldNames))
-	errors = append(errors, csvw.Write(fieldMax))
+	records := [][]string{fieldNames, fieldMax}
 
 	for _, sr := range studentRows {
 		var row []string
@@ -688,247 +731,83 @@ func marksExportHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			row = append(row, sr.Remark)
 		}
-
-		errors = append(errors, csvw.Write(row))
+		records = append(records, row)
 	}
 
-	csvw.Flush()
+	return records
+}
 
-	for _, err := range errors {
-		if err != nil {
-			log.Errorf(c, "Error writing csv: %s", err)
+// writeMarksCSV writes the marks in the format of readMarksFile
+func writeMarksCSV(w io.Writer, term Term, classSection, subject string,
+	cols []colDescription, studentRows []studentRow) error {
+	csvw := csv.NewWriter(w)
+	csvw.UseCRLF = true
+	return csvw.WriteAll(marksRecords(term, classSection, subject, cols, studentRows))
+}
+
+// writeMarksXLSX writes the marks in the format of readMarksFile
+func writeMarksXLSX(w io.Writer, term Term, classSection, subject string,
+	cols []colDescription, studentRows []studentRow) error {
+	formats := []xlsxFormat{xlsxText, xlsxText}
+	if subject != "Remarks" {
+		for i := 0; i < len(cols); i++ {
+			formats = append(formats, xlsxNumber)
 		}
 	}
 
+	records := marksRecords(term, classSection, subject, cols, studentRows)
+	sheet := xlsxSheet{
+		fmt.Sprintf("%s %s", subject, strings.Replace(classSection, "|", "", -1)),
+		xlsxRecords(records, 2, formats),
+		2,
+	}
+	return writeXLSX(w, sheet)
 }
 
-func marksImportHandler(w http.ResponseWriter, r *http.Request) {
+func marksExportHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
 	sy := getSchoolYear(c)
 
-	err := r.ParseMultipartForm(1e6)
-	if err != nil {
-		log.Errorf(c, "Could not parse multipart form: %s", err)
-		renderError(w, r, http.StatusInternalServerError)
-		return
-	} else if r.MultipartForm == nil || len(r.MultipartForm.File["csvfile"]) != 1 {
-		log.Errorf(c, "No file uploaded: %s", err)
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 
-	f := url.Values(r.MultipartForm.Value)
-	term, err1 := parseTerm(f.Get("Term"))
-	subject := f.Get("Subject")
-	classSection := f.Get("ClassSection")
-	class, _, err2 := parseClassSection(classSection)
-	if err1 != nil || subject == "" || err2 != nil {
-		log.Errorf(c, "Could not import marks: Term err: %s, subject: %q, classSection err: %s",
-			err1, subject, err2)
-		renderError(w, r, http.StatusInternalServerError)
-		return
+	term, err := parseTerm(r.Form.Get("Term"))
+	if err != nil {
+		term = Term{}
 	}
 
-	// used for redirecting
-	urlValues := url.Values{
-		"Term":         []string{term.Value()},
-		"ClassSection": []string{classSection},
-		"Subject":      []string{subject},
-	}
-	redirectURL := fmt.Sprintf("/marks?%s", urlValues.Encode())
+	classSection := r.Form.Get("ClassSection")
+	subject := r.Form.Get("Subject")
 
-	file, err := r.MultipartForm.File["csvfile"][0].Open()
+	cols, studentRows, err := getMarksRows(c, sy, term, classSection, subject)
 	if err != nil {
-		log.Errorf(c, "Could not open uploaded file: %s", err)
+		log.Errorf(c, "Could not get students: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	// used for validating the first two rows
 	filename := fmt.Sprintf("%s-%s-%s", term, classSection, subject)
-	fieldNames := []string{filename, "Student Name"}
-	fieldMax := []string{"Do not modify this column", ""}
-	var cols []colDescription
-	if gs := getGradingSystem(c, sy, class, subject); gs != nil {
-		cols = gs.description(c, sy, term)
-		for _, col := range cols {
-			fieldNames = append(fieldNames, col.Name)
-			fieldMax = append(fieldMax, maxAndWeight(col.Max, col.FinalWeight))
-		}
-	} else if subject == "Remarks" {
-		fieldNames = append(fieldNames, "Remarks")
-		fieldMax = append(fieldMax, formatMark(0))
-	}
-
-	csvr := csv.NewReader(file)
-	csvr.LazyQuotes = true
-	csvr.TrailingComma = true
-	csvMarks := make(map[string][]string)
-	var errors []error
-	i := 0
-	for {
-		i++
-		record, err := csvr.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			errors = append(errors, fmt.Errorf("Error in row %d: %s", i, err))
-			continue
-		}
-		if i == 1 {
-			// header
-			if !reflect.DeepEqual(record, fieldNames) {
-				log.Errorf(c, "Invalid file header: %q. Expected: %q", record, fieldNames)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			continue
-		}
-		if i == 2 {
-			for i, recordStr := range record {
-				recordNum, recordErr := strconv.ParseFloat(recordStr, 64)
-				expectedStr := fieldMax[i]
-				expectedNum, expectedErr := strconv.ParseFloat(expectedStr, 64)
-				if recordErr == nil && expectedErr == nil {
-					if recordNum != expectedNum {
-						log.Errorf(c, "Invalid file header: %q. Expected: %q", record, fieldMax)
-						renderError(w, r, http.StatusInternalServerError)
-						return
-					}
-				} else {
-					// not numbers
-					if recordStr != expectedStr {
-						log.Errorf(c, "Invalid file header: %q. Expected: %q", record, fieldMax)
-						renderError(w, r, http.StatusInternalServerError)
-						return
-					}
-				}
-			}
-			continue
-		}
-		csvMarks[record[0]] = record[1:]
-	}
-
-	nComplete := 0
-	if gs := getGradingSystem(c, sy, class, subject); gs != nil {
-		cols := gs.description(c, sy, term)
-		hasEditable := false
-		for _, col := range cols {
-			if col.Editable {
-				hasEditable = true
-			}
-		}
-		if !hasEditable {
-			http.Redirect(w, r, redirectURL, http.StatusFound)
-			return
-		}
 
-		students, err := findStudents(c, sy, classSection)
-		if err != nil {
-			log.Errorf(c, "Could not retrieve students: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-
-		for _, s := range students {
-			if !gs.inStream(s.Stream) {
-				continue
-			}
-			marksRecord, ok := csvMarks[s.ID]
-			if !ok {
-				log.Errorf(c, "Student not found in class: %s", s.ID)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			delete(csvMarks, s.ID)
-			if marksRecord[0] != s.Name {
-				log.Errorf(c, "Student ID does not match name in csv: %s, %s", s.ID, marksRecord[0])
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			marksRecord = marksRecord[1:]
-			m, err := getStudentMarks(c, s.ID, sy, subject)
-			if err != nil {
-				log.Errorf(c, "Could not get student marks: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			gs.evaluate(c, s.ID, sy, term, m) // TODO: check error
-
-			marksChanged := false
-			for i, col := range cols {
-				v, err := strconv.ParseFloat(marksRecord[i], 64)
-				if err != nil || v > col.Max {
-					// invalid or empty marks
-					v = math.NaN()
-				}
-				if m[term][i] != v {
-					marksChanged = true
-					m[term][i] = v
-				}
-
-			}
-			gs.evaluate(c, s.ID, sy, term, m) // TODO: check error
-			if marksChanged {
-				err := storeMarksRow(c, s.ID, sy, term, subject, m, gs)
-				if err != nil {
-					log.Errorf(c, "Could not store marks: %s", err)
-					renderError(w, r, http.StatusInternalServerError)
-					return
-				}
-			}
-			if gs.ready(term, m) {
-				nComplete++
-			}
-		}
-	} else if subject == "Remarks" {
-		students, err := findStudents(c, sy, classSection)
-		if err != nil {
-			log.Errorf(c, "Could not get students: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-
-		for _, s := range students {
-			marksRecord, ok := csvMarks[s.ID]
-			if !ok {
-				log.Errorf(c, "Student not found in class: %s", s.ID)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			delete(csvMarks, s.ID)
-			if marksRecord[0] != s.Name {
-				log.Errorf(c, "Student ID does not match name in csv: %s, %s", s.ID, marksRecord[0])
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			marksRecord = marksRecord[1:]
-			remark := marksRecord[0]
-			if remark == "" {
-				// no remark to update
-				continue
-			}
-
-			err = storeRemark(c, s.ID, sy, term, remark)
-			if err != nil {
-				log.Errorf(c, "Could not store remark: %s", err)
-				renderError(w, r, http.StatusInternalServerError)
-				return
-			}
-			nComplete++
+	if r.Form.Get("format") == "xlsx" {
+		setXLSXHeaders(w, "Marks-"+filename)
+		if err := writeMarksXLSX(w, term, classSection, subject, cols, studentRows); err != nil {
+			log.Errorf(c, "Error writing xlsx: %s", err)
 		}
+		return
 	}
 
-	err = storeCompletion(c, classSection, term, subject, nComplete)
-	if err != nil {
-		log.Errorf(c, "Could not store completion: %s", err)
-	}
+	w.Header().Set("Content-Type", "text/csv")
+	// Force save as with filename
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment;filename=Marks-%s.csv", filename))
 
-	// TODO: message of success/fail
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	if err := writeMarksCSV(w, term, classSection, subject, cols, studentRows); err != nil {
+		log.Errorf(c, "Error writing csv: %s", err)
+	}
 }
 
 func subjectsMapHandler(w http.ResponseWriter, r *http.Request) {
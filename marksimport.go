@@ -0,0 +1,520 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	http.HandleFunc("/marks/import/commit", accessHandler(marksImportCommitHandler))
+}
+
+// readMarksFile reads a CSV or XLSX file written by writeMarksCSV
+func readMarksFile(filename string, r io.Reader) ([][]string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(strings.ToLower(filename), ".xlsx") || isXLSX(data) {
+		return readXLSX(data)
+	}
+
+	csvr := csv.NewReader(bytes.NewReader(data))
+	csvr.LazyQuotes = true
+	csvr.TrailingComma = true
+	csvr.FieldsPerRecord = -1
+	records, err := csvr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// marksImportCell is a mark or a remark in an imported file
+type marksImportCell struct {
+	Old     string
+	New     string
+	Changed bool
+	Error   string
+}
+
+// marksImportRow is a row of an imported file
+type marksImportRow struct {
+	Row   int // in the file
+	ID    string
+	Name  string
+	Cells []marksImportCell
+
+	Errors   []string
+	Warnings []string
+
+	marks []float64
+}
+
+// marksImport is the preview of importing a file. The file can be imported
+// only if there are no errors.
+type marksImport struct {
+	Term         Term
+	ClassSection string
+	Subject      string
+
+	Cols    []colDescription
+	Rows    []marksImportRow
+	Missing []studentClass // students of the class section not in the file
+
+	Errors  int
+	Changes int
+}
+
+// marksImportColumns returns the columns of the imported file and the
+// expected first two rows of the file
+func marksImportColumns(c context.Context, sy string, term Term, classSection, subject string) ([]colDescription, []string, []string, error) {
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	filename := fmt.Sprintf("%s-%s-%s", term, classSection, subject)
+	fieldNames := []string{filename, "Student Name"}
+	fieldMax := []string{"Do not modify this column", ""}
+	var cols []colDescription
+	if subject == "Remarks" {
+		cols = []colDescription{{Name: "Remarks", Editable: true}}
+		fieldNames = append(fieldNames, "Remarks")
+		fieldMax = append(fieldMax, formatMark(0))
+	} else if gs := getGradingSystem(c, sy, class, subject); gs != nil {
+		cols = gs.description(c, sy, term)
+		for _, col := range cols {
+			fieldNames = append(fieldNames, col.Name)
+			fieldMax = append(fieldMax, maxAndWeight(col.Max, col.FinalWeight))
+		}
+	} else {
+		return nil, nil, nil, fmt.Errorf("Class %s does not have subject %s", class, subject)
+	}
+
+	return cols, fieldNames, fieldMax, nil
+}
+
+// checkMarksHeader returns an error if record is not the expected row of the
+// header. Numbers are compared by value, so 10 and 10.00 are equal.
+func checkMarksHeader(record, expected []string) error {
+	for i, expectedStr := range expected {
+		recordStr := record[i]
+		recordNum, recordErr := strconv.ParseFloat(recordStr, 64)
+		expectedNum, expectedErr := strconv.ParseFloat(expectedStr, 64)
+		if recordErr == nil && expectedErr == nil {
+			if recordNum != expectedNum {
+				return fmt.Errorf("Invalid file header: %q. Expected: %q", record, expected)
+			}
+		} else if recordStr != expectedStr {
+			return fmt.Errorf("Invalid file header: %q. Expected: %q", record, expected)
+		}
+	}
+	return nil
+}
+
+// previewMarksImport compares the marks in records with the stored marks.
+// It returns an error if the file is not for the term, class section and
+// subject.
+func previewMarksImport(c context.Context, sy string, term Term, classSection, subject string, records [][]string) (marksImport, error) {
+	mi := marksImport{
+		Term:         term,
+		ClassSection: classSection,
+		Subject:      subject,
+	}
+
+	cols, fieldNames, fieldMax, err := marksImportColumns(c, sy, term, classSection, subject)
+	if err != nil {
+		return mi, err
+	}
+	mi.Cols = cols
+
+	// Spreadsheets could add or remove empty cells at the end
+	width := len(fieldNames)
+	for i, record := range records {
+		for len(record) > width && strings.TrimSpace(record[len(record)-1]) == "" {
+			record = record[:len(record)-1]
+		}
+		for len(record) < width {
+			record = append(record, "")
+		}
+		records[i] = record
+	}
+
+	if len(records) < 2 {
+		return mi, fmt.Errorf("The file has no header")
+	}
+	if err := checkMarksHeader(records[0], fieldNames); err != nil {
+		return mi, err
+	}
+	if err := checkMarksHeader(records[1], fieldMax); err != nil {
+		return mi, err
+	}
+
+	students, err := findStudents(c, sy, classSection)
+	if err != nil {
+		return mi, fmt.Errorf("Could not retrieve students: %s", err)
+	}
+	studentsMap := make(map[string]studentClass)
+	for _, s := range students {
+		studentsMap[s.ID] = s
+	}
+
+	class, _, _ := parseClassSection(classSection)
+	var gs gradingSystem
+	if subject != "Remarks" {
+		gs = getGradingSystem(c, sy, class, subject)
+	}
+
+	seen := make(map[string]bool)
+	for i, record := range records[2:] {
+		if strings.Join(record, "") == "" {
+			// empty row
+			continue
+		}
+
+		row := marksImportRow{
+			Row:  i + 3,
+			ID:   strings.TrimSpace(record[0]),
+			Name: record[1],
+		}
+		addError := func(format string, a ...interface{}) {
+			row.Errors = append(row.Errors, fmt.Sprintf(format, a...))
+			mi.Errors++
+		}
+
+		s, ok := studentsMap[row.ID]
+		switch {
+		case len(record) > width:
+			addError("Too many columns")
+		case !ok:
+			addError("Student %s is not in %s", row.ID, classSection)
+		case seen[row.ID]:
+			addError("Student %s is repeated", row.ID)
+		case record[1] != s.Name:
+			addError("Student name does not match: %s", s.Name)
+		case gs != nil && !gs.inStream(s.Stream):
+			row.Warnings = append(row.Warnings, fmt.Sprintf("Not in the %s stream of the subject. The row is ignored.", s.Stream))
+		}
+		seen[row.ID] = true
+
+		if len(row.Errors) > 0 || len(row.Warnings) > 0 {
+			mi.Rows = append(mi.Rows, row)
+			continue
+		}
+
+		values := record[2:]
+		if gs == nil {
+			// Remarks
+			old, err := getStudentRemark(c, sy, s.ID, term)
+			if err != nil {
+				return mi, err
+			}
+			cell := marksImportCell{Old: old, New: values[0]}
+			// Empty remarks are not imported
+			cell.Changed = values[0] != "" && values[0] != old
+			if cell.Changed {
+				mi.Changes++
+			}
+			row.Cells = append(row.Cells, cell)
+			mi.Rows = append(mi.Rows, row)
+			continue
+		}
+
+		var m studentMarks
+		if term.Typ == WeekS1 || term.Typ == WeekS2 {
+			m = make(studentMarks)
+		} else {
+			m, err = getStudentMarks(c, s.ID, sy, subject)
+			if err != nil {
+				return mi, fmt.Errorf("Could not get student marks: %s", err)
+			}
+		}
+		gs.evaluate(c, s.ID, sy, term, m) // TODO: check error
+
+		row.marks = make([]float64, len(cols))
+		for j, col := range cols {
+			old := m[term][j]
+			cell := marksImportCell{Old: formatMark(old), New: strings.TrimSpace(values[j])}
+			row.marks[j] = old
+			if !col.Editable {
+				// calculated
+				cell.New = cell.Old
+				row.Cells = append(row.Cells, cell)
+				continue
+			}
+
+			v := math.NaN()
+			if cell.New != "" {
+				v, err = strconv.ParseFloat(cell.New, 64)
+				switch {
+				case err != nil:
+					cell.Error = "Not a number"
+				case v < 0 || v > col.Max:
+					cell.Error = fmt.Sprintf("Must be from 0 to %s", formatMarkTrim(col.Max))
+				}
+			}
+			if cell.Error != "" {
+				mi.Errors++
+			} else if old != v && !(math.IsNaN(old) && math.IsNaN(v)) {
+				cell.Changed = true
+				cell.New = formatMark(v)
+				row.marks[j] = v
+				mi.Changes++
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+
+		mi.Rows = append(mi.Rows, row)
+	}
+
+	for _, s := range students {
+		if gs != nil && !gs.inStream(s.Stream) {
+			continue
+		}
+		if !seen[s.ID] {
+			mi.Missing = append(mi.Missing, s)
+			mi.Errors++
+		}
+	}
+
+	return mi, nil
+}
+
+// applyMarksImport stores the marks in records if they have no errors
+func applyMarksImport(c context.Context, sy string, term Term, classSection, subject string, records [][]string) error {
+	mi, err := previewMarksImport(c, sy, term, classSection, subject, records)
+	if err != nil {
+		return err
+	}
+	if mi.Errors > 0 {
+		return fmt.Errorf("The file has %d errors", mi.Errors)
+	}
+
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		return err
+	}
+
+	nComplete := 0
+	if subject == "Remarks" {
+		for _, row := range mi.Rows {
+			cell := row.Cells[0]
+			if cell.Changed {
+				if err := storeRemark(c, row.ID, sy, term, cell.New); err != nil {
+					return fmt.Errorf("Could not store remark: %s", err)
+				}
+			}
+			if cell.New != "" || cell.Old != "" {
+				nComplete++
+			}
+		}
+	} else if gs := getGradingSystem(c, sy, class, subject); gs != nil {
+		hasEditable := false
+		for _, col := range mi.Cols {
+			if col.Editable {
+				hasEditable = true
+			}
+		}
+		if !hasEditable {
+			return nil
+		}
+
+		anyChanged := false
+		for _, row := range mi.Rows {
+			if row.marks == nil {
+				// not in the stream
+				continue
+			}
+
+			var m studentMarks
+			if term.Typ == WeekS1 || term.Typ == WeekS2 {
+				m = make(studentMarks)
+			} else {
+				m, err = getStudentMarks(c, row.ID, sy, subject)
+				if err != nil {
+					return fmt.Errorf("Could not get student marks: %s", err)
+				}
+			}
+			gs.evaluate(c, row.ID, sy, term, m) // TODO: check error
+
+			marksChanged := false
+			for i, cell := range row.Cells {
+				if cell.Changed {
+					marksChanged = true
+					m[term][i] = row.marks[i]
+				}
+			}
+			gs.evaluate(c, row.ID, sy, term, m) // TODO: check error
+			if marksChanged {
+				anyChanged = true
+				err := storeMarksRow(c, row.ID, sy, term, subject, m, gs)
+				if err != nil {
+					return fmt.Errorf("Could not store marks: %s", err)
+				}
+			}
+			if gs.ready(term, m) {
+				nComplete++
+			}
+		}
+
+		// Reviewed marks are reviewed again after they are changed
+		if anyChanged {
+			if err := resubmitMarksReview(c, sy, classSection, term, subject); err != nil {
+				return fmt.Errorf("Could not resubmit marks review: %s", err)
+			}
+		}
+	}
+
+	if err := storeCompletion(c, sy, classSection, term, subject, nComplete); err != nil {
+		log.Errorf(c, "Could not store completion: %s", err)
+	}
+
+	return nil
+}
+
+func marksImportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	err := r.ParseMultipartForm(1e6)
+	if err != nil {
+		log.Errorf(c, "Could not parse multipart form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	} else if r.MultipartForm == nil || len(r.MultipartForm.File["csvfile"]) != 1 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "No file uploaded")
+		return
+	}
+
+	f := url.Values(r.MultipartForm.Value)
+	term, err1 := parseTerm(f.Get("Term"))
+	subject := f.Get("Subject")
+	classSection := f.Get("ClassSection")
+	_, _, err2 := parseClassSection(classSection)
+	if err1 != nil || subject == "" || err2 != nil {
+		log.Errorf(c, "Could not import marks: Term err: %s, subject: %q, classSection err: %s",
+			err1, subject, err2)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permMarksEdit, "", classSection, subject) {
+		return
+	}
+
+	fileHeader := r.MultipartForm.File["csvfile"][0]
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Errorf(c, "Could not open uploaded file: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	records, err := readMarksFile(fileHeader.Filename, file)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, fmt.Sprintf("Could not read file: %s", err))
+		return
+	}
+
+	mi, err := previewMarksImport(c, sy, term, classSection, subject, records)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	recordsJSON, err := json.Marshal(records)
+	if err != nil {
+		log.Errorf(c, "Could not encode records: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		marksImport
+		Records string
+	}{
+		mi,
+		string(recordsJSON),
+	}
+
+	if err := render(w, r, "marksimport", data); err != nil {
+		log.Errorf(c, "Could not render template marksimport: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func marksImportCommitHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	f := r.PostForm
+	term, err1 := parseTerm(f.Get("Term"))
+	subject := f.Get("Subject")
+	classSection := f.Get("ClassSection")
+	_, _, err2 := parseClassSection(classSection)
+	if err1 != nil || subject == "" || err2 != nil {
+		log.Errorf(c, "Could not import marks: Term err: %s, subject: %q, classSection err: %s",
+			err1, subject, err2)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permMarksEdit, "", classSection, subject) {
+		return
+	}
+
+	// used for redirecting
+	urlValues := url.Values{
+		"Term":         []string{term.Value()},
+		"ClassSection": []string{classSection},
+		"Subject":      []string{subject},
+	}
+	redirectURL := fmt.Sprintf("/marks?%s", urlValues.Encode())
+
+	var records [][]string
+	if err := json.Unmarshal([]byte(f.Get("Records")), &records); err != nil {
+		log.Errorf(c, "Could not decode records: %s", err)
+		renderError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// The marks are checked again, in case they were changed since the preview
+	if err := applyMarksImport(c, sy, term, classSection, subject, records); err != nil {
+		log.Errorf(c, "Could not import marks: %s", err)
+		renderErrorMsg(w, r, http.StatusBadRequest, fmt.Sprintf("Could not import marks: %s", err))
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
@@ -0,0 +1,392 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/marks/review", accessHandler(marksReviewHandler))
+	http.HandleFunc("/marks/review/save", accessHandler(marksReviewSaveHandler))
+	http.HandleFunc("/settings/hods", accessHandler(settingsHodsHandler))
+}
+
+// headOfDepartment is the teacher who reviews the marks of a subject in all
+// class sections
+type headOfDepartment struct {
+	Subject string
+	Teacher int64
+}
+
+type headsOfDepartmentSetting struct {
+	Value []headOfDepartment
+}
+
+// getHeadsOfDepartment returns the head of department of each subject
+func getHeadsOfDepartment(c context.Context, sy string) map[string]int64 {
+	key := datastore.NewKey(c, "settings", "hods-"+sy, 0, nil)
+
+	setting := headsOfDepartmentSetting{}
+	if err := nds.Get(c, key, &setting); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Could not get heads of department: %s", err)
+	}
+
+	hods := make(map[string]int64)
+	for _, hod := range setting.Value {
+		hods[hod.Subject] = hod.Teacher
+	}
+	return hods
+}
+
+func saveHeadsOfDepartment(c context.Context, sy string, hods []headOfDepartment) error {
+	key := datastore.NewKey(c, "settings", "hods-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &headsOfDepartmentSetting{hods})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// hodSubjects returns the subjects of which the employee is the head of
+// department
+func hodSubjects(c context.Context, sy string, employee int64) []string {
+	var subjects []string
+	for subject, teacher := range getHeadsOfDepartment(c, sy) {
+		if teacher == employee {
+			subjects = append(subjects, subject)
+		}
+	}
+	return subjects
+}
+
+type marksReviewStatus string
+
+const (
+	reviewPending     marksReviewStatus = ""
+	reviewApproved    marksReviewStatus = "Approved"
+	reviewReturned    marksReviewStatus = "Returned"
+	reviewResubmitted marksReviewStatus = "Resubmitted"
+)
+
+// Context returns the bootstrap contextual class of the status
+func (s marksReviewStatus) Context() string {
+	switch s {
+	case reviewApproved:
+		return "success"
+	case reviewReturned:
+		return "warning"
+	}
+	return "info"
+}
+
+// marksReview is the review of the marks of a subject in a class section.
+// It will be stored in the datastore.
+type marksReview struct {
+	SY           string
+	ClassSection string
+	Term         string
+	Subject      string
+
+	Status   marksReviewStatus
+	Comments string `datastore:",noindex"`
+	Reviewer string
+	Time     time.Time
+}
+
+func marksReviewKey(c context.Context, sy, classSection string, term Term, subject string) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%s|%s|%s", sy, classSection, term.Value(), subject)
+	return datastore.NewKey(c, "marksreview", keyStr, 0, nil)
+}
+
+func getMarksReview(c context.Context, sy, classSection string, term Term, subject string) (marksReview, error) {
+	var review marksReview
+	err := nds.Get(c, marksReviewKey(c, sy, classSection, term, subject), &review)
+	if err == datastore.ErrNoSuchEntity {
+		return review, nil
+	}
+	return review, err
+}
+
+// getMarksReviews returns the reviews of term, by class section and subject
+func getMarksReviews(c context.Context, sy string, term Term) (map[string]map[string]marksReview, error) {
+	q := datastore.NewQuery("marksreview").
+		Filter("SY =", sy).
+		Filter("Term =", term.Value())
+
+	var reviews []marksReview
+	if _, err := q.GetAll(c, &reviews); err != nil {
+		return nil, err
+	}
+
+	reviewsMap := make(map[string]map[string]marksReview)
+	for _, review := range reviews {
+		if reviewsMap[review.ClassSection] == nil {
+			reviewsMap[review.ClassSection] = make(map[string]marksReview)
+		}
+		reviewsMap[review.ClassSection][review.Subject] = review
+	}
+	return reviewsMap, nil
+}
+
+// resubmitMarksReview marks a reviewed subject as resubmitted after its marks
+// are changed, so it is reviewed again
+func resubmitMarksReview(c context.Context, sy, classSection string, term Term, subject string) error {
+	review, err := getMarksReview(c, sy, classSection, term, subject)
+	if err != nil {
+		return err
+	}
+	if review.Status != reviewApproved && review.Status != reviewReturned {
+		return nil
+	}
+
+	review.Status = reviewResubmitted
+	_, err = nds.Put(c, marksReviewKey(c, sy, classSection, term, subject), &review)
+	return err
+}
+
+// assignedTeacherEmails returns the emails of the teachers assigned to the
+// subject in the class section
+func assignedTeacherEmails(c context.Context, sy, classSection, subject string) ([]string, error) {
+	assigns, err := getAllAssignments(c, sy)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []string
+	for _, assign := range assigns {
+		if assign.ClassSection != classSection || assign.Subject != subject {
+			continue
+		}
+		emp, err := getEmployee(c, strconv.FormatInt(assign.Teacher, 10))
+		if err != nil {
+			log.Warningf(c, "Could not get employee %d: %s", assign.Teacher, err)
+			continue
+		}
+		emails = append(emails, emp.CPSEmail)
+	}
+	return emails, nil
+}
+
+type marksReviewRow struct {
+	Subject      string
+	ClassSection string
+	Teachers     []string
+	Completion   int
+	NumStudents  int
+	Review       marksReview
+}
+
+func marksReviewHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, err := parseTerm(r.Form.Get("Term"))
+	if err != nil {
+		term = Term{}
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var rows []marksReviewRow
+	if (term != Term{}) {
+		completionRows, err := getCompletionRows(c, sy, term)
+		if err != nil {
+			log.Errorf(c, "Could not get completion: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		for _, subject := range getAllSubjects(c, sy) {
+			for _, cr := range completionRows {
+				n, ok := cr.NumStudents[subject]
+				if !ok {
+					// class doesn't have subject
+					continue
+				}
+				if !user.Permissions.inScope(permMarksReview, "", cr.Key, subject) {
+					continue
+				}
+				var teachers []string
+				for _, emp := range cr.Teachers[subject] {
+					teachers = append(teachers, emp.Name)
+				}
+				rows = append(rows, marksReviewRow{
+					subject,
+					cr.Key,
+					teachers,
+					cr.Completion[subject],
+					n,
+					cr.Reviews[subject],
+				})
+			}
+		}
+	}
+
+	data := struct {
+		Terms []Term
+		Term  Term
+
+		Rows []marksReviewRow
+	}{
+		terms,
+		term,
+
+		rows,
+	}
+
+	if err := render(w, r, "marksreview", data); err != nil {
+		log.Errorf(c, "Could not render template marksreview: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func marksReviewSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	f := r.PostForm
+
+	term, err := parseTerm(f.Get("Term"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid term")
+		return
+	}
+	classSection := f.Get("ClassSection")
+	if _, _, err := parseClassSection(classSection); err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	subject := f.Get("Subject")
+	comments := strings.TrimSpace(f.Get("Comments"))
+
+	var status marksReviewStatus
+	switch f.Get("action") {
+	case "Approve":
+		status = reviewApproved
+	case "Return":
+		if comments == "" {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Comments are required to return marks")
+			return
+		}
+		status = reviewReturned
+	default:
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid action")
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	review := marksReview{
+		SY:           sy,
+		ClassSection: classSection,
+		Term:         term.Value(),
+		Subject:      subject,
+
+		Status:   status,
+		Comments: comments,
+		Reviewer: user.FullName(),
+		Time:     time.Now(),
+	}
+	if review.Reviewer == "" {
+		review.Reviewer = user.Name
+	}
+
+	key := marksReviewKey(c, sy, classSection, term, subject)
+	if _, err := nds.Put(c, key, &review); err != nil {
+		log.Errorf(c, "Could not save marks review: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	emails, err := assignedTeacherEmails(c, sy, classSection, subject)
+	if err != nil {
+		log.Errorf(c, "Could not get teachers: %s", err)
+	}
+	cs := strings.Replace(classSection, "|", "", 1)
+	notifySubject := fmt.Sprintf("%s %s Marks %s", subject, cs, status)
+	marksURL := fmt.Sprintf("%s/marks?%s", siteURL, url.Values{
+		"Term":         {term.Value()},
+		"ClassSection": {classSection},
+		"Subject":      {subject},
+	}.Encode())
+	notifyBody := fmt.Sprintf("The %s marks of %s for %s were %s by %s.\n\n%s\n\nTo view them, go to: %s",
+		subject, cs, term, strings.ToLower(string(status)), review.Reviewer, comments, marksURL)
+	notify(c, notifyMarksReview, emails, notifySubject, notifyBody)
+
+	// TODO: message of success
+	http.Redirect(w, r, "/marks/review?Term="+term.Value(), http.StatusFound)
+}
+
+func settingsHodsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var hods []headOfDepartment
+	for _, subject := range getAllSubjects(c, sy) {
+		teacherStr := r.PostForm.Get("hod-" + subject)
+		if teacherStr == "" {
+			continue
+		}
+		teacher, err := strconv.ParseInt(teacherStr, 10, 64)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid teacher")
+			return
+		}
+		hods = append(hods, headOfDepartment{subject, teacher})
+	}
+
+	if err := saveHeadsOfDepartment(c, sy, hods); err != nil {
+		log.Errorf(c, "Could not save heads of department: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
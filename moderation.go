@@ -0,0 +1,614 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/moderation", accessHandler(moderationHandler))
+	http.HandleFunc("/moderation/save", accessHandler(moderationSaveHandler))
+	http.HandleFunc("/moderation/delete", accessHandler(moderationDeleteHandler))
+}
+
+type moderationType string
+
+const (
+	moderationScale moderationType = "scale"
+	moderationBonus moderationType = "bonus"
+	moderationCap   moderationType = "cap"
+)
+
+var moderationTypes = []moderationType{
+	moderationScale,
+	moderationBonus,
+	moderationCap,
+}
+
+var moderationTypeStrings = map[moderationType]string{
+	moderationScale: "Scale (multiply by)",
+	moderationBonus: "Bonus (add)",
+	moderationCap:   "Cap (maximum mark)",
+}
+
+func (mt moderationType) Value() string {
+	return string(mt)
+}
+
+func (mt moderationType) String() string {
+	str, ok := moderationTypeStrings[mt]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid moderationType: %s", string(mt)))
+}
+
+func parseModerationType(s string) (moderationType, error) {
+	mt := moderationType(s)
+	if _, ok := moderationTypeStrings[mt]; !ok {
+		return "", fmt.Errorf("Invalid moderation type: %s", s)
+	}
+	return mt, nil
+}
+
+// moderation adjusts the marks of a column of a subject. The raw marks are
+// not changed, and the moderation is applied when the marks are evaluated.
+type moderation struct {
+	ID string
+
+	Class      string
+	Section    string // empty for all sections
+	Subject    string
+	Term       string
+	Column     int
+	ColumnName string
+
+	Type  moderationType
+	Value float64
+
+	Created   time.Time
+	CreatedBy string
+}
+
+// apply returns the moderated mark, between 0 and the maximum mark of the
+// column
+func (m moderation) apply(mark, max float64) float64 {
+	if math.IsNaN(mark) {
+		return mark
+	}
+
+	switch m.Type {
+	case moderationScale:
+		mark *= m.Value
+	case moderationBonus:
+		mark += m.Value
+	case moderationCap:
+		mark = math.Min(mark, m.Value)
+	}
+
+	return math.Max(0, math.Min(mark, max))
+}
+
+// matches returns whether the moderation applies to a student of the class
+// section in term
+func (m moderation) matches(class, section, subject string, term Term) bool {
+	return m.Class == class && m.Subject == subject && m.Term == term.Value() &&
+		(m.Section == "" || m.Section == section)
+}
+
+func (m moderation) Description() string {
+	switch m.Type {
+	case moderationScale:
+		return fmt.Sprintf("× %s", formatMarkTrim(m.Value))
+	case moderationBonus:
+		return fmt.Sprintf("+ %s", formatMarkTrim(m.Value))
+	case moderationCap:
+		return fmt.Sprintf("at most %s", formatMarkTrim(m.Value))
+	}
+	return ""
+}
+
+type moderationsSetting struct {
+	Value []moderation
+}
+
+// getModerations returns the moderations of sy in the order they are applied
+func getModerations(c context.Context, sy string) []moderation {
+	key := datastore.NewKey(c, "settings", "moderations-"+sy, 0, nil)
+
+	setting := moderationsSetting{}
+	if err := nds.Get(c, key, &setting); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Could not get moderations: %s", err)
+	}
+
+	return setting.Value
+}
+
+// errModerationNotFound is returned by updateModerations when the
+// moderation to delete doesn't exist
+var errModerationNotFound = errors.New("Moderation not found")
+
+// updateModerations replaces the moderations of sy with the result of
+// update, in a transaction so that concurrent changes are not lost
+func updateModerations(c context.Context, sy string, update func([]moderation) ([]moderation, error)) error {
+	key := datastore.NewKey(c, "settings", "moderations-"+sy, 0, nil)
+	return nds.RunInTransaction(c, func(c context.Context) error {
+		setting := moderationsSetting{}
+		if err := nds.Get(c, key, &setting); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		moderations, err := update(setting.Value)
+		if err != nil {
+			return err
+		}
+		_, err = nds.Put(c, key, &moderationsSetting{moderations})
+		return err
+	}, nil)
+}
+
+// refreshModeratedMarks evaluates and stores the marks of the students of
+// mod after it is added or deleted. The semester and end of year marks are
+// stored with them.
+func refreshModeratedMarks(c context.Context, sy string, mod moderation) error {
+	term, err := parseTerm(mod.Term)
+	if err != nil {
+		return err
+	}
+	gs := getGradingSystem(c, sy, mod.Class, mod.Subject)
+	if gs == nil {
+		return fmt.Errorf("Invalid class or subject: %s %s", mod.Class, mod.Subject)
+	}
+
+	for _, section := range getClassSections(c, sy)[mod.Class] {
+		if mod.Section != "" && mod.Section != section {
+			continue
+		}
+		students, err := findStudents(c, sy, mod.Class+"|"+section)
+		if err != nil {
+			return err
+		}
+		for _, s := range students {
+			if !gs.inStream(s.Stream) {
+				continue
+			}
+			if err := refreshStudentMarks(c, s.ID, sy, mod.Subject, term, gs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adjustableTerm returns whether the marks of term can be moderated or have
+// re-sits and make-ups. The other terms are copied to later terms from the
+// raw marks.
+func adjustableTerm(term Term) bool {
+	return term.Typ == Quarter || term.Typ == Semester
+}
+
+// moderate applies the moderations of the subject to the marks of the
+// student in term. It returns the raw marks of the moderated columns.
+func (s Subject) moderate(c context.Context, studentID, sy string, term Term, m []float64, cols []colDescription) map[int]float64 {
+	if !adjustableTerm(term) {
+		return nil
+	}
+
+	var moderations []moderation
+	for _, mod := range getModerations(c, sy) {
+		if mod.Subject == s.ShortName && mod.Term == term.Value() {
+			moderations = append(moderations, mod)
+		}
+	}
+	if len(moderations) == 0 {
+		return nil
+	}
+
+	sc, err := getStudentClass(c, studentID, sy)
+	if err != nil {
+		log.Warningf(c, "Could not get class of %s: %s", studentID, err)
+		return nil
+	}
+
+	raw := make(map[int]float64)
+	for _, mod := range moderations {
+		if !mod.matches(sc.Class, sc.Section, s.ShortName, term) {
+			continue
+		}
+		if mod.Column < 0 || mod.Column >= len(m) || !cols[mod.Column].Editable {
+			continue
+		}
+		if _, ok := raw[mod.Column]; !ok {
+			raw[mod.Column] = m[mod.Column]
+		}
+		m[mod.Column] = mod.apply(m[mod.Column], cols[mod.Column].Max)
+	}
+
+	return raw
+}
+
+// moderationStats are the statistics of a column before or after a moderation
+type moderationStats struct {
+	Name      string
+	N         int
+	Mean      float64
+	Median    float64
+	StdDev    float64
+	PassRate  float64
+	Histogram []int
+}
+
+func newModerationStats(name string, cs columnStats) moderationStats {
+	sort.Float64s(cs.Marks)
+	return moderationStats{
+		name,
+		len(cs.Marks),
+		cs.mean(),
+		cs.median(),
+		cs.stdDev(),
+		cs.passRate(),
+		cs.histogram(),
+	}
+}
+
+// previewModeration returns the statistics of the column of the class
+// sections before and after mod, and the number of changed marks. Existing
+// moderations are applied in both.
+func previewModeration(c context.Context, sy string, gs Subject, mod moderation, cols []colDescription) ([]moderationStats, int, error) {
+	term, err := parseTerm(mod.Term)
+	if err != nil {
+		return nil, 0, err
+	}
+	col := cols[mod.Column]
+
+	var existing []moderation
+	for _, em := range getModerations(c, sy) {
+		if em.Column == mod.Column {
+			existing = append(existing, em)
+		}
+	}
+
+	before := columnStats{Max: col.Max}
+	after := columnStats{Max: col.Max}
+	changed := 0
+
+	for _, section := range getClassSections(c, sy)[mod.Class] {
+		if mod.Section != "" && mod.Section != section {
+			continue
+		}
+		students, err := findStudents(c, sy, mod.Class+"|"+section)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, s := range students {
+			if !gs.inStream(s.Stream) {
+				continue
+			}
+			marks, err := getStudentMarks(c, s.ID, sy, mod.Subject)
+			if err != nil {
+				return nil, 0, err
+			}
+			m := marks[term]
+			if len(m) != len(cols) {
+				before.add(math.NaN())
+				after.add(math.NaN())
+				continue
+			}
+
+			mark := m[mod.Column]
+			if mark < 0 || mark > col.Max {
+				mark = math.NaN()
+			}
+			for _, em := range existing {
+				if em.matches(s.Class, s.Section, mod.Subject, term) {
+					mark = em.apply(mark, col.Max)
+				}
+			}
+			moderated := mod.apply(mark, col.Max)
+
+			before.add(mark)
+			after.add(moderated)
+			if !math.IsNaN(mark) && mark != moderated {
+				changed++
+			}
+		}
+	}
+
+	stats := []moderationStats{
+		newModerationStats("Before", before),
+		newModerationStats("After", after),
+	}
+
+	return stats, changed, nil
+}
+
+// parseModeration returns the moderation in the form, with its subject and
+// columns
+func parseModeration(c context.Context, sy string, f url.Values) (moderation, Subject, []colDescription, error) {
+	var mod moderation
+
+	term, err := parseTerm(f.Get("Term"))
+	if err != nil || !adjustableTerm(term) {
+		return mod, Subject{}, nil, fmt.Errorf("Only quarter and semester marks can be moderated")
+	}
+
+	class := f.Get("Class")
+	subject := f.Get("Subject")
+	gs, ok := getGradingSystem(c, sy, class, subject).(Subject)
+	if !ok {
+		return mod, Subject{}, nil, fmt.Errorf("Invalid class or subject")
+	}
+	cols := gs.description(c, sy, term)
+
+	column, err := strconv.Atoi(f.Get("Column"))
+	if err != nil || column < 0 || column >= len(cols) || !cols[column].Editable {
+		return mod, gs, cols, fmt.Errorf("Invalid column")
+	}
+
+	section := f.Get("Section")
+	if section != "" && !containsString(getClassSections(c, sy)[class], section) {
+		return mod, gs, cols, fmt.Errorf("Invalid section")
+	}
+
+	typ, err := parseModerationType(f.Get("Type"))
+	if err != nil {
+		return mod, gs, cols, err
+	}
+
+	value, err := strconv.ParseFloat(f.Get("Value"), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) ||
+		(typ == moderationScale && value <= 0) || (typ == moderationCap && value < 0) {
+		return mod, gs, cols, fmt.Errorf("Invalid value")
+	}
+
+	mod = moderation{
+		Class:      class,
+		Section:    section,
+		Subject:    subject,
+		Term:       term.Value(),
+		Column:     column,
+		ColumnName: cols[column].Name,
+		Type:       typ,
+		Value:      value,
+	}
+
+	return mod, gs, cols, nil
+}
+
+func moderationURL(class, subject string, term Term) string {
+	return "/moderation?" + url.Values{
+		"Class":   {class},
+		"Subject": {subject},
+		"Term":    {term.Value()},
+	}.Encode()
+}
+
+func moderationHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	class := r.Form.Get("Class")
+	subject := r.Form.Get("Subject")
+	term, err := parseTerm(r.Form.Get("Term"))
+	if err != nil || !adjustableTerm(term) {
+		term = Term{}
+	}
+
+	var cols []colDescription
+	var moderations []moderation
+	var stats []moderationStats
+	var changed int
+	var previewErr string
+
+	if class != "" && subject != "" && (term != Term{}) {
+		if gs, ok := getGradingSystem(c, sy, class, subject).(Subject); ok {
+			cols = gs.description(c, sy, term)
+		}
+
+		for _, mod := range getModerations(c, sy) {
+			if mod.Class == class && mod.Subject == subject && mod.Term == term.Value() {
+				moderations = append(moderations, mod)
+			}
+		}
+
+		if r.Form.Get("action") == "Preview" {
+			mod, gs, cols, err := parseModeration(c, sy, r.Form)
+			if err != nil {
+				previewErr = err.Error()
+			} else {
+				stats, changed, err = previewModeration(c, sy, gs, mod, cols)
+				if err != nil {
+					log.Errorf(c, "Could not preview moderation: %s", err)
+					renderError(w, r, http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+
+	var moderatedTerms []Term
+	for _, t := range terms {
+		if adjustableTerm(t) {
+			moderatedTerms = append(moderatedTerms, t)
+		}
+	}
+
+	var buckets []string
+	for i, bucket := range distributionBuckets {
+		if i == len(distributionBuckets)-1 {
+			buckets = append(buckets, fmt.Sprintf("%g - 100%%", bucket))
+		} else {
+			buckets = append(buckets, fmt.Sprintf("%g - %g%%", bucket, distributionBuckets[i+1]))
+		}
+	}
+
+	data := struct {
+		Classes  []string
+		Subjects []string
+		Terms    []Term
+		Types    []moderationType
+
+		Class    string
+		Subject  string
+		Term     Term
+		Sections []string
+		Cols     []colDescription
+
+		// the moderation being previewed
+		Form url.Values
+
+		Moderations []moderation
+		Buckets     []string
+		Stats       []moderationStats
+		Changed     int
+		PreviewErr  string
+	}{
+		getClasses(c, sy),
+		getAllSubjects(c, sy),
+		moderatedTerms,
+		moderationTypes,
+
+		class,
+		subject,
+		term,
+		getClassSections(c, sy)[class],
+		cols,
+
+		r.Form,
+
+		moderations,
+		buckets,
+		stats,
+		changed,
+		previewErr,
+	}
+
+	if err := render(w, r, "moderation", data); err != nil {
+		log.Errorf(c, "Could not render template moderation: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func moderationSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	mod, _, _, err := parseModeration(c, sy, r.PostForm)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	mod.Created = time.Now()
+	mod.CreatedBy = user.Email
+	mod.ID = strconv.FormatInt(mod.Created.UnixNano(), 36)
+
+	err = updateModerations(c, sy, func(moderations []moderation) ([]moderation, error) {
+		return append(moderations, mod), nil
+	})
+	if err != nil {
+		log.Errorf(c, "Could not save moderations: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if err := refreshModeratedMarks(c, sy, mod); err != nil {
+		log.Errorf(c, "Could not refresh moderated marks: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, _ := parseTerm(mod.Term)
+	log.Infof(c, "%s moderated %s %s %s %s: %s %s", user.Email, mod.Class, mod.Section,
+		mod.Subject, mod.Term, mod.ColumnName, mod.Description())
+
+	// TODO: message of success
+	http.Redirect(w, r, moderationURL(mod.Class, mod.Subject, term), http.StatusFound)
+}
+
+func moderationDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	id := r.PostForm.Get("ID")
+
+	var deleted moderation
+	err := updateModerations(c, sy, func(moderations []moderation) ([]moderation, error) {
+		deleted = moderation{}
+		var kept []moderation
+		for _, mod := range moderations {
+			if mod.ID == id {
+				deleted = mod
+				continue
+			}
+			kept = append(kept, mod)
+		}
+		if deleted.ID == "" {
+			return nil, errModerationNotFound
+		}
+		return kept, nil
+	})
+	if err == errModerationNotFound {
+		renderErrorMsg(w, r, http.StatusNotFound, "Moderation not found")
+		return
+	} else if err != nil {
+		log.Errorf(c, "Could not save moderations: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if err := refreshModeratedMarks(c, sy, deleted); err != nil {
+		log.Errorf(c, "Could not refresh moderated marks: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, _ := parseTerm(deleted.Term)
+
+	// TODO: message of success
+	http.Redirect(w, r, moderationURL(deleted.Class, deleted.Subject, term), http.StatusFound)
+}
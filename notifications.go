@@ -0,0 +1,465 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/notifications", accessHandler(notificationsHandler))
+	http.HandleFunc("/notifications/save", accessHandler(notificationsSaveHandler))
+
+	// Protected by "login: admin" in app.yaml
+	http.HandleFunc("/cron/notifications/digest", notificationsDigestHandler)
+}
+
+const siteURL = "https://creativity-private-school-2015.appspot.com"
+
+type notificationEvent string
+
+const (
+	notifyHomework       notificationEvent = "homework"
+	notifyDocument       notificationEvent = "document"
+	notifyDailylog       notificationEvent = "dailylog"
+	notifyDailylogWeekly notificationEvent = "dailylogweekly"
+	notifyLeave          notificationEvent = "leave"
+	notifyReportcard     notificationEvent = "reportcard"
+	notifyMarksReview    notificationEvent = "marksreview"
+	notifyDiscipline     notificationEvent = "discipline"
+	notifyLessonPlan     notificationEvent = "lessonplan"
+	notifyQuiz           notificationEvent = "quiz"
+)
+
+var notificationEvents = []notificationEvent{
+	notifyHomework,
+	notifyDocument,
+	notifyDailylog,
+	notifyDailylogWeekly,
+	notifyLeave,
+	notifyReportcard,
+	notifyMarksReview,
+	notifyDiscipline,
+	notifyLessonPlan,
+	notifyQuiz,
+}
+
+var notificationEventStrings = map[notificationEvent]string{
+	notifyHomework:       "New Homework",
+	notifyDocument:       "New Documents",
+	notifyDailylog:       "Daily Log Entries",
+	notifyDailylogWeekly: "Daily Log Weekly Summaries",
+	notifyLeave:          "Leave Request Decisions",
+	notifyReportcard:     "Published Report Cards",
+	notifyMarksReview:    "Marks Reviews",
+	notifyDiscipline:     "Discipline Incidents",
+	notifyLessonPlan:     "Lesson Plan Reviews",
+	notifyQuiz:           "New Quizzes",
+}
+
+func (ne notificationEvent) Value() string {
+	return string(ne)
+}
+
+func (ne notificationEvent) String() string {
+	str, ok := notificationEventStrings[ne]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid notificationEvent: %s", string(ne)))
+}
+
+type notificationDelivery string
+
+const (
+	deliverImmediate notificationDelivery = "I"
+	deliverDigest    notificationDelivery = "D"
+	deliverOff       notificationDelivery = "O"
+)
+
+var notificationDeliveries = []notificationDelivery{
+	deliverImmediate,
+	deliverDigest,
+	deliverOff,
+}
+
+var notificationDeliveryStrings = map[notificationDelivery]string{
+	deliverImmediate: "Immediately",
+	deliverDigest:    "Daily Digest",
+	deliverOff:       "Off",
+}
+
+func (nd notificationDelivery) Value() string {
+	return string(nd)
+}
+
+func (nd notificationDelivery) String() string {
+	str, ok := notificationDeliveryStrings[nd]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid notificationDelivery: %s", string(nd)))
+}
+
+// defaultNotificationDelivery is used when the user has not chosen a
+// delivery for an event. Documents and daily logs were always sent
+// immediately, so they are kept that way.
+var defaultNotificationDelivery = map[notificationEvent]notificationDelivery{
+	notifyHomework:       deliverDigest,
+	notifyDocument:       deliverImmediate,
+	notifyDailylog:       deliverImmediate,
+	notifyDailylogWeekly: deliverImmediate,
+	notifyLeave:          deliverImmediate,
+	notifyReportcard:     deliverImmediate,
+	notifyMarksReview:    deliverImmediate,
+	notifyDiscipline:     deliverImmediate,
+	notifyLessonPlan:     deliverImmediate,
+	notifyQuiz:           deliverDigest,
+}
+
+type notificationPreference struct {
+	Event    notificationEvent
+	Delivery notificationDelivery
+}
+
+type notificationPreferencesSetting struct {
+	Value []notificationPreference
+}
+
+func notificationPreferencesKey(c context.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "notificationprefs", strings.ToLower(email), 0, nil)
+}
+
+func getNotificationPreferences(c context.Context, email string) map[notificationEvent]notificationDelivery {
+	prefs := make(map[notificationEvent]notificationDelivery)
+	for k, v := range defaultNotificationDelivery {
+		prefs[k] = v
+	}
+
+	var setting notificationPreferencesSetting
+	err := nds.Get(c, notificationPreferencesKey(c, email), &setting)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Could not get notification preferences of %s: %s\nUsing defaults instead", email, err)
+	}
+
+	for _, pref := range setting.Value {
+		prefs[pref.Event] = pref.Delivery
+	}
+
+	return prefs
+}
+
+// getNotificationDeliveries returns how each email in emails wants to be
+// notified about event
+func getNotificationDeliveries(c context.Context, event notificationEvent, emails []string) []notificationDelivery {
+	var keys []*datastore.Key
+	for _, email := range emails {
+		keys = append(keys, notificationPreferencesKey(c, email))
+	}
+
+	settings := make([]notificationPreferencesSetting, len(keys))
+	err := nds.GetMulti(c, keys, settings)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for i, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				log.Warningf(c, "Could not get notification preferences of %s: %s\nUsing defaults instead", emails[i], err)
+			}
+		}
+	} else if err != nil {
+		log.Warningf(c, "Could not get notification preferences: %s\nUsing defaults instead", err)
+	}
+
+	deliveries := make([]notificationDelivery, len(emails))
+	for i, setting := range settings {
+		deliveries[i] = defaultNotificationDelivery[event]
+		for _, pref := range setting.Value {
+			if pref.Event == event {
+				deliveries[i] = pref.Delivery
+			}
+		}
+	}
+
+	return deliveries
+}
+
+func saveNotificationPreferences(c context.Context, email string, prefs map[notificationEvent]notificationDelivery) error {
+	var setting notificationPreferencesSetting
+	for _, event := range notificationEvents {
+		delivery, ok := prefs[event]
+		if !ok {
+			continue
+		}
+		setting.Value = append(setting.Value, notificationPreference{event, delivery})
+	}
+
+	_, err := nds.Put(c, notificationPreferencesKey(c, email), &setting)
+	return err
+}
+
+// pendingNotification is a notification waiting for the daily digest
+type pendingNotification struct {
+	Email   string
+	Event   notificationEvent
+	Created time.Time
+	Subject string `datastore:",noindex"`
+	Body    string `datastore:",noindex"`
+}
+
+// notify sends a notification about event to every email in emails
+// according to its owner's preferences. Notifications that are not sent
+// immediately are queued for the daily digest.
+func notify(c context.Context, event notificationEvent, emails []string, subject, body string) {
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, email := range emails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+		recipients = append(recipients, email)
+	}
+
+	var immediate []string
+	var keys []*datastore.Key
+	var pending []pendingNotification
+
+	now := time.Now()
+	deliveries := getNotificationDeliveries(c, event, recipients)
+	for i, email := range recipients {
+		switch deliveries[i] {
+		case deliverImmediate:
+			immediate = append(immediate, email)
+		case deliverDigest:
+			keys = append(keys, datastore.NewIncompleteKey(c, "notification", nil))
+			pending = append(pending, pendingNotification{email, event, now, subject, body})
+		}
+	}
+
+	sendEmails(c, immediate, subject, body)
+
+	if len(keys) > 0 {
+		if _, err := nds.PutMulti(c, keys, pending); err != nil {
+			log.Errorf(c, "Could not queue notifications: %s", err)
+		}
+	}
+}
+
+// studentNotificationEmails returns the emails of the students and of their
+// guardians
+func studentNotificationEmails(c context.Context, ids []string) []string {
+	var emails []string
+	for _, id := range ids {
+		emails = append(emails, studentEmail(id))
+	}
+
+	if len(ids) == 0 {
+		return emails
+	}
+
+	stus, err := getStudentMulti(c, ids)
+	if err != nil {
+		log.Warningf(c, "Could not get guardian emails: %s", err)
+		return emails
+	}
+	for _, stu := range stus {
+		if stu.GuardianEmail != "" {
+			emails = append(emails, stu.GuardianEmail)
+		}
+	}
+
+	return emails
+}
+
+// classNotificationEmails returns the emails of the students in class and
+// of their guardians. See getClassStudentIDs for the format of class
+func classNotificationEmails(c context.Context, class string) []string {
+	return studentNotificationEmails(c, getClassStudentIDs(c, class))
+}
+
+// requesterNotificationEmails returns the emails of the employee or student
+// with the given key, and the guardian's email for students
+func requesterNotificationEmails(c context.Context, requesterKey *datastore.Key) []string {
+	switch requesterKey.Kind() {
+	case "employee":
+		var emp employeeType
+		if err := nds.Get(c, requesterKey, &emp); err != nil {
+			log.Warningf(c, "Could not get employee: %s", err)
+			return nil
+		}
+		return []string{emp.CPSEmail}
+	case "student":
+		return studentNotificationEmails(c, []string{requesterKey.StringID()})
+	}
+
+	log.Warningf(c, "Could not get requester emails: %s", requesterKey)
+	return nil
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var guardianEmail string
+	var guardianPrefs map[notificationEvent]notificationDelivery
+	if user.Student != nil && user.Student.GuardianEmail != "" {
+		guardianEmail = user.Student.GuardianEmail
+		guardianPrefs = getNotificationPreferences(c, guardianEmail)
+	}
+
+	data := struct {
+		Events     []notificationEvent
+		Deliveries []notificationDelivery
+
+		Email string
+		Prefs map[notificationEvent]notificationDelivery
+
+		GuardianEmail string
+		GuardianPrefs map[notificationEvent]notificationDelivery
+	}{
+		notificationEvents,
+		notificationDeliveries,
+
+		user.Email,
+		getNotificationPreferences(c, user.Email),
+
+		guardianEmail,
+		guardianPrefs,
+	}
+
+	if err := render(w, r, "notifications", data); err != nil {
+		log.Errorf(c, "Could not render template notifications: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func parseNotificationPreferences(f map[string][]string, prefix string) map[notificationEvent]notificationDelivery {
+	prefs := make(map[notificationEvent]notificationDelivery)
+	for _, event := range notificationEvents {
+		values := f[prefix+event.Value()]
+		if len(values) == 0 {
+			continue
+		}
+		delivery := notificationDelivery(values[0])
+		if _, ok := notificationDeliveryStrings[delivery]; !ok {
+			continue
+		}
+		prefs[event] = delivery
+	}
+	return prefs
+}
+
+func notificationsSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	prefs := parseNotificationPreferences(r.PostForm, "user-")
+	if err := saveNotificationPreferences(c, user.Email, prefs); err != nil {
+		log.Errorf(c, "Could not save notification preferences: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// Students manage the notifications of their guardians
+	if user.Student != nil && user.Student.GuardianEmail != "" {
+		prefs := parseNotificationPreferences(r.PostForm, "guardian-")
+		if err := saveNotificationPreferences(c, user.Student.GuardianEmail, prefs); err != nil {
+			log.Errorf(c, "Could not save guardian notification preferences: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
+
+func notificationsDigestHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	q := datastore.NewQuery("notification").Order("Created")
+	var pending []pendingNotification
+	keys, err := q.GetAll(c, &pending)
+	if err != nil {
+		log.Errorf(c, "Could not get pending notifications: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	byEmail := make(map[string][]pendingNotification)
+	keysByEmail := make(map[string][]*datastore.Key)
+	for i, n := range pending {
+		byEmail[n.Email] = append(byEmail[n.Email], n)
+		keysByEmail[n.Email] = append(keysByEmail[n.Email], keys[i])
+	}
+
+	var emails []string
+	for email := range byEmail {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	for _, email := range emails {
+		// Preferences could have changed since the notification was queued
+		prefs := getNotificationPreferences(c, email)
+
+		body := new(bytes.Buffer)
+		count := 0
+		for _, n := range byEmail[email] {
+			if prefs[n.Event] == deliverOff {
+				continue
+			}
+			count++
+			fmt.Fprintf(body, "%s (%s)\n%s\n\n", n.Subject, n.Created.Format("2006-01-02 15:04"), n.Body)
+		}
+		if count > 0 {
+			fmt.Fprintf(body, "To change your notification preferences, go to: %s/notifications\n", siteURL)
+			subject := fmt.Sprintf("Daily Digest: %d new notifications", count)
+			sendEmails(c, []string{email}, subject, body.String())
+		}
+
+		if err := nds.DeleteMulti(c, keysByEmail[email]); err != nil {
+			log.Errorf(c, "Could not delete notifications of %s: %s", email, err)
+		}
+	}
+}
+
+// notifyReportcardPublished notifies all students of the current school year
+// that the report cards of term are available
+func notifyReportcardPublished(c context.Context, term Term) {
+	subject := fmt.Sprintf("%s Report Card Published", term)
+	body := fmt.Sprintf("The report card of %s is published. To view it, go to: %s/reportcard", term, siteURL)
+	notify(c, notifyReportcard, classNotificationEmails(c, "all"), subject, body)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
 
@@ -17,92 +18,255 @@ type link struct {
 	Active bool
 }
 
-var access = map[string]roles{
-
-	"/settings":                adminRole,
-	"/settings/saveschoolyear": adminRole,
-	"/settings/savesections":   adminRole,
-	"/settings/addclass":       adminRole,
-	"/settings/addschoolyear":  adminRole,
-	"/settings/addsubject":     adminRole,
-	"/settings/deletesubject":  adminRole,
-	"/settings/addstream":      adminRole,
-	"/settings/access":         adminRole,
-	"/gradinggroups/details":   adminRole,
-	"/gradinggroups/save":      adminRole,
-
-	"/assign":      adminRole,
-	"/assign/save": adminRole,
-
-	"/subjects":         adminRole,
-	"/subjects/details": adminRole,
-	"/subjects/save":    adminRole,
-	"/subjects/delete":  adminRole,
-
-	"/students":         hrRole,
-	"/students/details": hrRole,
-	"/students/save":    hrRole,
-	"/students/import":  hrRole,
-	"/students/export":  hrRole,
-
-	"/employees":         hrRole,
-	"/employees/details": hrRole,
-	"/employees/save":    hrRole,
-	"/employees/import":  hrRole,
-	"/employees/export":  hrRole,
-
-	"/completion":         hrRole,
-	"/printallmarks":      hrRole,
-	"/printstudentmarks":  hrRole,
-	"/reportcards":        hrRole,
-	"/reportcards/select": hrRole,
-	"/reportcards/print":  hrRole,
-	"/gpareportcard":      hrRole,
-
-	"/marks":        teacherRole,
-	"/marks/save":   teacherRole,
-	"/marks/import": teacherRole,
-	"/marks/export": teacherRole,
-	"/subjectsmap":  teacherRole,
-
-	"/homework":        teacherRole,
-	"/homework/save":   teacherRole,
-	"/homework/delete": teacherRole,
-
-	"/upload":           teacherRole,
-	"/upload/file":      teacherRole,
-	"/upload/link":      teacherRole,
-	"/upload/delete":    teacherRole,
-	"/dailylog":         teacherRole,
-	"/dailylog/student": teacherRole,
-	"/dailylog/edit":    teacherRole,
-	"/dailylog/save":    teacherRole,
-
-	"/leave/allrequests":  hrRole,
-	"/leave/myrequests":   anyRole,
-	"/leave/request":      anyRole,
-	"/leave/request/save": anyRole,
-	"/attendance":         hrRole,
-	"/attendance/save":    hrRole,
-	"/attendance/import":  hrRole,
-	"/attendance/export":  hrRole,
-	"/attendance/report":  hrRole,
-
-	"/progressreports/settings":      hrRole,
-	"/progressreports/settings/save": hrRole,
-	"/progressreports/report":        teacherRole,
-	"/progressreports/report/save":   teacherRole,
-	"/progressreports/report/print":  teacherRole,
-
-	"/reports":          hrRole,
-	"/reports/select":   hrRole,
-	"/reports/generate": hrRole,
-
-	"/reportcard":       studentRole,
-	"/documents":        studentRole,
-	"/viewdailylog":     studentRole,
-	"/viewdailylog/day": studentRole,
-	"/homeworks":        studentRole,
+// access is the permission needed for each page
+var access = map[string]permission{
+
+	"/settings":                permSettingsEdit,
+	"/settings/saveschoolyear": permSettingsEdit,
+	"/settings/savesections":   permSettingsEdit,
+	"/settings/addclass":       permSettingsEdit,
+	"/settings/addschoolyear":  permSettingsEdit,
+	"/settings/addsubject":     permSettingsEdit,
+	"/settings/deletesubject":  permSettingsEdit,
+	"/settings/addstream":      permSettingsEdit,
+	"/settings/access":         permSettingsEdit,
+	"/settings/workload":       permSettingsEdit,
+	"/settings/hods":           permSettingsEdit,
+	"/settings/remedial":       permSettingsEdit,
+	"/settings/roles":          permRolesEdit,
+	"/settings/roles/save":     permRolesEdit,
+	"/settings/roles/delete":   permRolesEdit,
+	"/settings/roles/grant":    permRolesEdit,
+	"/settings/roles/revoke":   permRolesEdit,
+	"/gradinggroups/details":   permSettingsEdit,
+	"/gradinggroups/save":      permSettingsEdit,
+	"/behaviorrubrics/details": permSettingsEdit,
+	"/behaviorrubrics/save":    permSettingsEdit,
+
+	"/assign":      permAssignmentsEdit,
+	"/assign/save": permAssignmentsEdit,
+
+	"/subjects":         permSubjectsEdit,
+	"/subjects/details": permSubjectsEdit,
+	"/subjects/save":    permSubjectsEdit,
+	"/subjects/delete":  permSubjectsEdit,
+
+	"/students":         permStudentsView,
+	"/students/details": permStudentsView,
+	"/students/save":    permStudentsEdit,
+	"/students/import":  permStudentsEdit,
+	"/students/export":  permStudentsView,
+
+	"/employees":         permEmployeesView,
+	"/employees/details": permEmployeesView,
+	"/employees/save":    permEmployeesEdit,
+	"/employees/import":  permEmployeesEdit,
+	"/employees/export":  permEmployeesView,
+
+	"/completion":          permCompletionView,
+	"/completion/deadline": permCompletionManage,
+	"/completion/history":  permCompletionView,
+	"/completion/rebuild":  permCompletionRebuild,
+	"/printallmarks":       permMarksView,
+	"/printstudentmarks":   permMarksView,
+	"/reportcards":         permReportCardsPrint,
+	"/reportcards/select":  permReportCardsPrint,
+	"/reportcards/print":   permReportCardsPrint,
+	"/gpareportcard":       permReportCardsPrint,
+
+	"/marks":                 permMarksView,
+	"/marks/save":            permMarksEdit,
+	"/marks/import":          permMarksEdit,
+	"/marks/import/commit":   permMarksEdit,
+	"/marks/export":          permMarksView,
+	"/marks/review":          permMarksReview,
+	"/marks/review/save":     permMarksReview,
+	"/marks/attempts":        permMarksEdit,
+	"/marks/attempts/save":   permMarksEdit,
+	"/marks/attempts/delete": permMarksEdit,
+	"/moderation":            permMarksModerate,
+	"/moderation/save":       permMarksModerate,
+	"/moderation/delete":     permMarksModerate,
+	"/remedial":              permRemedialManage,
+	"/remedial/save":         permRemedialManage,
+	"/remedial/enroll":       permRemedialManage,
+	"/subjectsmap":           permMarksView,
+
+	"/homework":        permHomeworkEdit,
+	"/homework/save":   permHomeworkEdit,
+	"/homework/delete": permHomeworkEdit,
+
+	"/upload":              permDocumentsUpload,
+	"/upload/file":         permDocumentsUpload,
+	"/upload/link":         permDocumentsUpload,
+	"/upload/delete":       permDocumentsUpload,
+	"/dailylog":            permDailyLogEdit,
+	"/dailylog/student":    permDailyLogEdit,
+	"/dailylog/edit":       permDailyLogEdit,
+	"/dailylog/save":       permDailyLogEdit,
+	"/dailylog/class":      permDailyLogEdit,
+	"/dailylog/class/save": permDailyLogEdit,
+
+	"/discipline":          permDisciplineEdit,
+	"/discipline/student":  permDisciplineEdit,
+	"/discipline/incident": permDisciplineEdit,
+	"/discipline/save":     permDisciplineEdit,
+	"/discipline/settings": permDisciplineManage,
+
+	"/lessonplans":                permLessonPlansEdit,
+	"/lessonplans/edit":           permLessonPlansEdit,
+	"/lessonplans/save":           permLessonPlansEdit,
+	"/lessonplans/review":         permLessonPlansApprove,
+	"/lessonplans/review/save":    permLessonPlansApprove,
+	"/lessonplans/standards":      permLessonPlansApprove,
+	"/lessonplans/standards/save": permLessonPlansApprove,
+
+	"/quizzes":         permQuizzesEdit,
+	"/quizzes/edit":    permQuizzesEdit,
+	"/quizzes/save":    permQuizzesEdit,
+	"/quizzes/delete":  permQuizzesEdit,
+	"/quizzes/results": permQuizzesEdit,
+	"/quizzes/record":  permQuizzesEdit,
+
+	"/leave/allrequests":  permLeaveApprove,
+	"/leave/myrequests":   permLeaveRequest,
+	"/leave/request":      permLeaveRequest,
+	"/leave/request/save": permLeaveRequest,
+	"/attendance":         permAttendanceEdit,
+	"/attendance/save":    permAttendanceEdit,
+	"/attendance/import":  permAttendanceEdit,
+	"/attendance/export":  permAttendanceView,
+	"/attendance/report":  permAttendanceView,
+	"/substitutions":      permSubstitutionsEdit,
+	"/substitutions/save": permSubstitutionsEdit,
+
+	"/progressreports/settings":        permProgressReportsSet,
+	"/progressreports/settings/save":   permProgressReportsSet,
+	"/progressreports/report":          permProgressReportsEdit,
+	"/progressreports/report/save":     permProgressReportsEdit,
+	"/progressreports/report/print":    permProgressReportsEdit,
+	"/progressreports/scales/details":  permSettingsEdit,
+	"/progressreports/scales/save":     permSettingsEdit,
+	"/progressreports/comments":        permProgressReportsEdit,
+	"/progressreports/comments/save":   permProgressReportsEdit,
+	"/progressreports/comments/delete": permProgressReportsEdit,
+
+	"/timetable":          permTimetableEdit,
+	"/timetable/settings": permTimetableEdit,
+	"/timetable/generate": permTimetableEdit,
+	"/timetable/save":     permTimetableEdit,
+	"/timetable/section":  permTimetableView,
+	"/timetable/teacher":  permTimetableView,
+
+	"/reports":          permReportsRun,
+	"/reports/select":   permReportsRun,
+	"/reports/generate": permReportsRun,
+
+	"/atrisk":               permReportsRun,
+	"/atrisk/settings":      permAtRiskManage,
+	"/atrisk/classteachers": permAtRiskManage,
+	"/atrisk/email":         permAtRiskManage,
+
+	"/notifications":      permAccount,
+	"/notifications/save": permAccount,
+
+	"/apitokens":        permAccount,
+	"/apitokens/save":   permAccount,
+	"/apitokens/delete": permAccount,
+
+	"/api/v1/students":      permStudentsView,
+	"/api/v1/employees":     permEmployeesView,
+	"/api/v1/classsections": permAccount,
+	"/api/v1/assignments":   permAssignmentsEdit,
+	"/api/v1/marks":         permMarksView,
+	"/api/v1/attendance":    permAttendanceView,
+	"/api/v1/leaverequests": permLeaveRequest,
+	"/api/v1/homework":      permAccount,
+
+	"/reportcard":       permStudentPortal,
+	"/documents":        permStudentPortal,
+	"/viewdailylog":     permStudentPortal,
+	"/viewdailylog/day": permStudentPortal,
+	"/homeworks":        permStudentPortal,
+	"/myquizzes":        permStudentPortal,
+	"/myquizzes/take":   permStudentPortal,
+	"/myquizzes/submit": permStudentPortal,
+}
+
+// studentPages are the pages of a student, with the name of the form value
+// of the student ID. Their scope is the class section of the student, not
+// the one of the form.
+var studentPages = map[string]string{
+	"/printstudentmarks":            "id",
+	"/dailylog/student":             "id",
+	"/dailylog/edit":                "id",
+	"/dailylog/save":                "ID",
+	"/discipline/student":           "id",
+	"/progressreports/report":       "StudentId",
+	"/progressreports/report/save":  "StudentId",
+	"/progressreports/report/print": "StudentId",
+}
+
+// ownScopePages check the scope of the user themselves, or let the user
+// choose a class or a subject first. They can be used with scoped
+// permissions without a class or a subject in the form.
+var ownScopePages = map[string]bool{
+	"/marks":                           true,
+	"/marks/import":                    true,
+	"/marks/review":                    true,
+	"/subjectsmap":                     true,
+	"/homework":                        true,
+	"/upload":                          true,
+	"/upload/file":                     true,
+	"/upload/delete":                   true,
+	"/dailylog":                        true,
+	"/discipline":                      true,
+	"/discipline/incident":             true,
+	"/lessonplans":                     true,
+	"/lessonplans/review":              true,
+	"/lessonplans/standards":           true,
+	"/quizzes":                         true,
+	"/quizzes/edit":                    true,
+	"/quizzes/save":                    true,
+	"/quizzes/delete":                  true,
+	"/quizzes/results":                 true,
+	"/quizzes/record":                  true,
+	"/progressreports/comments":        true,
+	"/progressreports/comments/save":   true,
+	"/progressreports/comments/delete": true,
+	"/reports":                         true,
+	"/reports/select":                  true,
+	"/reports/generate":                true,
+}
+
+// canAccessScope returns whether the user has the permission of the page
+// for the class, class section and subject of the request. Pages without
+// them need the permission in all classes and subjects, unless they check
+// the scope themselves.
+func canAccessScope(c context.Context, user user, r *http.Request) (bool, error) {
+	sy := getSchoolYear(c)
+
+	class, classSection, subject := formScope(r.Form)
+	if name, ok := studentPages[r.URL.Path]; ok {
+		if _, ok := r.Form[name]; ok {
+			// The class of the form can't be trusted for a student.
+			// Students without a class are only in the scope of users
+			// with the permission in all classes.
+			sc, err := getStudentClass(c, r.Form.Get(name), sy)
+			if err != nil {
+				return false, err
+			}
+			class, classSection = "", ""
+			if sc.Class != "" {
+				classSection = sc.Class + "|" + sc.Section
+			}
+		}
+	}
+
+	if class == "" && classSection == "" && subject == "" && ownScopePages[r.URL.Path] {
+		return user.can(access[r.URL.Path]), nil
+	}
+	return user.canIn(c, sy, access[r.URL.Path], class, classSection, subject)
 }
 
 func accessHandler(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
@@ -114,6 +278,7 @@ func accessHandler(f func(w http.ResponseWriter, r *http.Request)) func(w http.R
 			renderError(w, r, http.StatusInternalServerError)
 			return
 		}
+		defer keepUser(c, user)()
 
 		if !user.Roles.Admin {
 			staffAccess := getStaffAccess(c)
@@ -123,10 +288,26 @@ func accessHandler(f func(w http.ResponseWriter, r *http.Request)) func(w http.R
 			}
 		}
 
-		if !canAccess(user.Roles, r.URL.Path) {
+		if !canAccess(user, r.URL.Path) {
 			renderError(w, r, http.StatusForbidden)
 			return
 		}
+
+		if err := r.ParseForm(); err != nil {
+			log.Errorf(c, "Could not parse form: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		allowAccess, err := canAccessScope(c, user, r)
+		if err != nil {
+			log.Errorf(c, "Could not check access: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if !allowAccess {
+			renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
+			return
+		}
 		f(w, r)
 	}
 }
@@ -140,30 +321,53 @@ var pages = []link{
 	{Name: "Print All Marks", URL: "/printallmarks"},
 
 	{Name: "Enter Marks", URL: "/marks"},
+	{Name: "Review Marks", URL: "/marks/review"},
+	{Name: "Moderation", URL: "/moderation"},
+	{Name: "Remedial Courses", URL: "/remedial"},
 	{Name: "Homework", URL: "/homework"},
 	{Name: "Upload documents", URL: "/upload"},
 	{Name: "Daily Log", URL: "/dailylog"},
+	{Name: "Discipline", URL: "/discipline"},
+	{Name: "Lesson Plans", URL: "/lessonplans"},
+	{Name: "Review Lesson Plans", URL: "/lessonplans/review"},
+	{Name: "Quizzes", URL: "/quizzes"},
 	{Name: "Print Reportcards", URL: "/reportcards"},
+	{Name: "Timetable", URL: "/timetable"},
+	{Name: "My Timetable", URL: "/timetable/teacher"},
 	{Name: "Settings", URL: "/settings"},
+	{Name: "Roles", URL: "/settings/roles"},
 	{Name: "Subjects", URL: "/subjects"},
 
 	{Name: "Reportcard", URL: "/reportcard"},
 	{Name: "Download Documents", URL: "/documents"},
 	{Name: "Daily Log", URL: "/viewdailylog"},
 	{Name: "Homework", URL: "/homeworks"},
+	{Name: "Quizzes", URL: "/myquizzes"},
 
 	{Name: "Review Leave Requests", URL: "/leave/allrequests"},
 	{Name: "My Leave Requests", URL: "/leave/myrequests"},
 	{Name: "Attendance", URL: "/attendance"},
 	{Name: "Attendance Report", URL: "/attendance/report"},
+	{Name: "Substitutions", URL: "/substitutions"},
 
 	{Name: "Reports", URL: "/reports"},
+	{Name: "At-Risk Students", URL: "/atrisk"},
+
+	{Name: "Notifications", URL: "/notifications"},
+	{Name: "API Tokens", URL: "/apitokens"},
 }
 
-func canAccess(userRoles roles, url string) bool {
-	urlRoles := access[url]
-	return (urlRoles.Student && userRoles.Student) ||
-		(urlRoles.Admin && userRoles.Admin) ||
-		(urlRoles.HR && userRoles.HR) ||
-		(urlRoles.Teacher && userRoles.Teacher)
+// canAccess returns whether the user has the permission of the page, in
+// any scope
+func canAccess(user user, url string) bool {
+	return user.can(access[url])
+}
+
+// canOpen returns whether the user can open the page without a class or a
+// subject, like the links of the menu do
+func canOpen(user user, url string) bool {
+	if ownScopePages[url] {
+		return canAccess(user, url)
+	}
+	return user.Permissions.inScope(access[url], "", "", "")
 }
@@ -0,0 +1,743 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	http.HandleFunc("/settings/roles", accessHandler(rolesHandler))
+	http.HandleFunc("/settings/roles/save", accessHandler(rolesSaveHandler))
+	http.HandleFunc("/settings/roles/delete", accessHandler(rolesDeleteHandler))
+	http.HandleFunc("/settings/roles/grant", accessHandler(rolesGrantHandler))
+	http.HandleFunc("/settings/roles/revoke", accessHandler(rolesRevokeHandler))
+}
+
+// permission is the right to use a group of pages
+type permission string
+
+const (
+	permSettingsEdit    permission = "settings.edit"
+	permRolesEdit       permission = "roles.edit"
+	permAssignmentsEdit permission = "assignments.edit"
+	permSubjectsEdit    permission = "subjects.edit"
+
+	permStudentsView  permission = "students.view"
+	permStudentsEdit  permission = "students.edit"
+	permEmployeesView permission = "employees.view"
+	permEmployeesEdit permission = "employees.edit"
+
+	permMarksView         permission = "marks.view"
+	permMarksEdit         permission = "marks.edit"
+	permMarksReview       permission = "marks.review"
+	permMarksModerate     permission = "marks.moderate"
+	permRemedialManage    permission = "remedial.manage"
+	permCompletionView    permission = "completion.view"
+	permCompletionManage  permission = "completion.manage"
+	permCompletionRebuild permission = "completion.rebuild"
+	permReportCardsPrint  permission = "reportcards.print"
+	permReportsRun        permission = "reports.run"
+	permAtRiskManage      permission = "atrisk.manage"
+
+	permHomeworkEdit        permission = "homework.edit"
+	permDocumentsUpload     permission = "documents.upload"
+	permDailyLogEdit        permission = "dailylog.edit"
+	permDisciplineEdit      permission = "discipline.edit"
+	permDisciplineManage    permission = "discipline.manage"
+	permLessonPlansEdit     permission = "lessonplans.edit"
+	permLessonPlansApprove  permission = "lessonplans.approve"
+	permQuizzesEdit         permission = "quizzes.edit"
+	permProgressReportsEdit permission = "progressreports.edit"
+	permProgressReportsSet  permission = "progressreports.settings"
+
+	permLeaveRequest      permission = "leave.request"
+	permLeaveApprove      permission = "leave.approve"
+	permAttendanceView    permission = "attendance.view"
+	permAttendanceEdit    permission = "attendance.edit"
+	permSubstitutionsEdit permission = "substitutions.edit"
+	permTimetableView     permission = "timetable.view"
+	permTimetableEdit     permission = "timetable.edit"
+
+	permAccount       permission = "account"
+	permStudentPortal permission = "studentportal.view"
+)
+
+// allPermissions are the permissions that can be given to custom roles
+var allPermissions = []permission{
+	permSettingsEdit,
+	permRolesEdit,
+	permAssignmentsEdit,
+	permSubjectsEdit,
+	permStudentsView,
+	permStudentsEdit,
+	permEmployeesView,
+	permEmployeesEdit,
+	permMarksView,
+	permMarksEdit,
+	permMarksReview,
+	permMarksModerate,
+	permRemedialManage,
+	permCompletionView,
+	permCompletionManage,
+	permCompletionRebuild,
+	permReportCardsPrint,
+	permReportsRun,
+	permAtRiskManage,
+	permHomeworkEdit,
+	permDocumentsUpload,
+	permDailyLogEdit,
+	permDisciplineEdit,
+	permDisciplineManage,
+	permLessonPlansEdit,
+	permLessonPlansApprove,
+	permQuizzesEdit,
+	permProgressReportsEdit,
+	permProgressReportsSet,
+	permLeaveRequest,
+	permLeaveApprove,
+	permAttendanceView,
+	permAttendanceEdit,
+	permSubstitutionsEdit,
+	permTimetableView,
+	permTimetableEdit,
+	permAccount,
+}
+
+// personalPermissions are not about a class or a subject, so teachers have
+// them outside of their assignments
+var personalPermissions = map[permission]bool{
+	permTimetableView: true,
+	permLeaveRequest:  true,
+	permAccount:       true,
+}
+
+// Built-in roles. They can't be edited, and every employee has the ones
+// checked in their details.
+const (
+	roleAdmin   = "Admin"
+	roleHR      = "HR"
+	roleTeacher = "Teacher"
+	roleStudent = "Student"
+)
+
+var builtinRoles = map[string][]permission{
+	roleAdmin: {
+		permSettingsEdit,
+		permRolesEdit,
+		permAssignmentsEdit,
+		permSubjectsEdit,
+		permMarksView,
+		permMarksEdit,
+		permMarksReview,
+		permMarksModerate,
+		permRemedialManage,
+		permDisciplineEdit,
+		permDisciplineManage,
+		permLessonPlansEdit,
+		permLessonPlansApprove,
+		permQuizzesEdit,
+		permCompletionRebuild,
+		permTimetableEdit,
+		permAccount,
+	},
+	roleHR: {
+		permStudentsView,
+		permStudentsEdit,
+		permEmployeesView,
+		permEmployeesEdit,
+		permCompletionView,
+		permCompletionManage,
+		permReportCardsPrint,
+		permReportsRun,
+		permAtRiskManage,
+		permDisciplineEdit,
+		permDisciplineManage,
+		permProgressReportsSet,
+		permLeaveRequest,
+		permLeaveApprove,
+		permAttendanceView,
+		permAttendanceEdit,
+		permSubstitutionsEdit,
+		permAccount,
+	},
+	roleTeacher: {
+		permMarksView,
+		permMarksEdit,
+		permHomeworkEdit,
+		permDocumentsUpload,
+		permDailyLogEdit,
+		permDisciplineEdit,
+		permLessonPlansEdit,
+		permQuizzesEdit,
+		permProgressReportsEdit,
+		permTimetableView,
+		permLeaveRequest,
+		permAccount,
+	},
+	roleStudent: {
+		permStudentPortal,
+		permLeaveRequest,
+		permAccount,
+	},
+}
+
+// scope limits a permission to a class, a class section or a subject. Empty
+// fields don't limit the permission.
+type scope struct {
+	Class        string
+	ClassSection string
+	Subject      string
+
+	// Assigned limits the permission to the subjects the teacher is
+	// assigned to
+	Assigned bool
+}
+
+func (s scope) String() string {
+	var parts []string
+	if s.Class != "" {
+		parts = append(parts, "Class "+s.Class)
+	}
+	if s.ClassSection != "" {
+		parts = append(parts, "Section "+strings.Replace(s.ClassSection, "|", "", 1))
+	}
+	if s.Subject != "" {
+		parts = append(parts, "Subject "+s.Subject)
+	}
+	if s.Assigned {
+		parts = append(parts, "Assigned subjects")
+	}
+	if len(parts) == 0 {
+		return "All"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches returns whether the scope includes the class, class section and
+// subject. Empty arguments mean all of them, so they are only included in
+// scopes that don't limit them: a scope of a section doesn't include its
+// whole class. Teacher assignments are not checked.
+func (s scope) matches(class, classSection, subject string) bool {
+	if classSection != "" {
+		if c, _, err := parseClassSection(classSection); err == nil {
+			class = c
+		}
+	}
+	if s.ClassSection != "" && s.ClassSection != classSection {
+		return false
+	}
+	if s.Class != "" && s.Class != class {
+		return false
+	}
+	if s.Subject != "" && s.Subject != subject {
+		return false
+	}
+	return true
+}
+
+// permissions are the scopes in which a user has each permission
+type permissions map[permission][]scope
+
+func (p permissions) add(perms []permission, s scope) {
+	for _, perm := range perms {
+		p[perm] = append(p[perm], s)
+	}
+}
+
+// inScope returns whether one of the scopes of perm matches. Scopes limited
+// to the teacher assignments are not included.
+func (p permissions) inScope(perm permission, class, classSection, subject string) bool {
+	for _, s := range p[perm] {
+		if !s.Assigned && s.matches(class, classSection, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// formScope returns the class, class section and subject of a request, in
+// the form of the pages or of the API
+func formScope(f url.Values) (class, classSection, subject string) {
+	get := func(name string) string {
+		if v := f.Get(name); v != "" {
+			return v
+		}
+		return f.Get(strings.ToLower(name))
+	}
+	return get("Class"), get("ClassSection"), get("Subject")
+}
+
+// can returns whether the user has perm in any scope
+func (user user) can(perm permission) bool {
+	return len(user.Permissions[perm]) > 0
+}
+
+// canInScope returns whether the user has perm for the subject of the class
+// section, including the teacher assignments
+func (user user) canInScope(c context.Context, sy string, perm permission, classSection, subject string) (bool, error) {
+	return user.canIn(c, sy, perm, "", classSection, subject)
+}
+
+// canIn returns whether the user has perm for the class, class section and
+// subject, including the teacher assignments. Empty arguments mean all of
+// them, like in scope.matches.
+func (user user) canIn(c context.Context, sy string, perm permission, class, classSection, subject string) (bool, error) {
+	var assigns []assignType
+	gotAssigns := false
+	for _, s := range user.Permissions[perm] {
+		if !s.matches(class, classSection, subject) {
+			continue
+		}
+		if !s.Assigned {
+			return true, nil
+		}
+		if user.Employee == nil {
+			continue
+		}
+		if classSection != "" && subject != "" {
+			assigned, err := isTeacherAssigned(c, sy, classSection, subject, user.Employee.ID)
+			if err != nil {
+				return false, err
+			}
+			if assigned {
+				return true, nil
+			}
+			continue
+		}
+		if !gotAssigns {
+			var err error
+			assigns, err = getTeacherAssignments(c, sy, user.Employee.ID)
+			if err != nil {
+				return false, err
+			}
+			gotAssigns = true
+		}
+		if teaches(assigns, class, classSection, subject) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// canAccessIn checks that the user has perm for the class, class section and
+// subject, like canIn, and renders an error if not
+func canAccessIn(w http.ResponseWriter, r *http.Request, c context.Context, sy string,
+	perm permission, class, classSection, subject string) bool {
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return false
+	}
+	allowAccess, err := user.canIn(c, sy, perm, class, classSection, subject)
+	if err != nil {
+		log.Errorf(c, "Could not get assignment: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return false
+	}
+	if !allowAccess {
+		renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
+		return false
+	}
+	return true
+}
+
+// teaches returns whether one of the assignments is in the class, class
+// section and subject. A teacher is not assigned to all of them, so at
+// least one is needed.
+func teaches(assigns []assignType, class, classSection, subject string) bool {
+	if class == "" && classSection == "" && subject == "" {
+		return false
+	}
+	for _, a := range assigns {
+		if classSection != "" && a.ClassSection != classSection {
+			continue
+		}
+		if class != "" {
+			if c, _, err := parseClassSection(a.ClassSection); err != nil || c != class {
+				continue
+			}
+		}
+		if subject != "" && a.Subject != subject {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// roleDefinition is a custom role. It will be stored in the datastore with
+// its name as the key.
+type roleDefinition struct {
+	Name        string
+	Permissions []string
+}
+
+func (rd roleDefinition) Has(perm permission) bool {
+	return containsString(rd.Permissions, string(perm))
+}
+
+func getRoleDefinitions(c context.Context) ([]roleDefinition, error) {
+	q := datastore.NewQuery("role")
+
+	var rds []roleDefinition
+	if _, err := q.GetAll(c, &rds); err != nil {
+		return nil, err
+	}
+
+	return rds, nil
+}
+
+// getRolePermissions returns the permissions of a built-in or a custom role
+func getRolePermissions(c context.Context, role string) ([]permission, error) {
+	if perms, ok := builtinRoles[role]; ok {
+		return perms, nil
+	}
+
+	key := datastore.NewKey(c, "role", role, 0, nil)
+	var rd roleDefinition
+	if err := nds.Get(c, key, &rd); err != nil {
+		return nil, err
+	}
+
+	var perms []permission
+	for _, perm := range rd.Permissions {
+		perms = append(perms, permission(perm))
+	}
+	return perms, nil
+}
+
+// roleGrant gives an employee a role in a scope
+type roleGrant struct {
+	ID string `datastore:"-"`
+
+	Employee     int64
+	Role         string
+	Class        string
+	ClassSection string
+	Subject      string
+}
+
+func (rg roleGrant) scope() scope {
+	return scope{Class: rg.Class, ClassSection: rg.ClassSection, Subject: rg.Subject}
+}
+
+func (rg roleGrant) key(c context.Context) *datastore.Key {
+	keyStr := fmt.Sprintf("%d|%s|%s|%s|%s", rg.Employee, rg.Role, rg.Class, rg.ClassSection, rg.Subject)
+	return datastore.NewKey(c, "rolegrant", keyStr, 0, nil)
+}
+
+// getRoleGrants returns the grants of the employee, or of all employees if
+// employee is 0
+func getRoleGrants(c context.Context, employee int64) ([]roleGrant, error) {
+	q := datastore.NewQuery("rolegrant")
+	if employee != 0 {
+		q = q.Filter("Employee =", employee)
+	}
+
+	var grants []roleGrant
+	keys, err := q.GetAll(c, &grants)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range keys {
+		grants[i].ID = k.StringID()
+	}
+
+	return grants, nil
+}
+
+// getUserPermissions returns the permissions of the built-in roles and of
+// the role grants of the employee, if not nil
+func getUserPermissions(c context.Context, userRoles roles, emp *employeeType) permissions {
+	perms := make(permissions)
+	if userRoles.Admin {
+		perms.add(builtinRoles[roleAdmin], scope{})
+	}
+	if userRoles.HR {
+		perms.add(builtinRoles[roleHR], scope{})
+	}
+	if userRoles.Teacher {
+		for _, perm := range builtinRoles[roleTeacher] {
+			if userRoles.Admin || personalPermissions[perm] {
+				perms.add([]permission{perm}, scope{})
+			} else {
+				perms.add([]permission{perm}, scope{Assigned: true})
+			}
+		}
+	}
+	if userRoles.Student {
+		perms.add(builtinRoles[roleStudent], scope{})
+	}
+
+	if emp == nil {
+		return perms
+	}
+
+	// Heads of department review the marks and approve the lesson plans
+	// of their subjects in all class sections
+	for _, subject := range hodSubjects(c, getSchoolYear(c), emp.ID) {
+		perms.add([]permission{permMarksView, permMarksReview, permLessonPlansApprove}, scope{Subject: subject})
+	}
+
+	grants, err := getRoleGrants(c, emp.ID)
+	if err != nil {
+		log.Warningf(c, "Could not get role grants of %d: %s", emp.ID, err)
+		return perms
+	}
+	for _, grant := range grants {
+		rolePerms, err := getRolePermissions(c, grant.Role)
+		if err != nil {
+			log.Warningf(c, "Could not get role %s: %s", grant.Role, err)
+			continue
+		}
+		perms.add(rolePerms, grant.scope())
+	}
+
+	return perms
+}
+
+type roleGrantSorter []roleGrant
+
+func (rgs roleGrantSorter) Len() int {
+	return len(rgs)
+}
+
+func (rgs roleGrantSorter) Less(i, j int) bool {
+	return rgs[i].ID < rgs[j].ID
+}
+
+func (rgs roleGrantSorter) Swap(i, j int) {
+	rgs[i], rgs[j] = rgs[j], rgs[i]
+}
+
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	rds, err := getRoleDefinitions(c)
+	if err != nil {
+		log.Errorf(c, "Could not get roles: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	grants, err := getRoleGrants(c, 0)
+	if err != nil {
+		log.Errorf(c, "Could not get role grants: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	sort.Sort(roleGrantSorter(grants))
+
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		log.Errorf(c, "Could not get employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	employeeNames := make(map[int64]string)
+	for _, emp := range employees {
+		employeeNames[emp.ID] = emp.Name
+	}
+
+	type grantRow struct {
+		ID       string
+		Employee string
+		Role     string
+		Scope    string
+	}
+	var grantRows []grantRow
+	for _, grant := range grants {
+		grantRows = append(grantRows, grantRow{
+			grant.ID,
+			employeeNames[grant.Employee],
+			grant.Role,
+			grant.scope().String(),
+		})
+	}
+
+	roleNames := []string{roleAdmin, roleHR, roleTeacher}
+	for _, rd := range rds {
+		roleNames = append(roleNames, rd.Name)
+	}
+
+	var classSections []string
+	for _, class := range getClasses(c, sy) {
+		classSections = append(classSections, getClassSectionsOfClass(c, sy, class)...)
+	}
+
+	data := struct {
+		Permissions   []permission
+		Roles         []roleDefinition
+		RoleNames     []string
+		Grants        []grantRow
+		Employees     []employeeType
+		Classes       []string
+		ClassSections []string
+		Subjects      []string
+	}{
+		allPermissions,
+		rds,
+		roleNames,
+		grantRows,
+		employees,
+		getClasses(c, sy),
+		classSections,
+		getAllSubjects(c, sy),
+	}
+
+	if err := render(w, r, "roles", data); err != nil {
+		log.Errorf(c, "Could not render template roles: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func rolesSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimSpace(r.PostForm.Get("Name"))
+	if name == "" {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Role name is required")
+		return
+	}
+	if _, ok := builtinRoles[name]; ok {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Built-in roles can't be changed")
+		return
+	}
+
+	rd := roleDefinition{Name: name}
+	for _, perm := range allPermissions {
+		if r.PostForm.Get("perm-"+string(perm)) == "on" {
+			rd.Permissions = append(rd.Permissions, string(perm))
+		}
+	}
+
+	key := datastore.NewKey(c, "role", name, 0, nil)
+	if _, err := nds.Put(c, key, &rd); err != nil {
+		log.Errorf(c, "Could not save role: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings/roles", http.StatusFound)
+}
+
+func rolesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	name := r.PostForm.Get("Name")
+
+	grants, err := getRoleGrants(c, 0)
+	if err != nil {
+		log.Errorf(c, "Could not get role grants: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	for _, grant := range grants {
+		if grant.Role == name {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Role is granted to employees. Revoke it first.")
+			return
+		}
+	}
+
+	key := datastore.NewKey(c, "role", name, 0, nil)
+	if err := nds.Delete(c, key); err != nil {
+		log.Errorf(c, "Could not delete role: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings/roles", http.StatusFound)
+}
+
+func rolesGrantHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	f := r.PostForm
+
+	employee, err := strconv.ParseInt(f.Get("Employee"), 10, 64)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid employee")
+		return
+	}
+
+	grant := roleGrant{
+		Employee:     employee,
+		Role:         f.Get("Role"),
+		Class:        f.Get("Class"),
+		ClassSection: f.Get("ClassSection"),
+		Subject:      f.Get("Subject"),
+	}
+	if _, err := getRolePermissions(c, grant.Role); err != nil || grant.Role == roleStudent {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid role")
+		return
+	}
+
+	if _, err := nds.Put(c, grant.key(c), &grant); err != nil {
+		log.Errorf(c, "Could not save role grant: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings/roles", http.StatusFound)
+}
+
+func rolesRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	key := datastore.NewKey(c, "rolegrant", r.PostForm.Get("ID"), 0, nil)
+	if err := nds.Delete(c, key); err != nil {
+		log.Errorf(c, "Could not delete role grant: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings/roles", http.StatusFound)
+}
@@ -24,6 +24,9 @@ type printAllRow struct {
 	Name         string
 	Marks        []float64
 	SortBy       float64
+
+	// the re-sits and make-ups of the subject in the term
+	Attempts []markAttempt
 }
 
 type printAllRowSorter []printAllRow
@@ -75,6 +78,11 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 	subject := r.Form.Get("Subject")
 	doSort := r.Form.Get("Sort") != ""
 
+	// "all" class sections and "All" subjects are only in unlimited scopes
+	if !canAccessIn(w, r, c, sy, permMarksView, "", classSection, subject) {
+		return
+	}
+
 	var cols []colDescription
 	studentRows := make(map[string][]printAllRow)
 
@@ -159,7 +167,7 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 			studentMarksArr = append(studentMarksArr, average)
 
 			//TODO: Sort by marks other than average
-			row := printAllRow{stu.Class + stu.Section, stu.Name, studentMarksArr, average}
+			row := printAllRow{stu.Class + stu.Section, stu.Name, studentMarksArr, average, nil}
 			classSection := fmt.Sprintf("%s|%s", stu.Class, stu.Section)
 			studentRows[classSection] = append(studentRows[classSection], row)
 		}
@@ -185,8 +193,18 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 				m := make(studentMarks)
 				m[term] = marks
 
+				var attempts []markAttempt
+				if adjustableTerm(term) {
+					attempts, err = getStudentTermAttempts(c, stu.ID, sy, subject, term)
+					if err != nil {
+						log.Errorf(c, "Could not get attempts: %s", err)
+						renderError(w, r, http.StatusInternalServerError)
+						return
+					}
+				}
+
 				classSection := fmt.Sprintf("%s|%s", stu.Class, stu.Section)
-				row := printAllRow{stu.Class + stu.Section, stu.Name, m[term], gs.get100(term, m)}
+				row := printAllRow{stu.Class + stu.Section, stu.Name, m[term], gs.get100(term, m), attempts}
 				studentRows[classSection] = append(studentRows[classSection], row)
 			}
 		}
@@ -197,6 +215,7 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var allRows []printAllRow
+	hasAttempts := false
 	classGroups := getClassGroups(c, sy)
 	for _, cg := range classGroups {
 		for _, sec := range cg.Sections {
@@ -206,6 +225,11 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 				sort.Sort(printAllRowSorter(rows))
 			}
 			allRows = append(allRows, rows...)
+			for _, row := range rows {
+				if len(row.Attempts) > 0 {
+					hasAttempts = true
+				}
+			}
 		}
 	}
 
@@ -228,8 +252,9 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 		Subjects []string
 		CG       []classGroup
 
-		Cols     []colDescription
-		Students []printAllRow
+		Cols        []colDescription
+		Students    []printAllRow
+		HasAttempts bool
 	}{
 		classSection,
 		term,
@@ -242,6 +267,7 @@ func printAllHandler(w http.ResponseWriter, r *http.Request) {
 
 		maxCols,
 		allRows,
+		hasAttempts,
 	}
 
 	if err := render(w, r, "printallmarks", data); err != nil {
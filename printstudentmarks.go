@@ -16,6 +16,7 @@ type studentMarksTerm struct {
 	Term        Term
 	SubjectRows []studentMarksRow
 	Behavior    []float64
+	Rubric      BehaviorRubric
 	Remark      string
 }
 
@@ -26,6 +27,9 @@ type studentMarksRow struct {
 	DetailsMarks []float64
 
 	Letter string
+
+	// the re-sits and make-ups of the subject in the term
+	Attempts []markAttempt
 }
 
 func init() {
@@ -65,6 +69,28 @@ func printStudentMarksHandler(w http.ResponseWriter, r *http.Request) {
 		renderError(w, r, http.StatusInternalServerError)
 		return
 	}
+
+	// the marks of all the subjects are printed
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	classSection := class + "|" + section
+	for _, subject := range subjects {
+		allowAccess, err := user.canInScope(c, sy, permMarksView, classSection, subject)
+		if err != nil {
+			log.Errorf(c, "Could not get assignment: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if !allowAccess {
+			renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to all the subjects of the student")
+			return
+		}
+	}
+
 	subjects = append(subjects, "Behavior")
 
 	var marksTerms []studentMarksTerm
@@ -109,15 +135,25 @@ func printStudentMarksHandler(w http.ResponseWriter, r *http.Request) {
 			subjectsCols = append(subjectsCols, colDescription{subject, 100, math.NaN(), false})
 			subjectsMarks = append(subjectsMarks, mark)
 
+			var attempts []markAttempt
+			if adjustableTerm(term) {
+				attempts, err = getStudentTermAttempts(c, stu.ID, sy, subject, term)
+				if err != nil {
+					log.Errorf(c, "Could not get attempts: %s", err)
+					renderError(w, r, http.StatusInternalServerError)
+					return
+				}
+			}
+
 			studentMarksRows = append(studentMarksRows, studentMarksRow{
-				subject, gs.description(c, sy, term), marks[term], letter})
+				subject, gs.description(c, sy, term), marks[term], letter, attempts})
 		}
 
 		average := total / float64(numInAverage)
 		subjectsCols = append(subjectsCols, colDescription{"Average", 100, math.NaN(), false})
 		subjectsMarks = append(subjectsMarks, average)
 		studentMarksRows = append(studentMarksRows, studentMarksRow{
-			"All", subjectsCols, subjectsMarks, ""})
+			"All", subjectsCols, subjectsMarks, "", nil})
 
 		remark, err = getStudentRemark(c, sy, stu.ID, term)
 		if err != nil {
@@ -126,21 +162,24 @@ func printStudentMarksHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		rubric, err := getTermBehaviorRubric(c, sy, class, term)
+		if err != nil {
+			log.Errorf(c, "Could not get behavior rubric: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+
 		marksTerms = append(marksTerms, studentMarksTerm{
-			term, studentMarksRows, behavior, remark})
+			term, studentMarksRows, behavior, rubric, remark})
 	}
 
 	data := struct {
-		BehaviorDesc []colDescription
-
 		Name    string
 		Class   string
 		Section string
 
 		MarksTerms []studentMarksTerm
 	}{
-		behaviorDesc,
-
 		stu.Name,
 		class,
 		section,
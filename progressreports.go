@@ -25,6 +25,8 @@ func init() {
 	http.HandleFunc("/progressreports/report", accessHandler(progressreportsReportHandler))
 	http.HandleFunc("/progressreports/report/save", accessHandler(progressreportsReportSaveHandler))
 	http.HandleFunc("/progressreports/report/print", accessHandler(progressreportsReportPrintHandler))
+	http.HandleFunc("/progressreports/scales/details", accessHandler(progressreportsScalesDetailsHandler))
+	http.HandleFunc("/progressreports/scales/save", accessHandler(progressreportsScalesSaveHandler))
 }
 
 type ProgressReportSettings struct {
@@ -33,6 +35,7 @@ type ProgressReportSettings struct {
 	ShortName   string
 	Description string
 	Language    string
+	Scale       string // empty for the default scale
 	Rows        []ProgressReportRow
 }
 
@@ -143,22 +146,82 @@ type ProgressReportMark struct {
 	Number       string
 	Letter       string
 	ArabicLetter string
+
+	// Name and Rating are printed next to the letter in the grading scale
+	Name              string `datastore:",noindex"`
+	Rating            string `datastore:",noindex"`
+	Description       string `datastore:",noindex"`
+	ArabicDescription string `datastore:",noindex"`
+}
+
+// ProgressReportScale is the list of marks that can be given in a progress
+// report. Scales are defined by admins and shared by all school years.
+type ProgressReportScale struct {
+	Name  string
+	Marks []ProgressReportMark
 }
 
+const defaultProgressReportScale = "Default"
+
 var progressReportMarks = []ProgressReportMark{
-	{"1", "1", "C", "1"},
-	{"2", "2", "M", "2"},
-	{"3", "3", "R", "3"},
-	{"4", "4", "E", "4"},
-	{"0", "0", "N/A", "غ/م"},
+	{"1", "1", "C", "1", "Consistently", "Very Good", "Your child is working confidently and independently in this area.", "دائما"},
+	{"2", "2", "M", "2", "Most of the time", "Good", "Your child is showing expected growth in this area.", "غالبا"},
+	{"3", "3", "R", "3", "Requires Teachers Assistance", "Needs Improvement", "Your child requires extra individual attention and encouragement in this area.", "أحيانا"},
+	{"4", "4", "E", "4", "Experiencing Difficulty", "", "Your child is experiencing difficulty in this area. Positive encouragement from parents and teachers are essential.", "ليس بعد"},
+	{"0", "0", "N/A", "غ/م", "", "Not Applicable At This Time", "This area was not worked on during the reporting period.", "غير مقرر"},
 }
 
-var progressReportMarksMap = map[string]ProgressReportMark{
-	"1": progressReportMarks[0],
-	"2": progressReportMarks[1],
-	"3": progressReportMarks[2],
-	"4": progressReportMarks[3],
-	"0": progressReportMarks[4],
+type progressReportScalesSetting struct {
+	Value []string
+}
+
+func getProgressReportScales(c context.Context) []string {
+	key := datastore.NewKey(c, "settings", "progress-report-scales", 0, nil)
+
+	setting := progressReportScalesSetting{}
+	err := nds.Get(c, key, &setting)
+	if err != nil {
+		return []string{defaultProgressReportScale}
+	}
+
+	return append([]string{defaultProgressReportScale}, setting.Value...)
+}
+
+func getProgressReportScale(c context.Context, name string) (ProgressReportScale, error) {
+	if name == "" || name == defaultProgressReportScale {
+		return ProgressReportScale{defaultProgressReportScale, progressReportMarks}, nil
+	}
+
+	key := datastore.NewKey(c, "progress_report_scale", name, 0, nil)
+
+	var scale ProgressReportScale
+	if err := nds.Get(c, key, &scale); err != nil {
+		return ProgressReportScale{}, err
+	}
+	return scale, nil
+}
+
+func saveProgressReportScale(c context.Context, scale ProgressReportScale) error {
+	if scale.Name == "" || scale.Name == defaultProgressReportScale {
+		return fmt.Errorf("Invalid scale name: %q", scale.Name)
+	}
+
+	key := datastore.NewKey(c, "progress_report_scale", scale.Name, 0, nil)
+	if _, err := nds.Put(c, key, &scale); err != nil {
+		return err
+	}
+
+	scales := getProgressReportScales(c)[1:]
+	for _, name := range scales {
+		if name == scale.Name {
+			return nil
+		}
+	}
+	scales = append(scales, scale.Name)
+
+	settingKey := datastore.NewKey(c, "settings", "progress-report-scales", 0, nil)
+	_, err := nds.Put(c, settingKey, &progressReportScalesSetting{scales})
+	return err
 }
 
 func progressreportsSettingsHandler(w http.ResponseWriter, r *http.Request) {
@@ -186,11 +249,13 @@ func progressreportsSettingsHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Classes   []string
 		Languages []string
+		Scales    []string
 
 		PRS ProgressReportSettings
 	}{
 		classes,
 		[]string{"Arabic", "English"},
+		getProgressReportScales(c),
 
 		prs,
 	}
@@ -218,6 +283,11 @@ func progressreportsSettingsSaveHandler(w http.ResponseWriter, r *http.Request)
 		ShortName:   r.PostForm.Get("ShortName"),
 		Description: r.PostForm.Get("Description"),
 		Language:    r.PostForm.Get("Language"),
+		Scale:       r.PostForm.Get("Scale"),
+	}
+
+	if prs.Scale == defaultProgressReportScale {
+		prs.Scale = ""
 	}
 
 	for i := 0; ; i++ {
@@ -292,6 +362,13 @@ func progressreportsReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scale, err := getProgressReportScale(c, prs.Scale)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve progress report scale: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
 	var studentName string
 	if prs.Language == "Arabic" && stu.ArabicName != "" {
 		studentName = stu.ArabicName
@@ -317,6 +394,14 @@ func progressreportsReportHandler(w http.ResponseWriter, r *http.Request) {
 		prd.Marks = append(prd.Marks, make([]string, len(prs.Rows)-len(prd.Marks))...)
 	}
 
+	comments, err := getBankComments(c, "")
+	if err != nil {
+		log.Warningf(c, "Could not get comment bank: %s", err)
+	}
+	for i, bc := range comments {
+		comments[i].Text = bc.expand(studentName, sc.Class+sc.Section)
+	}
+
 	if prd.Teacher == 0 {
 		user, err := getUser(c)
 		if err == nil && user.Roles.Teacher {
@@ -338,10 +423,11 @@ func progressreportsReportHandler(w http.ResponseWriter, r *http.Request) {
 		StudentId   string
 		StudentName string
 
-		PRD ProgressReportData
+		PRD      ProgressReportData
+		Comments []bankComment
 	}{
 		teachers,
-		progressReportMarks,
+		scale.Marks,
 
 		sc.Class,
 		sc.Section,
@@ -351,6 +437,7 @@ func progressreportsReportHandler(w http.ResponseWriter, r *http.Request) {
 		studentName,
 
 		prd,
+		comments,
 	}
 
 	if err := render(w, r, "progressreport", data); err != nil {
@@ -510,6 +597,13 @@ func progressreportsReportPrintHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scale, err := getProgressReportScale(c, prs.Scale)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve progress report scale: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
 	var reports []ProgressReportPrintData
 
 	for _, stu := range students {
@@ -582,7 +676,7 @@ func progressreportsReportPrintHandler(w http.ResponseWriter, r *http.Request) {
 
 		Reports []ProgressReportPrintData
 	}{
-		progressReportMarks,
+		scale.Marks,
 
 		sy,
 		class,
@@ -614,3 +708,100 @@ func progressreportsReportPrintHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func progressreportsScalesDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	scale := ProgressReportScale{}
+	if name := r.Form.Get("scale"); name != "" {
+		var err error
+		scale, err = getProgressReportScale(c, name)
+		if err != nil {
+			log.Errorf(c, "Could not get progress report scale %s: %s", name, err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if len(scale.Marks) < 10 {
+		scale.Marks = append(scale.Marks, make([]ProgressReportMark, 10-len(scale.Marks))...)
+	}
+
+	data := struct {
+		Scale   ProgressReportScale
+		Default bool
+	}{
+		scale,
+		scale.Name == defaultProgressReportScale,
+	}
+
+	if err := render(w, r, "progressreportscale", data); err != nil {
+		log.Errorf(c, "Could not render template progressreportscale: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func progressreportsScalesSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	scale := ProgressReportScale{
+		Name: r.PostForm.Get("Name"),
+	}
+
+	values := make(map[string]bool)
+	for i := 0; ; i++ {
+		_, ok := r.PostForm[fmt.Sprintf("prm-value-%d", i)]
+		if !ok {
+			break
+		}
+
+		mark := ProgressReportMark{
+			Value:             r.PostForm.Get(fmt.Sprintf("prm-value-%d", i)),
+			Number:            r.PostForm.Get(fmt.Sprintf("prm-number-%d", i)),
+			Letter:            r.PostForm.Get(fmt.Sprintf("prm-letter-%d", i)),
+			ArabicLetter:      r.PostForm.Get(fmt.Sprintf("prm-arabicletter-%d", i)),
+			Name:              r.PostForm.Get(fmt.Sprintf("prm-name-%d", i)),
+			Rating:            r.PostForm.Get(fmt.Sprintf("prm-rating-%d", i)),
+			Description:       r.PostForm.Get(fmt.Sprintf("prm-description-%d", i)),
+			ArabicDescription: r.PostForm.Get(fmt.Sprintf("prm-arabicdescription-%d", i)),
+		}
+		if mark.Value == "" {
+			continue
+		}
+		if values[mark.Value] {
+			renderErrorMsg(w, r, http.StatusBadRequest,
+				fmt.Sprintf("Duplicate value: %s", mark.Value))
+			return
+		}
+		values[mark.Value] = true
+
+		scale.Marks = append(scale.Marks, mark)
+	}
+
+	if len(scale.Marks) == 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Please add marks")
+		return
+	}
+
+	if err := saveProgressReportScale(c, scale); err != nil {
+		log.Errorf(c, "Could not save progress report scale %v: %s", scale, err)
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
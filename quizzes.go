@@ -0,0 +1,1215 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/quizzes", accessHandler(quizzesHandler))
+	http.HandleFunc("/quizzes/edit", accessHandler(quizzesEditHandler))
+	http.HandleFunc("/quizzes/save", accessHandler(quizzesSaveHandler))
+	http.HandleFunc("/quizzes/delete", accessHandler(quizzesDeleteHandler))
+	http.HandleFunc("/quizzes/results", accessHandler(quizzesResultsHandler))
+	http.HandleFunc("/quizzes/record", accessHandler(quizzesRecordHandler))
+
+	http.HandleFunc("/myquizzes", accessHandler(myQuizzesHandler))
+	http.HandleFunc("/myquizzes/take", accessHandler(myQuizzesTakeHandler))
+	http.HandleFunc("/myquizzes/submit", accessHandler(myQuizzesSubmitHandler))
+}
+
+// schoolLocation is used for the time windows of quizzes. Bahrain does not
+// observe daylight saving time.
+var schoolLocation = time.FixedZone("AST", 3*60*60)
+
+const quizTimeFormat = "2006-01-02T15:04"
+
+type quizQuestionType string
+
+const (
+	quizMultipleChoice quizQuestionType = "mc"
+	quizTrueFalse      quizQuestionType = "tf"
+	quizNumeric        quizQuestionType = "num"
+)
+
+var quizQuestionTypes = []quizQuestionType{
+	quizMultipleChoice,
+	quizTrueFalse,
+	quizNumeric,
+}
+
+var quizQuestionTypeStrings = map[quizQuestionType]string{
+	quizMultipleChoice: "Multiple Choice",
+	quizTrueFalse:      "True/False",
+	quizNumeric:        "Numeric",
+}
+
+func (qt quizQuestionType) Value() string {
+	return string(qt)
+}
+
+func (qt quizQuestionType) String() string {
+	str, ok := quizQuestionTypeStrings[qt]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid quizQuestionType: %s", string(qt)))
+}
+
+func parseQuizQuestionType(s string) (quizQuestionType, error) {
+	qt := quizQuestionType(s)
+	if _, ok := quizQuestionTypeStrings[qt]; !ok {
+		return "", fmt.Errorf("Invalid question type: %s", s)
+	}
+	return qt, nil
+}
+
+// quizQuestion is a question of a quiz. The answer of a multiple choice
+// question is the number of the correct choice.
+type quizQuestion struct {
+	Type    quizQuestionType
+	Text    string
+	Choices string // one per line
+	Answer  string
+	Points  float64
+}
+
+// ChoiceList returns the choices of a multiple choice question
+func (q quizQuestion) ChoiceList() []string {
+	var choices []string
+	for _, choice := range strings.Split(q.Choices, "\n") {
+		choice = strings.TrimSpace(choice)
+		if choice != "" {
+			choices = append(choices, choice)
+		}
+	}
+	return choices
+}
+
+// AnswerText returns the correct answer as shown to students
+func (q quizQuestion) AnswerText() string {
+	if q.Type == quizMultipleChoice {
+		n, err := strconv.Atoi(q.Answer)
+		choices := q.ChoiceList()
+		if err == nil && n >= 1 && n <= len(choices) {
+			return choices[n-1]
+		}
+	}
+	return q.Answer
+}
+
+func (q quizQuestion) validate() error {
+	if q.Points <= 0 {
+		return fmt.Errorf("Invalid points of question: %s", q.Text)
+	}
+	switch q.Type {
+	case quizMultipleChoice:
+		choices := q.ChoiceList()
+		if len(choices) < 2 {
+			return fmt.Errorf("Please add choices to question: %s", q.Text)
+		}
+		n, err := strconv.Atoi(q.Answer)
+		if err != nil || n < 1 || n > len(choices) {
+			return fmt.Errorf("The answer of question %s must be the number of a choice", q.Text)
+		}
+	case quizTrueFalse:
+		if q.Answer != "True" && q.Answer != "False" {
+			return fmt.Errorf("The answer of question %s must be True or False", q.Text)
+		}
+	case quizNumeric:
+		if _, err := strconv.ParseFloat(q.Answer, 64); err != nil {
+			return fmt.Errorf("The answer of question %s must be a number", q.Text)
+		}
+	default:
+		return fmt.Errorf("Invalid type of question: %s", q.Text)
+	}
+	return nil
+}
+
+// correct returns whether answer is the answer of the question
+func (q quizQuestion) correct(answer string) bool {
+	answer = strings.TrimSpace(answer)
+	if q.Type == quizNumeric {
+		want, err1 := strconv.ParseFloat(q.Answer, 64)
+		got, err2 := strconv.ParseFloat(answer, 64)
+		return err1 == nil && err2 == nil && math.Abs(want-got) < 1e-6
+	}
+	return answer != "" && answer == q.Answer
+}
+
+// onlineQuiz is a quiz taken by students in the portal. Its mark is
+// recorded in a quiz slot of a quiz grading column. It will be stored in
+// the datastore.
+type onlineQuiz struct {
+	ID int64 `datastore:"-"`
+
+	SY           string
+	ClassSection string
+	Subject      string
+	Term         string // a Quarter, Midterm or Semester term
+	Column       string // a quiz grading column of the term
+	Slot         int    // the number of the quiz in the column
+
+	Title     string         `datastore:",noindex"`
+	Opens     time.Time      `datastore:",noindex"`
+	Closes    time.Time      `datastore:",noindex"`
+	Questions []quizQuestion `datastore:",noindex"`
+
+	Teacher string `datastore:",noindex"`
+	Created time.Time
+}
+
+// TermValue returns the term of the quiz
+func (quiz onlineQuiz) TermValue() Term {
+	term, err := parseTerm(quiz.Term)
+	if err != nil {
+		return Term{}
+	}
+	return term
+}
+
+// Target returns the quiz slot of the quiz
+func (quiz onlineQuiz) Target() string {
+	return fmt.Sprintf("%s - %s %d", quiz.TermValue(), quiz.Column, quiz.Slot)
+}
+
+func (quiz onlineQuiz) OpensInput() string {
+	if quiz.Opens.IsZero() {
+		return ""
+	}
+	return quiz.Opens.In(schoolLocation).Format(quizTimeFormat)
+}
+
+func (quiz onlineQuiz) ClosesInput() string {
+	if quiz.Closes.IsZero() {
+		return ""
+	}
+	return quiz.Closes.In(schoolLocation).Format(quizTimeFormat)
+}
+
+// Window returns the time window of the quiz in the school's time
+func (quiz onlineQuiz) Window() string {
+	const layout = "Jan 2, 2006 15:04"
+	return fmt.Sprintf("%s - %s",
+		quiz.Opens.In(schoolLocation).Format(layout),
+		quiz.Closes.In(schoolLocation).Format(layout))
+}
+
+func (quiz onlineQuiz) IsOpen() bool {
+	now := time.Now()
+	return !now.Before(quiz.Opens) && now.Before(quiz.Closes)
+}
+
+func (quiz onlineQuiz) IsClosed() bool {
+	return !time.Now().Before(quiz.Closes)
+}
+
+// total returns the points of all questions
+func (quiz onlineQuiz) total() float64 {
+	var total float64
+	for _, q := range quiz.Questions {
+		total += q.Points
+	}
+	return total
+}
+
+// score returns the points of the correct answers
+func (quiz onlineQuiz) score(answers []string) float64 {
+	var score float64
+	for i, q := range quiz.Questions {
+		if i < len(answers) && q.correct(answers[i]) {
+			score += q.Points
+		}
+	}
+	return score
+}
+
+type quizSorter []onlineQuiz
+
+func (s quizSorter) Len() int      { return len(s) }
+func (s quizSorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s quizSorter) Less(i, j int) bool {
+	return s[i].Opens.After(s[j].Opens)
+}
+
+func getQuiz(c context.Context, id int64) (onlineQuiz, error) {
+	var quiz onlineQuiz
+	if err := nds.Get(c, datastore.NewKey(c, "quiz", "", id, nil), &quiz); err != nil {
+		return quiz, err
+	}
+	quiz.ID = id
+	return quiz, nil
+}
+
+func getQuizzes(c context.Context, q *datastore.Query) ([]onlineQuiz, error) {
+	var quizzes []onlineQuiz
+	keys, err := q.GetAll(c, &quizzes)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		quizzes[i].ID = k.IntID()
+	}
+	sort.Sort(quizSorter(quizzes))
+	return quizzes, nil
+}
+
+// getClassQuizzes returns the quizzes of the class section, newest first.
+// If subject is empty, the quizzes of all subjects are returned.
+func getClassQuizzes(c context.Context, sy, classSection, subject string) ([]onlineQuiz, error) {
+	q := datastore.NewQuery("quiz").
+		Filter("SY =", sy).
+		Filter("ClassSection =", classSection)
+	if subject != "" {
+		q = q.Filter("Subject =", subject)
+	}
+	return getQuizzes(c, q)
+}
+
+// quizAttempt is the submission of a student. It will be stored in the
+// datastore.
+type quizAttempt struct {
+	QuizID    int64
+	StudentID string
+	Name      string   `datastore:",noindex"`
+	Answers   []string `datastore:",noindex"`
+	Score     float64  `datastore:",noindex"`
+	Total     float64  `datastore:",noindex"`
+	Mark      float64  `datastore:",noindex"`
+	Submitted time.Time
+
+	// Recorded is whether Mark is the one in the quiz slot of the marks. It
+	// is not after the mark is changed in the marks page.
+	Recorded bool `datastore:",noindex"`
+}
+
+func quizAttemptKey(c context.Context, quizID int64, studentID string) *datastore.Key {
+	return datastore.NewKey(c, "quizattempt", fmt.Sprintf("%d|%s", quizID, studentID), 0, nil)
+}
+
+// getQuizAttempt returns the attempt of the student, and whether it exists
+func getQuizAttempt(c context.Context, quizID int64, studentID string) (quizAttempt, bool, error) {
+	var attempt quizAttempt
+	err := nds.Get(c, quizAttemptKey(c, quizID, studentID), &attempt)
+	if err == datastore.ErrNoSuchEntity {
+		return attempt, false, nil
+	} else if err != nil {
+		return attempt, false, err
+	}
+	return attempt, true, nil
+}
+
+func getQuizAttempts(c context.Context, quizID int64) ([]quizAttempt, error) {
+	q := datastore.NewQuery("quizattempt").Filter("QuizID =", quizID)
+	var attempts []quizAttempt
+	if _, err := q.GetAll(c, &attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// quizTarget is a quiz grading column of a term
+type quizTarget struct {
+	Term       Term
+	Column     string
+	NumQuizzes int
+}
+
+func (t quizTarget) Value() string {
+	return fmt.Sprintf("%s|%s", t.Term.Value(), t.Column)
+}
+
+func (t quizTarget) String() string {
+	return fmt.Sprintf("%s - %s", t.Term, t.Column)
+}
+
+func parseQuizTarget(s string) (Term, string, error) {
+	parts := strings.SplitN(s, "|", 3)
+	if len(parts) != 3 {
+		return Term{}, "", fmt.Errorf("Invalid quiz column: %s", s)
+	}
+	term, err := parseTerm(parts[0] + "|" + parts[1])
+	if err != nil {
+		return Term{}, "", err
+	}
+	return term, parts[2], nil
+}
+
+// quizTargets returns the quiz grading columns of the subject in each term
+func (s Subject) quizTargets() []quizTarget {
+	var targets []quizTarget
+	for _, term := range terms {
+		var gcs []gradingColumn
+		switch {
+		case term.Typ == Quarter && s.SemesterType == QuarterSemester,
+			term.Typ == Midterm && s.SemesterType == MidtermSemester:
+			gcs = s.QuarterGradingColumns
+		case term.Typ == Semester:
+			gcs = s.SemesterGradingColumns
+		}
+		for _, gc := range gcs {
+			if gc.Type == quizGrading {
+				targets = append(targets, quizTarget{term, gc.Name, gc.NumQuizzes})
+			}
+		}
+	}
+	return targets
+}
+
+// quizSlot returns the index and max of the mark of the quiz in the marks
+// of term, or -1 if there is no such quiz
+func (s Subject) quizSlot(c context.Context, sy string, term Term, column string, slot int) (int, float64) {
+	name := fmt.Sprintf("%s %d", column, slot)
+	for i, col := range s.description(c, sy, term) {
+		if col.Editable && col.Name == name {
+			return i, col.Max
+		}
+	}
+	return -1, 0
+}
+
+// quizSubject returns the subject of the quiz. Only subjects graded by
+// marks have quiz columns.
+func quizSubject(c context.Context, quiz onlineQuiz) (Subject, error) {
+	class, _, err := parseClassSection(quiz.ClassSection)
+	if err != nil {
+		return Subject{}, err
+	}
+	s, ok := getGradingSystem(c, quiz.SY, class, quiz.Subject).(Subject)
+	if !ok {
+		return Subject{}, fmt.Errorf("Subject %s of %s does not have quiz columns", quiz.Subject, class)
+	}
+	return s, nil
+}
+
+// recordQuizMarks marks the attempts with the current questions, and
+// stores their marks in the quiz slot of the students' marks. Marks changed
+// in the marks page are kept.
+func recordQuizMarks(c context.Context, quiz onlineQuiz, attempts []quizAttempt) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+
+	s, err := quizSubject(c, quiz)
+	if err != nil {
+		return err
+	}
+	term := quiz.TermValue()
+	i, max := s.quizSlot(c, quiz.SY, term, quiz.Column, quiz.Slot)
+	if i < 0 {
+		return fmt.Errorf("Could not find %s %d in %s", quiz.Column, quiz.Slot, term)
+	}
+
+	total := quiz.total()
+	for _, attempt := range attempts {
+		m, recorded, err := recordQuizAttempt(c, quiz, s, term, i, max, total, attempt.StudentID)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			continue
+		}
+
+		// The other columns of the term are evaluated with the recorded
+		// mark, and the later terms are stored with them
+		marks, err := getStudentMarks(c, attempt.StudentID, quiz.SY, quiz.Subject)
+		if err != nil {
+			return err
+		}
+		marks[term] = m
+		s.evaluate(c, attempt.StudentID, quiz.SY, term, marks) // TODO: check error
+		if err := storeMarksRow(c, attempt.StudentID, quiz.SY, term, quiz.Subject, marks, s); err != nil {
+			return err
+		}
+	}
+
+	nComplete, err := computeCompletion(c, quiz.SY, term, quiz.ClassSection, quiz.Subject)
+	if err != nil {
+		return err
+	}
+	return storeCompletion(c, quiz.SY, quiz.ClassSection, term, quiz.Subject, nComplete)
+}
+
+// recordQuizAttempt marks the attempt of the student, and stores its mark in
+// the slot i of the marks of term if the slot is empty or still has the mark
+// recorded before. It returns the marks of term, and whether the mark was
+// recorded.
+func recordQuizAttempt(c context.Context, quiz onlineQuiz, s Subject, term Term,
+	i int, max, total float64, studentID string) ([]float64, bool, error) {
+
+	var m []float64
+	var recorded bool
+	err := nds.RunInTransaction(c, func(c context.Context) error {
+		key := quizAttemptKey(c, quiz.ID, studentID)
+		var attempt quizAttempt
+		if err := nds.Get(c, key, &attempt); err != nil {
+			return err
+		}
+		previous, wasRecorded := attempt.Mark, attempt.Recorded
+
+		attempt.Score = quiz.score(attempt.Answers)
+		attempt.Total = total
+		attempt.Mark = math.Floor(attempt.Score/total*max*100+0.5) / 100
+
+		var err error
+		m, err = getStudentTermMarks(c, studentID, quiz.SY, quiz.Subject, term, s)
+		if err != nil {
+			return err
+		}
+		recorded = math.IsNaN(m[i]) || (wasRecorded && m[i] == previous)
+		attempt.Recorded = recorded
+
+		if recorded {
+			m[i] = attempt.Mark
+			keyStr := fmt.Sprintf("%s|%s|%s|%s", studentID, quiz.SY, term.Value(), quiz.Subject)
+			marksKey := datastore.NewKey(c, "marks", keyStr, 0, nil)
+			mr := marksRow{studentID, quiz.SY, term.Value(), quiz.Subject, m}
+			if _, err := nds.Put(c, marksKey, &mr); err != nil {
+				return err
+			}
+		}
+
+		_, err = nds.Put(c, key, &attempt)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+
+	return m, recorded, err
+}
+
+func quizzesURL(classSection, subject string) string {
+	return "/quizzes?" + url.Values{
+		"ClassSection": {classSection},
+		"Subject":      {subject},
+	}.Encode()
+}
+
+// getQuizFromForm returns the quiz of the ID form value, and renders an
+// error if it can't be found
+func getQuizFromForm(w http.ResponseWriter, r *http.Request, c context.Context) (onlineQuiz, bool) {
+	id, err := strconv.ParseInt(r.Form.Get("ID"), 10, 64)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid quiz")
+		return onlineQuiz{}, false
+	}
+	quiz, err := getQuiz(c, id)
+	if err == datastore.ErrNoSuchEntity {
+		renderErrorMsg(w, r, http.StatusNotFound, "Quiz not found")
+		return quiz, false
+	} else if err != nil {
+		log.Errorf(c, "Could not get quiz %d: %s", id, err)
+		renderError(w, r, http.StatusInternalServerError)
+		return quiz, false
+	}
+	return quiz, true
+}
+
+// quizRow is a quiz in the quizzes page
+type quizRow struct {
+	Quiz     onlineQuiz
+	Attempts int
+}
+
+func quizzesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.Form.Get("ClassSection")
+	subject := r.Form.Get("Subject")
+
+	var rows []quizRow
+	if _, _, err := parseClassSection(classSection); err == nil && subject != "" {
+		if !canAccessIn(w, r, c, sy, permQuizzesEdit, "", classSection, subject) {
+			return
+		}
+
+		quizzes, err := getClassQuizzes(c, sy, classSection, subject)
+		if err != nil {
+			log.Errorf(c, "Could not get quizzes: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		for _, quiz := range quizzes {
+			attempts, err := getQuizAttempts(c, quiz.ID)
+			if err != nil {
+				log.Errorf(c, "Could not get quiz attempts: %s", err)
+				renderError(w, r, http.StatusInternalServerError)
+				return
+			}
+			rows = append(rows, quizRow{quiz, len(attempts)})
+		}
+	} else {
+		classSection = ""
+	}
+
+	data := struct {
+		CG           []classGroup
+		Subjects     []string
+		ClassSection string
+		Subject      string
+
+		Rows []quizRow
+	}{
+		getClassGroups(c, sy),
+		getAllSubjects(c, sy),
+		classSection,
+		subject,
+
+		rows,
+	}
+
+	if err := render(w, r, "quizzes", data); err != nil {
+		log.Errorf(c, "Could not render template quizzes: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func quizzesEditHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var quiz onlineQuiz
+	attempts := 0
+	if r.Form.Get("ID") != "" {
+		var ok bool
+		quiz, ok = getQuizFromForm(w, r, c)
+		if !ok {
+			return
+		}
+		as, err := getQuizAttempts(c, quiz.ID)
+		if err != nil {
+			log.Errorf(c, "Could not get quiz attempts: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		attempts = len(as)
+	} else {
+		quiz = onlineQuiz{
+			SY:           sy,
+			ClassSection: r.Form.Get("ClassSection"),
+			Subject:      r.Form.Get("Subject"),
+			Slot:         1,
+		}
+	}
+
+	if !canAccessIn(w, r, c, sy, permQuizzesEdit, "", quiz.ClassSection, quiz.Subject) {
+		return
+	}
+
+	s, err := quizSubject(c, quiz)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	targets := s.quizTargets()
+	if len(targets) == 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("%s does not have quiz columns", quiz.Subject))
+		return
+	}
+
+	n := len(quiz.Questions) + 5
+	if n < 10 {
+		n = 10
+	}
+	quiz.Questions = append(quiz.Questions, make([]quizQuestion, n-len(quiz.Questions))...)
+
+	data := struct {
+		Quiz          onlineQuiz
+		Attempts      int
+		Targets       []quizTarget
+		QuestionTypes []quizQuestionType
+	}{
+		quiz,
+		attempts,
+		targets,
+		quizQuestionTypes,
+	}
+
+	if err := render(w, r, "quizedit", data); err != nil {
+		log.Errorf(c, "Could not render template quizedit: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func quizzesSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	f := r.PostForm
+
+	var quiz onlineQuiz
+	var attempts []quizAttempt
+	if f.Get("ID") != "" {
+		var ok bool
+		quiz, ok = getQuizFromForm(w, r, c)
+		if !ok {
+			return
+		}
+		var err error
+		attempts, err = getQuizAttempts(c, quiz.ID)
+		if err != nil {
+			log.Errorf(c, "Could not get quiz attempts: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		quiz = onlineQuiz{
+			SY:           sy,
+			ClassSection: f.Get("ClassSection"),
+			Subject:      f.Get("Subject"),
+			Created:      time.Now(),
+		}
+		if _, _, err := parseClassSection(quiz.ClassSection); err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+			return
+		}
+	}
+
+	if !canAccessIn(w, r, c, sy, permQuizzesEdit, "", quiz.ClassSection, quiz.Subject) {
+		return
+	}
+
+	s, err := quizSubject(c, quiz)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	term, column, err := parseQuizTarget(f.Get("Target"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid quiz column")
+		return
+	}
+	slot, err := strconv.Atoi(f.Get("Slot"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid quiz number")
+		return
+	}
+	var target *quizTarget
+	for _, t := range s.quizTargets() {
+		if t.Term == term && t.Column == column {
+			target = &t
+			break
+		}
+	}
+	if target == nil || slot < 1 || slot > target.NumQuizzes {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Invalid quiz: %s %s %d", term, column, slot))
+		return
+	}
+	if len(attempts) > 0 && (term.Value() != quiz.Term || column != quiz.Column || slot != quiz.Slot) {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			"The quiz column can't be changed after students submitted the quiz")
+		return
+	}
+
+	quizzes, err := getClassQuizzes(c, sy, quiz.ClassSection, quiz.Subject)
+	if err != nil {
+		log.Errorf(c, "Could not get quizzes: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	for _, other := range quizzes {
+		if other.ID != quiz.ID && other.Term == term.Value() && other.Column == column && other.Slot == slot {
+			renderErrorMsg(w, r, http.StatusBadRequest,
+				fmt.Sprintf("%s is already used by the quiz %s", other.Target(), other.Title))
+			return
+		}
+	}
+
+	quiz.Term = term.Value()
+	quiz.Column = column
+	quiz.Slot = slot
+
+	quiz.Title = strings.TrimSpace(f.Get("Title"))
+	if quiz.Title == "" {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Title is required")
+		return
+	}
+
+	quiz.Opens, err = time.ParseInLocation(quizTimeFormat, f.Get("Opens"), schoolLocation)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid opening time")
+		return
+	}
+	quiz.Closes, err = time.ParseInLocation(quizTimeFormat, f.Get("Closes"), schoolLocation)
+	if err != nil || !quiz.Closes.After(quiz.Opens) {
+		renderErrorMsg(w, r, http.StatusBadRequest, "The closing time must be after the opening time")
+		return
+	}
+
+	quiz.Questions = nil
+	for i := 0; ; i++ {
+		_, ok := f[fmt.Sprintf("question-type-%d", i)]
+		if !ok {
+			break
+		}
+
+		text := strings.TrimSpace(f.Get(fmt.Sprintf("question-text-%d", i)))
+		if text == "" {
+			continue
+		}
+
+		typ, err := parseQuizQuestionType(f.Get(fmt.Sprintf("question-type-%d", i)))
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		pointsStr := f.Get(fmt.Sprintf("question-points-%d", i))
+		points := 1.0
+		if pointsStr != "" {
+			points, err = strconv.ParseFloat(pointsStr, 64)
+			if err != nil {
+				renderErrorMsg(w, r, http.StatusBadRequest,
+					fmt.Sprintf("Invalid points of question: %s", text))
+				return
+			}
+		}
+
+		q := quizQuestion{
+			Type:    typ,
+			Text:    text,
+			Choices: strings.TrimSpace(f.Get(fmt.Sprintf("question-choices-%d", i))),
+			Answer:  strings.TrimSpace(f.Get(fmt.Sprintf("question-answer-%d", i))),
+			Points:  points,
+		}
+		if err := q.validate(); err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		quiz.Questions = append(quiz.Questions, q)
+	}
+	if len(quiz.Questions) == 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Please add questions")
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	quiz.Teacher = user.FullName()
+
+	isNew := quiz.ID == 0
+	key := datastore.NewKey(c, "quiz", "", quiz.ID, nil)
+	if isNew {
+		key = datastore.NewIncompleteKey(c, "quiz", nil)
+	}
+	key, err = nds.Put(c, key, &quiz)
+	if err != nil {
+		log.Errorf(c, "Could not save quiz: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	quiz.ID = key.IntID()
+
+	// Submitted attempts are marked again with the changed answers
+	if err := recordQuizMarks(c, quiz, attempts); err != nil {
+		log.Errorf(c, "Could not record quiz marks: %s", err)
+		renderErrorMsg(w, r, http.StatusInternalServerError, "Could not record the marks of the quiz")
+		return
+	}
+
+	if isNew {
+		notifySubject := fmt.Sprintf("New %s Quiz", quiz.Subject)
+		notifyBody := fmt.Sprintf("A new %s quiz is added: %s\nIt can be taken between %s.\n\nTo take it, go to: %s/myquizzes",
+			quiz.Subject, quiz.Title, quiz.Window(), siteURL)
+		notify(c, notifyQuiz, classNotificationEmails(c, quiz.ClassSection), notifySubject, notifyBody)
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, quizzesURL(quiz.ClassSection, quiz.Subject), http.StatusFound)
+}
+
+func quizzesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	quiz, ok := getQuizFromForm(w, r, c)
+	if !ok {
+		return
+	}
+	if !canAccessIn(w, r, c, sy, permQuizzesEdit, "", quiz.ClassSection, quiz.Subject) {
+		return
+	}
+
+	attempts, err := getQuizAttempts(c, quiz.ID)
+	if err != nil {
+		log.Errorf(c, "Could not get quiz attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if len(attempts) > 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			"The quiz can't be deleted after students submitted it")
+		return
+	}
+
+	if err := nds.Delete(c, datastore.NewKey(c, "quiz", "", quiz.ID, nil)); err != nil {
+		log.Errorf(c, "Could not delete quiz %d: %s", quiz.ID, err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, quizzesURL(quiz.ClassSection, quiz.Subject), http.StatusFound)
+}
+
+// quizResultRow is a student in the results of a quiz
+type quizResultRow struct {
+	ID        string
+	Name      string
+	Attempt   quizAttempt
+	Submitted bool
+}
+
+func quizzesResultsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	quiz, ok := getQuizFromForm(w, r, c)
+	if !ok {
+		return
+	}
+	if !canAccessIn(w, r, c, sy, permQuizzesEdit, "", quiz.ClassSection, quiz.Subject) {
+		return
+	}
+
+	attempts, err := getQuizAttempts(c, quiz.ID)
+	if err != nil {
+		log.Errorf(c, "Could not get quiz attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	byStudent := make(map[string]quizAttempt)
+	for _, attempt := range attempts {
+		byStudent[attempt.StudentID] = attempt
+	}
+
+	students, err := findStudents(c, quiz.SY, quiz.ClassSection)
+	if err != nil {
+		log.Errorf(c, "Could not get students: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	var rows []quizResultRow
+	for _, stu := range students {
+		attempt, ok := byStudent[stu.ID]
+		rows = append(rows, quizResultRow{stu.ID, stu.Name, attempt, ok})
+	}
+
+	data := struct {
+		Quiz     onlineQuiz
+		Rows     []quizResultRow
+		Attempts int
+	}{
+		quiz,
+		rows,
+		len(attempts),
+	}
+
+	if err := render(w, r, "quizresults", data); err != nil {
+		log.Errorf(c, "Could not render template quizresults: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+// quizzesRecordHandler records the marks of the quiz again, for example if
+// they were cleared in the marks page
+func quizzesRecordHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	quiz, ok := getQuizFromForm(w, r, c)
+	if !ok {
+		return
+	}
+	if !canAccessIn(w, r, c, sy, permQuizzesEdit, "", quiz.ClassSection, quiz.Subject) {
+		return
+	}
+
+	attempts, err := getQuizAttempts(c, quiz.ID)
+	if err != nil {
+		log.Errorf(c, "Could not get quiz attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if err := recordQuizMarks(c, quiz, attempts); err != nil {
+		log.Errorf(c, "Could not record quiz marks: %s", err)
+		renderErrorMsg(w, r, http.StatusInternalServerError, "Could not record the marks of the quiz")
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, fmt.Sprintf("/quizzes/results?ID=%d", quiz.ID), http.StatusFound)
+}
+
+// myQuizRow is a quiz in the student's quizzes page
+type myQuizRow struct {
+	Quiz      onlineQuiz
+	Attempt   quizAttempt
+	Submitted bool
+}
+
+// getQuizStudent returns the student of the user and their class, and
+// renders an error if the user is not a student
+func getQuizStudent(w http.ResponseWriter, r *http.Request, c context.Context, sy string) (studentClass, bool) {
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return studentClass{}, false
+	}
+	if user.Student == nil {
+		log.Errorf(c, "User is not a student: %s", user.Email)
+		renderError(w, r, http.StatusInternalServerError)
+		return studentClass{}, false
+	}
+
+	cs, err := getStudentClass(c, user.Student.ID, sy)
+	if err != nil {
+		log.Errorf(c, "Could not get student class: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return studentClass{}, false
+	}
+	return cs, true
+}
+
+// getStudentQuiz returns the quiz of the ID form value if it is for the
+// student's class section, and renders an error if not
+func getStudentQuiz(w http.ResponseWriter, r *http.Request, c context.Context, cs studentClass) (onlineQuiz, bool) {
+	quiz, ok := getQuizFromForm(w, r, c)
+	if !ok {
+		return quiz, false
+	}
+	if quiz.SY != cs.SY || quiz.ClassSection != fmt.Sprintf("%s|%s", cs.Class, cs.Section) {
+		renderErrorMsg(w, r, http.StatusForbidden, "This quiz is not for your class")
+		return quiz, false
+	}
+	return quiz, true
+}
+
+func myQuizzesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	cs, ok := getQuizStudent(w, r, c, sy)
+	if !ok {
+		return
+	}
+
+	quizzes, err := getClassQuizzes(c, sy, fmt.Sprintf("%s|%s", cs.Class, cs.Section), "")
+	if err != nil {
+		log.Errorf(c, "Could not get quizzes: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var rows []myQuizRow
+	for _, quiz := range quizzes {
+		if s, err := getSubject(c, sy, cs.Class, quiz.Subject); err == nil && !s.inStream(cs.Stream) {
+			continue
+		}
+		attempt, submitted, err := getQuizAttempt(c, quiz.ID, cs.ID)
+		if err != nil {
+			log.Errorf(c, "Could not get quiz attempt: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		rows = append(rows, myQuizRow{quiz, attempt, submitted})
+	}
+
+	data := struct {
+		Rows []myQuizRow
+	}{
+		rows,
+	}
+
+	if err := render(w, r, "myquizzes", data); err != nil {
+		log.Errorf(c, "Could not render template myquizzes: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func myQuizzesTakeHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	cs, ok := getQuizStudent(w, r, c, sy)
+	if !ok {
+		return
+	}
+	quiz, ok := getStudentQuiz(w, r, c, cs)
+	if !ok {
+		return
+	}
+
+	attempt, submitted, err := getQuizAttempt(c, quiz.ID, cs.ID)
+	if err != nil {
+		log.Errorf(c, "Could not get quiz attempt: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !submitted && !quiz.IsOpen() {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("The quiz can only be taken between %s", quiz.Window()))
+		return
+	}
+
+	// answers are shown after the quiz closes, so they are not shared
+	// with students who did not take it yet
+	data := struct {
+		Quiz        onlineQuiz
+		Attempt     quizAttempt
+		Submitted   bool
+		ShowAnswers bool
+	}{
+		quiz,
+		attempt,
+		submitted,
+		submitted && quiz.IsClosed(),
+	}
+
+	if err := render(w, r, "myquiz", data); err != nil {
+		log.Errorf(c, "Could not render template myquiz: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func myQuizzesSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	cs, ok := getQuizStudent(w, r, c, sy)
+	if !ok {
+		return
+	}
+	quiz, ok := getStudentQuiz(w, r, c, cs)
+	if !ok {
+		return
+	}
+
+	if !quiz.IsOpen() {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("The quiz can only be taken between %s", quiz.Window()))
+		return
+	}
+
+	attempt := quizAttempt{
+		QuizID:    quiz.ID,
+		StudentID: cs.ID,
+		Name:      cs.Name,
+		Submitted: time.Now(),
+	}
+	for i := range quiz.Questions {
+		attempt.Answers = append(attempt.Answers, strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("answer-%d", i))))
+	}
+	submitted := false
+	err := nds.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		if _, submitted, err = getQuizAttempt(c, quiz.ID, cs.ID); err != nil || submitted {
+			return err
+		}
+		_, err = nds.Put(c, quizAttemptKey(c, quiz.ID, cs.ID), &attempt)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "Could not save quiz attempt: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if submitted {
+		renderErrorMsg(w, r, http.StatusBadRequest, "You already submitted this quiz")
+		return
+	}
+
+	if err := recordQuizMarks(c, quiz, []quizAttempt{attempt}); err != nil {
+		log.Errorf(c, "Could not record quiz marks: %s", err)
+		renderErrorMsg(w, r, http.StatusInternalServerError,
+			"Your answers were saved, but your mark could not be recorded. Please tell your teacher.")
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, fmt.Sprintf("/myquizzes/take?ID=%d", quiz.ID), http.StatusFound)
+}
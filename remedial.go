@@ -0,0 +1,571 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/remedial", accessHandler(remedialHandler))
+	http.HandleFunc("/remedial/save", accessHandler(remedialSaveHandler))
+	http.HandleFunc("/remedial/enroll", accessHandler(remedialEnrollHandler))
+	http.HandleFunc("/settings/remedial", accessHandler(settingsRemedialHandler))
+}
+
+// remedialSetting is how the remedial courses of a school year change the end
+// of year marks and the promotion of the students
+type remedialSetting struct {
+	Policy            attemptPolicy // how the remedial mark is combined with the end of year mark
+	MaxFailedSubjects int           // students failing more subjects after the remedial courses are retained
+}
+
+type remedialSettings struct {
+	Value remedialSetting
+}
+
+var defaultRemedialSetting = remedialSetting{
+	Policy:            policyCapped,
+	MaxFailedSubjects: 0,
+}
+
+func getRemedialSetting(c context.Context, sy string) remedialSetting {
+	key := datastore.NewKey(c, "settings", "remedial-"+sy, 0, nil)
+
+	setting := remedialSettings{}
+	if err := nds.Get(c, key, &setting); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Warningf(c, "Could not get remedial settings: %s", err)
+		}
+		return defaultRemedialSetting
+	}
+
+	return setting.Value
+}
+
+func saveRemedialSetting(c context.Context, sy string, setting remedialSetting) error {
+	key := datastore.NewKey(c, "settings", "remedial-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &remedialSettings{setting})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// remedialEnrollment is a student enrolled in the remedial course of a
+// subject after failing it at the end of the year. It will be stored in the
+// datastore.
+type remedialEnrollment struct {
+	SY        string
+	StudentID string
+	Name      string
+	Class     string
+	Section   string
+	Subject   string
+
+	EOYMark float64 // the failed end of year mark
+	Mark    float64 // the remedial mark, NaN until it is recorded
+
+	Enrolled   time.Time
+	Recorded   time.Time
+	RecordedBy string
+}
+
+func (re remedialEnrollment) HasMark() bool {
+	return !math.IsNaN(re.Mark)
+}
+
+// finalMark returns the end of year mark eoy after the remedial course
+func (re remedialEnrollment) finalMark(eoy float64, policy attemptPolicy) float64 {
+	if !re.HasMark() {
+		return eoy
+	}
+	return policy.apply(eoy, re.Mark, passPercentage)
+}
+
+// FinalMark returns the end of year mark after the remedial course
+func (re remedialEnrollment) FinalMark(policy attemptPolicy) float64 {
+	return re.finalMark(re.EOYMark, policy)
+}
+
+// Passed returns whether the student passed the subject after the remedial
+// course
+func (re remedialEnrollment) Passed(policy attemptPolicy) bool {
+	return re.HasMark() && re.FinalMark(policy) >= passPercentage
+}
+
+func remedialKey(c context.Context, sy, id, subject string) *datastore.Key {
+	return datastore.NewKey(c, "remedial", fmt.Sprintf("%s|%s|%s", sy, id, subject), 0, nil)
+}
+
+// getRemedialEnrollment returns the enrollment of the student in the remedial
+// course of subject, and whether the student is enrolled
+func getRemedialEnrollment(c context.Context, sy, id, subject string) (remedialEnrollment, bool, error) {
+	var re remedialEnrollment
+	err := nds.Get(c, remedialKey(c, sy, id, subject), &re)
+	if err == datastore.ErrNoSuchEntity {
+		return re, false, nil
+	} else if err != nil {
+		return re, false, err
+	}
+	return re, true, nil
+}
+
+// getStudentRemedials returns the remedial courses of the student
+func getStudentRemedials(c context.Context, sy, id string) ([]remedialEnrollment, error) {
+	q := datastore.NewQuery("remedial").
+		Filter("SY =", sy).
+		Filter("StudentID =", id)
+
+	var enrollments []remedialEnrollment
+	if _, err := q.GetAll(c, &enrollments); err != nil {
+		return nil, err
+	}
+	return enrollments, nil
+}
+
+// getClassRemedials returns the remedial courses of the students of the class
+// section
+func getClassRemedials(c context.Context, sy, class, section string) ([]remedialEnrollment, error) {
+	q := datastore.NewQuery("remedial").
+		Filter("SY =", sy).
+		Filter("Class =", class).
+		Filter("Section =", section)
+
+	var enrollments []remedialEnrollment
+	if _, err := q.GetAll(c, &enrollments); err != nil {
+		return nil, err
+	}
+	return enrollments, nil
+}
+
+// eoyRawMark returns the end of year mark from the end of year marks m,
+// before the remedial course
+func eoyRawMark(m []float64) float64 {
+	return sumMarks(m[0], m[1]) / 2.0
+}
+
+// remedialFinalMark returns the end of year mark eoy of the student after the
+// remedial course of the subject
+func (s Subject) remedialFinalMark(c context.Context, studentID, sy string, eoy float64) float64 {
+	if math.IsNaN(eoy) || eoy >= passPercentage {
+		return eoy
+	}
+
+	re, ok, err := getRemedialEnrollment(c, sy, studentID, s.ShortName)
+	if err != nil {
+		log.Warningf(c, "Could not get remedial of %s: %s", studentID, err)
+		return eoy
+	}
+	if !ok {
+		return eoy
+	}
+	return re.finalMark(eoy, getRemedialSetting(c, sy).Policy)
+}
+
+// syncRemedialEnrollment enrolls the student in the remedial course of the
+// subject when the end of year mark eoy is failing. A student who no longer
+// fails is withdrawn, unless the remedial mark is already recorded.
+func syncRemedialEnrollment(c context.Context, id, sy, subject string, eoy float64) error {
+	re, ok, err := getRemedialEnrollment(c, sy, id, subject)
+	if err != nil {
+		return err
+	}
+
+	failing := !math.IsNaN(eoy) && eoy < passPercentage
+	if !failing {
+		if ok && !re.HasMark() {
+			return nds.Delete(c, remedialKey(c, sy, id, subject))
+		}
+		return nil
+	}
+
+	if ok && re.EOYMark == eoy {
+		return nil
+	}
+	if !ok {
+		sc, err := getStudentClass(c, id, sy)
+		if err != nil {
+			return err
+		}
+		re = remedialEnrollment{
+			SY:        sy,
+			StudentID: id,
+			Name:      sc.Name,
+			Class:     sc.Class,
+			Section:   sc.Section,
+			Subject:   subject,
+
+			Mark: math.NaN(),
+
+			Enrolled: time.Now(),
+		}
+	}
+	re.EOYMark = eoy
+
+	_, err = nds.Put(c, remedialKey(c, sy, id, subject), &re)
+	return err
+}
+
+// enrollRemedialStudents enrolls the failing students of the class section
+// from their end of year marks. It is needed for the marks entered before
+// the remedial courses.
+func enrollRemedialStudents(c context.Context, sy, classSection string) error {
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		return err
+	}
+
+	subjects, err := getSubjects(c, sy, class)
+	if err != nil {
+		return err
+	}
+
+	students, err := findStudents(c, sy, classSection)
+	if err != nil {
+		return err
+	}
+
+	eoyTerm := Term{EndOfYear, 0}
+	for _, subject := range subjects {
+		gs, ok := getGradingSystem(c, sy, class, subject).(Subject)
+		if !ok {
+			continue
+		}
+		for _, s := range students {
+			if !gs.inStream(s.Stream) {
+				continue
+			}
+			marks, err := getStudentMarks(c, s.ID, sy, subject)
+			if err != nil {
+				return err
+			}
+			if err := gs.evaluate(c, s.ID, sy, eoyTerm, marks); err != nil {
+				log.Warningf(c, "Could not evaluate marks of %s in %s: %s", s.ID, subject, err)
+				continue
+			}
+			if err := syncRemedialEnrollment(c, s.ID, sy, subject, eoyRawMark(marks[eoyTerm])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type promotionDecision string
+
+const (
+	promotionPromoted promotionDecision = "Promoted"
+	promotionPending  promotionDecision = "Pending remedial"
+	promotionRetained promotionDecision = "Retained"
+)
+
+// Context returns the bootstrap contextual class of the decision
+func (pd promotionDecision) Context() string {
+	switch pd {
+	case promotionPromoted:
+		return "success"
+	case promotionRetained:
+		return "danger"
+	}
+	return "warning"
+}
+
+// decidePromotion returns the promotion decision of a student from their
+// remedial courses
+func decidePromotion(enrollments []remedialEnrollment, setting remedialSetting) promotionDecision {
+	failed := 0
+	pending := 0
+	for _, re := range enrollments {
+		if !re.HasMark() {
+			pending++
+		} else if !re.Passed(setting.Policy) {
+			failed++
+		}
+	}
+
+	switch {
+	case failed > setting.MaxFailedSubjects:
+		return promotionRetained
+	case failed+pending > setting.MaxFailedSubjects:
+		return promotionPending
+	}
+	return promotionPromoted
+}
+
+// getPromotionDecision returns the promotion decision of the student at the
+// end of sy
+func getPromotionDecision(c context.Context, sy, id string) (promotionDecision, error) {
+	enrollments, err := getStudentRemedials(c, sy, id)
+	if err != nil {
+		return "", err
+	}
+	return decidePromotion(enrollments, getRemedialSetting(c, sy)), nil
+}
+
+// remedialStudent is a student with remedial courses, as shown in the
+// remedial page
+type remedialStudent struct {
+	ID          string
+	Name        string
+	Enrollments []remedialEnrollment
+	Decision    promotionDecision
+}
+
+func remedialURL(classSection string) string {
+	return "/remedial?" + url.Values{"ClassSection": {classSection}}.Encode()
+}
+
+func remedialHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.Form.Get("ClassSection")
+	setting := getRemedialSetting(c, sy)
+
+	var students []remedialStudent
+	if class, section, err := parseClassSection(classSection); err == nil {
+		enrollments, err := getClassRemedials(c, sy, class, section)
+		if err != nil {
+			log.Errorf(c, "Could not get remedial courses: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		index := make(map[string]int)
+		for _, re := range enrollments {
+			i, ok := index[re.StudentID]
+			if !ok {
+				i = len(students)
+				index[re.StudentID] = i
+				students = append(students, remedialStudent{ID: re.StudentID, Name: re.Name})
+			}
+			students[i].Enrollments = append(students[i].Enrollments, re)
+		}
+		for i := range students {
+			students[i].Decision = decidePromotion(students[i].Enrollments, setting)
+		}
+	} else {
+		classSection = ""
+	}
+
+	data := struct {
+		CG           []classGroup
+		ClassSection string
+
+		Policy    attemptPolicy
+		MaxFailed int
+		PassMark  float64
+		Students  []remedialStudent
+	}{
+		getClassGroups(c, sy),
+		classSection,
+
+		setting.Policy,
+		setting.MaxFailedSubjects,
+		passPercentage,
+		students,
+	}
+
+	if err := render(w, r, "remedial", data); err != nil {
+		log.Errorf(c, "Could not render template remedial: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func remedialSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.PostForm.Get("ClassSection")
+	class, section, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	enrollments, err := getClassRemedials(c, sy, class, section)
+	if err != nil {
+		log.Errorf(c, "Could not get remedial courses: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	for _, re := range enrollments {
+		v := r.PostForm.Get(fmt.Sprintf("%s|%s", re.StudentID, re.Subject))
+		mark, err := strconv.ParseFloat(v, 64)
+		if err != nil || mark < 0 || mark > 100 {
+			// invalid or empty mark
+			mark = math.NaN()
+		}
+		if mark == re.Mark || (math.IsNaN(mark) && math.IsNaN(re.Mark)) {
+			continue
+		}
+
+		re.Mark = mark
+		re.Recorded = time.Now()
+		re.RecordedBy = user.Email
+		if _, err := nds.Put(c, remedialKey(c, sy, re.StudentID, re.Subject), &re); err != nil {
+			log.Errorf(c, "Could not save remedial mark: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		// the end of year mark is stored with the marks of the subject
+		if gs := getGradingSystem(c, sy, class, re.Subject); gs != nil {
+			if err := refreshStudentMarks(c, re.StudentID, sy, re.Subject, Term{EndOfYear, 0}, gs); err != nil {
+				log.Errorf(c, "Could not refresh marks: %s", err)
+			}
+		}
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, remedialURL(classSection), http.StatusFound)
+}
+
+func remedialEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	classSection := r.PostForm.Get("ClassSection")
+	if _, _, err := parseClassSection(classSection); err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+
+	if err := enrollRemedialStudents(c, sy, classSection); err != nil {
+		log.Errorf(c, "Could not enroll remedial students: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, remedialURL(classSection), http.StatusFound)
+}
+
+func settingsRemedialHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	policy, err := parseAttemptPolicy(r.PostForm.Get("Policy"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	maxFailed, err := strconv.Atoi(r.PostForm.Get("MaxFailedSubjects"))
+	if err != nil || maxFailed < 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid number of failed subjects")
+		return
+	}
+
+	if err := saveRemedialSetting(c, sy, remedialSetting{policy, maxFailed}); err != nil {
+		log.Errorf(c, "Could not save remedial settings: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// applyRemedial changes the GPA row of subject after the remedial course of
+// the student. The failed semesters earn their credits if the course is
+// passed, and the final mark is changed by the policy. It returns the credits
+// earned and the weighted total added to the year.
+func (row *GPARow) applyRemedial(c context.Context, sy, id, subject string) (float64, float64) {
+	re, ok, err := getRemedialEnrollment(c, sy, id, subject)
+	if err != nil {
+		log.Warningf(c, "Could not get remedial of %s: %s", id, err)
+		return 0, 0
+	}
+	if !ok || !re.HasMark() {
+		return 0, 0
+	}
+
+	policy := getRemedialSetting(c, sy).Policy
+	row.Remedial = true
+
+	var credits, weighted float64
+	if re.Passed(policy) {
+		if row.S1Available && row.S1CE == 0 {
+			row.S1CE = row.S1CA
+			credits += row.S1CE
+			weighted += row.S1CE * row.S1AV
+		}
+		if row.S2Available && row.S2CE == 0 {
+			row.S2CE = row.S2CA
+			credits += row.S2CE
+			weighted += row.S2CE * row.S2AV
+		}
+	}
+
+	if final := re.finalMark(row.FinalMark, policy); final != row.FinalMark {
+		row.FinalMark = final
+		_, row.FinalGpa = gpaAvWgp(final)
+	}
+
+	return credits, weighted
+}
+
+// fromRemedial returns whether the mark of the student in subject and term
+// comes from the remedial course
+func fromRemedial(c context.Context, sy, id, subject string, term Term) bool {
+	if term.Typ != EndOfYear {
+		return false
+	}
+	re, ok, err := getRemedialEnrollment(c, sy, id, subject)
+	if err != nil {
+		log.Warningf(c, "Could not get remedial of %s: %s", id, err)
+		return false
+	}
+	return ok && re.HasMark()
+}
@@ -21,6 +21,9 @@ type reportcardRow struct {
 
 	DetailsCols  []colDescription
 	DetailsMarks []float64
+
+	// the mark comes from the remedial course
+	Remedial bool
 }
 
 func init() {
@@ -74,6 +77,7 @@ func reportcardHandler(w http.ResponseWriter, r *http.Request) {
 	var reportcardRows []reportcardRow
 	var average float64
 	var behavior []float64
+	var behaviorDesc []BehaviorCriterion
 	var remark, letterDesc string
 	if publish {
 		total := math.NaN()
@@ -120,7 +124,8 @@ func reportcardHandler(w http.ResponseWriter, r *http.Request) {
 				inAverage = true
 			}
 			reportcardRows = append(reportcardRows, reportcardRow{
-				subject, mark, letter, inAverage, gs.description(c, sy, term), marks[term]})
+				subject, mark, letter, inAverage, gs.description(c, sy, term), marks[term],
+				fromRemedial(c, sy, stu.ID, subject, term)})
 		}
 		average = total / float64(numInAverage)
 
@@ -130,6 +135,14 @@ func reportcardHandler(w http.ResponseWriter, r *http.Request) {
 			renderError(w, r, http.StatusInternalServerError)
 			return
 		}
+
+		rubric, err := getTermBehaviorRubric(c, sy, class, term)
+		if err != nil {
+			log.Errorf(c, "Could not get behavior rubric: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		behaviorDesc = rubric.Criteria
 	}
 
 	data := struct {
@@ -144,7 +157,7 @@ func reportcardHandler(w http.ResponseWriter, r *http.Request) {
 		SubjectRows  []reportcardRow
 		Average      float64
 		Behavior     []float64
-		BehaviorDesc []colDescription
+		BehaviorDesc []BehaviorCriterion
 		Remark       string
 
 		LetterDesc string
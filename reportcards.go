@@ -30,14 +30,20 @@ type reportcard struct {
 
 	Remark string
 
-	Behavior     []float64
-	BehaviorDesc []colDescription
+	// Outcomes are the levels of the standards-based subjects
+	Outcomes          []reportcardOutcomes
+	ProficiencyLevels []string
+
+	Behavior       []float64
+	BehaviorDesc   []BehaviorCriterion
+	BehaviorLevels []string
 
 	Attendance     []float64
 	AttendanceDesc []colDescription
 
 	LetterDesc   string
 	CalculateAll bool
+	Remedial     bool // some marks come from remedial courses
 }
 
 type eoyGpaReportcard struct {
@@ -54,6 +60,9 @@ type reportcardsRow struct {
 	Name   string
 	Marks  []float64
 	Letter string
+
+	// the mark comes from the remedial course
+	Remedial bool
 }
 
 func init() {
@@ -308,6 +317,12 @@ func reportcardsPrintHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				continue
 			}
+			if sgs, ok := gs.(standardsGradingSystem); ok {
+				if len(sgs.description(c, sy, term)) > 0 {
+					rc.Outcomes = append(rc.Outcomes, sgs.reportcardOutcomes(c, sy, term, marks))
+				}
+				continue
+			}
 
 			mark := gs.get100(term, marks)
 			letter := ls.getLetter(mark)
@@ -332,6 +347,10 @@ func reportcardsPrintHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			} else if term.Typ == EndOfYear {
 				rcRow.Marks = marks[term]
+				if fromRemedial(c, sy, stu.ID, subject, term) {
+					rcRow.Remedial = true
+					rc.Remedial = true
+				}
 			}
 
 			if gs.subjectInAverage() {
@@ -402,7 +421,15 @@ func reportcardsPrintHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		rc.Remark = remark
 
-		rc.BehaviorDesc = behaviorDesc
+		rubric, err := getTermBehaviorRubric(c, sy, stu.Class, term)
+		if err != nil {
+			log.Errorf(c, "Could not get behavior rubric: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		rc.BehaviorDesc = rubric.Criteria
+		rc.BehaviorLevels = rubric.Levels
+		rc.ProficiencyLevels = proficiencyLevels
 		rc.AttendanceDesc = displayAttendanceDesc
 		rc.LetterDesc = ls.String()
 		rc.CalculateAll = calculateAll
@@ -600,6 +627,10 @@ func reportcardsGpaTermHandler(w http.ResponseWriter, r *http.Request) {
 				gpaRow.FinalGpa = gpaRow.S2WGP
 			}
 
+			earned, weighted := gpaRow.applyRemedial(c, sy, stu.ID, subject)
+			yearCreditsEarned += earned
+			yearWeightedTotal += weighted
+
 			yearSubjectCount += 1
 			yearMarksTotal += gpaRow.FinalMark
 			yearGpTotal += gpaRow.FinalGpa
@@ -8,12 +8,44 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 func init() {
 	http.HandleFunc("/reports", accessHandler(reportsHandler))
 	http.HandleFunc("/reports/select", accessHandler(reportsSelectHandler))
 	http.HandleFunc("/reports/generate", accessHandler(reportsGenerateHandler))
+
+	registerReport(reportType{
+		Name:   ReportProficiencyAndExcellence,
+		Params: []reportParam{reportParamSchoolYears, reportParamClasses, reportParamSubjects},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportProficiencyAndExcellence(c, p.SchoolYears, p.Classes, p.Subjects)
+		},
+	})
+	registerReport(reportType{
+		Name:   ReportProficiencyAndExcellenceBySubject,
+		Params: []reportParam{reportParamSchoolYears, reportParamClasses, reportParamSubjects},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportProficiencyAndExcellenceBySubject(c, p.SchoolYears, p.Classes, p.Subjects)
+		},
+	})
+	registerReport(reportType{
+		Name:   ReportFinalMarksSummary,
+		Params: []reportParam{reportParamSchoolYear, reportParamClasses, reportParamSubjects},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportFinalMarksSummary(c, p.SchoolYears[0], p.singleClasses(), p.singleSubjects())
+		},
+	})
+	registerReport(reportType{
+		Name:   ReportSemesterTestResultComparison,
+		Params: []reportParam{reportParamSchoolYear, reportParamClasses, reportParamSubjects},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportSemesterTestResultComparison(c, p.SchoolYears[0], p.singleClasses(), p.singleSubjects())
+		},
+	})
 }
 
 const ReportProficiencyAndExcellence = "Proficiency and Excellence"
@@ -21,19 +53,214 @@ const ReportProficiencyAndExcellenceBySubject = "Proficiency and Excellence (By
 const ReportFinalMarksSummary = "Final Marks Summary"
 const ReportSemesterTestResultComparison = "Semester Test Result Comparison"
 
-var reportNames = []string{
-	ReportProficiencyAndExcellence,
-	ReportProficiencyAndExcellenceBySubject,
-	ReportFinalMarksSummary,
-	ReportSemesterTestResultComparison,
-}
-
 type ReportCell struct {
 	Value   string
 	Colspan int
 	Rowspan int
 }
 
+// reportParam is a parameter of a report, which is shown in its form
+type reportParam int
+
+const (
+	reportParamSchoolYear  reportParam = iota // one school year
+	reportParamSchoolYears                    // one or more school years to compare
+	reportParamClasses
+	reportParamSubjects
+	reportParamTerm
+	reportParamDateRange
+)
+
+// reportParams are the values of the parameters of a report. Classes and
+// Subjects have a row per class or subject, with a column per school year.
+type reportParams struct {
+	SchoolYears []string
+	Classes     [][]string
+	Subjects    [][]string
+	Term        Term
+	From        time.Time
+	To          time.Time
+}
+
+// singleClasses returns the classes of the first school year
+func (p reportParams) singleClasses() []string {
+	var classes []string
+	for _, class := range p.Classes {
+		classes = append(classes, class[0])
+	}
+	return classes
+}
+
+// singleSubjects returns the subjects of the first school year
+func (p reportParams) singleSubjects() []string {
+	var subjects []string
+	for _, subject := range p.Subjects {
+		subjects = append(subjects, subject[0])
+	}
+	return subjects
+}
+
+// reportType is a report that can be generated in the reports page
+type reportType struct {
+	Name     string
+	Params   []reportParam
+	Generate func(c context.Context, p reportParams) ([][]ReportCell, error)
+}
+
+func (rt reportType) has(param reportParam) bool {
+	for _, p := range rt.Params {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+// Used in the templates
+func (rt reportType) HasClasses() bool   { return rt.has(reportParamClasses) }
+func (rt reportType) HasSubjects() bool  { return rt.has(reportParamSubjects) }
+func (rt reportType) HasTerm() bool      { return rt.has(reportParamTerm) }
+func (rt reportType) HasDateRange() bool { return rt.has(reportParamDateRange) }
+
+// reportTypes are the registered reports, in the order they are shown
+var reportTypes []reportType
+
+// registerReport adds a report to the reports page. It should be called in
+// init.
+func registerReport(rt reportType) {
+	if _, ok := getReportType(rt.Name); ok {
+		panic(fmt.Sprintf("Report registered twice: %s", rt.Name))
+	}
+	reportTypes = append(reportTypes, rt)
+}
+
+func getReportType(name string) (reportType, bool) {
+	for _, rt := range reportTypes {
+		if rt.Name == name {
+			return rt, true
+		}
+	}
+	return reportType{}, false
+}
+
+func reportNames() []string {
+	var names []string
+	for _, rt := range reportTypes {
+		names = append(names, rt.Name)
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReportParams validates the parameters of rt in the form
+func parseReportParams(c context.Context, rt reportType, form url.Values) (reportParams, error) {
+	var p reportParams
+
+	allSchoolYears := getSchoolYears(c)
+	for _, sy := range form["SchoolYears"] {
+		if !containsString(allSchoolYears, sy) {
+			return p, fmt.Errorf("Invalid school year: %s", sy)
+		}
+		p.SchoolYears = append(p.SchoolYears, sy)
+	}
+	switch {
+	case rt.has(reportParamSchoolYear) && len(p.SchoolYears) != 1:
+		return p, fmt.Errorf("Select one school year")
+	case rt.has(reportParamSchoolYears) && len(p.SchoolYears) == 0:
+		return p, fmt.Errorf("Select at least one school year")
+	}
+
+	// rows returns the rows of the select elements with the prefix name,
+	// which have a column per school year
+	rows := func(prefix string, valid func(sy string) []string, required bool) ([][]string, error) {
+		if len(p.SchoolYears) == 0 {
+			return nil, nil
+		}
+		n := len(form[prefix+p.SchoolYears[0]])
+		for _, sy := range p.SchoolYears {
+			if len(form[prefix+sy]) != n {
+				return nil, fmt.Errorf("Invalid form")
+			}
+		}
+
+		var result [][]string
+		for i := 0; i < n; i++ {
+			row := make([]string, len(p.SchoolYears))
+			empty := true
+			for syi, sy := range p.SchoolYears {
+				value := form[prefix+sy][i]
+				if value == "" {
+					if required {
+						return nil, fmt.Errorf("Row %d is incomplete", i+1)
+					}
+				} else if !containsString(valid(sy), value) {
+					return nil, fmt.Errorf("Invalid value in %s: %s", sy, value)
+				} else {
+					empty = false
+				}
+				row[syi] = value
+			}
+			if !empty {
+				result = append(result, row)
+			}
+		}
+		return result, nil
+	}
+
+	if rt.has(reportParamClasses) {
+		classes, err := rows("classes-", func(sy string) []string { return getClasses(c, sy) }, true)
+		if err != nil {
+			return p, fmt.Errorf("Classes: %s", err)
+		}
+		if len(classes) == 0 {
+			return p, fmt.Errorf("Add at least one class")
+		}
+		p.Classes = classes
+	}
+
+	if rt.has(reportParamSubjects) {
+		subjects, err := rows("subjects-", func(sy string) []string { return getAllSubjects(c, sy) }, false)
+		if err != nil {
+			return p, fmt.Errorf("Subjects: %s", err)
+		}
+		if len(subjects) == 0 {
+			return p, fmt.Errorf("Add at least one subject")
+		}
+		p.Subjects = subjects
+	}
+
+	if rt.has(reportParamTerm) {
+		term, err := parseTerm(form.Get("Term"))
+		if err != nil {
+			return p, fmt.Errorf("Select a term")
+		}
+		p.Term = term
+	}
+
+	if rt.has(reportParamDateRange) {
+		from, err1 := parseDate(form.Get("From"))
+		to, err2 := parseDate(form.Get("To"))
+		if err1 != nil || err2 != nil || from.IsZero() || to.IsZero() {
+			return p, fmt.Errorf("Enter the dates")
+		}
+		if to.Before(from) {
+			return p, fmt.Errorf("The end date is before the start date")
+		}
+		p.From = from
+		p.To = to
+	}
+
+	return p, nil
+}
+
 func reportsHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
@@ -43,7 +270,7 @@ func reportsHandler(w http.ResponseWriter, r *http.Request) {
 		ReportNames []string
 		SchoolYears []string
 	}{
-		reportNames,
+		reportNames(),
 		schoolYears,
 	}
 
@@ -63,9 +290,21 @@ func reportsSelectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reportName := r.PostForm.Get("ReportName")
+	rt, ok := getReportType(r.PostForm.Get("ReportName"))
+	if !ok {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Select a report")
+		return
+	}
 
 	schoolYears := r.PostForm["SchoolYears"]
+	switch {
+	case rt.has(reportParamSchoolYear) && len(schoolYears) != 1:
+		renderErrorMsg(w, r, http.StatusBadRequest, fmt.Sprintf("%s uses one school year", rt.Name))
+		return
+	case rt.has(reportParamSchoolYears) && len(schoolYears) == 0:
+		renderErrorMsg(w, r, http.StatusBadRequest, "Select at least one school year")
+		return
+	}
 
 	classes := make(map[string][]string)
 	subjects := make(map[string][]string)
@@ -74,26 +313,36 @@ func reportsSelectHandler(w http.ResponseWriter, r *http.Request) {
 		subjects[sy] = getAllSubjects(c, sy)
 	}
 
-	switch reportName {
-	case ReportProficiencyAndExcellence:
-	case ReportProficiencyAndExcellenceBySubject:
-	case ReportFinalMarksSummary:
-		schoolYears = schoolYears[:1]
-	case ReportSemesterTestResultComparison:
-		schoolYears = schoolYears[:1]
-	default:
+	var weekS1Terms []Term
+	var weekS2Terms []Term
+	if rt.HasTerm() {
+		maxWeeks := getMaxWeeks(c)
+		for i := 1; i <= maxWeeks; i++ {
+			weekS1Terms = append(weekS1Terms, Term{WeekS1, i})
+			weekS2Terms = append(weekS2Terms, Term{WeekS2, i})
+		}
 	}
 
 	data := struct {
 		ReportName  string
+		Type        reportType
 		SchoolYears []string
 		Classes     map[string][]string
 		Subjects    map[string][]string
+
+		Terms       []Term
+		WeekS1Terms []Term
+		WeekS2Terms []Term
 	}{
-		reportName,
+		rt.Name,
+		rt,
 		schoolYears,
 		classes,
 		subjects,
+
+		terms,
+		weekS1Terms,
+		weekS2Terms,
 	}
 
 	if err := render(w, r, "reportsselect", data); err != nil {
@@ -113,57 +362,63 @@ func reportsGenerateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reportName := r.PostForm.Get("ReportName")
-
-	schoolYears := r.PostForm["SchoolYears"]
-
-	classes := make([][]string, len(r.PostForm["classes-"+schoolYears[0]]))
-	for i := 0; i < len(classes); i++ {
-		classes[i] = make([]string, len(schoolYears))
-		for syi, sy := range schoolYears {
-			formClasses := r.PostForm["classes-"+sy]
-			classes[i][syi] = formClasses[i]
-		}
+	rt, ok := getReportType(reportName)
+	if !ok {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Select a report")
+		return
 	}
 
-	var classesSingle []string
-	for _, class := range classes {
-		classesSingle = append(classesSingle, class[0])
+	params, err := parseReportParams(c, rt, r.PostForm)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	subjects := make([][]string, len(r.PostForm["subjects-"+schoolYears[0]]))
-	for i := 0; i < len(subjects); i++ {
-		subjects[i] = make([]string, len(schoolYears))
-		for syi, sy := range schoolYears {
-			formsubjects := r.PostForm["subjects-"+sy]
-			subjects[i][syi] = formsubjects[i]
-		}
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
 	}
-
-	var subjectsSingle []string
-	for _, subjectSy := range subjects {
-		subjectsSingle = append(subjectsSingle, subjectSy[0])
+	// Each class and subject of the report must be in one scope. Reports
+	// without classes or subjects are about all of them.
+	var classes, subjects []string
+	for _, cs := range params.Classes {
+		classes = append(classes, cs...)
 	}
-
-	var report [][]ReportCell
-	var err error
-	switch reportName {
-	case ReportProficiencyAndExcellence:
-		report, err = generateReportProficiencyAndExcellence(c, schoolYears, classes, subjects)
-	case ReportProficiencyAndExcellenceBySubject:
-		report, err = generateReportProficiencyAndExcellenceBySubject(c, schoolYears, classes, subjects)
-	case ReportFinalMarksSummary:
-		report, err = generateReportFinalMarksSummary(c, schoolYears[0], classesSingle, subjectsSingle)
-	case ReportSemesterTestResultComparison:
-		report, err = generateReportSemesterTestResultComparison(c, schoolYears[0], classesSingle, subjectsSingle)
-	default:
+	for _, ss := range params.Subjects {
+		subjects = append(subjects, ss...)
+	}
+	if len(classes) == 0 {
+		classes = []string{""}
+	}
+	if len(subjects) == 0 {
+		subjects = []string{""}
+	}
+	for _, class := range classes {
+		for _, subject := range subjects {
+			if !user.Permissions.inScope(permReportsRun, class, "", subject) {
+				renderErrorMsg(w, r, http.StatusForbidden, "You do not have access to this class/subject")
+				return
+			}
+		}
 	}
 
+	report, err := rt.Generate(c, params)
 	if err != nil {
 		log.Errorf(c, "Could not get report: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 
+	if r.PostForm.Get("Format") == "xlsx" {
+		setXLSXHeaders(w, strings.Replace(reportName, " ", "-", -1))
+		if err := writeXLSX(w, reportXLSX(reportName, report)); err != nil {
+			log.Errorf(c, "Error writing xlsx: %s", err)
+		}
+		return
+	}
+
 	data := struct {
 		ReportName string
 		Report     [][]ReportCell
@@ -565,3 +820,87 @@ func mapRow(title string, count int, f func(int) string) []ReportCell {
 	}
 	return row
 }
+
+// flattenReport converts a report to a grid of strings. The value of a merged
+// cell is in its first row and column, and the rest of its cells are empty.
+func flattenReport(report [][]ReportCell) [][]string {
+	var grid [][]string
+
+	// column -> number of rows still covered by a cell above
+	covered := make(map[int]int)
+	for _, row := range report {
+		var line []string
+		next := make(map[int]int)
+
+		skipCovered := func() {
+			for covered[len(line)] > 0 {
+				if covered[len(line)] > 1 {
+					next[len(line)] = covered[len(line)] - 1
+				}
+				line = append(line, "")
+			}
+		}
+
+		for _, cell := range row {
+			if cell.Colspan == 0 || cell.Rowspan == 0 {
+				// not shown
+				continue
+			}
+			skipCovered()
+			value := strings.TrimSpace(strings.Replace(cell.Value, "\u00A0", " ", -1))
+			for i := 0; i < cell.Colspan; i++ {
+				if cell.Rowspan > 1 {
+					next[len(line)] = cell.Rowspan - 1
+				}
+				if i == 0 {
+					line = append(line, value)
+				} else {
+					line = append(line, "")
+				}
+			}
+		}
+		skipCovered()
+
+		for col, n := range covered {
+			if col >= len(line) && n > 1 {
+				next[col] = n - 1
+			}
+		}
+		covered = next
+
+		grid = append(grid, line)
+	}
+
+	return grid
+}
+
+// reportXLSX converts a report to a worksheet. Numbers and percentages are
+// written as numbers, and the rows of the first row's cells are the header.
+func reportXLSX(reportName string, report [][]ReportCell) xlsxSheet {
+	sheet := xlsxSheet{Name: reportName}
+
+	for i, row := range report {
+		var cells []xlsxCell
+		for _, cell := range row {
+			value := strings.TrimSpace(strings.Replace(cell.Value, "\u00A0", " ", -1))
+			xc := xlsxCell{Value: value, Colspan: cell.Colspan, Rowspan: cell.Rowspan}
+			if i == 0 && cell.Rowspan > sheet.HeaderRows {
+				sheet.HeaderRows = cell.Rowspan
+			}
+
+			if value == "" {
+				xc.Value = nil
+			} else if f, percent, ok := parseXLSXNumber(value); ok {
+				xc.Value = f
+				xc.Format = xlsxNumber
+				if percent {
+					xc.Format = xlsxPercent
+				}
+			}
+			cells = append(cells, xc)
+		}
+		sheet.Rows = append(sheet.Rows, cells)
+	}
+
+	return sheet
+}
@@ -0,0 +1,597 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/marks/attempts", accessHandler(attemptsHandler))
+	http.HandleFunc("/marks/attempts/save", accessHandler(attemptsSaveHandler))
+	http.HandleFunc("/marks/attempts/delete", accessHandler(attemptsDeleteHandler))
+}
+
+type attemptKind string
+
+const (
+	attemptResit  attemptKind = "resit"
+	attemptMakeup attemptKind = "makeup"
+)
+
+var attemptKinds = []attemptKind{
+	attemptResit,
+	attemptMakeup,
+}
+
+var attemptKindStrings = map[attemptKind]string{
+	attemptResit:  "Re-sit",
+	attemptMakeup: "Make-up",
+}
+
+func (ak attemptKind) Value() string {
+	return string(ak)
+}
+
+func (ak attemptKind) String() string {
+	str, ok := attemptKindStrings[ak]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid attemptKind: %s", string(ak)))
+}
+
+func parseAttemptKind(s string) (attemptKind, error) {
+	ak := attemptKind(s)
+	if _, ok := attemptKindStrings[ak]; !ok {
+		return "", fmt.Errorf("Invalid attempt kind: %s", s)
+	}
+	return ak, nil
+}
+
+// attemptPolicy decides how the mark of an attempt is combined with the mark
+// of the column
+type attemptPolicy string
+
+const (
+	policyReplace attemptPolicy = "replace"
+	policyMax     attemptPolicy = "max"
+	policyCapped  attemptPolicy = "capped"
+)
+
+var attemptPolicies = []attemptPolicy{
+	policyReplace,
+	policyMax,
+	policyCapped,
+}
+
+var attemptPolicyStrings = map[attemptPolicy]string{
+	policyReplace: "Replace the mark",
+	policyMax:     "Best of the attempts",
+	policyCapped:  "Best of the attempts, capped at the pass mark",
+}
+
+func (ap attemptPolicy) Value() string {
+	return string(ap)
+}
+
+func (ap attemptPolicy) String() string {
+	str, ok := attemptPolicyStrings[ap]
+	if ok {
+		return str
+	}
+	panic(fmt.Sprintf("Invalid attemptPolicy: %s", string(ap)))
+}
+
+func parseAttemptPolicy(s string) (attemptPolicy, error) {
+	ap := attemptPolicy(s)
+	if _, ok := attemptPolicyStrings[ap]; !ok {
+		return "", fmt.Errorf("Invalid attempt policy: %s", s)
+	}
+	return ap, nil
+}
+
+// apply returns the mark of the column after the attempt. pass is the pass
+// mark of the column.
+func (ap attemptPolicy) apply(mark, attempt, pass float64) float64 {
+	switch ap {
+	case policyReplace:
+		return attempt
+	case policyCapped:
+		attempt = math.Min(attempt, pass)
+	}
+	if math.IsNaN(mark) || attempt > mark {
+		return attempt
+	}
+	return mark
+}
+
+// markAttempt is a re-sit or a make-up of a column of a subject. The mark of
+// the column is not changed, and the attempt is applied when the marks are
+// evaluated.
+type markAttempt struct {
+	ID string
+
+	Subject    string
+	Term       string
+	Column     int
+	ColumnName string
+
+	Kind   attemptKind
+	Policy attemptPolicy
+	Mark   float64
+	Date   time.Time
+	Reason string `datastore:",noindex"`
+
+	Created   time.Time
+	CreatedBy string
+}
+
+// matches returns whether the attempt is of subject in term, and its column
+// is still one of cols
+func (a markAttempt) matches(subject string, term Term, cols []colDescription) bool {
+	return a.Subject == subject && a.Term == term.Value() &&
+		a.Column >= 0 && a.Column < len(cols) && cols[a.Column].Name == a.ColumnName
+}
+
+type markAttemptSorter []markAttempt
+
+func (s markAttemptSorter) Len() int {
+	return len(s)
+}
+
+func (s markAttemptSorter) Less(i, j int) bool {
+	if !s[i].Date.Equal(s[j].Date) {
+		return s[i].Date.Before(s[j].Date)
+	}
+	return s[i].Created.Before(s[j].Created)
+}
+
+func (s markAttemptSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// studentAttempts are all the attempts of a student in a school year. It will
+// be stored in the datastore.
+type studentAttempts struct {
+	StudentID string
+	SY        string
+	Attempts  []markAttempt
+}
+
+func studentAttemptsKey(c context.Context, id, sy string) *datastore.Key {
+	return datastore.NewKey(c, "markattempts", fmt.Sprintf("%s|%s", id, sy), 0, nil)
+}
+
+// getStudentAttempts returns the attempts of the student, in the order they
+// were sat
+func getStudentAttempts(c context.Context, id, sy string) ([]markAttempt, error) {
+	var sa studentAttempts
+	err := nds.Get(c, studentAttemptsKey(c, id, sy), &sa)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Sort(markAttemptSorter(sa.Attempts))
+	return sa.Attempts, nil
+}
+
+func saveStudentAttempts(c context.Context, id, sy string, attempts []markAttempt) error {
+	_, err := nds.Put(c, studentAttemptsKey(c, id, sy), &studentAttempts{id, sy, attempts})
+	return err
+}
+
+// getStudentTermAttempts returns the attempts of the student in subject and
+// term
+func getStudentTermAttempts(c context.Context, id, sy, subject string, term Term) ([]markAttempt, error) {
+	attempts, err := getStudentAttempts(c, id, sy)
+	if err != nil {
+		return nil, err
+	}
+
+	var termAttempts []markAttempt
+	for _, a := range attempts {
+		if a.Subject == subject && a.Term == term.Value() {
+			termAttempts = append(termAttempts, a)
+		}
+	}
+	return termAttempts, nil
+}
+
+// applyAttempts applies the attempts of the student to the marks of the
+// subject in term. It returns the marks of the columns before the attempts.
+func (s Subject) applyAttempts(c context.Context, studentID, sy string, term Term, m []float64, cols []colDescription) map[int]float64 {
+	if !adjustableTerm(term) {
+		return nil
+	}
+
+	attempts, err := getStudentTermAttempts(c, studentID, sy, s.ShortName, term)
+	if err != nil {
+		log.Warningf(c, "Could not get attempts of %s: %s", studentID, err)
+		return nil
+	}
+	if len(attempts) == 0 {
+		return nil
+	}
+
+	raw := make(map[int]float64)
+	for _, a := range attempts {
+		if !a.matches(s.ShortName, term, cols) || !cols[a.Column].Editable {
+			continue
+		}
+		if _, ok := raw[a.Column]; !ok {
+			raw[a.Column] = m[a.Column]
+		}
+		pass := cols[a.Column].Max * passPercentage / 100.0
+		m[a.Column] = a.Policy.apply(m[a.Column], a.Mark, pass)
+	}
+
+	return raw
+}
+
+// refreshStudentMarks evaluates and stores the marks of the student in term
+// after its attempts are changed. The later terms don't need to be evaluated
+// here: storeMarksRow evaluates and stores each next term up to the end of
+// year, and syncs the remedial enrollment with the end of year mark.
+func refreshStudentMarks(c context.Context, id, sy, subject string, term Term, gs gradingSystem) error {
+	m, err := getStudentMarks(c, id, sy, subject)
+	if err != nil {
+		return err
+	}
+	if err := gs.evaluate(c, id, sy, term, m); err != nil {
+		return err
+	}
+	return storeMarksRow(c, id, sy, term, subject, m, gs)
+}
+
+func attemptsURL(classSection, subject string, term Term) string {
+	return "/marks/attempts?" + url.Values{
+		"ClassSection": {classSection},
+		"Subject":      {subject},
+		"Term":         {term.Value()},
+	}.Encode()
+}
+
+// attemptRow is an attempt of a student, as shown in the attempts page
+type attemptRow struct {
+	StudentID string
+	Name      string
+	Original  float64
+	Attempt   markAttempt
+}
+
+// getAttemptRows returns the attempts of the students of the class section
+// in subject and term
+func getAttemptRows(c context.Context, sy string, students []studentClass, subject string, term Term) ([]attemptRow, error) {
+	var rows []attemptRow
+	for _, s := range students {
+		attempts, err := getStudentTermAttempts(c, s.ID, sy, subject, term)
+		if err != nil {
+			return nil, err
+		}
+		if len(attempts) == 0 {
+			continue
+		}
+
+		keyStr := fmt.Sprintf("%s|%s|%s|%s", s.ID, sy, term.Value(), subject)
+		key := datastore.NewKey(c, "marks", keyStr, 0, nil)
+		var mr marksRow
+		if err := nds.Get(c, key, &mr); err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+
+		for _, a := range attempts {
+			original := math.NaN()
+			if a.Column < len(mr.Marks) {
+				original = mr.Marks[a.Column]
+			}
+			rows = append(rows, attemptRow{s.ID, s.Name, original, a})
+		}
+	}
+	return rows, nil
+}
+
+func attemptsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, err := parseTerm(r.Form.Get("Term"))
+	if err != nil || !adjustableTerm(term) {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Only quarter and semester marks can have re-sits and make-ups")
+		return
+	}
+	classSection := r.Form.Get("ClassSection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	subject := r.Form.Get("Subject")
+	gs, ok := getGradingSystem(c, sy, class, subject).(Subject)
+	if !ok {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid subject")
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permMarksEdit, "", classSection, subject) {
+		return
+	}
+
+	students, err := findStudentsSorted(c, sy, classSection, true)
+	if err != nil {
+		log.Errorf(c, "Could not get students: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	var inStream []studentClass
+	for _, s := range students {
+		if gs.inStream(s.Stream) {
+			inStream = append(inStream, s)
+		}
+	}
+
+	rows, err := getAttemptRows(c, sy, inStream, subject, term)
+	if err != nil {
+		log.Errorf(c, "Could not get attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Term         Term
+		ClassSection string
+		Subject      string
+
+		Students []studentClass
+		Cols     []colDescription
+		Kinds    []attemptKind
+		Policies []attemptPolicy
+		Today    time.Time
+
+		Rows []attemptRow
+	}{
+		term,
+		classSection,
+		subject,
+
+		inStream,
+		gs.description(c, sy, term),
+		attemptKinds,
+		attemptPolicies,
+		time.Now(),
+
+		rows,
+	}
+
+	if err := render(w, r, "attempts", data); err != nil {
+		log.Errorf(c, "Could not render template attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+// saveAttemptsChange refreshes the marks of the student and the completion of
+// the class section after its attempts are changed
+func saveAttemptsChange(c context.Context, sy, classSection, studentID, subject string, term Term, gs gradingSystem) error {
+	if err := refreshStudentMarks(c, studentID, sy, subject, term, gs); err != nil {
+		return err
+	}
+
+	nComplete, err := computeCompletion(c, sy, term, classSection, subject)
+	if err != nil {
+		return err
+	}
+	return storeCompletion(c, sy, classSection, term, subject, nComplete)
+}
+
+func attemptsSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	f := r.PostForm
+
+	term, err := parseTerm(f.Get("Term"))
+	if err != nil || !adjustableTerm(term) {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Only quarter and semester marks can have re-sits and make-ups")
+		return
+	}
+	classSection := f.Get("ClassSection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	subject := f.Get("Subject")
+	gs, ok := getGradingSystem(c, sy, class, subject).(Subject)
+	if !ok {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid subject")
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permMarksEdit, "", classSection, subject) {
+		return
+	}
+
+	studentID := f.Get("StudentID")
+	sc, err := getStudentClass(c, studentID, sy)
+	if err != nil || fmt.Sprintf("%s|%s", sc.Class, sc.Section) != classSection {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid student")
+		return
+	}
+
+	cols := gs.description(c, sy, term)
+	column, err := strconv.Atoi(f.Get("Column"))
+	if err != nil || column < 0 || column >= len(cols) || !cols[column].Editable {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid column")
+		return
+	}
+
+	kind, err := parseAttemptKind(f.Get("Kind"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	policy, err := parseAttemptPolicy(f.Get("Policy"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	mark, err := strconv.ParseFloat(f.Get("Mark"), 64)
+	if err != nil || mark < 0 || mark > cols[column].Max {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid mark")
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", f.Get("Date"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid date")
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	attempt := markAttempt{
+		Subject:    subject,
+		Term:       term.Value(),
+		Column:     column,
+		ColumnName: cols[column].Name,
+
+		Kind:   kind,
+		Policy: policy,
+		Mark:   mark,
+		Date:   date,
+		Reason: strings.TrimSpace(f.Get("Reason")),
+
+		Created:   time.Now(),
+		CreatedBy: user.Email,
+	}
+	attempt.ID = strconv.FormatInt(attempt.Created.UnixNano(), 36)
+
+	attempts, err := getStudentAttempts(c, studentID, sy)
+	if err != nil {
+		log.Errorf(c, "Could not get attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	attempts = append(attempts, attempt)
+	if err := saveStudentAttempts(c, studentID, sy, attempts); err != nil {
+		log.Errorf(c, "Could not save attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveAttemptsChange(c, sy, classSection, studentID, subject, term, gs); err != nil {
+		log.Errorf(c, "Could not refresh marks: %s", err)
+	}
+
+	log.Infof(c, "%s added a %s of %s %s %s for %s: %s", user.Email, kind, subject,
+		term.Value(), attempt.ColumnName, studentID, formatMarkTrim(mark))
+
+	// TODO: message of success
+	http.Redirect(w, r, attemptsURL(classSection, subject, term), http.StatusFound)
+}
+
+func attemptsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	f := r.PostForm
+
+	classSection := f.Get("ClassSection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid class and section")
+		return
+	}
+	studentID := f.Get("StudentID")
+	sc, err := getStudentClass(c, studentID, sy)
+	if err != nil || fmt.Sprintf("%s|%s", sc.Class, sc.Section) != classSection {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid student")
+		return
+	}
+	id := f.Get("ID")
+
+	attempts, err := getStudentAttempts(c, studentID, sy)
+	if err != nil {
+		log.Errorf(c, "Could not get attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	var deleted markAttempt
+	var kept []markAttempt
+	for _, a := range attempts {
+		if a.ID == id {
+			deleted = a
+			continue
+		}
+		kept = append(kept, a)
+	}
+	if deleted.ID == "" {
+		renderErrorMsg(w, r, http.StatusNotFound, "Attempt not found")
+		return
+	}
+
+	if !canAccessIn(w, r, c, sy, permMarksEdit, "", classSection, deleted.Subject) {
+		return
+	}
+
+	if err := saveStudentAttempts(c, studentID, sy, kept); err != nil {
+		log.Errorf(c, "Could not save attempts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	term, _ := parseTerm(deleted.Term)
+	if gs := getGradingSystem(c, sy, class, deleted.Subject); gs != nil {
+		if err := saveAttemptsChange(c, sy, classSection, studentID, deleted.Subject, term, gs); err != nil {
+			log.Errorf(c, "Could not refresh marks: %s", err)
+		}
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, attemptsURL(classSection, deleted.Subject, term), http.StatusFound)
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+)
+
+type rolloverResult struct {
+	Promoted  int
+	Graduated int
+	Retained  int // failed after the remedial courses, so they repeat the class
+	Pending   int // waiting for the remedial marks, so they are not assigned yet
+	Skipped   int // already assigned to a class in the new school year
+
+	// Unplaced are the students whose section does not exist in their
+	// class of the new school year, so they are not assigned
+	Unplaced []string
+}
+
+// rolloverSchoolYear prepares the school year to from the school year from.
+// The settings of from (classes, subjects, streams, grading groups and
+// behavior rubrics) are copied unless to already has them, and the students
+// of every class are assigned to the same section of the next class in
+// order, which has all the classes of from. Students of the last class
+// graduate. Students retained after the remedial courses repeat the class,
+// and the ones waiting for remedial marks are left for a later run. Students
+// whose section does not exist in their new class are reported and left
+// unassigned. It is safe to run it more than once.
+func rolloverSchoolYear(c context.Context, from, to string, order []string) (rolloverResult, error) {
+	var result rolloverResult
+
+	var fromYear, toYear int
+	if _, err := fmt.Sscanf(from, "%d-", &fromYear); err != nil {
+		return result, fmt.Errorf("Invalid school year: %s", from)
+	}
+	if _, err := fmt.Sscanf(to, "%d-", &toYear); err != nil || to != fmt.Sprintf("%d-%d", toYear, toYear+1) {
+		return result, fmt.Errorf("Invalid school year: %s", to)
+	}
+	if toYear <= fromYear {
+		return result, fmt.Errorf("%s is not after %s", to, from)
+	}
+
+	classSettings := getClassSettings(c, from)
+	if err := checkClassOrder(classSettings, order); err != nil {
+		return result, err
+	}
+
+	if toYear > getMaxSchoolYear(c) {
+		if err := saveMaxSchoolYear(c, toYear); err != nil {
+			return result, err
+		}
+	}
+
+	if len(getClassSettings(c, to)) == 0 {
+		if err := saveClassSettings(c, to, classSettings); err != nil {
+			return result, err
+		}
+	}
+
+	if len(getAllSubjects(c, to)) == 0 {
+		if err := saveAllSubjects(c, to, getAllSubjects(c, from)); err != nil {
+			return result, err
+		}
+	}
+
+	if len(getAllStreams(c, to)) == 0 {
+		if err := saveAllStreams(c, to, getAllStreams(c, from)); err != nil {
+			return result, err
+		}
+	}
+
+	if len(getGradingGroups(c, to)) == 0 {
+		for _, name := range getGradingGroups(c, from) {
+			group, err := getGradingGroup(c, from, name)
+			if err != nil {
+				return result, err
+			}
+			if err := saveGradingGroup(c, to, group); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, cs := range classSettings {
+		if err := rolloverClass(c, from, to, cs.Class); err != nil {
+			return result, fmt.Errorf("Could not copy class %s: %s", cs.Class, err)
+		}
+	}
+
+	toSections := getClassSections(c, to)
+	hasSection := func(class, section string) bool {
+		for _, s := range toSections[class] {
+			if s == section {
+				return true
+			}
+		}
+		return false
+	}
+	unplaced := func(stu studentClass, class string) {
+		result.Unplaced = append(result.Unplaced,
+			fmt.Sprintf("%s %s (%s%s)", stu.ID, stu.Name, class, stu.Section))
+	}
+
+	for i, class := range order {
+		students, err := findStudents(c, from, class+"|")
+		if err != nil {
+			return result, err
+		}
+
+		for _, stu := range students {
+			sc, err := getStudentClass(c, stu.ID, to)
+			if err != nil {
+				return result, err
+			}
+			if sc.Class != "" {
+				result.Skipped++
+				continue
+			}
+
+			decision, err := getPromotionDecision(c, from, stu.ID)
+			if err != nil {
+				return result, err
+			}
+			switch decision {
+			case promotionPending:
+				result.Pending++
+				continue
+			case promotionRetained:
+				if !hasSection(class, stu.Section) {
+					unplaced(stu, class)
+					continue
+				}
+				err = saveStudentClass(c, stu.ID, stu.Name, to, class, stu.Section, stu.Stream)
+				if err != nil {
+					return result, fmt.Errorf("Could not retain %s: %s", stu.ID, err)
+				}
+				result.Retained++
+				continue
+			}
+
+			if i+1 == len(order) {
+				result.Graduated++
+				continue
+			}
+
+			nextClass := order[i+1]
+			if !hasSection(nextClass, stu.Section) {
+				unplaced(stu, nextClass)
+				continue
+			}
+			err = saveStudentClass(c, stu.ID, stu.Name, to, nextClass, stu.Section, stu.Stream)
+			if err != nil {
+				return result, fmt.Errorf("Could not promote %s: %s", stu.ID, err)
+			}
+			result.Promoted++
+		}
+	}
+
+	log.Infof(c, "Rollover %s to %s: %+v", from, to, result)
+
+	return result, nil
+}
+
+// checkClassOrder checks that order has every class of the class settings
+// once, and no other class
+func checkClassOrder(classSettings []classSetting, order []string) error {
+	if len(order) == 0 {
+		return fmt.Errorf("The order of the classes is required")
+	}
+	seen := make(map[string]bool)
+	for _, class := range order {
+		if seen[class] {
+			return fmt.Errorf("Class %s is in the order more than once", class)
+		}
+		seen[class] = true
+	}
+	for _, cs := range classSettings {
+		if !seen[cs.Class] {
+			return fmt.Errorf("Class %s is not in the order", cs.Class)
+		}
+		delete(seen, cs.Class)
+	}
+	for class := range seen {
+		return fmt.Errorf("Invalid class: %s", class)
+	}
+	return nil
+}
+
+// rolloverClass copies the subjects and behavior rubric of the class
+func rolloverClass(c context.Context, from, to, class string) error {
+	existing, err := getSubjects(c, to, class)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		subjects, err := getSubjects(c, from, class)
+		if err != nil {
+			return err
+		}
+		if err := saveSubjects(c, to, class, subjects); err != nil {
+			return err
+		}
+
+		for _, name := range subjects {
+			subject, err := getSubject(c, from, class, name)
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := saveSubject(c, to, class, subject); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+
+	if getCurrentBehaviorRubricVersion(c, to, class) == 0 {
+		version := getCurrentBehaviorRubricVersion(c, from, class)
+		if version > 0 {
+			rubric, err := getBehaviorRubric(c, from, class, version)
+			if err != nil {
+				return err
+			}
+			rubric.SY = to
+			if err := saveBehaviorRubric(c, rubric); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
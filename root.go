@@ -7,6 +7,7 @@ package main
 import (
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
+	_ "google.golang.org/appengine/remote_api" // used by the cps command
 	appengineuser "google.golang.org/appengine/user"
 
 	"net/http"
@@ -25,7 +26,24 @@ func root(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := render(w, r, "root", nil); err != nil {
+	// Students see the timetable of their class section
+	var data interface{}
+	if user, err := getUser(c); err == nil && user.Student != nil {
+		grid, teacherNames, err := getStudentTimetable(c, user.Student.ID)
+		if err != nil {
+			log.Errorf(c, "Could not get timetable: %s", err)
+		} else if len(grid.Cells) > 0 {
+			data = struct {
+				Grid         timetableGrid
+				TeacherNames map[int64]string
+			}{
+				grid,
+				teacherNames,
+			}
+		}
+	}
+
+	if err := render(w, r, "root", data); err != nil {
 		log.Errorf(c, "Could not render template root: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
 		return
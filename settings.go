@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -113,6 +114,15 @@ func saveSchoolYear(c context.Context, sy string) error {
 	return nil
 }
 
+// schoolYearDates returns the start and end of sy, from August of its first
+// year until August of its second year
+func schoolYearDates(sy string) (time.Time, time.Time) {
+	var year int
+	fmt.Sscanf(sy, "%d-", &year)
+	from := time.Date(year, time.August, 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(1, 0, 0)
+}
+
 type classSetting struct {
 	Class            string
 	MaxSection       string
@@ -137,9 +147,7 @@ func getClassSettings(c context.Context, sy string) []classSetting {
 	return setting.Value
 }
 
-func saveClassSettings(c context.Context, settings []classSetting) error {
-	sy := getSchoolYear(c)
-
+func saveClassSettings(c context.Context, sy string, settings []classSetting) error {
 	key := datastore.NewKey(c, "settings", "class-settings-"+sy, 0, nil)
 	_, err := nds.Put(c, key, &classSettings{settings})
 	if err != nil {
@@ -309,6 +317,15 @@ func settingsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Warningf(c, "Could not get ProgressReportSettings: %s", err)
 	}
 
+	progressReportScales := getProgressReportScales(c)
+
+	maxTeacherPeriods := getMaxTeacherPeriods(c, sy)
+
+	teachers, err := getEmployees(c, true, "Teacher")
+	if err != nil {
+		log.Warningf(c, "Could not get teachers: %s", err)
+	}
+
 	data := struct {
 		SectionChoices      []string
 		LetterSystemChoices []string
@@ -327,6 +344,16 @@ func settingsHandler(w http.ResponseWriter, r *http.Request) {
 		GradingGroups   []string
 		ProgressReports map[string][]ProgressReportSettings
 
+		ProgressReportScales []string
+
+		MaxTeacherPeriods int
+
+		Teachers          []employeeType
+		HeadsOfDepartment map[string]int64
+
+		Remedial         remedialSetting
+		RemedialPolicies []attemptPolicy
+
 		NextSchoolYear string
 	}{
 		sectionChoices,
@@ -346,6 +373,16 @@ func settingsHandler(w http.ResponseWriter, r *http.Request) {
 		gradingGroups,
 		progressReports,
 
+		progressReportScales,
+
+		maxTeacherPeriods,
+
+		teachers,
+		getHeadsOfDepartment(c, sy),
+
+		getRemedialSetting(c, sy),
+		attemptPolicies,
+
 		nextSchoolYear,
 	}
 
@@ -415,7 +452,7 @@ func settingsSaveSectionsHandler(w http.ResponseWriter, r *http.Request) {
 		settings[i] = classSetting
 	}
 
-	if err := saveClassSettings(c, settings); err != nil {
+	if err := saveClassSettings(c, sy, settings); err != nil {
 		log.Errorf(c, "Could not save max sections: %s", err)
 		renderError(w, r, http.StatusInternalServerError)
 		return
@@ -454,7 +491,7 @@ func settingsAddClassHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		settings = append(settings, newSetting)
 
-		if err := saveClassSettings(c, settings); err != nil {
+		if err := saveClassSettings(c, sy, settings); err != nil {
 			log.Errorf(c, "Could not add class: %s", err)
 			renderError(w, r, http.StatusInternalServerError)
 			return
@@ -625,6 +662,8 @@ func settingsAccessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	oldStudentAccess := getStudentAccess(c)
+
 	studentAccess := make(map[Term]bool)
 	for _, term := range terms {
 		access := r.PostForm.Get("student-access-"+term.Value()) == "on"
@@ -637,6 +676,12 @@ func settingsAccessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, term := range terms {
+		if studentAccess[term] && !oldStudentAccess[term] {
+			notifyReportcardPublished(c, term)
+		}
+	}
+
 	// TODO: message of success
 	http.Redirect(w, r, "/settings", http.StatusFound)
 }
@@ -0,0 +1,248 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"golang.org/x/net/context"
+
+	"fmt"
+	"math"
+)
+
+// maxProficiency is the highest proficiency level of a learning outcome
+const maxProficiency = 4
+
+// proficiencyLevels are the descriptions of the proficiency levels, shown on
+// report cards
+var proficiencyLevels = []string{
+	"4 = Exceeding Expectations",
+	"3 = Meeting Expectations",
+	"2 = Approaching Expectations",
+	"1 = Beginning",
+}
+
+// learningOutcome is an outcome of a standards-based subject, assessed in a
+// term
+type learningOutcome struct {
+	Term string // value of a Quarter, Midterm or Semester term
+	Name string
+}
+
+// outcomeTerms are the terms in which the outcomes of a subject of the
+// semester type are assessed
+func outcomeTerms(st semesterType) []Term {
+	var ts []Term
+	for _, term := range terms {
+		switch term.Typ {
+		case Quarter:
+			if st == QuarterSemester {
+				ts = append(ts, term)
+			}
+		case Midterm:
+			if st == MidtermSemester {
+				ts = append(ts, term)
+			}
+		case Semester:
+			ts = append(ts, term)
+		}
+	}
+	return ts
+}
+
+// standardsGradingSystem contains a subject that reports the proficiency of
+// each of its learning outcomes instead of marks. The overall level of a
+// term is the average of its outcomes.
+type standardsGradingSystem struct {
+	Subject
+}
+
+// outcomes returns the learning outcomes assessed in term
+func (sgs standardsGradingSystem) outcomes(term Term) []learningOutcome {
+	var outcomes []learningOutcome
+	for _, outcome := range sgs.Outcomes {
+		if outcome.Term == term.Value() {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+	return outcomes
+}
+
+// assessed returns whether the subject has outcomes in term
+func (sgs standardsGradingSystem) assessed(term Term) bool {
+	for _, t := range outcomeTerms(sgs.SemesterType) {
+		if t == term {
+			return len(sgs.outcomes(term)) > 0
+		}
+	}
+	return false
+}
+
+func (sgs standardsGradingSystem) description(c context.Context, sy string, term Term) []colDescription {
+	switch term.Typ {
+	case Quarter, Midterm, Semester:
+		if !sgs.assessed(term) {
+			return nil
+		}
+		var cols []colDescription
+		for _, outcome := range sgs.outcomes(term) {
+			cols = append(cols, colDescription{outcome.Name, maxProficiency, math.NaN(), true})
+		}
+		cols = append(cols, colDescription{"Overall", maxProficiency, math.NaN(), false})
+		return cols
+	case EndOfYear:
+		return []colDescription{
+			{"Semester 1", maxProficiency, math.NaN(), false},
+			{"Semester 2", maxProficiency, math.NaN(), false},
+			{"Overall", maxProficiency, math.NaN(), false},
+		}
+	case WeekS1, WeekS2:
+		return nil
+	}
+	panic(fmt.Sprintf("Invalid term type: %d", term.Typ))
+}
+
+func (sgs standardsGradingSystem) evaluate(c context.Context, studentID, sy string, term Term, marks studentMarks) (err error) {
+	m := marks[term]
+	desc := sgs.description(c, sy, term)
+
+	switch {
+	case m == nil: // first time to evaluate it
+		m = make([]float64, len(desc))
+		for i, _ := range desc {
+			m[i] = math.NaN()
+		}
+	case len(m) != len(desc): // sanity check
+		err = invalidNumberOfMarks
+		m = make([]float64, len(desc))
+		for i, _ := range desc {
+			m[i] = math.NaN()
+		}
+	}
+
+	// more sanity checks: levels are whole numbers
+	for i, d := range desc {
+		if !d.Editable || math.IsNaN(m[i]) {
+			continue
+		}
+		if m[i] < 1 || m[i] > d.Max || m[i] != math.Floor(m[i]) {
+			m[i] = math.NaN()
+			if err == nil {
+				err = invalidRangeOfMarks
+			}
+		}
+	}
+
+	switch term.Typ {
+	case Quarter, Midterm, Semester:
+		if len(m) > 0 {
+			m[len(m)-1] = averageLevel(m[:len(m)-1])
+		}
+	case EndOfYear:
+		var levels []float64
+		for i, s := range []Term{{Semester, 1}, {Semester, 2}} {
+			m[i] = math.NaN()
+			if !sgs.assessed(s) {
+				continue
+			}
+			sgs.evaluate(c, studentID, sy, s, marks)
+			m[i] = sgs.level(s, marks)
+			levels = append(levels, m[i])
+		}
+		m[2] = averageLevel(levels)
+	}
+
+	marks[term] = m
+	return
+}
+
+// averageLevel returns the average of the levels rounded to one decimal, or
+// math.NaN() if one of them is missing
+func averageLevel(levels []float64) float64 {
+	if len(levels) == 0 {
+		return math.NaN()
+	}
+	total := sumMarks(levels...)
+	return math.Floor(total/float64(len(levels))*10+0.5) / 10
+}
+
+// level returns the overall level of term
+func (sgs standardsGradingSystem) level(term Term, marks studentMarks) float64 {
+	m := marks[term]
+	if len(m) == 0 {
+		return math.NaN()
+	}
+	return m[len(m)-1]
+}
+
+func (sgs standardsGradingSystem) get100(term Term, marks studentMarks) float64 {
+	if term.Typ == WeekS1 || term.Typ == WeekS2 {
+		return math.NaN()
+	}
+	return sgs.level(term, marks) * 100 / maxProficiency
+}
+
+func (sgs standardsGradingSystem) getExam(term Term, marks studentMarks) float64 {
+	return math.NaN()
+}
+
+func (sgs standardsGradingSystem) ready(term Term, marks studentMarks) bool {
+	return !math.IsNaN(sgs.get100(term, marks))
+}
+
+func (sgs standardsGradingSystem) quarterWeight() float64 {
+	return math.NaN()
+}
+
+func (sgs standardsGradingSystem) semesterWeight() float64 {
+	return math.NaN()
+}
+
+// subjectInAverage is false because levels are not percentages
+func (sgs standardsGradingSystem) subjectInAverage() bool {
+	return false
+}
+
+// reportcardOutcomes are the levels of the learning outcomes of a subject
+// in a term, shown on report cards
+type reportcardOutcomes struct {
+	Name     string
+	Outcomes []colDescription
+	Levels   []float64
+	Overall  float64
+}
+
+func (sgs standardsGradingSystem) reportcardOutcomes(c context.Context, sy string, term Term, marks studentMarks) reportcardOutcomes {
+	desc := sgs.description(c, sy, term)
+	m := marks[term]
+	return reportcardOutcomes{
+		Name:     sgs.displayName(),
+		Outcomes: desc[:len(desc)-1],
+		Levels:   m[:len(m)-1],
+		Overall:  sgs.level(term, marks),
+	}
+}
+
+// validateOutcomes checks the learning outcomes of a standards-based subject
+func validateOutcomes(subject Subject) error {
+	if subject.SemesterType != QuarterSemester && subject.SemesterType != MidtermSemester {
+		return fmt.Errorf("Invalid semester type: %d", subject.SemesterType)
+	}
+	if len(subject.Outcomes) == 0 {
+		return fmt.Errorf("Please add learning outcomes")
+	}
+
+	validTerms := make(map[string]bool)
+	for _, term := range outcomeTerms(subject.SemesterType) {
+		validTerms[term.Value()] = true
+	}
+	for _, outcome := range subject.Outcomes {
+		if !validTerms[outcome.Term] {
+			term, _ := parseTerm(outcome.Term)
+			return fmt.Errorf("Learning outcome %s can't be in %s with the semester type %s",
+				outcome.Name, term, subject.SemesterType)
+		}
+	}
+	return nil
+}
@@ -107,7 +107,7 @@
 						}).append(
 							$("<option></option>"),
 							$("<option></option>", {value: "Section", text: "Section header"}),
-							$("<option></option>", {value: "CMRENA", text: "C, M, R, E, N/A"}),
+							$("<option></option>", {value: "CMRENA", text: "Marks"}),
 							$("<option></option>", {value: "Delete", text: "Delete"})
 						)
 					)
@@ -115,6 +115,23 @@
 			);
 		});
 
+		$("#cps-comment-search").on("input", function(e) {
+			var search = $(this).val().toLowerCase();
+			$(".cps-comment-row").each(function() {
+				$(this).toggle($(this).text().toLowerCase().indexOf(search) >= 0);
+			});
+		});
+
+		$(".cps-comment-insert").click(function(e) {
+			var comments = $("#Comments");
+			var text = comments.val();
+			if (text !== "" && !/\s$/.test(text)) {
+				text += " ";
+			}
+			comments.val(text + $(this).data("text"));
+			setConfirmUnload(true);
+		});
+
 		$(".add-report-classes-row").click(function(e) {
 			var template = document.getElementById("add-report-classes-row-template");
 			var clone = document.importNode(template.content, true);
@@ -40,6 +40,7 @@ type studentType struct {
 	CPR            string
 	Passport       string
 	ParentInfo     string
+	GuardianEmail  string
 	EmergencyPhone string
 	HealthInfo     string
 	Comments       string
@@ -240,6 +241,11 @@ func (stu *studentType) validate(c context.Context) error {
 		}
 	}
 
+	stu.GuardianEmail = strings.TrimSpace(stu.GuardianEmail)
+	if stu.GuardianEmail != "" && !strings.Contains(stu.GuardianEmail, "@") {
+		return fmt.Errorf("Invalid guardian email: %s", stu.GuardianEmail)
+	}
+
 	intCPR, err := strconv.Atoi(stu.CPR)
 	if err == nil {
 		stu.CPR = fmt.Sprintf("%09d", intCPR)
@@ -569,6 +575,7 @@ func studentsSaveHandler(w http.ResponseWriter, r *http.Request) {
 		CPR:            f.Get("CPR"),
 		Passport:       f.Get("Passport"),
 		ParentInfo:     f.Get("ParentInfo"),
+		GuardianEmail:  f.Get("GuardianEmail"),
 		EmergencyPhone: f.Get("EmergencyPhone"),
 		HealthInfo:     f.Get("HealthInfo"),
 		Comments:       f.Get("Comments"),
@@ -628,6 +635,7 @@ var studentFields = []string{
 	"HealthInfo",
 	"Comments",
 	"Stream for School Year",
+	"GuardianEmail",
 }
 
 // used for CSV
@@ -648,53 +656,17 @@ var studentFieldsDesc = []string{
 	"",
 	"",
 	"",
+	"",
 }
 
-func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	sy := getSchoolYear(c)
-
-	var errors []error
-
-	message := struct {
-		Msg string
-	}{}
-
-	if r.Method != "POST" {
-		if err := render(w, r, "studentsimport", message); err != nil {
-			log.Errorf(c, "Could not render template studentsimport: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		return
-	}
-
-	err := r.ParseMultipartForm(1e6)
-	if err != nil || r.MultipartForm == nil || len(r.MultipartForm.File["csvfile"]) != 1 {
-		// nothing to import
-		if err != nil {
-			message.Msg = err.Error()
-		}
-		if err := render(w, r, "studentsimport", message); err != nil {
-			log.Errorf(c, "Could not render template studentsimport: %s", err)
-			renderError(w, r, http.StatusInternalServerError)
-			return
-		}
-		return
-	}
-
-	file, err := r.MultipartForm.File["csvfile"][0].Open()
-	if err != nil {
-		log.Errorf(c, "Could not open uploaded file: %s", err)
-		renderError(w, r, http.StatusInternalServerError)
-		return
-	}
-	defer file.Close()
-
-	csvr := csv.NewReader(file)
+// importStudentsCSV saves the students in the CSV file and assigns them to
+// their classes in sy. errors has the errors of individual rows, and err is
+// returned if the file is not in the expected format.
+func importStudentsCSV(c context.Context, sy string, r io.Reader) (errors []error, err error) {
+	csvr := csv.NewReader(r)
 	csvr.LazyQuotes = true
 	csvr.TrailingComma = true
+	hasGuardianEmail := true
 	i := 0
 	for {
 		i++
@@ -707,15 +679,12 @@ func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 		if i == 1 {
-			// header
-			if !reflect.DeepEqual(record, studentFields) {
-				message.Msg = fmt.Sprintf("Invalid file format: %q", record)
-				if err := render(w, r, "studentsimport", message); err != nil {
-					log.Errorf(c, "Could not render template studentsimport: %s", err)
-					renderError(w, r, http.StatusInternalServerError)
-					return
-				}
-				return
+			// header. Files exported before GuardianEmail was added don't
+			// have it.
+			if reflect.DeepEqual(record, studentFields[:len(studentFields)-1]) {
+				hasGuardianEmail = false
+			} else if !reflect.DeepEqual(record, studentFields) {
+				return nil, fmt.Errorf("Invalid file format: %q", record)
 			}
 			continue
 		} else if i == 2 {
@@ -728,6 +697,18 @@ func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
 			errors = append(errors, fmt.Errorf("Error in row %d: %s", i, err))
 			continue
 		}
+		var guardianEmail string
+		if hasGuardianEmail && len(record) > 16 {
+			guardianEmail = record[16]
+		} else if !hasGuardianEmail && record[0] != "" {
+			// keep the stored guardian email of existing students
+			old, err := getStudent(c, record[0])
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				errors = append(errors, fmt.Errorf("Error in row %d: %s", i, err))
+				continue
+			}
+			guardianEmail = old.GuardianEmail
+		}
 		stu := studentType{
 			ID:             record[0],
 			Name:           record[1],
@@ -739,6 +720,7 @@ func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
 			CPR:            record[9],
 			Passport:       record[10],
 			ParentInfo:     record[11],
+			GuardianEmail:  guardianEmail,
 			EmergencyPhone: record[12],
 			HealthInfo:     record[13],
 			Comments:       record[14],
@@ -766,6 +748,60 @@ func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	return errors, nil
+}
+
+func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	message := struct {
+		Msg string
+	}{}
+
+	if r.Method != "POST" {
+		if err := render(w, r, "studentsimport", message); err != nil {
+			log.Errorf(c, "Could not render template studentsimport: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	err := r.ParseMultipartForm(1e6)
+	if err != nil || r.MultipartForm == nil || len(r.MultipartForm.File["csvfile"]) != 1 {
+		// nothing to import
+		if err != nil {
+			message.Msg = err.Error()
+		}
+		if err := render(w, r, "studentsimport", message); err != nil {
+			log.Errorf(c, "Could not render template studentsimport: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	file, err := r.MultipartForm.File["csvfile"][0].Open()
+	if err != nil {
+		log.Errorf(c, "Could not open uploaded file: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	errors, err := importStudentsCSV(c, sy, file)
+	if err != nil {
+		message.Msg = err.Error()
+		if err := render(w, r, "studentsimport", message); err != nil {
+			log.Errorf(c, "Could not render template studentsimport: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
 	if len(errors) == 0 {
 		// no errors
 		http.Redirect(w, r, "/students", http.StatusFound)
@@ -785,12 +821,53 @@ func studentsImportHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// writeStudentsCSV writes the students in the format of importStudentsCSV.
+// studentClasses are the classes of students, in the same order.
+// studentsRecords returns the rows of the students file, including the two
+// header rows
+func studentsRecords(students []studentType, studentClasses []studentClass) [][]string {
+	records := [][]string{studentFields, studentFieldsDesc}
+
+	for i, stu := range students {
+		stuClass := studentClasses[i]
+		var row []string
+		row = append(row, stu.ID)
+		row = append(row, stu.Name)
+		row = append(row, stu.ArabicName)
+		row = append(row, stu.Gender)
+		row = append(row, stuClass.Class)
+		row = append(row, stuClass.Section)
+		row = append(row, stu.DateOfBirth.Format("2006-01-02"))
+		row = append(row, stu.Nationality)
+		row = append(row, stu.Stream)
+		row = append(row, stu.CPR)
+		row = append(row, stu.Passport)
+		row = append(row, stu.ParentInfo)
+		row = append(row, stu.EmergencyPhone)
+		row = append(row, stu.HealthInfo)
+		row = append(row, stu.Comments)
+		row = append(row, stuClass.Stream)
+		row = append(row, stu.GuardianEmail)
+		records = append(records, row)
+	}
+
+	return records
+}
+
+func writeStudentsCSV(w io.Writer, students []studentType, studentClasses []studentClass) error {
+	csvw := csv.NewWriter(w)
+	csvw.UseCRLF = true
+	return csvw.WriteAll(studentsRecords(students, studentClasses))
+}
+
+// used for XLSX. The rest of the fields are text.
+var studentFieldsFormats = []xlsxFormat{6: xlsxDate}
+
 func studentsExportHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
 	sy := getSchoolYear(c)
 
-	var errors []error
 	var students []studentType
 	var studentClasses []studentClass
 	var filename string
@@ -827,44 +904,25 @@ func studentsExportHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if r.Form.Get("format") == "xlsx" {
+		setXLSXHeaders(w, filename)
+		sheet := xlsxSheet{
+			"Students",
+			xlsxRecords(studentsRecords(students, studentClasses), 2, studentFieldsFormats),
+			2,
+		}
+		if err := writeXLSX(w, sheet); err != nil {
+			log.Errorf(c, "Error writing xlsx: %s", err)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/csv")
 	// Force save as with filename
 	w.Header().Set("Content-Disposition",
 		fmt.Sprintf("attachment;filename=%s.csv", filename))
 
-	csvw := csv.NewWriter(w)
-	csvw.UseCRLF = true
-	errors = append(errors, csvw.Write(studentFields))
-	errors = append(errors, csvw.Write(studentFieldsDesc))
-
-	for i, stu := range students {
-		stuClass := studentClasses[i]
-		var row []string
-		row = append(row, stu.ID)
-		row = append(row, stu.Name)
-		row = append(row, stu.ArabicName)
-		row = append(row, stu.Gender)
-		row = append(row, stuClass.Class)
-		row = append(row, stuClass.Section)
-		row = append(row, stu.DateOfBirth.Format("2006-01-02"))
-		row = append(row, stu.Nationality)
-		row = append(row, stu.Stream)
-		row = append(row, stu.CPR)
-		row = append(row, stu.Passport)
-		row = append(row, stu.ParentInfo)
-		row = append(row, stu.EmergencyPhone)
-		row = append(row, stu.HealthInfo)
-		row = append(row, stu.Comments)
-		row = append(row, stuClass.Stream)
-
-		errors = append(errors, csvw.Write(row))
-	}
-
-	csvw.Flush()
-
-	for _, err := range errors {
-		if err != nil {
-			log.Errorf(c, "Error writing csv: %s", err)
-		}
+	if err := writeStudentsCSV(w, students, studentClasses); err != nil {
+		log.Errorf(c, "Error writing csv: %s", err)
 	}
 }
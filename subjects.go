@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func init() {
@@ -135,11 +136,13 @@ func saveSubject(c context.Context, sy, class string, subject Subject) error {
 		sTotal += gc.FinalWeight
 	}
 
-	if qTotal == 0.0 && sTotal == 0.0 && wTotal == 0.0 {
+	if subject.StandardsBased {
+		if err := validateOutcomes(subject); err != nil {
+			return err
+		}
+	} else if qTotal == 0.0 && sTotal == 0.0 && wTotal == 0.0 {
 		return fmt.Errorf("Please add columns")
-	}
-
-	if subject.SemesterType == QuarterSemester {
+	} else if subject.SemesterType == QuarterSemester {
 		if qTotal != 0.0 && qTotal != 100.0 {
 			return fmt.Errorf("Total marks for quarter must be 100. Got %f", qTotal)
 		}
@@ -296,6 +299,17 @@ func subjectsDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	subject.SemesterGradingColumns = tempGCs
 
+	if len(subject.Outcomes) < 20 {
+		subject.Outcomes = append(subject.Outcomes, make([]learningOutcome, 20-len(subject.Outcomes))...)
+	}
+
+	var outcomeTermChoices []Term
+	for _, term := range terms {
+		if term.Typ != EndOfYear {
+			outcomeTermChoices = append(outcomeTermChoices, term)
+		}
+	}
+
 	allSubjects := getAllSubjects(c, sy)
 	classes := getClasses(c, sy)
 
@@ -341,6 +355,8 @@ func subjectsDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		WeekGradingColumnChoices []gradingColumnChoice
 		SemesterTypes            []semesterType
 		GradingGroups            []string
+		OutcomeTerms             []Term
+		ProficiencyLevels        []string
 
 		Class   string
 		Subject Subject
@@ -354,6 +370,8 @@ func subjectsDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		weekGradingColumnChoices,
 		semesterTypes,
 		gradingGroups,
+		outcomeTermChoices,
+		proficiencyLevels,
 
 		class,
 		subject,
@@ -437,6 +455,7 @@ func subjectsSaveHandler(w http.ResponseWriter, r *http.Request) {
 	subject.Description = r.PostForm.Get("Description")
 	subject.Stream = r.PostForm.Get("Stream")
 	subject.CalculateInAverage = r.PostForm.Get("CalculateInAverage") == "on"
+	subject.StandardsBased = r.PostForm.Get("StandardsBased") == "on"
 	s1credits, err := strconv.ParseFloat(r.PostForm.Get("S1Credits"), 64)
 	if err != nil {
 		renderErrorMsg(w, r, http.StatusBadRequest,
@@ -493,6 +512,14 @@ func subjectsSaveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	subject.TotalWeeksS2 = totalWeeksS2
 
+	periodsPerWeek, err := strconv.Atoi(r.PostForm.Get("PeriodsPerWeek"))
+	if err != nil || periodsPerWeek < 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Invalid Periods per Week: %s", r.PostForm.Get("PeriodsPerWeek")))
+		return
+	}
+	subject.PeriodsPerWeek = periodsPerWeek
+
 	if midtermWeeksS1 > totalWeeksS1 {
 		renderErrorMsg(w, r, http.StatusBadRequest,
 			fmt.Sprintf("Weeks until Midterm must be less than Total Weeks, got: %d > %d", midtermWeeksS1, totalWeeksS1))
@@ -800,6 +827,28 @@ func subjectsSaveHandler(w http.ResponseWriter, r *http.Request) {
 		subject.SemesterGradingColumns = append(subject.SemesterGradingColumns, gc)
 	}
 
+	for i := 0; ; i++ {
+		_, ok := r.PostForm[fmt.Sprintf("outcome-term-%d", i)]
+		if !ok {
+			break
+		}
+
+		termStr := r.PostForm.Get(fmt.Sprintf("outcome-term-%d", i))
+		name := strings.TrimSpace(r.PostForm.Get(fmt.Sprintf("outcome-name-%d", i)))
+		if name == "" {
+			continue
+		}
+
+		term, err := parseTerm(termStr)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest,
+				fmt.Sprintf("Invalid Term for %s: %s", name, termStr))
+			return
+		}
+
+		subject.Outcomes = append(subject.Outcomes, learningOutcome{term.Value(), name})
+	}
+
 	err = saveSubject(c, sy, class, subject)
 	if err != nil {
 		log.Errorf(c, "could not save subject %s %s %v: %s", sy, class, subject, err)
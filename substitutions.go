@@ -0,0 +1,440 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/substitutions", accessHandler(substitutionsHandler))
+	http.HandleFunc("/substitutions/save", accessHandler(substitutionsSaveHandler))
+}
+
+// substitution will be stored in the datastore. Period is -1 if there is no
+// timetable, and the substitute covers the class for the whole day.
+type substitution struct {
+	SY            string
+	Date          time.Time
+	Period        int
+	ClassSection  string
+	Subject       string
+	AbsentTeacher int64
+	Substitute    int64
+}
+
+func substitutionKey(c context.Context, date time.Time, period int, classSection, subject string) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%d|%s|%s", date.Format("2006-01-02"), period, classSection, subject)
+	return datastore.NewKey(c, "substitution", keyStr, 0, nil)
+}
+
+func getSubstitutions(c context.Context, date time.Time) ([]substitution, error) {
+	q := datastore.NewQuery("substitution").Filter("Date =", date)
+	var substitutions []substitution
+	_, err := q.GetAll(c, &substitutions)
+	if err != nil {
+		return nil, err
+	}
+
+	return substitutions, nil
+}
+
+// getCoverCounts returns the number of periods each teacher covered in sy
+func getCoverCounts(c context.Context, sy string) (map[int64]int, error) {
+	q := datastore.NewQuery("substitution").Filter("SY =", sy).Project("Substitute")
+	var substitutions []substitution
+	_, err := q.GetAll(c, &substitutions)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int64]int)
+	for _, s := range substitutions {
+		counts[s.Substitute]++
+	}
+	return counts, nil
+}
+
+// getAbsentEmployees returns the IDs of the employees with approved leave of
+// absence on date
+func getAbsentEmployees(c context.Context, date time.Time) (map[int64]bool, error) {
+	q := datastore.NewQuery("leaverequest")
+	q = q.Filter("RequesterKeyKind =", "employee")
+	q = q.Filter("Status =", leaveRequestApproved)
+	q = q.Filter("StartDate <=", date)
+	q = q.Order("StartDate")
+	q = q.Order("Time")
+	q = q.Order("EndDate")
+
+	var requests []leaveRequest
+	_, err := q.GetAll(c, &requests)
+	if err != nil {
+		return nil, err
+	}
+
+	absent := make(map[int64]bool)
+	for _, request := range requests {
+		if request.Type != LeaveOfAbsence || request.EndDate.Before(date) {
+			continue
+		}
+		absent[request.RequesterKey.IntID()] = true
+	}
+	return absent, nil
+}
+
+// timetableDay returns the day of date in the timetable, or -1 if it is not
+// a school day
+func timetableDay(setting timetableSetting, date time.Time) int {
+	for i, day := range setting.Days {
+		if strings.EqualFold(day, date.Weekday().String()) {
+			return i
+		}
+	}
+	return -1
+}
+
+// coverPeriod is a period of an absent teacher that needs cover
+type coverPeriod struct {
+	Period        int
+	ClassSection  string
+	Subject       string
+	Room          string
+	AbsentTeacher int64
+	Substitute    int64
+
+	// Free teachers, with the fewest covers first
+	Suggestions []int64
+}
+
+type coverPeriodSorter []coverPeriod
+
+func (cps coverPeriodSorter) Len() int {
+	return len(cps)
+}
+
+func (cps coverPeriodSorter) Less(i, j int) bool {
+	if cps[i].Period != cps[j].Period {
+		return cps[i].Period < cps[j].Period
+	}
+	return cps[i].ClassSection < cps[j].ClassSection
+}
+
+func (cps coverPeriodSorter) Swap(i, j int) {
+	cps[i], cps[j] = cps[j], cps[i]
+}
+
+// getCoverPeriods returns the periods of the absent teachers on date. The
+// periods come from the timetable if it has any for the teacher, or else from
+// the assignments of the teacher for the whole day.
+func getCoverPeriods(c context.Context, sy string, date time.Time) ([]coverPeriod, error) {
+	absent, err := getAbsentEmployees(c, date)
+	if err != nil {
+		return nil, err
+	}
+
+	setting := getTimetableSetting(c, sy)
+	day := timetableDay(setting, date)
+
+	slots, err := getTimetableSlots(c, sy, "")
+	if err != nil {
+		return nil, err
+	}
+	hasSlots := make(map[int64]bool)
+	busy := make(map[string]bool)
+	for _, slot := range slots {
+		hasSlots[slot.Teacher] = true
+		if slot.Day == day {
+			busy[fmt.Sprintf("%d|%d", slot.Teacher, slot.Period)] = true
+		}
+	}
+
+	substitutions, err := getSubstitutions(c, date)
+	if err != nil {
+		return nil, err
+	}
+	substitutes := make(map[string]int64)
+	for _, s := range substitutions {
+		substitutes[fmt.Sprintf("%d|%s|%s", s.Period, s.ClassSection, s.Subject)] = s.Substitute
+		busy[fmt.Sprintf("%d|%d", s.Substitute, s.Period)] = true
+	}
+
+	var periods []coverPeriod
+	for teacher := range absent {
+		if hasSlots[teacher] {
+			if day == -1 {
+				continue
+			}
+			for _, slot := range slots {
+				if slot.Teacher != teacher || slot.Day != day {
+					continue
+				}
+				periods = append(periods, coverPeriod{
+					Period:        slot.Period,
+					ClassSection:  slot.ClassSection,
+					Subject:       slot.Subject,
+					Room:          slot.Room,
+					AbsentTeacher: teacher,
+				})
+			}
+			continue
+		}
+
+		assigns, err := getTeacherAssignments(c, sy, teacher)
+		if err != nil {
+			return nil, err
+		}
+		for _, assign := range assigns {
+			periods = append(periods, coverPeriod{
+				Period:        -1,
+				ClassSection:  assign.ClassSection,
+				Subject:       assign.Subject,
+				AbsentTeacher: teacher,
+			})
+		}
+	}
+	sort.Sort(coverPeriodSorter(periods))
+
+	teachers, err := getEmployees(c, true, "Teacher")
+	if err != nil {
+		return nil, err
+	}
+	counts, err := getCoverCounts(c, sy)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(coverCountSorter{teachers, counts})
+
+	for i, p := range periods {
+		p.Substitute = substitutes[fmt.Sprintf("%d|%s|%s", p.Period, p.ClassSection, p.Subject)]
+		for _, t := range teachers {
+			if absent[t.ID] {
+				continue
+			}
+			if t.ID != p.Substitute && p.Period != -1 && busy[fmt.Sprintf("%d|%d", t.ID, p.Period)] {
+				continue
+			}
+			p.Suggestions = append(p.Suggestions, t.ID)
+		}
+		periods[i] = p
+	}
+
+	return periods, nil
+}
+
+// coverCountSorter sorts teachers by the number of periods they covered
+type coverCountSorter struct {
+	teachers []employeeType
+	counts   map[int64]int
+}
+
+func (ccs coverCountSorter) Len() int {
+	return len(ccs.teachers)
+}
+
+func (ccs coverCountSorter) Less(i, j int) bool {
+	ci, cj := ccs.counts[ccs.teachers[i].ID], ccs.counts[ccs.teachers[j].ID]
+	if ci != cj {
+		return ci < cj
+	}
+	return ccs.teachers[i].Name < ccs.teachers[j].Name
+}
+
+func (ccs coverCountSorter) Swap(i, j int) {
+	ccs.teachers[i], ccs.teachers[j] = ccs.teachers[j], ccs.teachers[i]
+}
+
+// coverCount is the number of periods a teacher covered, used in the
+// templates
+type coverCount struct {
+	Name  string
+	Count int
+}
+
+func substitutionsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+
+	date, err := parseDate(r.Form.Get("Date"))
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid date")
+		return
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	date = dateOnly(date)
+
+	periods, err := getCoverPeriods(c, sy, date)
+	if err != nil {
+		log.Errorf(c, "Could not get cover periods: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	teacherNames, err := getTeacherNames(c)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	counts, err := getCoverCounts(c, sy)
+	if err != nil {
+		log.Errorf(c, "Could not get cover counts: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	teachers, err := getEmployees(c, true, "Teacher")
+	if err != nil {
+		log.Errorf(c, "Could not retrieve teachers: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	sort.Sort(coverCountSorter{teachers, counts})
+	var coverCounts []coverCount
+	for i := len(teachers) - 1; i >= 0; i-- {
+		coverCounts = append(coverCounts, coverCount{teachers[i].Name, counts[teachers[i].ID]})
+	}
+
+	data := struct {
+		Date         time.Time
+		PrevDate     time.Time
+		NextDate     time.Time
+		Periods      []coverPeriod
+		TeacherNames map[int64]string
+		CoverCounts  []coverCount
+	}{
+		date,
+		date.AddDate(0, 0, -1),
+		date.AddDate(0, 0, 1),
+		periods,
+		teacherNames,
+		coverCounts,
+	}
+
+	if err := render(w, r, "substitutions", data); err != nil {
+		log.Errorf(c, "Could not render template substitutions: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func substitutionsSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+
+	date, err := parseDate(r.PostForm.Get("Date"))
+	if err != nil || date.IsZero() {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid date")
+		return
+	}
+
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		log.Errorf(c, "Could not retrieve employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	emails := make(map[int64]string)
+	for _, emp := range employees {
+		emails[emp.ID] = emp.CPSEmail
+	}
+
+	old, err := getSubstitutions(c, date)
+	if err != nil {
+		log.Errorf(c, "Could not get substitutions: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	oldSubstitutes := make(map[string]int64)
+	for _, s := range old {
+		oldSubstitutes[substitutionKey(c, date, s.Period, s.ClassSection, s.Subject).StringID()] = s.Substitute
+	}
+
+	for i := 0; ; i++ {
+		suffix := fmt.Sprintf("-%d", i)
+		if _, ok := r.PostForm["classsection"+suffix]; !ok {
+			break
+		}
+
+		period, err1 := strconv.Atoi(r.PostForm.Get("period" + suffix))
+		absent, err2 := strconv.ParseInt(r.PostForm.Get("absent"+suffix), 10, 64)
+		var substitute int64
+		var err3 error
+		if substituteStr := r.PostForm.Get("substitute" + suffix); substituteStr != "" {
+			substitute, err3 = strconv.ParseInt(substituteStr, 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid form")
+			return
+		}
+
+		s := substitution{
+			SY:            sy,
+			Date:          date,
+			Period:        period,
+			ClassSection:  r.PostForm.Get("classsection" + suffix),
+			Subject:       r.PostForm.Get("subject" + suffix),
+			AbsentTeacher: absent,
+			Substitute:    substitute,
+		}
+		key := substitutionKey(c, date, s.Period, s.ClassSection, s.Subject)
+
+		if s.Substitute == 0 {
+			if err := nds.Delete(c, key); err != nil {
+				log.Errorf(c, "Could not delete substitution: %s", err)
+				renderError(w, r, http.StatusInternalServerError)
+				return
+			}
+			continue
+		}
+
+		if _, err := nds.Put(c, key, &s); err != nil {
+			log.Errorf(c, "Could not save substitution: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if email := emails[s.Substitute]; email != "" && oldSubstitutes[key.StringID()] != s.Substitute {
+			when := "the whole day"
+			if s.Period != -1 {
+				when = fmt.Sprintf("period %d", s.Period+1)
+			}
+			subject := fmt.Sprintf("Cover on %s", formatDateHuman(date))
+			body := fmt.Sprintf("You are covering %s %s on %s, %s.\n\nTo view the cover sheet, go to: %s/substitutions?Date=%s",
+				strings.Replace(s.ClassSection, "|", "", 1), s.Subject, formatDateHuman(date), when,
+				siteURL, formatDate(date))
+			sendEmails(c, []string{email}, subject, body)
+		}
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/substitutions?Date="+formatDate(date), http.StatusFound)
+}
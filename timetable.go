@@ -0,0 +1,740 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	http.HandleFunc("/timetable", accessHandler(timetableHandler))
+	http.HandleFunc("/timetable/settings", accessHandler(timetableSettingsHandler))
+	http.HandleFunc("/timetable/generate", accessHandler(timetableGenerateHandler))
+	http.HandleFunc("/timetable/section", accessHandler(timetableSectionHandler))
+	http.HandleFunc("/timetable/save", accessHandler(timetableSaveHandler))
+	http.HandleFunc("/timetable/teacher", accessHandler(timetableTeacherHandler))
+}
+
+type timetableSetting struct {
+	Days    []string
+	Periods int
+	Rooms   []string
+}
+
+type timetableSettings struct {
+	Value timetableSetting
+}
+
+var defaultTimetableSetting = timetableSetting{
+	Days:    []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday"},
+	Periods: 7,
+}
+
+func getTimetableSetting(c context.Context, sy string) timetableSetting {
+	key := datastore.NewKey(c, "settings", "timetable-"+sy, 0, nil)
+
+	setting := timetableSettings{}
+	if err := nds.Get(c, key, &setting); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			log.Warningf(c, "Could not get timetable settings: %s", err)
+		}
+		return defaultTimetableSetting
+	}
+
+	return setting.Value
+}
+
+func saveTimetableSetting(c context.Context, sy string, setting timetableSetting) error {
+	key := datastore.NewKey(c, "settings", "timetable-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &timetableSettings{setting})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// timetableSlot will be stored in the datastore. Day and Period start from 0.
+type timetableSlot struct {
+	SY           string
+	ClassSection string
+	Day          int
+	Period       int
+	Subject      string
+	Teacher      int64
+	Room         string
+}
+
+func timetableSlotKey(c context.Context, sy, classSection string, day, period int) *datastore.Key {
+	keyStr := fmt.Sprintf("%s|%s|%d|%d", sy, classSection, day, period)
+	return datastore.NewKey(c, "timetable", keyStr, 0, nil)
+}
+
+// getTimetableSlots returns the slots of sy. If classSection is not empty,
+// only the slots of the class section are returned.
+func getTimetableSlots(c context.Context, sy, classSection string) ([]timetableSlot, error) {
+	q := datastore.NewQuery("timetable").Filter("SY =", sy)
+	if classSection != "" {
+		q = q.Filter("ClassSection =", classSection)
+	}
+	var slots []timetableSlot
+	_, err := q.GetAll(c, &slots)
+	if err != nil {
+		return nil, err
+	}
+
+	return slots, nil
+}
+
+// saveTimetableSlots replaces the slots of the class section, or all of the
+// slots of sy if classSection is empty
+func saveTimetableSlots(c context.Context, sy, classSection string, slots []timetableSlot) error {
+	q := datastore.NewQuery("timetable").Filter("SY =", sy).KeysOnly()
+	if classSection != "" {
+		q = q.Filter("ClassSection =", classSection)
+	}
+	oldKeys, err := q.GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := nds.DeleteMulti(c, oldKeys); err != nil {
+		return err
+	}
+
+	var keys []*datastore.Key
+	for _, slot := range slots {
+		keys = append(keys, timetableSlotKey(c, sy, slot.ClassSection, slot.Day, slot.Period))
+	}
+	if _, err := nds.PutMulti(c, keys, slots); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// timetableConflicts returns the teachers and rooms that are booked more than
+// once at the same time. The slots that conflict are marked in conflicting,
+// by class section, day and period.
+func timetableConflicts(slots []timetableSlot, teacherNames map[int64]string, setting timetableSetting) (conflicts []string, conflicting map[string]bool) {
+	conflicting = make(map[string]bool)
+
+	teacherSlots := make(map[string][]timetableSlot)
+	roomSlots := make(map[string][]timetableSlot)
+	var teacherKeys, roomKeys []string
+	for _, slot := range slots {
+		when := fmt.Sprintf("%d|%d", slot.Day, slot.Period)
+		if slot.Teacher != 0 {
+			k := fmt.Sprintf("%s|%d", when, slot.Teacher)
+			if teacherSlots[k] == nil {
+				teacherKeys = append(teacherKeys, k)
+			}
+			teacherSlots[k] = append(teacherSlots[k], slot)
+		}
+		if slot.Room != "" {
+			k := when + "|" + slot.Room
+			if roomSlots[k] == nil {
+				roomKeys = append(roomKeys, k)
+			}
+			roomSlots[k] = append(roomSlots[k], slot)
+		}
+	}
+
+	describe := func(what string, slots []timetableSlot) {
+		var sections []string
+		for _, slot := range slots {
+			sections = append(sections, strings.Replace(slot.ClassSection, "|", "", 1))
+			conflicting[fmt.Sprintf("%s|%d|%d", slot.ClassSection, slot.Day, slot.Period)] = true
+		}
+		sort.Strings(sections)
+		conflicts = append(conflicts, fmt.Sprintf("%s is booked on %s period %d by %s",
+			what, setting.dayName(slots[0].Day), slots[0].Period+1, strings.Join(sections, ", ")))
+	}
+
+	sort.Strings(teacherKeys)
+	for _, k := range teacherKeys {
+		if ts := teacherSlots[k]; len(ts) > 1 {
+			describe(teacherNames[ts[0].Teacher], ts)
+		}
+	}
+	sort.Strings(roomKeys)
+	for _, k := range roomKeys {
+		if rs := roomSlots[k]; len(rs) > 1 {
+			describe("Room "+rs[0].Room, rs)
+		}
+	}
+
+	return conflicts, conflicting
+}
+
+func (setting timetableSetting) dayName(day int) string {
+	if day < 0 || day >= len(setting.Days) {
+		return fmt.Sprintf("day %d", day+1)
+	}
+	return setting.Days[day]
+}
+
+// timetableDemand is the number of periods a subject needs in a class
+// section, used by solveTimetable
+type timetableDemand struct {
+	ClassSection string
+	Subject      string
+	Teacher      int64
+	Periods      int
+}
+
+type timetableDemandSorter []timetableDemand
+
+func (tds timetableDemandSorter) Len() int {
+	return len(tds)
+}
+
+func (tds timetableDemandSorter) Less(i, j int) bool {
+	// the subjects with the most periods are placed first
+	if tds[i].Periods != tds[j].Periods {
+		return tds[i].Periods > tds[j].Periods
+	}
+	if tds[i].ClassSection != tds[j].ClassSection {
+		return tds[i].ClassSection < tds[j].ClassSection
+	}
+	return tds[i].Subject < tds[j].Subject
+}
+
+func (tds timetableDemandSorter) Swap(i, j int) {
+	tds[i], tds[j] = tds[j], tds[i]
+}
+
+// solveTimetable fills the timetable of every class section from the periods
+// per week of its subjects and the assigned teachers. A teacher is never
+// booked twice at the same time, and the periods of a subject are spread over
+// the week. The periods that could not be placed are returned in unplaced.
+func solveTimetable(c context.Context, sy string, setting timetableSetting) (slots []timetableSlot, unplaced []string, err error) {
+	assigns, err := getAllAssignments(c, sy)
+	if err != nil {
+		return nil, nil, err
+	}
+	teachers := make(map[string]int64)
+	for _, assign := range assigns {
+		k := assign.ClassSection + "|" + assign.Subject
+		if _, ok := teachers[k]; !ok {
+			teachers[k] = assign.Teacher
+		}
+	}
+
+	var demands []timetableDemand
+	for _, class := range getClasses(c, sy) {
+		subjects, err := getSubjects(c, sy, class)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, subjectName := range subjects {
+			subject, err := getSubject(c, sy, class, subjectName)
+			if err != nil {
+				log.Warningf(c, "Could not get subject %s %s %s: %s", sy, class, subjectName, err)
+				continue
+			}
+			if subject.PeriodsPerWeek == 0 {
+				continue
+			}
+			for _, classSection := range getClassSectionsOfClass(c, sy, class) {
+				demands = append(demands, timetableDemand{
+					classSection, subjectName, teachers[classSection+"|"+subjectName], subject.PeriodsPerWeek,
+				})
+			}
+		}
+	}
+	sort.Sort(timetableDemandSorter(demands))
+
+	nDays := len(setting.Days)
+	busy := make(map[string]bool)
+	// class section|subject|day -> number of periods
+	perDay := make(map[string]int)
+
+	for _, d := range demands {
+		for n := 0; n < d.Periods; n++ {
+			placed := false
+			// prefer the days with the fewest periods of the subject
+			for least := 0; least <= n && !placed; least++ {
+				for day := 0; day < nDays && !placed; day++ {
+					if perDay[fmt.Sprintf("%s|%s|%d", d.ClassSection, d.Subject, day)] != least {
+						continue
+					}
+					for period := 0; period < setting.Periods; period++ {
+						sectionKey := fmt.Sprintf("section|%s|%d|%d", d.ClassSection, day, period)
+						teacherKey := fmt.Sprintf("teacher|%d|%d|%d", d.Teacher, day, period)
+						if busy[sectionKey] || (d.Teacher != 0 && busy[teacherKey]) {
+							continue
+						}
+						busy[sectionKey] = true
+						if d.Teacher != 0 {
+							busy[teacherKey] = true
+						}
+						perDay[fmt.Sprintf("%s|%s|%d", d.ClassSection, d.Subject, day)]++
+						slots = append(slots, timetableSlot{sy, d.ClassSection, day, period, d.Subject, d.Teacher, ""})
+						placed = true
+						break
+					}
+				}
+			}
+			if !placed {
+				unplaced = append(unplaced, fmt.Sprintf("%s %s: %d of %d periods",
+					strings.Replace(d.ClassSection, "|", "", 1), d.Subject, d.Periods-n, d.Periods))
+				break
+			}
+		}
+	}
+
+	return slots, unplaced, nil
+}
+
+// timetableCell is the slots of a day and period. Teachers can have more
+// than one slot at the same time if they are double-booked.
+type timetableCell struct {
+	Slots    []timetableSlot
+	Conflict bool
+}
+
+// Used in the templates
+func (cell timetableCell) Subject() string {
+	if len(cell.Slots) == 0 {
+		return ""
+	}
+	return cell.Slots[0].Subject
+}
+
+func (cell timetableCell) Teacher() int64 {
+	if len(cell.Slots) == 0 {
+		return 0
+	}
+	return cell.Slots[0].Teacher
+}
+
+func (cell timetableCell) Room() string {
+	if len(cell.Slots) == 0 {
+		return ""
+	}
+	return cell.Slots[0].Room
+}
+
+// timetableGrid is a timetable with a row per day and a column per period
+type timetableGrid struct {
+	Days    []string
+	Periods []int
+	Cells   [][]timetableCell
+}
+
+func makeTimetableGrid(setting timetableSetting, slots []timetableSlot, conflicting map[string]bool) timetableGrid {
+	grid := timetableGrid{Days: setting.Days}
+	for i := 1; i <= setting.Periods; i++ {
+		grid.Periods = append(grid.Periods, i)
+	}
+	grid.Cells = make([][]timetableCell, len(setting.Days))
+	for i := 0; i < len(grid.Cells); i++ {
+		grid.Cells[i] = make([]timetableCell, setting.Periods)
+	}
+
+	for _, slot := range slots {
+		if slot.Day >= len(setting.Days) || slot.Period >= setting.Periods {
+			continue
+		}
+		cell := &grid.Cells[slot.Day][slot.Period]
+		cell.Slots = append(cell.Slots, slot)
+		if conflicting[fmt.Sprintf("%s|%d|%d", slot.ClassSection, slot.Day, slot.Period)] {
+			cell.Conflict = true
+		}
+	}
+
+	return grid
+}
+
+func getTeacherNames(c context.Context) (map[int64]string, error) {
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string)
+	for _, emp := range employees {
+		names[emp.ID] = emp.Name
+	}
+	return names, nil
+}
+
+// getStudentTimetable returns the timetable of the class section of the
+// student, used in the main page
+func getStudentTimetable(c context.Context, studentID string) (timetableGrid, map[int64]string, error) {
+	sy := getSchoolYear(c)
+
+	sc, err := getStudentClass(c, studentID, sy)
+	if err != nil {
+		return timetableGrid{}, nil, err
+	}
+	if sc.Class == "" {
+		return timetableGrid{}, nil, nil
+	}
+
+	slots, err := getTimetableSlots(c, sy, sc.Class+"|"+sc.Section)
+	if err != nil {
+		return timetableGrid{}, nil, err
+	}
+	if len(slots) == 0 {
+		return timetableGrid{}, nil, nil
+	}
+
+	teacherNames, err := getTeacherNames(c)
+	if err != nil {
+		return timetableGrid{}, nil, err
+	}
+
+	return makeTimetableGrid(getTimetableSetting(c, sy), slots, nil), teacherNames, nil
+}
+
+func timetableHandler(w http.ResponseWriter, r *http.Request) {
+	renderTimetable(w, r, nil)
+}
+
+// renderTimetable renders the timetable page, with the periods that could not
+// be placed after generating the timetable
+func renderTimetable(w http.ResponseWriter, r *http.Request, unplaced []string) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+	setting := getTimetableSetting(c, sy)
+
+	slots, err := getTimetableSlots(c, sy, "")
+	if err != nil {
+		log.Errorf(c, "Could not get timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	teachers, err := getEmployees(c, true, "Teacher")
+	if err != nil {
+		log.Errorf(c, "Could not retrieve teachers: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	teacherNames, err := getTeacherNames(c)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	conflicts, _ := timetableConflicts(slots, teacherNames, setting)
+
+	data := struct {
+		Setting   timetableSetting
+		Slots     int
+		Conflicts []string
+		Unplaced  []string
+		Generated bool
+
+		CG       []classGroup
+		Teachers []employeeType
+	}{
+		setting,
+		len(slots),
+		conflicts,
+		unplaced,
+		unplaced != nil,
+
+		getClassGroups(c, sy),
+		teachers,
+	}
+
+	if err := render(w, r, "timetable", data); err != nil {
+		log.Errorf(c, "Could not render template timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func timetableSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+
+	var setting timetableSetting
+	for _, day := range strings.Split(r.PostForm.Get("Days"), ",") {
+		if day = strings.TrimSpace(day); day != "" {
+			setting.Days = append(setting.Days, day)
+		}
+	}
+	for _, room := range strings.Split(r.PostForm.Get("Rooms"), ",") {
+		if room = strings.TrimSpace(room); room != "" {
+			setting.Rooms = append(setting.Rooms, room)
+		}
+	}
+	periods, err := strconv.Atoi(r.PostForm.Get("Periods"))
+	if err != nil || periods < 1 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid number of periods")
+		return
+	}
+	setting.Periods = periods
+	if len(setting.Days) == 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Enter the days")
+		return
+	}
+
+	if err := saveTimetableSetting(c, sy, setting); err != nil {
+		log.Errorf(c, "Could not save timetable settings: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/timetable", http.StatusFound)
+}
+
+func timetableGenerateHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+	setting := getTimetableSetting(c, sy)
+
+	slots, unplaced, err := solveTimetable(c, sy, setting)
+	if err != nil {
+		log.Errorf(c, "Could not generate timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveTimetableSlots(c, sy, "", slots); err != nil {
+		log.Errorf(c, "Could not save timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if unplaced == nil {
+		unplaced = []string{}
+	}
+	renderTimetable(w, r, unplaced)
+}
+
+func timetableSectionHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getUser(c)
+	if err != nil {
+		log.Errorf(c, "Could not get user: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+	setting := getTimetableSetting(c, sy)
+
+	classSection := r.Form.Get("ClassSection")
+	class, _, err := parseClassSection(classSection)
+	if err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Select a class and section")
+		return
+	}
+
+	subjects, err := getSubjects(c, sy, class)
+	if err != nil {
+		log.Errorf(c, "Could not get subjects: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	allSlots, err := getTimetableSlots(c, sy, "")
+	if err != nil {
+		log.Errorf(c, "Could not get timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	var slots []timetableSlot
+	for _, slot := range allSlots {
+		if slot.ClassSection == classSection {
+			slots = append(slots, slot)
+		}
+	}
+
+	teachers, err := getEmployees(c, true, "Teacher")
+	if err != nil {
+		log.Errorf(c, "Could not retrieve teachers: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	teacherNames, err := getTeacherNames(c)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	_, conflicting := timetableConflicts(allSlots, teacherNames, setting)
+
+	data := struct {
+		ClassSection string
+		Grid         timetableGrid
+		CanEdit      bool
+
+		Subjects     []string
+		Teachers     []employeeType
+		TeacherNames map[int64]string
+		Rooms        []string
+	}{
+		classSection,
+		makeTimetableGrid(setting, slots, conflicting),
+		canAccess(user, "/timetable/save"),
+
+		subjects,
+		teachers,
+		teacherNames,
+		setting.Rooms,
+	}
+
+	if err := render(w, r, "timetablesection", data); err != nil {
+		log.Errorf(c, "Could not render template timetablesection: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
+
+func timetableSaveHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+	setting := getTimetableSetting(c, sy)
+
+	classSection := r.PostForm.Get("ClassSection")
+	if _, _, err := parseClassSection(classSection); err != nil {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Select a class and section")
+		return
+	}
+
+	var slots []timetableSlot
+	for day := 0; day < len(setting.Days); day++ {
+		for period := 0; period < setting.Periods; period++ {
+			suffix := fmt.Sprintf("-%d-%d", day, period)
+			subject := r.PostForm.Get("subject" + suffix)
+			if subject == "" {
+				continue
+			}
+			var teacher int64
+			if teacherStr := r.PostForm.Get("teacher" + suffix); teacherStr != "" {
+				var err error
+				teacher, err = strconv.ParseInt(teacherStr, 10, 64)
+				if err != nil {
+					renderErrorMsg(w, r, http.StatusBadRequest, "Invalid teacher")
+					return
+				}
+			}
+			room := r.PostForm.Get("room" + suffix)
+			slots = append(slots, timetableSlot{sy, classSection, day, period, subject, teacher, room})
+		}
+	}
+
+	if err := saveTimetableSlots(c, sy, classSection, slots); err != nil {
+		log.Errorf(c, "Could not save timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/timetable/section?ClassSection="+classSection, http.StatusFound)
+}
+
+func timetableTeacherHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	sy := getSchoolYear(c)
+	setting := getTimetableSetting(c, sy)
+
+	var teacher int64
+	if teacherStr := r.Form.Get("Teacher"); teacherStr != "" {
+		var err error
+		teacher, err = strconv.ParseInt(teacherStr, 10, 64)
+		if err != nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Invalid teacher")
+			return
+		}
+	} else {
+		// the timetable of the current teacher
+		user, err := getUser(c)
+		if err != nil {
+			log.Errorf(c, "Could not get user: %s", err)
+			renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if user.Employee == nil {
+			renderErrorMsg(w, r, http.StatusBadRequest, "Select a teacher")
+			return
+		}
+		teacher = user.Employee.ID
+	}
+
+	allSlots, err := getTimetableSlots(c, sy, "")
+	if err != nil {
+		log.Errorf(c, "Could not get timetable: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	var slots []timetableSlot
+	for _, slot := range allSlots {
+		if slot.Teacher == teacher {
+			slots = append(slots, slot)
+		}
+	}
+
+	teacherNames, err := getTeacherNames(c)
+	if err != nil {
+		log.Errorf(c, "Could not retrieve employees: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	_, conflicting := timetableConflicts(allSlots, teacherNames, setting)
+
+	data := struct {
+		Teacher string
+		Periods int
+		Grid    timetableGrid
+	}{
+		teacherNames[teacher],
+		len(slots),
+		makeTimetableGrid(setting, slots, conflicting),
+	}
+
+	if err := render(w, r, "timetableteacher", data); err != nil {
+		log.Errorf(c, "Could not render template timetableteacher: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+}
@@ -6,8 +6,11 @@ package main
 
 import (
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	appengineuser "google.golang.org/appengine/user"
+
+	"sync"
 )
 
 type user struct {
@@ -15,6 +18,9 @@ type user struct {
 	Name  string
 	Roles roles
 
+	// Permissions are the permissions of the roles of the user
+	Permissions permissions
+
 	Employee *employeeType // nil if not employee
 	Student  *studentType  // nil if not student
 }
@@ -39,6 +45,8 @@ func (user user) FullName() string {
 	return ""
 }
 
+// roles are the built-in roles of a user. Each role gives its permissions in
+// builtinRoles.
 type roles struct {
 	Student bool
 
@@ -47,25 +55,49 @@ type roles struct {
 	Teacher bool
 }
 
-var (
-	studentRole = roles{Student: true}
-
-	adminRole   = roles{Admin: true}
-	hrRole      = roles{HR: true}
-	teacherRole = roles{Teacher: true}
-
-	anyRole = roles{true, true, true, true}
-)
+// requestUsers are the users of the requests being handled, by request ID,
+// so that their roles and permissions are read once per request
+var requestUsers = struct {
+	sync.Mutex
+	m map[string]user
+}{m: make(map[string]user)}
+
+// keepUser makes getUser return user for the rest of the request of c. The
+// returned function forgets it, and must be called when the request ends.
+func keepUser(c context.Context, user user) func() {
+	id := appengine.RequestID(c)
+
+	requestUsers.Lock()
+	requestUsers.m[id] = user
+	requestUsers.Unlock()
+
+	return func() {
+		requestUsers.Lock()
+		delete(requestUsers.m, id)
+		requestUsers.Unlock()
+	}
+}
 
 func getUser(c context.Context) (user, error) {
+	requestUsers.Lock()
+	kept, ok := requestUsers.m[appengine.RequestID(c)]
+	requestUsers.Unlock()
+	if ok {
+		return kept, nil
+	}
+
 	u := appengineuser.Current(c)
 
-	name := u.String()
+	return getUserFromEmail(c, u.Email, u.String(), u.Admin)
+}
 
+// getUserFromEmail finds the student or employee with the given email.
+// isAdmin is true for administrators of the application.
+func getUserFromEmail(c context.Context, email, name string, isAdmin bool) (user, error) {
 	var userRoles roles
 	var empp *employeeType
 	var stup *studentType
-	if u.Admin {
+	if isAdmin {
 		userRoles = roles{
 			Student: false,
 			Admin:   true,
@@ -73,20 +105,20 @@ func getUser(c context.Context) (user, error) {
 			Teacher: true,
 		}
 		// Don't fail if admin is not employee
-		if emp, err := getEmployeeFromEmail(c, u.Email); err == nil {
+		if emp, err := getEmployeeFromEmail(c, email); err == nil {
 			empp = &emp
 		}
 	} else {
-		if stu, err := getStudentFromEmail(c, u.Email); err == nil {
+		if stu, err := getStudentFromEmail(c, email); err == nil {
 			userRoles = roles{
 				Student: true,
 			}
 			stup = &stu
 		} else {
-			emp, err := getEmployeeFromEmail(c, u.Email)
+			emp, err := getEmployeeFromEmail(c, email)
 			if err != nil {
 				return user{
-					Email: u.Email,
+					Email: email,
 					Name:  "Unknown",
 				}, err
 			}
@@ -96,10 +128,12 @@ func getUser(c context.Context) (user, error) {
 	}
 
 	user := user{
-		Email: u.Email,
+		Email: email,
 		Name:  name,
 		Roles: userRoles,
 
+		Permissions: getUserPermissions(c, userRoles, empp),
+
 		Employee: empp,
 		Student:  stup,
 	}
@@ -65,7 +65,7 @@ func render(w http.ResponseWriter, r *http.Request,
 
 	var links []link
 	for _, page := range pages {
-		if canAccess(user.Roles, page.URL) {
+		if canOpen(user, page.URL) {
 			if r.URL.Path == page.URL {
 				page.Active = true
 			}
@@ -135,6 +135,7 @@ var funcMap = htmltemplate.FuncMap{
 		return i == len-1
 	},
 	"parseTerm": parseTerm,
+	"join":      strings.Join,
 }
 
 func formatMark(mark float64) string {
@@ -0,0 +1,257 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	http.HandleFunc("/settings/workload", accessHandler(settingsWorkloadHandler))
+
+	registerReport(reportType{
+		Name:   ReportTeacherWorkload,
+		Params: []reportParam{reportParamSchoolYear},
+		Generate: func(c context.Context, p reportParams) ([][]ReportCell, error) {
+			return generateReportTeacherWorkload(c, p.SchoolYears[0])
+		},
+	})
+}
+
+const ReportTeacherWorkload = "Teacher Workload"
+
+type maxPeriodsSetting struct {
+	Value int
+}
+
+// getMaxTeacherPeriods returns the number of periods per week above which a
+// teacher is overloaded, or 0 if it is not set
+func getMaxTeacherPeriods(c context.Context, sy string) int {
+	key := datastore.NewKey(c, "settings", "max-teacher-periods-"+sy, 0, nil)
+
+	setting := maxPeriodsSetting{}
+	if err := nds.Get(c, key, &setting); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Could not get max teacher periods: %s", err)
+	}
+
+	return setting.Value
+}
+
+func saveMaxTeacherPeriods(c context.Context, sy string, value int) error {
+	key := datastore.NewKey(c, "settings", "max-teacher-periods-"+sy, 0, nil)
+	_, err := nds.Put(c, key, &maxPeriodsSetting{value})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// teacherWorkload is the total of the assignments of a teacher
+type teacherWorkload struct {
+	Name         string
+	Assignments  []string
+	Sections     map[string]bool
+	Students     int
+	Periods      int
+	MissingCount int // assignments of subjects without periods per week
+}
+
+type teacherWorkloadSorter []*teacherWorkload
+
+func (tws teacherWorkloadSorter) Len() int {
+	return len(tws)
+}
+
+func (tws teacherWorkloadSorter) Less(i, j int) bool {
+	// greater than for reverse sort
+	if tws[i].Periods != tws[j].Periods {
+		return tws[i].Periods > tws[j].Periods
+	}
+
+	return tws[i].Name < tws[j].Name
+}
+
+func (tws teacherWorkloadSorter) Swap(i, j int) {
+	tws[i], tws[j] = tws[j], tws[i]
+}
+
+func generateReportTeacherWorkload(c context.Context, sy string) ([][]ReportCell, error) {
+	maxPeriods := getMaxTeacherPeriods(c, sy)
+
+	assigns, err := getAllAssignments(c, sy)
+	if err != nil {
+		return nil, err
+	}
+	employees, err := getEmployees(c, true, "all")
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := make(map[int64]*teacherWorkload)
+	for _, emp := range employees {
+		workloads[emp.ID] = &teacherWorkload{Name: emp.Name, Sections: make(map[string]bool)}
+	}
+
+	// class section|subject -> assigned
+	assigned := make(map[string]bool)
+	for _, assign := range assigns {
+		assigned[assign.ClassSection+"|"+assign.Subject] = true
+	}
+
+	type unassignedSubject struct {
+		ClassSection string
+		Subject      string
+		Periods      int
+	}
+	var unassigned []unassignedSubject
+
+	for _, class := range getClasses(c, sy) {
+		subjects, err := getSubjects(c, sy, class)
+		if err != nil {
+			return nil, err
+		}
+		for _, subjectName := range subjects {
+			subject, err := getSubject(c, sy, class, subjectName)
+			if err != nil {
+				log.Warningf(c, "Could not get subject %s %s %s: %s", sy, class, subjectName, err)
+				continue
+			}
+
+			for _, classSection := range getClassSectionsOfClass(c, sy, class) {
+				if assigned[classSection+"|"+subjectName] {
+					continue
+				}
+				unassigned = append(unassigned, unassignedSubject{classSection, subjectName, subject.PeriodsPerWeek})
+			}
+		}
+	}
+
+	for _, assign := range assigns {
+		tw, ok := workloads[assign.Teacher]
+		if !ok {
+			// disabled employee
+			continue
+		}
+
+		class, _, err := parseClassSection(assign.ClassSection)
+		if err != nil {
+			return nil, err
+		}
+		subject, err := getSubject(c, sy, class, assign.Subject)
+		if err != nil {
+			log.Warningf(c, "Could not get subject %s %s %s: %s", sy, class, assign.Subject, err)
+			continue
+		}
+		nStudents, err := findStudentsCount(c, sy, assign.ClassSection, subject.Stream)
+		if err != nil {
+			return nil, err
+		}
+
+		tw.Assignments = append(tw.Assignments, fmt.Sprintf("%s %s (%d)",
+			assign.Subject, strings.Replace(assign.ClassSection, "|", "", 1), subject.PeriodsPerWeek))
+		tw.Sections[assign.ClassSection] = true
+		tw.Students += nStudents
+		tw.Periods += subject.PeriodsPerWeek
+		if subject.PeriodsPerWeek == 0 {
+			tw.MissingCount++
+		}
+	}
+
+	var teachers []*teacherWorkload
+	for _, tw := range workloads {
+		if len(tw.Assignments) > 0 {
+			teachers = append(teachers, tw)
+		}
+	}
+	sort.Sort(teacherWorkloadSorter(teachers))
+
+	maxStr := "not set"
+	if maxPeriods > 0 {
+		maxStr = strconv.Itoa(maxPeriods)
+	}
+
+	rows := [][]ReportCell{
+		{{fmt.Sprintf("Teachers (maximum periods per week: %s)", maxStr), 6, 1}},
+		{
+			{"Teacher", 1, 1},
+			{"Periods per Week", 1, 1},
+			{"Sections", 1, 1},
+			{"Students", 1, 1},
+			{"Status", 1, 1},
+			{"Assignments (periods per week)", 1, 1},
+		},
+	}
+	for _, tw := range teachers {
+		var status []string
+		if maxPeriods > 0 && tw.Periods > maxPeriods {
+			status = append(status, fmt.Sprintf("Overloaded by %d", tw.Periods-maxPeriods))
+		}
+		if tw.MissingCount > 0 {
+			status = append(status, fmt.Sprintf("%d subjects without periods per week", tw.MissingCount))
+		}
+		rows = append(rows, []ReportCell{
+			{tw.Name, 1, 1},
+			{strconv.Itoa(tw.Periods), 1, 1},
+			{strconv.Itoa(len(tw.Sections)), 1, 1},
+			{strconv.Itoa(tw.Students), 1, 1},
+			{strings.Join(status, "; "), 1, 1},
+			{strings.Join(tw.Assignments, ", "), 1, 1},
+		})
+	}
+
+	rows = append(rows, emptyRow(6))
+	rows = append(rows, []ReportCell{{fmt.Sprintf("Unassigned Subjects (%d)", len(unassigned)), 6, 1}})
+	rows = append(rows, []ReportCell{
+		{"Class/Section", 2, 1},
+		{"Subject", 2, 1},
+		{"Periods per Week", 2, 1},
+	})
+	for _, u := range unassigned {
+		rows = append(rows, []ReportCell{
+			{strings.Replace(u.ClassSection, "|", "", 1), 2, 1},
+			{u.Subject, 2, 1},
+			{strconv.Itoa(u.Periods), 2, 1},
+		})
+	}
+
+	return rows, nil
+}
+
+func settingsWorkloadHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	sy := getSchoolYear(c)
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf(c, "Could not parse form: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	maxPeriods, err := strconv.Atoi(r.PostForm.Get("MaxTeacherPeriods"))
+	if err != nil || maxPeriods < 0 {
+		renderErrorMsg(w, r, http.StatusBadRequest, "Invalid maximum periods per week")
+		return
+	}
+
+	if err := saveMaxTeacherPeriods(c, sy, maxPeriods); err != nil {
+		log.Errorf(c, "Could not save max teacher periods: %s", err)
+		renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: message of success
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
@@ -0,0 +1,519 @@
+// Copyright 2019 Ibrahim Ghazal. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isXLSX checks if data is a zip file, which is the format of XLSX files
+func isXLSX(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxRichText is a string that can be split in runs of different formatting
+type xlsxRichText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) String() string {
+	s := t.T
+	for _, r := range t.R {
+		s += r.T
+	}
+	return s
+}
+
+type xlsxSharedStrings struct {
+	SI []xlsxRichText `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string       `xml:"r,attr"`
+			T  string       `xml:"t,attr"`
+			V  string       `xml:"v"`
+			Is xlsxRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func xlsxDecode(files map[string]*zip.File, name string, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("Missing %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// xlsxColumn returns the zero-based column of a cell reference, e.g. 2 for C7
+func xlsxColumn(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A') + 1
+	}
+	return col - 1
+}
+
+// readXLSX returns the cells of the first worksheet of an XLSX file as text.
+// Only the values are read; formatting and formulas are ignored.
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var workbook xlsxWorkbook
+	if err := xlsxDecode(files, "xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return nil, fmt.Errorf("The file has no worksheets")
+	}
+
+	var rels xlsxRelationships
+	if err := xlsxDecode(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	sheetPath := ""
+	for _, rel := range rels.Relationships {
+		if rel.ID == workbook.Sheets[0].RID {
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetPath = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetPath = path.Join("xl", rel.Target)
+			}
+		}
+	}
+	if sheetPath == "" {
+		return nil, fmt.Errorf("Could not find worksheet %s", workbook.Sheets[0].Name)
+	}
+
+	var sst xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := xlsxDecode(files, "xl/sharedStrings.xml", &sst); err != nil {
+			return nil, err
+		}
+	}
+
+	var sheet xlsxWorksheet
+	if err := xlsxDecode(files, sheetPath, &sheet); err != nil {
+		return nil, err
+	}
+
+	var records [][]string
+	for _, row := range sheet.Rows {
+		// Empty rows are not stored
+		for row.R > len(records)+1 {
+			records = append(records, nil)
+		}
+
+		var record []string
+		for _, cell := range row.Cells {
+			col := len(record)
+			if cell.R != "" {
+				col = xlsxColumn(cell.R)
+			}
+			for col > len(record) {
+				record = append(record, "")
+			}
+
+			var value string
+			switch cell.T {
+			case "s":
+				i, err := strconv.Atoi(cell.V)
+				if err != nil || i < 0 || i >= len(sst.SI) {
+					return nil, fmt.Errorf("Invalid shared string in %s", cell.R)
+				}
+				value = sst.SI[i].String()
+			case "inlineStr":
+				value = cell.Is.String()
+			case "b":
+				value = "FALSE"
+				if cell.V == "1" {
+					value = "TRUE"
+				}
+			case "str", "e":
+				value = cell.V
+			default:
+				value = cell.V
+				if f, err := strconv.ParseFloat(cell.V, 64); err == nil {
+					// Remove floating point noise, e.g. 12.499999999999998
+					value = strconv.FormatFloat(f, 'g', 15, 64)
+				}
+			}
+			record = append(record, value)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// xlsxFormat is the type of the value of a cell written by writeXLSX
+type xlsxFormat int
+
+const (
+	xlsxText xlsxFormat = iota
+	xlsxNumber
+	xlsxDate
+	xlsxTime
+	xlsxPercent
+)
+
+// xlsxCell is a cell written by writeXLSX. Value is a string, a float64, an
+// int or a time.Time, or nil for an empty cell. Cells with a Colspan or
+// Rowspan greater than 1 are merged, and cells with a Colspan or Rowspan of
+// 0 are not written, like in ReportCell.
+type xlsxCell struct {
+	Value   interface{}
+	Format  xlsxFormat
+	Colspan int
+	Rowspan int
+}
+
+// xlsxSheet is a worksheet written by writeXLSX. The first HeaderRows rows
+// are bold and frozen.
+type xlsxSheet struct {
+	Name       string
+	Rows       [][]xlsxCell
+	HeaderRows int
+}
+
+// xlsxNumberPattern matches plain decimals, with an optional percent sign.
+// Other values that strconv.ParseFloat accepts, like NaN, Inf and 1e5, are
+// not numbers in Excel files, and numbers with leading zeros, like CPR and
+// phone numbers, would lose their zeros.
+var xlsxNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?%?$`)
+
+// parseXLSXNumber returns the number of s, and whether it is a percentage.
+// Percentages are divided by 100.
+func parseXLSXNumber(s string) (float64, bool, bool) {
+	if !xlsxNumberPattern.MatchString(s) {
+		return 0, false, false
+	}
+	percent := strings.HasSuffix(s, "%")
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || math.IsInf(f, 0) {
+		return 0, false, false
+	}
+	if percent {
+		f /= 100
+	}
+	return f, percent, true
+}
+
+// xlsxRecords converts records, like the ones written to CSV files, to cells.
+// The values of every column after the header rows are converted to formats,
+// and are kept as text if they could not be converted.
+func xlsxRecords(records [][]string, headerRows int, formats []xlsxFormat) [][]xlsxCell {
+	var rows [][]xlsxCell
+	for i, record := range records {
+		var row []xlsxCell
+		for j, s := range record {
+			cell := xlsxCell{Value: s, Colspan: 1, Rowspan: 1}
+			format := xlsxText
+			if j < len(formats) && i >= headerRows {
+				format = formats[j]
+			}
+			switch {
+			case s == "":
+				cell.Value = nil
+			case format == xlsxNumber || format == xlsxPercent:
+				if f, percent, ok := parseXLSXNumber(s); ok {
+					if percent {
+						format = xlsxPercent
+					}
+					cell.Value = f
+					cell.Format = format
+				}
+			case format == xlsxDate:
+				if t, err := time.Parse("2006-01-02", s); err == nil && t.Year() >= 1900 {
+					cell.Value = t
+					cell.Format = format
+				}
+			case format == xlsxTime:
+				if t, err := time.Parse("15:04", s); err == nil {
+					cell.Value = t
+					cell.Format = format
+				}
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// xlsxCellRef returns the reference of a cell from its zero-based column and
+// row, e.g. C7 for 2, 6
+func xlsxCellRef(col, row int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return fmt.Sprintf("%s%d", name, row+1)
+}
+
+// xlsxSerial returns the number of days since 1899-12-30, which is how
+// dates and times are stored in XLSX files
+func xlsxSerial(t time.Time) float64 {
+	if t.Year() == 0 {
+		// time only
+		return float64(t.Hour()*60+t.Minute()) / (24 * 60)
+	}
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, t.Location())
+	return t.Sub(epoch).Hours() / 24
+}
+
+func xlsxEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const (
+	xlsxStyleGeneral = iota
+	xlsxStyleDate
+	xlsxStyleTime
+	xlsxStylePercent
+	xlsxStyleHeader
+)
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/><numFmt numFmtId="165" formatCode="hh:mm"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="5">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="10" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+</cellXfs>
+</styleSheet>`
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+</Types>`
+
+const xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`
+
+// xlsxSheetName returns a valid name for a worksheet
+func xlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, name)
+	if r := []rune(name); len(r) > 31 {
+		name = string(r[:31])
+	}
+	if name == "" {
+		name = "Sheet1"
+	}
+	return name
+}
+
+// writeXLSX writes sheet as an XLSX file
+func writeXLSX(w io.Writer, sheet xlsxSheet) error {
+	var data bytes.Buffer
+	var merged []string
+
+	data.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	data.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if sheet.HeaderRows > 0 {
+		fmt.Fprintf(&data, `<sheetViews><sheetView workbookViewId="0"><pane ySplit="%d" topLeftCell="%s" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`,
+			sheet.HeaderRows, xlsxCellRef(0, sheet.HeaderRows))
+	}
+	data.WriteString(`<sheetData>`)
+
+	// column -> number of rows still covered by a merged cell above
+	covered := make(map[int]int)
+	for r, row := range sheet.Rows {
+		fmt.Fprintf(&data, `<row r="%d">`, r+1)
+		next := make(map[int]int)
+		col := 0
+
+		skipCovered := func() {
+			for covered[col] > 0 {
+				if covered[col] > 1 {
+					next[col] = covered[col] - 1
+				}
+				col++
+			}
+		}
+
+		for _, cell := range row {
+			if cell.Colspan == 0 || cell.Rowspan == 0 {
+				// not shown
+				continue
+			}
+			skipCovered()
+
+			if cell.Colspan > 1 || cell.Rowspan > 1 {
+				merged = append(merged, xlsxCellRef(col, r)+":"+
+					xlsxCellRef(col+cell.Colspan-1, r+cell.Rowspan-1))
+			}
+
+			style := xlsxStyleGeneral
+			if r < sheet.HeaderRows {
+				style = xlsxStyleHeader
+			}
+			ref := xlsxCellRef(col, r)
+			switch v := cell.Value.(type) {
+			case string:
+				fmt.Fprintf(&data, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+					ref, style, xlsxEscape(v))
+			case float64:
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					fmt.Fprintf(&data, `<c r="%s" s="%d"/>`, ref, style)
+					break
+				}
+				if cell.Format == xlsxPercent {
+					style = xlsxStylePercent
+				}
+				fmt.Fprintf(&data, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style,
+					strconv.FormatFloat(v, 'f', -1, 64))
+			case int:
+				if cell.Format == xlsxPercent {
+					style = xlsxStylePercent
+				}
+				fmt.Fprintf(&data, `<c r="%s" s="%d"><v>%v</v></c>`, ref, style, v)
+			case time.Time:
+				style = xlsxStyleDate
+				if cell.Format == xlsxTime {
+					style = xlsxStyleTime
+				}
+				fmt.Fprintf(&data, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style,
+					strconv.FormatFloat(xlsxSerial(v), 'f', -1, 64))
+			}
+
+			for i := 0; i < cell.Colspan; i++ {
+				if cell.Rowspan > 1 {
+					next[col] = cell.Rowspan - 1
+				}
+				col++
+			}
+		}
+		skipCovered()
+
+		for c, n := range covered {
+			if c >= col && n > 1 {
+				next[c] = n - 1
+			}
+		}
+		covered = next
+
+		data.WriteString(`</row>`)
+	}
+	data.WriteString(`</sheetData>`)
+
+	if len(merged) > 0 {
+		fmt.Fprintf(&data, `<mergeCells count="%d">`, len(merged))
+		for _, ref := range merged {
+			fmt.Fprintf(&data, `<mergeCell ref="%s"/>`, ref)
+		}
+		data.WriteString(`</mergeCells>`)
+	}
+	data.WriteString(`</worksheet>`)
+
+	workbook := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="` + xlsxEscape(xlsxSheetName(sheet.Name)) + `" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+	zw := zip.NewWriter(w)
+	files := []struct {
+		Name string
+		Body string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", workbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+		{"xl/worksheets/sheet1.xml", data.String()},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, file.Body); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// setXLSXHeaders sets the headers of an XLSX file download
+func setXLSXHeaders(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	// Force save as with filename
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment;filename=%s.xlsx", filename))
+}